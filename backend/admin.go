@@ -0,0 +1,719 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+	Admin subcommands. Most run against the database file:
+
+		admin users [-search PREFIX]           list users
+		admin friends -user NAME               friends and pending requests
+		admin messages [-since DURATION]       messages sent and received per user
+		admin ban -user NAME [-reason TEXT]    stop an account logging in
+		admin unban -user NAME
+		admin reset-password -user NAME        set a new password, printing it
+		admin unlock -user NAME                clear failed logins and any lockout
+		admin create-bot -user NAME            make a bot account, printing its token
+		admin rotate-bot-token -user NAME      replace a bot's token, printing the new one
+		admin add-webhook -url URL [-user NAME] [-events LIST]
+		                                       subscribe a URL to events, printing its secret
+		admin webhooks                         list webhook subscriptions
+		admin remove-webhook -id ID
+		admin webhook-failures [-webhook ID]   deliveries that failed every attempt
+		admin redeliver-webhook -id N | -all   post failed deliveries again
+		admin add-incoming-webhook -bot NAME -user NAME
+		                                       a URL that posts as the bot to its friend,
+		                                       printed once
+		admin incoming-webhooks                list incoming webhooks
+		admin remove-incoming-webhook -id ID
+		admin audit [-user NAME] [-since DURATION | -from TIME -to TIME]
+		                                       logins, credential changes, friendships
+		                                       and admin actions from the audit log
+
+	Reports print a table, or JSON with -json. Webhook changes apply to a
+	running server within a few seconds. To try a webhook out without a
+	receiver of your own:
+
+		admin webhook-receiver -secret SECRET [-listen ADDR]
+		                                       print deliveries, checking signatures
+
+	The server reads bans, lockouts, passwords and bot tokens from the
+	database on every login, so those apply to a running server straight
+	away. Sessions already open need the server itself, through its /admin
+	endpoints:
+
+		admin disconnect -user NAME            close the user's session
+
+	ban, reset-password and rotate-bot-token use the same endpoint when a
+	token is given, to close the session of the banned user, or of whoever
+	logged in with the old password or token. The token is the server's
+	admin_token, passed with -token or MESSAGING_ADMIN_TOKEN.
+
+	Commands find the database, and the keys it is encrypted at rest with,
+	in the server's config file (-config or MESSAGING_CONFIG) and
+	environment, the same way the server does. -db and -db-key-file
+	override them.
+*/
+
+const adminUsage = `usage: admin COMMAND [flags]
+
+commands:
+	users, friends, messages, ban, unban, reset-password, unlock, disconnect, audit,
+	create-bot, rotate-bot-token, add-webhook, webhooks, remove-webhook, webhook-failures,
+	redeliver-webhook, webhook-receiver, add-incoming-webhook, incoming-webhooks,
+	remove-incoming-webhook
+
+run "admin COMMAND -h" for the flags of each`
+
+func runAdmin(args []string) error {
+
+	if len(args) == 0 {
+		return fmt.Errorf("%s", adminUsage)
+	}
+
+	switch args[0] {
+	case "users":
+		return adminUsers(args[1:])
+	case "friends":
+		return adminFriends(args[1:])
+	case "messages":
+		return adminMessages(args[1:])
+	case "ban":
+		return adminBan(args[1:])
+	case "unban":
+		return adminUnban(args[1:])
+	case "reset-password":
+		return adminResetPassword(args[1:])
+	case "unlock":
+		return adminUnlock(args[1:])
+	case "disconnect":
+		return adminDisconnect(args[1:])
+	case "audit":
+		return adminAudit(args[1:])
+	case "create-bot":
+		return adminCreateBot(args[1:])
+	case "rotate-bot-token":
+		return adminRotateBotToken(args[1:])
+	case "add-webhook":
+		return adminAddWebhook(args[1:])
+	case "webhooks":
+		return adminWebhooks(args[1:])
+	case "remove-webhook":
+		return adminRemoveWebhook(args[1:])
+	case "webhook-failures":
+		return adminWebhookFailures(args[1:])
+	case "redeliver-webhook":
+		return adminRedeliverWebhook(args[1:])
+	case "webhook-receiver":
+		return adminWebhookReceiver(args[1:])
+	case "add-incoming-webhook":
+		return adminAddIncomingWebhook(args[1:])
+	case "incoming-webhooks":
+		return adminIncomingWebhooks(args[1:])
+	case "remove-incoming-webhook":
+		return adminRemoveIncomingWebhook(args[1:])
+	}
+
+	return fmt.Errorf("unknown admin command %q\n%s", args[0], adminUsage)
+}
+
+// Flags of a command run against the database. Where it is and its keys
+// come from the server's config file and environment, read as the server
+// reads them, unless -db or -db-key-file is given
+type adminCommand struct {
+	*flag.FlagSet
+	configPath *string
+	dbPath     *string
+	dbKeyFile  *string
+}
+
+func newAdminCommand(name string) *adminCommand {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+
+	return &adminCommand{
+		FlagSet:    fs,
+		configPath: fs.String("config", os.Getenv("MESSAGING_CONFIG"), "the server's .toml or .yaml config file"),
+		dbPath:     fs.String("db", "", "path to the SQLite database (default the config's db_path, or "+defaultDBPath+")"),
+		dbKeyFile:  fs.String("db-key-file", "", "file of keys sealing the database at rest (default the config's db_key_file or db_key)"),
+	}
+}
+
+// The server's configuration, with the command's flags applied
+func (c *adminCommand) config() (*Config, error) {
+
+	cfg, err := loadConfigLayers(*c.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if *c.dbPath != "" {
+		cfg.DBPath = *c.dbPath
+	}
+
+	if *c.dbKeyFile != "" {
+		cfg.DBKeyFile = *c.dbKeyFile
+		cfg.DBKey = ""
+	}
+
+	return cfg, nil
+}
+
+// Run fn with the database open, closing it after
+func (c *adminCommand) withDB(fn func(conn *DBConn) error) error {
+
+	cfg, err := c.config()
+	if err != nil {
+		return err
+	}
+
+	conn, err := openAdminDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return fn(conn)
+}
+
+// Open the configured database for an admin command, refusing an out of date schema
+func openAdminDB(cfg *Config) (*DBConn, error) {
+
+	conn, err := openDB(cfg.DBPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := pendingMigrations(conn.db)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if len(pending) > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("database has %d pending migrations, run migrate first", len(pending))
+	}
+
+	// Same keys as the server, for databases encrypted at rest
+	conn.keys, err = loadDBKeys(cfg.DBKeyFile, cfg.DBKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Key of a live (not deleted) user
+func adminUserKey(conn *DBConn, name string) (apiKey, error) {
+
+	if name == "" {
+		return "", fmt.Errorf("-user is required")
+	}
+
+	ids, err := conn.GetUserAPI(name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(*ids) == 0 {
+		return "", fmt.Errorf("user %q not found", name)
+	}
+
+	return apiKey((*ids)[0]), nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func adminUsers(args []string) error {
+
+	cmd := newAdminCommand("admin users")
+	search := cmd.String("search", "", "only users whose name starts with this")
+	asJSON := cmd.Bool("json", false, "print JSON instead of a table")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		users, err := conn.AdminUsers(*search)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			return printJSON(users)
+		}
+
+		t := newTable()
+		fmt.Fprintln(t, "USERNAME\tKIND\tSTATUS\tLAST SEEN\tFRIENDS\tSENT\tFAILED LOGINS")
+		for _, u := range users {
+			status := u.Status
+			if u.DisabledReason != "" {
+				status += " (" + u.DisabledReason + ")"
+			}
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", u.Username, u.Kind, status, u.LastSeen, u.Friends, u.MessagesSent, u.FailedLogins)
+		}
+		return t.Flush()
+	})
+}
+
+func adminFriends(args []string) error {
+
+	cmd := newAdminCommand("admin friends")
+	user := cmd.String("user", "", "username to show friends of")
+	asJSON := cmd.Bool("json", false, "print JSON instead of a table")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		k, err := adminUserKey(conn, *user)
+		if err != nil {
+			return err
+		}
+
+		friends, err := conn.AdminFriends(k)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			return printJSON(friends)
+		}
+
+		t := newTable()
+		fmt.Fprintln(t, "USERNAME\tRELATION\tMESSAGES\tLAST MESSAGE")
+		for _, f := range friends {
+			fmt.Fprintf(t, "%s\t%s\t%d\t%s\n", f.Username, f.Relation, f.Messages, f.LastMessage)
+		}
+		return t.Flush()
+	})
+}
+
+func adminMessages(args []string) error {
+
+	cmd := newAdminCommand("admin messages")
+	since := cmd.Duration("since", 0, "only count messages this recent, e.g. 24h. All time if 0")
+	asJSON := cmd.Bool("json", false, "print JSON instead of a table")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		counts, err := conn.AdminMessageCounts(*since)
+		if err != nil {
+			return err
+		}
+
+		// Every message has one sender, so sent counts add up to the total
+		total := 0
+		for _, c := range counts {
+			total += c.Sent
+		}
+
+		if *asJSON {
+			return printJSON(struct {
+				Total int                 `json:"total"`
+				Users []AdminMessageCount `json:"users"`
+			}{total, counts})
+		}
+
+		t := newTable()
+		fmt.Fprintln(t, "USERNAME\tSENT\tRECEIVED")
+		for _, c := range counts {
+			fmt.Fprintf(t, "%s\t%d\t%d\n", c.Username, c.Sent, c.Received)
+		}
+		fmt.Fprintf(t, "TOTAL\t%d\t\n", total)
+		return t.Flush()
+	})
+}
+
+func adminBan(args []string) error {
+
+	cmd := newAdminCommand("admin ban")
+	user := cmd.String("user", "", "username of the account to disable")
+	reason := cmd.String("reason", "", "shown to the user when they try to log in")
+	live := addLiveFlags(cmd.FlagSet)
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		k, err := adminUserKey(conn, *user)
+		if err != nil {
+			return err
+		}
+
+		if err := conn.SetDisabled(k, true, *reason); err != nil {
+			return err
+		}
+		auditTo(conn, AuditAdminBan, auditAdmin, *user, "cli", *reason)
+
+		fmt.Printf("Disabled %s\n", *user)
+
+		if !live.enabled() {
+			fmt.Println("Any open session stays until it closes. Pass -token to disconnect it now")
+			return nil
+		}
+
+		return live.disconnect(*user)
+	})
+}
+
+func adminUnban(args []string) error {
+
+	cmd := newAdminCommand("admin unban")
+	user := cmd.String("user", "", "username of the account to enable")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		k, err := adminUserKey(conn, *user)
+		if err != nil {
+			return err
+		}
+
+		if err := conn.SetDisabled(k, false, ""); err != nil {
+			return err
+		}
+		auditTo(conn, AuditAdminUnban, auditAdmin, *user, "cli", "")
+
+		fmt.Printf("Enabled %s\n", *user)
+		return nil
+	})
+}
+
+func adminResetPassword(args []string) error {
+
+	cmd := newAdminCommand("admin reset-password")
+	user := cmd.String("user", "", "username of the account")
+	password := cmd.String("password", "", "new password. Generated if not given")
+	live := addLiveFlags(cmd.FlagSet)
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		k, err := adminUserKey(conn, *user)
+		if err != nil {
+			return err
+		}
+
+		newPassword := *password
+		if newPassword == "" {
+			newPassword = rand.Text()[:16]
+		}
+
+		hash, err := hashPassword(newPassword)
+		if err != nil {
+			return err
+		}
+		if err := conn.SetPassword(k, hash); err != nil {
+			return err
+		}
+
+		// A reset is the usual way out of a lockout too
+		if err := conn.SetLoginFailures(k, 0, time.Time{}); err != nil {
+			return err
+		}
+		auditTo(conn, AuditAdminResetPassword, auditAdmin, *user, "cli", "")
+
+		fmt.Printf("Password for %s reset to: %s\n", *user, newPassword)
+
+		if !live.enabled() {
+			fmt.Fprintf(os.Stderr, "Warning: a session %s already has open stays open. Pass -token to close it now\n", *user)
+			return nil
+		}
+
+		return live.disconnect(*user)
+	})
+}
+
+func adminUnlock(args []string) error {
+
+	cmd := newAdminCommand("admin unlock")
+	user := cmd.String("user", "", "username of the account to unlock")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		k, err := adminUserKey(conn, *user)
+		if err != nil {
+			return err
+		}
+
+		failures, _, err := conn.GetLoginFailures(k)
+		if err != nil {
+			return err
+		}
+
+		err = conn.SetLoginFailures(k, 0, time.Time{})
+		if err != nil {
+			return err
+		}
+		auditTo(conn, AuditAdminUnlock, auditAdmin, *user, "cli", fmt.Sprintf("cleared %d failed logins", failures))
+
+		fmt.Printf("Unlocked %s, cleared %d failed logins\n", *user, failures)
+		return nil
+	})
+}
+
+func adminCreateBot(args []string) error {
+
+	cmd := newAdminCommand("admin create-bot")
+	user := cmd.String("user", "", "username of the new bot")
+	cmd.Parse(args)
+
+	if *user == "" {
+		return fmt.Errorf("-user is required")
+	}
+
+	// The token starts with the name, up to the separator
+	if strings.Contains(*user, botTokenSeparator) {
+		return fmt.Errorf("bot names can't contain %q", botTokenSeparator)
+	}
+
+	return cmd.withDB(func(conn *DBConn) error {
+		ids, err := conn.GetUserAPI(*user)
+		if err != nil {
+			return err
+		}
+
+		if len(*ids) > 0 {
+			return fmt.Errorf("username %q is taken", *user)
+		}
+
+		id, err := generateId()
+		if err != nil {
+			return err
+		}
+
+		token := newBotToken(*user)
+
+		if err := conn.CreateBot(apiKey(id), *user, hashToken(token)); err != nil {
+			return err
+		}
+		auditTo(conn, AuditAdminCreateBot, auditAdmin, *user, "cli", "")
+
+		fmt.Printf("Created bot %s. Its token, shown only once:\n%s\n", *user, token)
+		return nil
+	})
+}
+
+func adminRotateBotToken(args []string) error {
+
+	cmd := newAdminCommand("admin rotate-bot-token")
+	user := cmd.String("user", "", "username of the bot")
+	live := addLiveFlags(cmd.FlagSet)
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		k, err := adminUserKey(conn, *user)
+		if err != nil {
+			return err
+		}
+
+		token := newBotToken(*user)
+
+		if err := conn.SetBotToken(k, hashToken(token)); err != nil {
+			return fmt.Errorf("%s: %w", *user, err)
+		}
+		auditTo(conn, AuditAdminBotToken, auditAdmin, *user, "cli", "")
+
+		fmt.Printf("New token for %s, shown only once:\n%s\n", *user, token)
+
+		if !live.enabled() {
+			fmt.Fprintf(os.Stderr, "Warning: %s stays connected with the old token until its session closes. Pass -token to disconnect it now\n", *user)
+			return nil
+		}
+
+		return live.disconnect(*user)
+	})
+}
+
+func adminDisconnect(args []string) error {
+
+	fs := flag.NewFlagSet("admin disconnect", flag.ExitOnError)
+	user := fs.String("user", "", "username whose session to close")
+	live := addLiveFlags(fs)
+	fs.Parse(args)
+
+	if *user == "" {
+		return fmt.Errorf("-user is required")
+	}
+
+	if !live.enabled() {
+		return fmt.Errorf("-token or MESSAGING_ADMIN_TOKEN is required")
+	}
+
+	return live.disconnect(*user)
+}
+
+func adminAudit(args []string) error {
+
+	cmd := newAdminCommand("admin audit")
+	user := cmd.String("user", "", "only events where this username is the actor or target")
+	event := cmd.String("event", "", "only this event, e.g. login_failed")
+	since := cmd.Duration("since", 0, "only events this recent, e.g. 24h")
+	from := cmd.String("from", "", "only events at or after this UTC time, e.g. 2025-01-31 or \"2025-01-31 09:00\"")
+	to := cmd.String("to", "", "only events before this UTC time")
+	limit := cmd.Int("limit", 100, "most recent events to show. 0 shows all")
+	asJSON := cmd.Bool("json", false, "print JSON instead of a table")
+	cmd.Parse(args)
+
+	filter := AuditFilter{
+		User:  *user,
+		Event: *event,
+		Limit: *limit,
+	}
+
+	var err error
+
+	if *since > 0 {
+		if *from != "" {
+			return fmt.Errorf("use -since or -from, not both")
+		}
+		filter.From = time.Now().Add(-*since)
+	}
+
+	if *from != "" {
+		if filter.From, err = parseAdminTime(*from); err != nil {
+			return fmt.Errorf("-from: %w", err)
+		}
+	}
+
+	if *to != "" {
+		if filter.To, err = parseAdminTime(*to); err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+	}
+
+	return cmd.withDB(func(conn *DBConn) error {
+		events, err := conn.AuditEvents(filter)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			return printJSON(events)
+		}
+
+		t := newTable()
+		fmt.Fprintln(t, "TIME (UTC)\tEVENT\tACTOR\tTARGET\tSOURCE\tDETAIL")
+		for _, e := range events {
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\t%s\n", e.At.UTC().Format(time.DateTime), e.Event, e.Actor, e.Target, e.Source, e.Detail)
+		}
+		return t.Flush()
+	})
+}
+
+// A date, date and time, or RFC 3339 time. Times without a zone are UTC
+func parseAdminTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.DateOnly, "2006-01-02 15:04", time.DateTime, time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date like 2025-01-31 or 2025-01-31 09:00", s)
+}
+
+// Connection to a running server's /admin endpoints
+type liveServer struct {
+	server *string
+	token  *string
+	caFile *string
+}
+
+func addLiveFlags(fs *flag.FlagSet) *liveServer {
+	return &liveServer{
+		server: fs.String("server", "http://localhost:8000", "URL of the running server"),
+		token:  fs.String("token", os.Getenv("MESSAGING_ADMIN_TOKEN"), "the server's admin_token"),
+		caFile: fs.String("ca", "", "PEM CA certificate to trust for an https server"),
+	}
+}
+
+func (l *liveServer) enabled() bool {
+	return *l.token != ""
+}
+
+func (l *liveServer) disconnect(name string) error {
+
+	var result struct {
+		Disconnected bool `json:"disconnected"`
+	}
+
+	if err := l.post("/admin/users/"+url.PathEscape(name)+"/disconnect", &result); err != nil {
+		return err
+	}
+
+	if result.Disconnected {
+		fmt.Printf("Disconnected %s\n", name)
+	} else {
+		fmt.Printf("%s has no open session\n", name)
+	}
+	return nil
+}
+
+func (l *liveServer) post(path string, result interface{}) error {
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	if *l.caFile != "" {
+		pem, err := os.ReadFile(*l.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", *l.caFile)
+		}
+
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: pool,
+			},
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*l.server, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*l.token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr adminError
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("server: %s", apiErr.Error)
+		}
+		return fmt.Errorf("server: %s", resp.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
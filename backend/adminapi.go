@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Admin JSON API on the running server:
+
+		GET  /admin/users?search=PREFIX      users, with whether they are online
+		GET  /admin/connections              open websocket sessions
+		POST /admin/users/{name}/ban         {"reason": "..."}, also closes the session
+		POST /admin/users/{name}/unban
+		POST /admin/users/{name}/disconnect  close the session
+		POST /admin/users/{name}/reload      reread login details, which logins also do
+		POST /admin/broadcast                {"message": "..."} to everyone logged in
+
+	Requests need "Authorization: Bearer <admin_token>". They aren't served
+	at all when no token is configured. Errors come back as {"error": "..."}.
+*/
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminUserStatus struct {
+	AdminUser
+	Online bool `json:"online"`
+}
+
+type adminConnection struct {
+	Username    string `json:"username"`
+	RemoteAddr  string `json:"remote_addr"`
+	ConnectedAt string `json:"connected_at"`
+	LoggedIn    bool   `json:"logged_in"`
+}
+
+type adminBanRequest struct {
+	Reason string `json:"reason"`
+}
+
+type adminAnnouncement struct {
+	Message string `json:"message"`
+}
+
+func (s *Server) adminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/users", requireAdmin(s.adminUsers))
+	mux.HandleFunc("GET /admin/connections", requireAdmin(s.adminConnections))
+	mux.HandleFunc("POST /admin/users/{name}/ban", requireAdmin(s.adminBan))
+	mux.HandleFunc("POST /admin/users/{name}/unban", requireAdmin(s.adminUnban))
+	mux.HandleFunc("POST /admin/users/{name}/disconnect", requireAdmin(s.adminDisconnect))
+	mux.HandleFunc("POST /admin/users/{name}/reload", requireAdmin(s.adminReload))
+	mux.HandleFunc("POST /admin/broadcast", requireAdmin(s.adminBroadcast))
+}
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			slog.Warn("Admin request refused", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, adminError{"invalid admin token"})
+			return
+		}
+
+		slog.Info("Admin request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error writing admin response", "err", err)
+	}
+}
+
+// Optional JSON body. An empty body leaves v as it is
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxMessageSizeLimit))
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid JSON body"})
+		return false
+	}
+	return true
+}
+
+// Key of the user named in the path, answering 404 if there is none
+func adminPathUser(w http.ResponseWriter, r *http.Request) (string, apiKey, bool) {
+	name := r.PathValue("name")
+
+	// From the store, which knows accounts made since startup, such as bots
+	ids, err := dbConn.GetUserAPI(name)
+	if err != nil {
+		slog.Error("Error reading user", "user", name, "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"failed to read user"})
+		return name, "", false
+	}
+	if len(*ids) == 0 {
+		writeJSON(w, http.StatusNotFound, adminError{fmt.Sprintf("user %q not found", name)})
+		return name, "", false
+	}
+	return name, apiKey((*ids)[0]), true
+}
+
+// Tell the user why, then close their connection. False if they had none
+func (s *Server) closeSession(k apiKey, message string) bool {
+	conn, ok := s.getConnection(k)
+	if !ok {
+		return false
+	}
+
+	conn.SendOnConnection(&ClientResponse{
+		Err:     nil,
+		Message: message,
+		Code:    ConnectionError,
+	})
+	conn.conn.Close()
+	return true
+}
+
+func (s *Server) adminUsers(w http.ResponseWriter, r *http.Request) {
+
+	users, err := dbConn.AdminUsers(r.URL.Query().Get("search"))
+	if err != nil {
+		slog.Error("Error listing users", "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"failed to list users"})
+		return
+	}
+
+	result := make([]adminUserStatus, 0, len(users))
+	for _, u := range users {
+		online := false
+		if k, ok := registry.GetKey(u.Username); ok {
+			if c, ok := registry.Get(k); ok {
+				online = c.LoggedIn()
+			}
+		}
+
+		result = append(result, adminUserStatus{
+			AdminUser: u,
+			Online:    online,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) adminConnections(w http.ResponseWriter, r *http.Request) {
+
+	type open struct {
+		k    apiKey
+		conn *ClientConnection
+	}
+
+	s.mu.Lock()
+	conns := make([]open, 0, len(s.clients))
+	for k, c := range s.clients {
+		conns = append(conns, open{k, c})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].conn.connectedAt.Before(conns[j].conn.connectedAt)
+	})
+
+	result := make([]adminConnection, 0, len(conns))
+	for _, o := range conns {
+		loggedIn := false
+		if c, ok := registry.Get(o.k); ok {
+			loggedIn = c.LoggedIn()
+		}
+
+		result = append(result, adminConnection{
+			// Empty until a new user picks a name
+			Username:    registry.Username(o.k),
+			RemoteAddr:  o.conn.remoteAddr,
+			ConnectedAt: o.conn.connectedAt.UTC().Format(time.RFC3339),
+			LoggedIn:    loggedIn,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) adminBan(w http.ResponseWriter, r *http.Request) {
+
+	var ban adminBanRequest
+	if !readJSON(w, r, &ban) {
+		return
+	}
+
+	name, k, ok := adminPathUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := dbConn.SetDisabled(k, true, ban.Reason); err != nil {
+		slog.Error("Error disabling user", "user", name, "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"failed to disable user"})
+		return
+	}
+
+	audit(AuditAdminBan, auditAdmin, name, remoteHost(r.RemoteAddr), ban.Reason)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"username":     name,
+		"disabled":     true,
+		"disconnected": s.closeSession(k, "Account disabled by an admin"),
+	})
+}
+
+func (s *Server) adminUnban(w http.ResponseWriter, r *http.Request) {
+
+	name, k, ok := adminPathUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := dbConn.SetDisabled(k, false, ""); err != nil {
+		slog.Error("Error enabling user", "user", name, "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"failed to enable user"})
+		return
+	}
+
+	audit(AuditAdminUnban, auditAdmin, name, remoteHost(r.RemoteAddr), "")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"username": name,
+		"disabled": false,
+	})
+}
+
+// Close the user's session, if they have one. They can log straight back in unless also banned
+func (s *Server) adminDisconnect(w http.ResponseWriter, r *http.Request) {
+
+	name, k, ok := adminPathUser(w, r)
+	if !ok {
+		return
+	}
+
+	disconnected := s.closeSession(k, "Disconnected by an admin")
+	audit(AuditAdminDisconnect, auditAdmin, name, remoteHost(r.RemoteAddr), "")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"username":     name,
+		"disconnected": disconnected,
+	})
+}
+
+// Read the user's login details from the store again, after an admin password reset
+func (s *Server) adminReload(w http.ResponseWriter, r *http.Request) {
+
+	name, k, ok := adminPathUser(w, r)
+	if !ok {
+		return
+	}
+
+	details, err := dbConn.GetLoginDetails(k)
+	if err != nil {
+		slog.Error("Error reloading user", "user", name, "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"failed to read user"})
+		return
+	}
+
+	if c, ok := registry.Get(k); ok {
+		c.setPassword(details.Password)
+	}
+
+	audit(AuditAdminReload, auditAdmin, name, remoteHost(r.RemoteAddr), "")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"username": name,
+		"reloaded": true,
+	})
+}
+
+// Send an announcement to everyone logged in. Returns how many it reached
+func (s *Server) adminBroadcast(w http.ResponseWriter, r *http.Request) {
+
+	var announcement adminAnnouncement
+	if !readJSON(w, r, &announcement) {
+		return
+	}
+
+	if announcement.Message == "" || len(announcement.Message) > config.MaxMessageSize {
+		writeJSON(w, http.StatusBadRequest, adminError{fmt.Sprintf("message must be between 1 and %d bytes", config.MaxMessageSize)})
+		return
+	}
+
+	s.mu.Lock()
+	keys := make([]apiKey, 0, len(s.clients))
+	for k := range s.clients {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+
+	sent := 0
+	for _, k := range keys {
+		c, ok := registry.Get(k)
+		if !ok || !c.LoggedIn() {
+			continue
+		}
+
+		err := s.sendTo(k, &ClientResponse{
+			Err:     nil,
+			Message: announcement.Message,
+			Code:    Announcement,
+		})
+		if err == nil {
+			sent++
+		}
+	}
+
+	audit(AuditAdminBroadcast, auditAdmin, "", remoteHost(r.RemoteAddr), announcement.Message)
+
+	writeJSON(w, http.StatusOK, map[string]int{
+		"sent": sent,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// POST to an admin endpoint with the test server's admin token
+func postAdmin(t *testing.T, srv *httptest.Server, path string) (int, map[string]interface{}) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+config.AdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func setTestAdminToken(t *testing.T) {
+	old := config.AdminToken
+	config.AdminToken = "admin-token"
+	t.Cleanup(func() { config.AdminToken = old })
+}
+
+// Bots made since startup are only in the store until they connect
+func TestAdminDisconnectBot(t *testing.T) {
+	setTestAdminToken(t)
+	srv := newTestServer(t)
+	token := createTestBot(t, "echo")
+
+	status, body := postAdmin(t, srv, "/admin/users/echo/disconnect")
+	if status != http.StatusOK || body["disconnected"] != false {
+		t.Fatalf("offline bot: got %d %v", status, body)
+	}
+
+	loginTestBot(t, srv, token)
+
+	status, body = postAdmin(t, srv, "/admin/users/echo/disconnect")
+	if status != http.StatusOK || body["disconnected"] != true {
+		t.Fatalf("connected bot: got %d %v", status, body)
+	}
+
+	status, _ = postAdmin(t, srv, "/admin/users/nobody/disconnect")
+	if status != http.StatusNotFound {
+		t.Fatalf("unknown user: got %d", status)
+	}
+}
+
+// A reset by the admin command writes only to the store, and must still
+// apply to the next login without a reload
+func TestAdminResetPasswordApplies(t *testing.T) {
+	srv := newTestServer(t)
+
+	alice := loginTest(t, srv, "alice-key", "alice")
+	alice.ws.Close()
+	eventually(t, "alice to log out", func() bool {
+		return !checkUserLoggedIn("alice-key")
+	})
+
+	hash, err := hashPassword("new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbConn.SetPassword("alice-key", hash); err != nil {
+		t.Fatal(err)
+	}
+
+	again := dialTest(t, srv, "alice-key")
+	again.expect(LoginDetailsRequired)
+	again.send(AttemptLogin, LoginDetails{Username: "alice", Password: "new password"})
+	again.expect(LoginSuccessful)
+
+	again.ws.Close()
+	eventually(t, "alice to log out", func() bool {
+		return !checkUserLoggedIn("alice-key")
+	})
+
+	old := dialTest(t, srv, "alice-key")
+	old.expect(LoginDetailsRequired)
+	old.send(AttemptLogin, LoginDetails{Username: "alice", Password: "password"})
+	old.expect(IncorrectLogin)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+	Read-only reports for the admin command and the /admin endpoints.
+	AdminUsers is also served by the running server, so it is part of the
+	Store interface. The rest only run against the SQLite database, as do
+	the webhook subscription changes, which only the admin command makes.
+*/
+
+type AdminUser struct {
+	Username string `json:"username"`
+	// user or bot
+	Kind string `json:"kind"`
+	// ok, locked, disabled or deleted
+	Status         string `json:"status"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+	LastSeen       string `json:"last_seen"`
+	FailedLogins   int    `json:"failed_logins"`
+	Friends        int    `json:"friends"`
+	MessagesSent   int    `json:"messages_sent"`
+}
+
+type AdminFriend struct {
+	Username string `json:"username"`
+	// friend, request sent or request received
+	Relation    string `json:"relation"`
+	Messages    int    `json:"messages"`
+	LastMessage string `json:"last_message"`
+}
+
+type AdminMessageCount struct {
+	Username string `json:"username"`
+	Sent     int    `json:"sent"`
+	Received int    `json:"received"`
+}
+
+const adminTimeLayout = "2006-01-02 15:04"
+
+// Users whose name starts with prefix, placeholders for unfinished signups left out
+func (c *DBConn) AdminUsers(prefix string) ([]AdminUser, error) {
+
+	rows, err := c.db.Query(
+		`
+	SELECT u.username, u.kind, u.lastSeen, u.failedLogins, u.lockedUntil, u.disabledAt, u.disabledReason, u.deletedAt,
+		(SELECT COUNT(*) FROM friends f WHERE f.user1 = u.id OR f.user2 = u.id),
+		(SELECT COUNT(*) FROM messages m WHERE m.senderId = u.id)
+	FROM users u
+	WHERE u.username != '' AND u.username LIKE ?
+	ORDER BY u.username
+	;
+	`,
+		prefix+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	users := []AdminUser{}
+
+	for rows.Next() {
+		var u AdminUser
+		var lastSeen sql.NullTime
+		var lockedUntil sql.NullTime
+		var disabledAt sql.NullTime
+		var deletedAt sql.NullTime
+
+		err := rows.Scan(
+			&u.Username,
+			&u.Kind,
+			&lastSeen,
+			&u.FailedLogins,
+			&lockedUntil,
+			&disabledAt,
+			&u.DisabledReason,
+			&deletedAt,
+			&u.Friends,
+			&u.MessagesSent,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case deletedAt.Valid:
+			u.Status = "deleted"
+		case disabledAt.Valid:
+			u.Status = "disabled"
+		case lockedUntil.Valid && lockedUntil.Time.After(now):
+			u.Status = "locked"
+		default:
+			u.Status = "ok"
+		}
+
+		u.LastSeen = "never"
+		if lastSeen.Valid {
+			u.LastSeen = lastSeen.Time.UTC().Format(adminTimeLayout)
+		}
+
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// Friends and pending requests of k, with message counts per friendship
+func (c *DBConn) AdminFriends(k apiKey) ([]AdminFriend, error) {
+
+	rows, err := c.db.Query(
+		`
+	SELECT u.username, 'friend', COUNT(m.id), COALESCE(MAX(m.date), '')
+	FROM friends f
+	JOIN users u ON u.id = CASE WHEN f.user1 = ? THEN f.user2 ELSE f.user1 END
+	LEFT JOIN messages m ON m.friendId = f.id
+	WHERE f.user1 = ? OR f.user2 = ?
+	GROUP BY f.id, u.username
+	UNION ALL
+	SELECT u.username, CASE WHEN r.reqId = ? THEN 'request sent' ELSE 'request received' END, 0, ''
+	FROM friend_requests r
+	JOIN users u ON u.id = CASE WHEN r.reqId = ? THEN r.resId ELSE r.reqId END
+	WHERE r.reqId = ? OR r.resId = ?
+	ORDER BY 1
+	;
+	`,
+		k, k, k,
+		k, k, k, k,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	friends := []AdminFriend{}
+
+	for rows.Next() {
+		var f AdminFriend
+		var lastMessage string
+
+		if err := rows.Scan(&f.Username, &f.Relation, &f.Messages, &lastMessage); err != nil {
+			return nil, err
+		}
+
+		// Aggregates lose the column type, so the date comes back as SQLite text
+		f.LastMessage = "-"
+		if t, err := time.Parse(time.DateTime, lastMessage); err == nil {
+			f.LastMessage = t.Format(adminTimeLayout)
+		}
+
+		friends = append(friends, f)
+	}
+
+	return friends, rows.Err()
+}
+
+// Messages sent and received per user. A zero since counts all time
+func (c *DBConn) AdminMessageCounts(since time.Duration) ([]AdminMessageCount, error) {
+
+	// SQLite datetime modifier, far enough back to include everything when since is zero
+	modifier := "-1000 years"
+	if since > 0 {
+		modifier = fmt.Sprintf("-%d seconds", int64(since.Seconds()))
+	}
+
+	rows, err := c.db.Query(
+		`
+	SELECT u.username,
+		(SELECT COUNT(*) FROM messages m
+			WHERE m.senderId = u.id AND m.date >= datetime('now', ?)),
+		(SELECT COUNT(*) FROM messages m
+			JOIN friends f ON m.friendId = f.id
+			WHERE (f.user1 = u.id OR f.user2 = u.id) AND m.senderId != u.id AND m.date >= datetime('now', ?))
+	FROM users u
+	WHERE u.username != ''
+	ORDER BY u.username
+	;
+	`,
+		modifier,
+		modifier,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []AdminMessageCount{}
+
+	for rows.Next() {
+		var count AdminMessageCount
+
+		if err := rows.Scan(&count.Username, &count.Sent, &count.Received); err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
+
+type AuditFilter struct {
+	// Matches either the actor or the target
+	User  string
+	Event string
+	// Zero times leave that end of the range open
+	From time.Time
+	To   time.Time
+	// Most recent events kept when there are more. No limit when zero
+	Limit int
+}
+
+// Audit events matching f, oldest first
+func (c *DBConn) AuditEvents(f AuditFilter) ([]AuditEvent, error) {
+
+	query := `
+	SELECT id, at, event, actor, target, source, detail
+	FROM audit_log
+	WHERE 1 = 1`
+	args := []interface{}{}
+
+	if f.User != "" {
+		query += ` AND (actor = ? OR target = ?)`
+		args = append(args, f.User, f.User)
+	}
+	if f.Event != "" {
+		query += ` AND event = ?`
+		args = append(args, f.Event)
+	}
+	// Stored as UTC text by CURRENT_TIMESTAMP, so compare in the same form
+	if !f.From.IsZero() {
+		query += ` AND at >= ?`
+		args = append(args, f.From.UTC().Format(time.DateTime))
+	}
+	if !f.To.IsZero() {
+		query += ` AND at < ?`
+		args = append(args, f.To.UTC().Format(time.DateTime))
+	}
+
+	query += ` ORDER BY id DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+
+	rows, err := c.db.Query(query+";", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+
+	for rows.Next() {
+		var e AuditEvent
+
+		if err := rows.Scan(&e.Id, &e.At, &e.Event, &e.Actor, &e.Target, &e.Source, &e.Detail); err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest were read first so the limit keeps them. Put them back in order
+	slices.Reverse(events)
+
+	return events, nil
+}
+
+// Subscribe h, for k's events only or for every user's when k is empty
+func (c *DBConn) AddWebhook(h *Webhook, k apiKey) error {
+
+	secret, err := c.keys.seal(sealedSecret, h.Secret)
+	if err != nil {
+		return err
+	}
+
+	userId := sql.NullString{String: string(k), Valid: k != ""}
+
+	_, err = c.db.Exec(
+		`
+	INSERT INTO webhooks (id, url, secret, userId, events) VALUES (?,?,?,?,?);
+	`,
+		h.Id,
+		h.URL,
+		secret,
+		userId,
+		strings.Join(h.Events, ","),
+	)
+
+	return err
+}
+
+// False if there was no such webhook. Its dead letters are kept
+func (c *DBConn) DeleteWebhook(id string) (bool, error) {
+
+	res, err := c.db.Exec(`DELETE FROM webhooks WHERE id = ?;`, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Failed deliveries, oldest first. All webhooks when webhookId is empty, and no limit when zero
+func (c *DBConn) DeadLetters(webhookId string, limit int) ([]DeadLetter, error) {
+
+	query := `
+	SELECT id, webhookId, deliveryId, event, payload, attempts, lastError, failedAt
+	FROM webhook_dead_letters
+	WHERE 1 = 1`
+	args := []interface{}{}
+
+	if webhookId != "" {
+		query += ` AND webhookId = ?`
+		args = append(args, webhookId)
+	}
+
+	query += ` ORDER BY id DESC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := c.db.Query(query+";", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+
+	for rows.Next() {
+		var d DeadLetter
+
+		if err := rows.Scan(&d.Id, &d.WebhookId, &d.DeliveryId, &d.Event, &d.Payload, &d.Attempts, &d.LastError, &d.FailedAt); err != nil {
+			return nil, err
+		}
+
+		letters = append(letters, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest were read first so the limit keeps them
+	slices.Reverse(letters)
+
+	return letters, nil
+}
+
+func (c *DBConn) DeleteDeadLetter(id int64) error {
+	_, err := c.db.Exec(`DELETE FROM webhook_dead_letters WHERE id = ?;`, id)
+	return err
+}
+
+func (c *DBConn) AddIncomingWebhook(h *IncomingWebhook, tokenHash string) error {
+	_, err := c.db.Exec(
+		`
+	INSERT INTO incoming_webhooks (id, tokenHash, senderId, receiverId) VALUES (?,?,?,?);
+	`,
+		h.Id,
+		tokenHash,
+		h.SenderId,
+		h.ReceiverId,
+	)
+	return err
+}
+
+func (c *DBConn) IncomingWebhooks() ([]IncomingWebhook, error) {
+
+	rows, err := c.db.Query(
+		`
+	SELECT h.id, s.username, r.username, h.createdAt
+	FROM incoming_webhooks h
+	JOIN users s ON s.id = h.senderId
+	JOIN users r ON r.id = h.receiverId
+	ORDER BY h.createdAt, h.id
+	;
+	`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []IncomingWebhook{}
+
+	for rows.Next() {
+		var h IncomingWebhook
+
+		if err := rows.Scan(&h.Id, &h.Sender, &h.Receiver, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		hooks = append(hooks, h)
+	}
+
+	return hooks, rows.Err()
+}
+
+// False if there was no such webhook
+func (c *DBConn) DeleteIncomingWebhook(id string) (bool, error) {
+
+	res, err := c.db.Exec(`DELETE FROM incoming_webhooks WHERE id = ?;`, id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Admin commands for outgoing and incoming webhooks. See admin.go for
+	the list, and webhooks.go and incoming.go for how they are delivered.
+*/
+
+func adminAddWebhook(args []string) error {
+
+	cmd := newAdminCommand("admin add-webhook")
+	target := cmd.String("url", "", "http or https URL to POST events to")
+	user := cmd.String("user", "", "only events involving this username. Every user's if empty")
+	events := cmd.String("events", strings.Join(webhookEvents, ","), "comma separated events to send")
+	secret := cmd.String("secret", "", "secret to sign deliveries with. Generated if empty")
+	cmd.Parse(args)
+
+	u, err := url.Parse(*target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("-url must be an http or https URL")
+	}
+
+	h := &Webhook{
+		URL:    *target,
+		Secret: *secret,
+		User:   *user,
+	}
+
+	for _, e := range strings.Split(*events, ",") {
+		e = strings.TrimSpace(e)
+		if !slices.Contains(webhookEvents, e) {
+			return fmt.Errorf("unknown event %q, expected some of %s", e, strings.Join(webhookEvents, ", "))
+		}
+		if !slices.Contains(h.Events, e) {
+			h.Events = append(h.Events, e)
+		}
+	}
+
+	if h.Secret == "" {
+		h.Secret = newWebhookSecret()
+	}
+
+	return cmd.withDB(func(conn *DBConn) error {
+		var k apiKey
+		var err error
+		if *user != "" {
+			if k, err = adminUserKey(conn, *user); err != nil {
+				return err
+			}
+		}
+
+		if h.Id, err = generateId(); err != nil {
+			return err
+		}
+
+		if err := conn.AddWebhook(h, k); err != nil {
+			return err
+		}
+		auditTo(conn, AuditAdminAddWebhook, auditAdmin, *user, "cli", h.Id+" "+h.URL)
+
+		fmt.Printf("Added webhook %s for %s\nSecret, shown only once:\n%s\n", h.Id, strings.Join(h.Events, ","), h.Secret)
+		return nil
+	})
+}
+
+func adminWebhooks(args []string) error {
+
+	cmd := newAdminCommand("admin webhooks")
+	asJSON := cmd.Bool("json", false, "print JSON instead of a table")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		hooks, err := conn.Webhooks()
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			if hooks == nil {
+				hooks = []Webhook{}
+			}
+			return printJSON(hooks)
+		}
+
+		t := newTable()
+		fmt.Fprintln(t, "ID\tURL\tUSER\tEVENTS\tCREATED (UTC)")
+		for _, h := range hooks {
+			user := h.User
+			if user == "" {
+				user = "(all)"
+			}
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\t%s\n", h.Id, h.URL, user, strings.Join(h.Events, ","), h.CreatedAt.UTC().Format(adminTimeLayout))
+		}
+		return t.Flush()
+	})
+}
+
+func adminRemoveWebhook(args []string) error {
+
+	cmd := newAdminCommand("admin remove-webhook")
+	id := cmd.String("id", "", "id of the webhook, from admin webhooks")
+	cmd.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	return cmd.withDB(func(conn *DBConn) error {
+		removed, err := conn.DeleteWebhook(*id)
+		if err != nil {
+			return err
+		}
+
+		if !removed {
+			return fmt.Errorf("webhook %q not found", *id)
+		}
+		auditTo(conn, AuditAdminRemoveWebhook, auditAdmin, "", "cli", *id)
+
+		fmt.Printf("Removed webhook %s\n", *id)
+		return nil
+	})
+}
+
+func adminWebhookFailures(args []string) error {
+
+	cmd := newAdminCommand("admin webhook-failures")
+	webhookId := cmd.String("webhook", "", "only failures of this webhook")
+	limit := cmd.Int("limit", 100, "most recent failures to show. 0 shows all")
+	asJSON := cmd.Bool("json", false, "print JSON, with payloads, instead of a table")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		letters, err := conn.DeadLetters(*webhookId, *limit)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			return printJSON(letters)
+		}
+
+		t := newTable()
+		fmt.Fprintln(t, "ID\tFAILED (UTC)\tWEBHOOK\tEVENT\tATTEMPTS\tLAST ERROR")
+		for _, d := range letters {
+			fmt.Fprintf(t, "%d\t%s\t%s\t%s\t%d\t%s\n", d.Id, d.FailedAt.UTC().Format(time.DateTime), d.WebhookId, d.Event, d.Attempts, d.LastError)
+		}
+		return t.Flush()
+	})
+}
+
+// Post failed deliveries once more, as they were first sent but freshly
+// signed. Those delivered are removed from the dead letter table
+func adminRedeliverWebhook(args []string) error {
+
+	cmd := newAdminCommand("admin redeliver-webhook")
+	id := cmd.Int64("id", 0, "id of the failure, from admin webhook-failures")
+	all := cmd.Bool("all", false, "every failure whose webhook still exists")
+	timeout := cmd.Duration("timeout", 10*time.Second, "how long each delivery may take")
+	cmd.Parse(args)
+
+	if (*id == 0) == !*all {
+		return fmt.Errorf("give one of -id and -all")
+	}
+
+	return cmd.withDB(func(conn *DBConn) error {
+		hooks, err := conn.Webhooks()
+		if err != nil {
+			return err
+		}
+
+		letters, err := conn.DeadLetters("", 0)
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{
+			Timeout: *timeout,
+		}
+
+		found, failed := false, 0
+
+		for _, d := range letters {
+			if !*all && d.Id != *id {
+				continue
+			}
+			found = true
+
+			i := slices.IndexFunc(hooks, func(h Webhook) bool { return h.Id == d.WebhookId })
+			if i < 0 {
+				if !*all {
+					return fmt.Errorf("webhook %s of failure %d was removed", d.WebhookId, d.Id)
+				}
+				continue
+			}
+
+			if _, err := postWebhook(context.Background(), client, &hooks[i], d.Event, d.DeliveryId, []byte(d.Payload)); err != nil {
+				fmt.Printf("%d: %v\n", d.Id, err)
+				failed++
+				continue
+			}
+
+			if err := conn.DeleteDeadLetter(d.Id); err != nil {
+				return err
+			}
+			fmt.Printf("%d: delivered to %s\n", d.Id, hooks[i].URL)
+		}
+
+		if !found && !*all {
+			return fmt.Errorf("failure %d not found", *id)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d deliveries failed again", failed)
+		}
+		return nil
+	})
+}
+
+// Print deliveries to stdout, for checking a subscription works. Answers
+// 401 to deliveries whose signature or timestamp is wrong
+func adminWebhookReceiver(args []string) error {
+
+	fs := flag.NewFlagSet("admin webhook-receiver", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:9000", "address to listen on")
+	secret := fs.String("secret", os.Getenv("MESSAGING_WEBHOOK_SECRET"), "the webhook's secret, from add-webhook")
+	fail := fs.Int("fail", 0, "answer 503 to the first N deliveries, to try out retries")
+	fs.Parse(args)
+
+	if *secret == "" {
+		return fmt.Errorf("-secret or MESSAGING_WEBHOOK_SECRET is required")
+	}
+
+	var mu sync.Mutex
+	received := 0
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Error reading body", http.StatusBadRequest)
+			return
+		}
+
+		event := r.Header.Get("X-Messaging-Event")
+		delivery := r.Header.Get("X-Messaging-Delivery")
+
+		err = verifyWebhook(*secret, r.Header.Get("X-Messaging-Timestamp"), r.Header.Get("X-Messaging-Signature"), body, time.Now())
+		if err != nil {
+			fmt.Printf("%s rejected %s %s: %v\n", time.Now().Format(time.TimeOnly), event, delivery, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		received++
+		n := received
+		mu.Unlock()
+
+		if n <= *fail {
+			fmt.Printf("%s failing %s %s on purpose (%d of %d)\n", time.Now().Format(time.TimeOnly), event, delivery, n, *fail)
+			http.Error(w, "Failing on purpose", http.StatusServiceUnavailable)
+			return
+		}
+
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") != nil {
+			pretty.Reset()
+			pretty.Write(body)
+		}
+
+		fmt.Printf("%s %s %s\n%s\n", time.Now().Format(time.TimeOnly), event, delivery, pretty.String())
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	fmt.Printf("Listening for webhooks on http://%s\n", *listen)
+	return http.ListenAndServe(*listen, http.HandlerFunc(handler))
+}
+
+func adminAddIncomingWebhook(args []string) error {
+
+	cmd := newAdminCommand("admin add-incoming-webhook")
+	bot := cmd.String("bot", "", "bot account the webhook posts as")
+	user := cmd.String("user", "", "friend of the bot the webhook posts to")
+	server := cmd.String("server", "http://localhost:8000", "URL of the server, for the printed webhook URL")
+	cmd.Parse(args)
+
+	if *bot == "" {
+		return fmt.Errorf("-bot is required")
+	}
+
+	return cmd.withDB(func(conn *DBConn) error {
+		botId, err := adminUserKey(conn, *bot)
+		if err != nil {
+			return err
+		}
+
+		// Only bots, so nobody's own account can be posted as
+		users, err := conn.AdminUsers(*bot)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(users, func(u AdminUser) bool { return u.Username == *bot })
+		if i < 0 || users[i].Kind != "bot" {
+			return fmt.Errorf("%s is not a bot. Make one with admin create-bot", *bot)
+		}
+
+		userId, err := adminUserKey(conn, *user)
+		if err != nil {
+			return err
+		}
+
+		friendship, err := conn.GetFriendshipByIds(string(botId), string(userId))
+		if err != nil {
+			return err
+		}
+		if len(*friendship) == 0 {
+			return fmt.Errorf("%s and %s aren't friends. %s can add %s as a friend first", *bot, *user, *user, *bot)
+		}
+
+		h := &IncomingWebhook{
+			SenderId:   botId,
+			ReceiverId: userId,
+		}
+		if h.Id, err = generateId(); err != nil {
+			return err
+		}
+
+		token := newIncomingToken()
+
+		if err := conn.AddIncomingWebhook(h, hashToken(token)); err != nil {
+			return err
+		}
+		auditTo(conn, AuditAdminAddIncoming, auditAdmin, *user, "cli", h.Id+" as "+*bot)
+
+		fmt.Printf("Added incoming webhook %s, posting as %s to %s. Its URL, shown only once:\n%s/hooks/%s\n", h.Id, *bot, *user, strings.TrimSuffix(*server, "/"), token)
+		return nil
+	})
+}
+
+func adminIncomingWebhooks(args []string) error {
+
+	cmd := newAdminCommand("admin incoming-webhooks")
+	asJSON := cmd.Bool("json", false, "print JSON instead of a table")
+	cmd.Parse(args)
+
+	return cmd.withDB(func(conn *DBConn) error {
+		hooks, err := conn.IncomingWebhooks()
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			return printJSON(hooks)
+		}
+
+		t := newTable()
+		fmt.Fprintln(t, "ID\tSENDER\tRECEIVER\tCREATED (UTC)")
+		for _, h := range hooks {
+			fmt.Fprintf(t, "%s\t%s\t%s\t%s\n", h.Id, h.Sender, h.Receiver, h.CreatedAt.UTC().Format(adminTimeLayout))
+		}
+		return t.Flush()
+	})
+}
+
+func adminRemoveIncomingWebhook(args []string) error {
+
+	cmd := newAdminCommand("admin remove-incoming-webhook")
+	id := cmd.String("id", "", "id of the webhook, from admin incoming-webhooks")
+	cmd.Parse(args)
+
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+
+	return cmd.withDB(func(conn *DBConn) error {
+		removed, err := conn.DeleteIncomingWebhook(*id)
+		if err != nil {
+			return err
+		}
+
+		if !removed {
+			return fmt.Errorf("incoming webhook %q not found", *id)
+		}
+		auditTo(conn, AuditAdminRemoveIncoming, auditAdmin, "", "cli", *id)
+
+		fmt.Printf("Removed incoming webhook %s. Its URL no longer works\n", *id)
+		return nil
+	})
+}
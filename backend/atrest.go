@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+	Encryption at rest for message bodies, passwords and webhook secrets.
+
+	Off unless a key is configured, with db_key_file or db_key (usually
+	MESSAGING_DB_KEY in the environment). Keys are written one per line, or
+	comma separated, as
+
+		ID:BASE64
+
+	where the key is 32 random bytes for AES-256-GCM. The first key seals
+	everything written from then on. Any others only open values sealed
+	before a rotation. Sealed values are stored as
+
+		$enc$1$ID$<base64 of nonce and sealed value>
+
+	with the table and column as additional data, so a value can't be
+	moved to another column. Values without the prefix were written before
+	encryption was turned on and are read as they are.
+
+	To rotate, put a new key first and keep the old one after it, restart,
+	then run "rekey" to reseal everything under the new key. The old key
+	can go once it finishes. "rekey -decrypt" turns encryption off again,
+	and "rekey -generate ID" prints a new key line.
+*/
+
+const sealedPrefix = "$enc$1$"
+
+const dbKeySize = 32
+
+// Columns sealed at rest, with the key column rekey updates them by
+type sealedColumn struct {
+	table  string
+	id     string
+	column string
+}
+
+var (
+	sealedMessage  = sealedColumn{"messages", "id", "message"}
+	sealedPassword = sealedColumn{"users", "id", "password"}
+	sealedSecret   = sealedColumn{"webhooks", "id", "secret"}
+)
+
+var sealedColumns = []sealedColumn{sealedMessage, sealedPassword, sealedSecret}
+
+type dbKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// Keys for sealing columns, the active one first. A nil *DBKeys leaves values in plaintext
+type DBKeys struct {
+	keys []dbKey
+}
+
+func validDBKeyId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Parse ID:BASE64 keys, separated by newlines or commas. Blank lines and # comments are skipped
+func parseDBKeys(spec string) (*DBKeys, error) {
+
+	keys := &DBKeys{}
+	seen := make(map[string]bool)
+
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok || !validDBKeyId(id) {
+			return nil, fmt.Errorf("database key %q must be ID:BASE64, with an ID of letters, digits, - or _", line)
+		}
+
+		if seen[id] {
+			return nil, fmt.Errorf("database key id %q used twice", id)
+		}
+		seen[id] = true
+
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(raw) != dbKeySize {
+			return nil, fmt.Errorf("database key %q must be %d bytes of base64", id, dbKeySize)
+		}
+
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		keys.keys = append(keys.keys, dbKey{id: id, aead: aead})
+	}
+
+	if len(keys.keys) == 0 {
+		return nil, fmt.Errorf("no database keys found")
+	}
+
+	return keys, nil
+}
+
+// Keys from a file or an inline value. Neither set means encryption at rest is off
+func loadDBKeys(path string, inline string) (*DBKeys, error) {
+
+	switch {
+	case path != "" && inline != "":
+		return nil, fmt.Errorf("set only one of db_key_file and db_key")
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return parseDBKeys(string(data))
+	case inline != "":
+		return parseDBKeys(inline)
+	}
+
+	return nil, nil
+}
+
+// Id of the key new values are sealed with
+func (k *DBKeys) ActiveId() string {
+	if k == nil {
+		return ""
+	}
+	return k.keys[0].id
+}
+
+func (c sealedColumn) additionalData() []byte {
+	return []byte(c.table + "." + c.column)
+}
+
+// Seal a value with the active key
+func (k *DBKeys) seal(col sealedColumn, value string) (string, error) {
+
+	if k == nil {
+		return value, nil
+	}
+
+	key := k.keys[0]
+
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := key.aead.Seal(nonce, nonce, []byte(value), col.additionalData())
+	return sealedPrefix + key.id + "$" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open a sealed value. Plaintext values pass straight through
+func (k *DBKeys) open(col sealedColumn, value string) (string, error) {
+
+	rest, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return value, nil
+	}
+
+	id, encoded, ok := strings.Cut(rest, "$")
+	if !ok {
+		return "", fmt.Errorf("%s.%s: malformed sealed value", col.table, col.column)
+	}
+
+	if k == nil {
+		return "", fmt.Errorf("%s.%s is encrypted but no database key is configured", col.table, col.column)
+	}
+
+	for _, key := range k.keys {
+		if key.id != id {
+			continue
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(sealed) < key.aead.NonceSize() {
+			return "", fmt.Errorf("%s.%s: malformed sealed value", col.table, col.column)
+		}
+
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, col.additionalData())
+		if err != nil {
+			return "", fmt.Errorf("%s.%s: %w", col.table, col.column, err)
+		}
+		return string(plain), nil
+	}
+
+	return "", fmt.Errorf("%s.%s is sealed with unknown database key %q", col.table, col.column, id)
+}
+
+// Whether a value is already stored the way k would write it
+func (k *DBKeys) current(value string) bool {
+	if k == nil {
+		return !strings.HasPrefix(value, sealedPrefix)
+	}
+	return strings.HasPrefix(value, sealedPrefix+k.keys[0].id+"$")
+}
+
+// Reseal every sealed column with the active key of to, or write plaintext when to is nil.
+// Runs in one transaction and returns how many values were rewritten
+func rekeyDB(db *sql.DB, from *DBKeys, to *DBKeys) (int, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rewritten := 0
+
+	for _, col := range sealedColumns {
+
+		rows, err := tx.Query(fmt.Sprintf(`SELECT %s, %s FROM %s WHERE %s IS NOT NULL;`, col.id, col.column, col.table, col.column))
+		if err != nil {
+			return 0, err
+		}
+
+		updates := map[string]string{}
+		for rows.Next() {
+			var id string
+			var value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return 0, err
+			}
+
+			if value == "" || to.current(value) {
+				continue
+			}
+
+			plain, err := from.open(col, value)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+
+			updates[id], err = to.seal(col, plain)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for id, value := range updates {
+			_, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE %s = ?;`, col.table, col.column, col.id), value, id)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		rewritten += len(updates)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return rewritten, nil
+}
+
+// rekey subcommand
+func runRekey(args []string) error {
+
+	cmd := newAdminCommand("rekey")
+	decrypt := cmd.Bool("decrypt", false, "write every value back in plaintext, turning encryption at rest off")
+	generate := cmd.String("generate", "", "print a new key line with this id and exit")
+	cmd.Parse(args)
+
+	if *generate != "" {
+		if !validDBKeyId(*generate) {
+			return fmt.Errorf("key id %q must be letters, digits, - or _", *generate)
+		}
+		fmt.Printf("%s:%s\n", *generate, base64.StdEncoding.EncodeToString(randomKey()))
+		return nil
+	}
+
+	// The server's keys, the new one first
+	cfg, err := cmd.config()
+	if err != nil {
+		return err
+	}
+
+	conn, err := openAdminDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	keys := conn.keys
+	if keys == nil {
+		return fmt.Errorf("no database keys given, set db_key_file or db_key, or use -db-key-file")
+	}
+
+	// The old ciphertext stays readable in the backup, so remove it once done with
+	backupPath, err := backupDB(conn.db, cfg.DBPath)
+	if err != nil {
+		return fmt.Errorf("backing up database before rekeying: %w", err)
+	}
+	fmt.Printf("Backed up database to %s\n", backupPath)
+
+	to := keys
+	if *decrypt {
+		to = nil
+	}
+
+	rewritten, err := rekeyDB(conn.db, keys, to)
+	if err != nil {
+		return err
+	}
+
+	if *decrypt {
+		fmt.Printf("Decrypted %d values\n", rewritten)
+	} else {
+		fmt.Printf("Resealed %d values with key %q\n", rewritten, keys.ActiveId())
+	}
+	return nil
+}
+
+func randomKey() []byte {
+	key := make([]byte, dbKeySize)
+	rand.Read(key)
+	return key
+}
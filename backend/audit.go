@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+/*
+	Audit log of security-relevant events, kept in the append-only
+	audit_log table.
+
+		actor    who did it: a username, or "admin"
+		target   the other user involved, if any
+		source   remote host for events from a connection, "cli" for the
+		         admin command
+		detail   anything else worth keeping, e.g. why a login failed
+
+	Writes never fail the action they describe. An error is logged instead.
+	Query the log with "admin audit".
+*/
+
+const (
+	AuditLogin            = "login"
+	AuditLoginFailed      = "login_failed"
+	AuditPasswordChanged  = "password_changed"
+	AuditRecoveryCodes    = "recovery_codes_issued"
+	AuditAccountRecovered = "account_recovered"
+	AuditFriendRequest    = "friend_request"
+	AuditFriendAccept     = "friend_accept"
+	AuditFriendDecline    = "friend_decline"
+	AuditAccountDeleted   = "account_deleted"
+	AuditKeyPublished     = "key_published"
+
+	AuditAdminBan            = "admin_ban"
+	AuditAdminUnban          = "admin_unban"
+	AuditAdminResetPassword  = "admin_reset_password"
+	AuditAdminUnlock         = "admin_unlock"
+	AuditAdminDisconnect     = "admin_disconnect"
+	AuditAdminReload         = "admin_reload"
+	AuditAdminBroadcast      = "admin_broadcast"
+	AuditAdminCreateBot      = "admin_create_bot"
+	AuditAdminBotToken       = "admin_rotate_bot_token"
+	AuditAdminAddWebhook     = "admin_add_webhook"
+	AuditAdminRemoveWebhook  = "admin_remove_webhook"
+	AuditAdminAddIncoming    = "admin_add_incoming_webhook"
+	AuditAdminRemoveIncoming = "admin_remove_incoming_webhook"
+)
+
+// Actor of admin events
+const auditAdmin = "admin"
+
+type AuditEvent struct {
+	Id     int64     `json:"id"`
+	At     time.Time `json:"at"`
+	Event  string    `json:"event"`
+	Actor  string    `json:"actor"`
+	Target string    `json:"target,omitempty"`
+	Source string    `json:"source,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Record an event in the active store
+func audit(event string, actor string, target string, source string, detail string) {
+	auditTo(dbConn, event, actor, target, source, detail)
+}
+
+// Remote host of k's connection, for events that don't carry one
+func (s *Server) auditSource(k apiKey) string {
+	if c, ok := s.getConnection(k); ok {
+		return remoteHost(c.remoteAddr)
+	}
+	return ""
+}
+
+func auditTo(store Store, event string, actor string, target string, source string, detail string) {
+
+	err := store.AppendAudit(&AuditEvent{
+		Event:  event,
+		Actor:  actor,
+		Target: target,
+		Source: source,
+		Detail: detail,
+	})
+
+	if err != nil {
+		slog.Error("Error writing audit log", "event", event, "actor", actor, "err", err)
+	}
+}
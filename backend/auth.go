@@ -4,6 +4,7 @@ package main
 
 import (
 	"encoding/base64"
+	"log/slog"
 	"net/http"
 	"strings"
 )
@@ -18,22 +19,34 @@ type LoginDetails struct {
 func getApiKey(r *http.Request) (apiKey, *RequestError) {
 	keyRaw := r.Header.Get("Authorization")
 
+	// Bots send their token instead, see bots.go
+	if token, ok := strings.CutPrefix(keyRaw, "Bearer "); ok {
+		return botKeyFromToken(token)
+	}
+
 	// User must send Auth header with API key
 	k, err := checkAuthValid(keyRaw)
 	if err != nil {
 		return "", err
 	}
 
+	// A bot's key is never handed out, but its account only takes the token
+	if c, ok := registry.Get(k); ok && c.Bot() {
+		return "", &RequestError{
+			Message: "Bots connect with their token",
+			Code:    AuthenticationError,
+		}
+	}
+
 	return k, nil
 }
 
 func doesUserExist(k apiKey) bool {
 
-	_, ok := UserMap[k]
-	return ok
+	return registry.Exists(k)
 }
 
-func authenticationCycle(k apiKey, l *LoginDetails) (*AuthResponse, *RequestError) {
+func authenticationCycle(k apiKey, l *LoginDetails, addr string) (*AuthResponse, *RequestError) {
 
 	var err *RequestError
 	// Check if there are login details
@@ -44,10 +57,18 @@ func authenticationCycle(k apiKey, l *LoginDetails) (*AuthResponse, *RequestErro
 		}, nil
 	}
 
+	c, ok := registry.Get(k)
+	if !ok {
+		return nil, &RequestError{
+			Message: "Unknown user",
+			Code:    AuthenticationError,
+		}
+	}
+
 	// Check if user has login details
 	if haveLogin := userHaveLogin(k); !haveLogin {
 		// Set new login details on client
-		err = UserMap[k].SetNewLogin(l, k)
+		err = c.SetNewLogin(l, k)
 
 		if err != nil {
 			return nil, err
@@ -56,15 +77,64 @@ func authenticationCycle(k apiKey, l *LoginDetails) (*AuthResponse, *RequestErro
 
 	// Check for logged in user
 	if loggedIn := checkUserLoggedIn(k); !loggedIn {
+		// Read on every attempt, so a ban from the admin command applies straight away
+		disabled, reason, dbErr := dbConn.GetDisabled(k)
+		if dbErr != nil {
+			return nil, &RequestError{
+				Message: "Error reading account",
+				Code:    DatabaseError,
+			}
+		}
+
+		if disabled {
+			authAttempts.Inc("disabled")
+			audit(AuditLoginFailed, l.Username, "", addr, "account disabled")
+
+			message := "Account disabled by an admin"
+			if reason != "" {
+				message += ": " + reason
+			}
+
+			return &AuthResponse{
+				Message: message,
+				Code:    AccountDisabled,
+			}, nil
+		}
+
+		// Refuse attempts while the account or address is backing off
+		lockedResp, err := checkLoginAllowed(k, addr)
+		if err != nil || lockedResp != nil {
+			if lockedResp != nil {
+				authAttempts.Inc("locked")
+				audit(AuditLoginFailed, l.Username, "", addr, "locked out")
+			}
+			return lockedResp, err
+		}
+
 		// Attempt login
 		if !loginUser(l, k) {
+			authAttempts.Inc("incorrect")
+			audit(AuditLoginFailed, l.Username, "", addr, "incorrect login details")
+
+			if err := recordLoginFailure(k, addr); err != nil {
+				slog.Error("Error recording failed login", "key", keyFingerprint(k), "err", err)
+			}
+
 			return &AuthResponse{
 				Message: "Login details incorrect",
 				Code:    IncorrectLogin,
 			}, nil
 		}
+
+		if err := recordLoginSuccess(k, addr); err != nil {
+			slog.Error("Error clearing failed logins", "key", keyFingerprint(k), "err", err)
+		}
+
+		audit(AuditLogin, l.Username, "", addr, "")
 	}
 
+	authAttempts.Inc("success")
+
 	return &AuthResponse{
 		Message: "Login successful",
 		Code:    LoginSuccessful,
@@ -116,10 +186,13 @@ func checkAuthValid(baseKey string) (apiKey, *RequestError) {
 
 func userHaveLogin(k apiKey) bool {
 
-	c := UserMap[k]
+	c, ok := registry.Get(k)
+	if !ok {
+		return false
+	}
 
 	// No username means detail required
-	if c.loginDetails.Username == "" {
+	if c.Login().Username == "" {
 		return false
 	}
 
@@ -128,25 +201,48 @@ func userHaveLogin(k apiKey) bool {
 
 func checkUserLoggedIn(k apiKey) bool {
 
-	// Check user is logged in on the map
-	c := UserMap[k]
-	return c.loggedIn
+	// Check user is logged in on the registry
+	c, ok := registry.Get(k)
+	if !ok {
+		return false
+	}
+	return c.LoggedIn()
+}
+
+// Whether password is the user's. Checked against the store, so a reset by
+// an admin applies straight away, and the registry's copy updated from it
+func passwordMatches(k apiKey, password string) bool {
+
+	stored, err := dbConn.GetLoginDetails(k)
+	if err != nil {
+		slog.Error("Error reading login details", "key", keyFingerprint(k), "err", err)
+		return false
+	}
+
+	if c, ok := registry.Get(k); ok {
+		c.setPassword(stored.Password)
+	}
+
+	return checkPassword(stored.Password, password)
 }
 
 func loginUser(l *LoginDetails, k apiKey) bool {
 	// Get user details
-	c := UserMap[k]
+	c, ok := registry.Get(k)
+	if !ok {
+		return false
+	}
 
-	if l.Username != c.loginDetails.Username {
+	if l.Username != c.Login().Username {
 		return false
 	}
 
-	if l.Password != c.loginDetails.Password {
+	if !passwordMatches(k, l.Password) {
 		return false
 	}
 
-	// Change state of client data
-	c.LoginClient(k)
+	// Change state of client data, notifying presence subscribers
+	registry.Login(k)
 
 	return true
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/*
+	Bot accounts, for standup reminders, deploy announcers and the like.
+
+	Bots are made by an admin with "admin create-bot", which prints a
+	long-lived token once. Only its SHA-256 hash is stored. Tokens look like
+
+		NAME:SECRET
+
+	so a bot can tell its own username from its token. A bot connects to
+	/ws like any client, but with "Authorization: Bearer TOKEN" in place of
+	an API key, and is logged in straight away instead of being asked for
+	login details. "admin rotate-bot-token" replaces a lost or leaked token.
+
+	Friend requests to a bot are accepted as soon as they are made. Requests
+	the server couldn't accept then, such as those to a bot made since the
+	server started, are accepted the next time the bot logs in.
+
+	Bots have no password or recovery codes, so the messages that change
+	them are refused. The SDK in botsdk/ speaks the rest of the protocol.
+*/
+
+// Between the bot's username and the secret in its token. Bot names can't contain it
+const botTokenSeparator = ":"
+
+func newBotToken(username string) string {
+	return username + botTokenSeparator + rand.Text()
+}
+
+// Stored in place of bot and incoming webhook tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Key of the bot a bearer token belongs to, registering the bot if this server hasn't seen it yet
+func botKeyFromToken(token string) (apiKey, *RequestError) {
+
+	k, err := dbConn.GetBotByToken(hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", &RequestError{
+			Message: "Unknown bot token",
+			Code:    AuthenticationError,
+		}
+	}
+	if err != nil {
+		slog.Error("Error reading bot token", "err", err)
+		return "", &RequestError{
+			Message: "Error reading account",
+			Code:    DatabaseError,
+		}
+	}
+
+	// Made by the admin command after the registry was loaded
+	if !registry.Exists(k) {
+		details, err := dbConn.GetLoginDetails(k)
+		if err != nil {
+			slog.Error("Error reading bot account", "key", keyFingerprint(k), "err", err)
+			return "", &RequestError{
+				Message: "Error reading account",
+				Code:    DatabaseError,
+			}
+		}
+
+		registry.Add(&clientData{
+			message:      fmt.Sprintf("Newly created on %q", time.Now()),
+			apiKey:       k,
+			username:     details.Username,
+			loginDetails: details,
+			accountMade:  true,
+			welcomeSent:  true,
+			bot:          true,
+			mu:           sync.Mutex{},
+			rwmu:         sync.RWMutex{},
+		})
+	}
+
+	return k, nil
+}
+
+// Key of a bot by username, if it is one
+func botKey(username string) (apiKey, bool) {
+	c, ok := registry.GetByUsername(username)
+	if !ok || !c.Bot() {
+		return "", false
+	}
+	return registry.GetKey(username)
+}
+
+// Messages bots may not send. They have a token in place of a password and recovery codes, and only admins remove them
+func botRefused(code MessageCode) bool {
+	switch code {
+	case ChangePassword, RecoveryCodes, DeleteAccount:
+		return true
+	}
+	return false
+}
+
+// In place of the auth loop. The token was checked when the connection opened
+func (s *Server) botLogin(k apiKey, addr string, logger *slog.Logger) *RequestError {
+
+	username := registry.Username(k)
+
+	// Bans apply to bots too
+	disabled, reason, err := dbConn.GetDisabled(k)
+	if err != nil {
+		logger.Error("Error reading account", "err", err)
+		return &RequestError{
+			Message: "Error reading account",
+			Code:    DatabaseError,
+		}
+	}
+
+	if disabled {
+		authAttempts.Inc("disabled")
+		audit(AuditLoginFailed, username, "", addr, "account disabled")
+
+		message := "Account disabled by an admin"
+		if reason != "" {
+			message += ": " + reason
+		}
+
+		return &RequestError{
+			Message: message,
+			Code:    AccountDisabled,
+		}
+	}
+
+	// Logged in status is broadcast by the registry presence hook
+	registry.Login(k)
+	authAttempts.Inc("success")
+	audit(AuditLogin, username, "", addr, "bot token")
+
+	reqErr := s.sendTo(k, &AuthResponse{
+		Message: "Login successful",
+		Code:    LoginSuccessful,
+	})
+	if reqErr != nil {
+		return reqErr
+	}
+
+	s.acceptPendingForBot(k, logger)
+
+	return nil
+}
+
+// Accept a friend request made to a bot, and send both sides the friendship
+func (s *Server) acceptForBot(k apiKey, requestId string) error {
+
+	ids, err := dbConn.GetFriendRequestById(requestId)
+	if err != nil {
+		return err
+	}
+
+	if len(*ids) < 3 {
+		return fmt.Errorf("friend request not found")
+	}
+
+	err = UpdateFriendRequest(&FriendAcceptData{
+		Accept:    true,
+		RequestId: requestId,
+	}, string(k))
+	if err != nil {
+		return err
+	}
+
+	// Second id is always the requesting user
+	audit(AuditFriendAccept, registry.Username(k), registry.Username(apiKey((*ids)[1])), "", "accepted by bot")
+
+	s.broadcast <- &BackendMessage{
+		Code:    BroadcastFriendship,
+		Payload: ids,
+	}
+
+	return nil
+}
+
+// Accept requests still waiting for a bot that has just logged in
+func (s *Server) acceptPendingForBot(k apiKey, logger *slog.Logger) {
+
+	content, err := dbConn.GetAllFriendsContent(k)
+	if err != nil {
+		logger.Error("Error reading friend requests", "err", err)
+		return
+	}
+
+	for _, request := range content.FriendRequests {
+		// Requests the bot made itself wait for the other user
+		if request.FromClient {
+			continue
+		}
+
+		if err := s.acceptForBot(k, request.RequestId); err != nil {
+			logger.Error("Error accepting friend request", "from", request.Username, "err", err)
+		}
+	}
+}
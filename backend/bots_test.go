@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sbow19/messaging-cli-backend/botsdk"
+)
+
+// Bot account in the test server's store. Returns its token
+func createTestBot(t *testing.T, username string) string {
+	t.Helper()
+
+	token := newBotToken(username)
+	if err := dbConn.CreateBot(apiKey(username+"-key"), username, hashToken(token)); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Connect with a bot token, logged in without being asked for details
+func loginTestBot(t *testing.T, srv *httptest.Server, token string) *testClient {
+	t.Helper()
+
+	c := dialAuthorized(t, srv, "Bearer "+token)
+	c.expect(LoginSuccessful)
+	c.expect(AllContent)
+	return c
+}
+
+// Bot made with the SDK, for runTestBot once its handlers are set
+func newTestBotSDK(t *testing.T, srv *httptest.Server, token string) *botsdk.Bot {
+	t.Helper()
+
+	bot, err := botsdk.New(botsdk.Config{
+		Server:     wsURL(srv),
+		Token:      token,
+		RetryDelay: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+// Run a bot until the test ends
+func runTestBot(t *testing.T, bot *botsdk.Bot) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- bot.Run(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("bot %s: %v", bot.Username(), err)
+		}
+	})
+}
+
+// Poll until cond holds, failing the test after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestBotTokenLogin(t *testing.T) {
+	srv := newTestServer(t)
+	token := createTestBot(t, "echo")
+
+	bot := loginTestBot(t, srv, token)
+
+	// Bots have a token in place of a password
+	bot.send(ChangePassword, PasswordChange{Current: "", New: "password"})
+	if r := bot.expect(ChangePassword); r.Err == nil {
+		t.Fatal("bot allowed to change its password")
+	}
+
+	unknown := dialAuthorized(t, srv, "Bearer echo:wrong")
+	if r := unknown.expect(AuthenticationError); r.Code != AuthenticationError {
+		t.Fatalf("unknown token answered with %d", r.Code)
+	}
+
+	// Nor can the bot's key be used as a person's
+	byKey := dialTest(t, srv, "echo-key")
+	byKey.expect(AuthenticationError)
+}
+
+func TestBotAcceptsFriendRequests(t *testing.T) {
+	srv := newTestServer(t)
+	token := createTestBot(t, "echo")
+
+	// Made before the bot connects, so accepted when it logs in
+	alice := loginTest(t, srv, "alice-key", "alice")
+	alice.send(FriendRequest, "echo")
+	alice.expect(FriendRequestResult)
+
+	bot := loginTestBot(t, srv, token)
+
+	// The first update may still be for the request
+	var content UserContent
+	for len(content.Friends) == 0 {
+		alice.expectPayload(UpdateFriendContent, &content)
+	}
+	if len(content.Friends) != 1 || content.Friends[0].Username != "echo" || !content.Friends[0].Bot {
+		t.Fatalf("alice's friends after the bot logged in: %+v", content.Friends)
+	}
+
+	// Made while the bot is connected, so accepted straight away
+	bob := loginTest(t, srv, "bob-key", "bob")
+	bob.send(FriendRequest, "echo")
+	bob.expect(FriendRequestResult)
+
+	bob.expectPayload(UpdateFriendContent, &content)
+	if len(content.Friends) != 1 || len(content.FriendRequests) != 0 {
+		t.Fatalf("bob's content after asking the bot: %+v", content)
+	}
+
+	for {
+		bot.expectPayload(UpdateFriendContent, &content)
+		if len(content.Friends) == 2 {
+			break
+		}
+	}
+}
+
+func TestEchoBot(t *testing.T) {
+	srv := newTestServer(t)
+	echoToken := createTestBot(t, "echo")
+	callerToken := createTestBot(t, "caller")
+
+	// Accepted by echo when it logs in
+	if _, err := dbConn.SetFriendRequest("echo", "caller-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	replies := make(chan *botsdk.Message, 1)
+	caller := newTestBotSDK(t, srv, callerToken)
+	caller.OnMessage(func(ctx context.Context, m *botsdk.Message) {
+		replies <- m
+	})
+	runTestBot(t, caller)
+
+	// Bots are only known to the server once they have connected
+	eventually(t, "caller to log in", func() bool {
+		return checkUserLoggedIn("caller-key")
+	})
+
+	// As examples/echobot does
+	echo := newTestBotSDK(t, srv, echoToken)
+	echo.OnMessage(func(ctx context.Context, m *botsdk.Message) {
+		// Caller can get the reply, ending the test, before echo hears it was saved
+		if err := echo.Send(ctx, m.From, m.Text); err != nil && ctx.Err() == nil {
+			t.Errorf("echo: %v", err)
+		}
+	})
+	runTestBot(t, echo)
+
+	eventually(t, "echo to accept the request", func() bool {
+		return slices.Contains(caller.Friends(), "echo")
+	})
+
+	// Echo publishes its key just after logging in, so the first tries may find none
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	eventually(t, "the chat to be saved", func() bool {
+		return caller.Send(ctx, "echo", "hello") == nil
+	})
+
+	select {
+	case m := <-replies:
+		if m.From != "echo" || m.Text != "hello" {
+			t.Fatalf("caller received %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no echo")
+	}
+}
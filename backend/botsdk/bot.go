@@ -0,0 +1,559 @@
+/*
+Package botsdk runs bots on a messaging-cli server.
+
+A bot account is made by an admin with "admin create-bot", which prints
+its token. The bot connects with it, stays connected, and reconnects if
+the connection drops:
+
+	bot, err := botsdk.New(botsdk.Config{
+		Server:  "ws://localhost:8000/ws",
+		Token:   os.Getenv("BOT_TOKEN"),
+		KeyFile: "standup.key",
+	})
+
+	bot.OnMessage(func(ctx context.Context, m *botsdk.Message) {
+		bot.Send(ctx, m.From, "You said: "+m.Text)
+	})
+
+	err = bot.Run(ctx)
+
+The server accepts every friend request made to a bot, so anyone can add
+one. OnFriendRequest is told about each new friend.
+
+Messages are end-to-end encrypted as in the client app. KeyFile keeps the
+bot's device key between runs. Without it the bot has a new key each run,
+and friends are warned it changed device every time it restarts.
+
+See examples/echobot for a complete bot.
+*/
+package botsdk
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type Config struct {
+	// Websocket URL of the server, e.g. ws://localhost:8000/ws
+	Server string
+	// Printed by "admin create-bot". It starts with the bot's username
+	Token string
+	// X25519 device key, created on first run. Empty for a new key every run
+	KeyFile string
+	// For wss:// servers, e.g. to trust a private CA
+	TLSConfig *tls.Config
+	// Wait between reconnects. Defaults to 2 seconds
+	RetryDelay time.Duration
+	// Defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+// Message from a friend, decrypted
+type Message struct {
+	From string
+	Text string
+	// UTC, "2006-01-02 15:04"
+	Date string
+}
+
+// Returned by Run when the server refuses the bot: an unknown token, or a disabled account
+type AuthError struct {
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return "botsdk: " + e.Message
+}
+
+// Returned by Send while the bot isn't logged in
+var ErrNotConnected = errors.New("botsdk: not connected")
+
+const defaultRetryDelay = 2 * time.Second
+
+type Bot struct {
+	cfg      Config
+	username string
+	private  *ecdh.PrivateKey
+	log      *slog.Logger
+
+	onMessage       func(context.Context, *Message)
+	onFriendRequest func(context.Context, string)
+
+	mu sync.Mutex
+	// Nil until logged in
+	session *session
+	// Nil until the server first sends the friend list
+	friends map[string]bool
+	// Friends' public keys, and lookups waiting for them
+	keys    map[string]string
+	keyWait map[string][]chan string
+	// Chat waiting for the server to save it
+	pending *pendingChat
+
+	// One chat is sent at a time, so a failure can only be for that chat
+	sendMu sync.Mutex
+}
+
+type session struct {
+	ws *websocket.Conn
+	// Closed when the connection ends
+	done chan struct{}
+
+	writeMu sync.Mutex
+}
+
+type pendingChat struct {
+	clientId string
+	result   chan error
+}
+
+func New(cfg Config) (*Bot, error) {
+
+	username, _, ok := strings.Cut(cfg.Token, ":")
+	if !ok || username == "" {
+		return nil, fmt.Errorf("botsdk: token should look like NAME:SECRET")
+	}
+
+	if cfg.Server == "" {
+		return nil, fmt.Errorf("botsdk: no server")
+	}
+
+	private, err := loadPrivateKey(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("botsdk: loading key: %w", err)
+	}
+
+	if cfg.RetryDelay == 0 {
+		cfg.RetryDelay = defaultRetryDelay
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &Bot{
+		cfg:      cfg,
+		username: username,
+		private:  private,
+		log:      logger.With("bot", username),
+		keys:     make(map[string]string),
+		keyWait:  make(map[string][]chan string),
+	}, nil
+}
+
+func (b *Bot) Username() string {
+	return b.username
+}
+
+// Handle messages from friends. Each runs in its own goroutine. Set before Run
+func (b *Bot) OnMessage(fn func(ctx context.Context, m *Message)) {
+	b.onMessage = fn
+}
+
+// Handle new friends. The server has already accepted the request. Set before Run
+func (b *Bot) OnFriendRequest(fn func(ctx context.Context, from string)) {
+	b.onFriendRequest = fn
+}
+
+// Usernames of the bot's friends, as last sent by the server
+func (b *Bot) Friends() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	friends := make([]string, 0, len(b.friends))
+	for name := range b.friends {
+		friends = append(friends, name)
+	}
+	return friends
+}
+
+// Connect and handle messages until ctx is done, reconnecting whenever the connection drops.
+// Returns an *AuthError straight away if the server refuses the bot
+func (b *Bot) Run(ctx context.Context) error {
+
+	for {
+		err := b.connect(ctx)
+
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		b.log.Warn("Disconnected, reconnecting", "err", err, "delay", b.cfg.RetryDelay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(b.cfg.RetryDelay):
+		}
+	}
+}
+
+// One connection, until it drops
+func (b *Bot) connect(ctx context.Context) error {
+
+	config, err := websocket.NewConfig(b.cfg.Server, "http://localhost/")
+	if err != nil {
+		return err
+	}
+	config.Header.Set("Authorization", "Bearer "+b.cfg.Token)
+	config.TlsConfig = b.cfg.TLSConfig
+
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	s := &session{
+		ws:   ws,
+		done: make(chan struct{}),
+	}
+
+	// Unblocks the read below when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		ws.Close()
+	})
+
+	defer func() {
+		stop()
+		ws.Close()
+		b.endSession(s)
+	}()
+
+	for {
+		var m serverMessage
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			return err
+		}
+
+		if err := b.handle(ctx, s, &m); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Bot) endSession(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.session == s {
+		b.session = nil
+	}
+	close(s.done)
+}
+
+func (b *Bot) handle(ctx context.Context, s *session, m *serverMessage) error {
+
+	switch m.Code {
+	case authenticationError, accountDisabled:
+		return &AuthError{Message: m.text()}
+
+	case loginSuccessful:
+		b.mu.Lock()
+		b.session = s
+		b.mu.Unlock()
+
+		b.log.Info("Logged in")
+
+		// Friends need it to write to the bot
+		return s.send(publishKey, encodePublicKey(b.private))
+
+	case allContent, updateFriendContent:
+		var content userContent
+		if err := json.Unmarshal(m.Payload, &content); err != nil {
+			b.log.Warn("Invalid friend list", "err", err)
+			break
+		}
+		b.updateFriends(ctx, content.Friends)
+
+	case receiveMessage:
+		var msg message
+		if err := json.Unmarshal(m.Payload, &msg); err != nil {
+			b.log.Warn("Invalid message", "err", err)
+			break
+		}
+
+		// Senders are sent their own chats too
+		if msg.Sender == b.username || b.onMessage == nil {
+			break
+		}
+		go b.receive(ctx, &msg)
+
+	case keyLookupResult:
+		var key publicKey
+		if err := json.Unmarshal(m.Payload, &key); err != nil {
+			b.log.Warn("Invalid public key", "err", err)
+			break
+		}
+		b.setKey(&key)
+
+	case messageAck:
+		var clientId string
+		if err := json.Unmarshal(m.Payload, &clientId); err != nil {
+			break
+		}
+		b.chatResult(clientId, nil)
+
+	case failedMessageSend:
+		// Refusals carry the chat's id. Failures on the server don't
+		var clientId string
+		if len(m.Payload) > 0 {
+			if err := json.Unmarshal(m.Payload, &clientId); err != nil {
+				break
+			}
+		}
+		b.chatResult(clientId, errors.New(m.text()))
+
+	case databaseError, serverShutdown, announcement:
+		b.log.Warn("Server message", "code", int(m.Code), "message", m.text())
+	}
+
+	return nil
+}
+
+// Replace the friend list, telling OnFriendRequest about anyone new.
+// Friends at the first login aren't new. Those added while disconnected are
+func (b *Bot) updateFriends(ctx context.Context, friends []friend) {
+
+	b.mu.Lock()
+	first := b.friends == nil
+	current := make(map[string]bool, len(friends))
+	added := []string{}
+
+	for _, f := range friends {
+		current[f.Username] = true
+		if !first && !b.friends[f.Username] {
+			added = append(added, f.Username)
+		}
+	}
+	b.friends = current
+	b.mu.Unlock()
+
+	if b.onFriendRequest == nil {
+		return
+	}
+
+	for _, name := range added {
+		go b.onFriendRequest(ctx, name)
+	}
+}
+
+func (b *Bot) receive(ctx context.Context, msg *message) {
+
+	text, err := b.decrypt(ctx, msg)
+	if err != nil {
+		b.log.Warn("Message not decrypted", "from", msg.Sender, "err", err)
+		return
+	}
+
+	b.onMessage(ctx, &Message{
+		From: msg.Sender,
+		Text: text,
+		Date: msg.Date,
+	})
+}
+
+func (b *Bot) decrypt(ctx context.Context, msg *message) (string, error) {
+
+	// Sent before encryption
+	if !strings.HasPrefix(msg.Text, e2ePrefix) {
+		return msg.Text, nil
+	}
+
+	key, err := b.lookupKey(ctx, msg.Sender)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := decrypt(b.private, msg, key)
+	if err == nil {
+		return text, nil
+	}
+
+	// The sender may have moved device since their key was fetched
+	key, err = b.fetchKey(ctx, msg.Sender)
+	if err != nil {
+		return "", err
+	}
+	return decrypt(b.private, msg, key)
+}
+
+// Send text to a friend, returning once the server has saved it
+func (b *Bot) Send(ctx context.Context, to string, text string) error {
+
+	key, err := b.lookupKey(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := encrypt(b.private, b.username, to, key, text)
+	if err != nil {
+		return err
+	}
+
+	b.sendMu.Lock()
+	defer b.sendMu.Unlock()
+
+	s, err := b.current()
+	if err != nil {
+		return err
+	}
+
+	pending := &pendingChat{
+		clientId: newClientId(),
+		result:   make(chan error, 1),
+	}
+
+	b.mu.Lock()
+	b.pending = pending
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.pending = nil
+		b.mu.Unlock()
+	}()
+
+	err = s.send(sendMessage, &chat{
+		Text:     sealed,
+		Sender:   b.username,
+		Receiver: to,
+		ClientId: pending.clientId,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-pending.result:
+		if err != nil {
+			return fmt.Errorf("botsdk: message to %s not sent: %w", to, err)
+		}
+		return nil
+	case <-s.done:
+		return ErrNotConnected
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Saved, or refused, by the server. Failures on the server carry no id, but only one chat is sent at a time
+func (b *Bot) chatResult(clientId string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending == nil || ((err == nil || clientId != "") && b.pending.clientId != clientId) {
+		return
+	}
+
+	b.pending.result <- err
+	b.pending = nil
+}
+
+func (b *Bot) current() (*session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.session == nil {
+		return nil, ErrNotConnected
+	}
+	return b.session, nil
+}
+
+// Friend's public key, fetched the first time it's needed
+func (b *Bot) lookupKey(ctx context.Context, username string) (string, error) {
+	b.mu.Lock()
+	key, ok := b.keys[username]
+	b.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	return b.fetchKey(ctx, username)
+}
+
+// Ask the server for a friend's current key. It only answers for friends
+func (b *Bot) fetchKey(ctx context.Context, username string) (string, error) {
+
+	s, err := b.current()
+	if err != nil {
+		return "", err
+	}
+
+	wait := make(chan string, 1)
+
+	b.mu.Lock()
+	b.keyWait[username] = append(b.keyWait[username], wait)
+	b.mu.Unlock()
+
+	if err := s.send(keyLookup, username); err != nil {
+		return "", err
+	}
+
+	select {
+	case key := <-wait:
+		if key == "" {
+			return "", fmt.Errorf("botsdk: %s has no encryption key, or isn't a friend", username)
+		}
+		return key, nil
+	case <-s.done:
+		return "", ErrNotConnected
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// A key looked up, or pushed by the server when a friend changes device
+func (b *Bot) setKey(key *publicKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if key.Key != "" {
+		b.keys[key.Username] = key.Key
+	}
+
+	for _, wait := range b.keyWait[key.Username] {
+		wait <- key.Key
+	}
+	delete(b.keyWait, key.Username)
+}
+
+func (s *session) send(c code, payload interface{}) error {
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return websocket.JSON.Send(s.ws, &clientMessage{
+		Code:    c,
+		Payload: data,
+	})
+}
+
+// Random id the server acknowledges a chat with, as the client app uses
+func newClientId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,149 @@
+package botsdk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+/*
+	End-to-end encryption, the same as the client app's e2e.go so bots and
+	people can read each other's messages. X25519 and HKDF-SHA256 give both
+	ends the same AES-256 key, and each message is sealed with AES-GCM with
+	the sender and receiver as additional data:
+
+		e2e:v1:<base64 of nonce and sealed text>
+
+	The key file has the same format as the app's identity.key.
+*/
+
+const (
+	e2ePrefix = "e2e:v1:"
+	e2eInfo   = "messaging-cli e2e v1"
+)
+
+// Device key from path, created on first use. An empty path gives a key for this run only
+func loadPrivateKey(path string) (*ecdh.PrivateKey, error) {
+
+	if path == "" {
+		return ecdh.X25519().GenerateKey(rand.Reader)
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return ecdh.X25519().NewPrivateKey(raw)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(private.Bytes()) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+
+	return private, nil
+}
+
+func encodePublicKey(private *ecdh.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(private.PublicKey().Bytes())
+}
+
+// AEAD shared by the holders of private and peerKey
+func sealer(private *ecdh.PrivateKey, peerKey string) (cipher.AEAD, error) {
+
+	raw, err := base64.StdEncoding.DecodeString(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both ends must agree on the salt, so order the keys
+	keys := [][]byte{private.PublicKey().Bytes(), peer.Bytes()}
+	slices.SortFunc(keys, bytes.Compare)
+
+	key, err := hkdf.Key(sha256.New, secret, bytes.Join(keys, nil), e2eInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(sender string, receiver string) []byte {
+	return []byte(sender + "\x00" + receiver)
+}
+
+func encrypt(private *ecdh.PrivateKey, sender string, receiver string, peerKey string, text string) (string, error) {
+
+	aead, err := sealer(private, peerKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(text), additionalData(sender, receiver))
+	return e2ePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Text of a message from the holder of peerKey
+func decrypt(private *ecdh.PrivateKey, m *message, peerKey string) (string, error) {
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(m.Text, e2ePrefix))
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := sealer(private, peerKey)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("message too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, additionalData(m.Sender, m.Receiver))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
@@ -0,0 +1,67 @@
+package botsdk
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"testing"
+)
+
+// Device keys for the vector below, base64 as in a key file
+const (
+	testAliceKey = "6d/p47pQ1WJq1VxcTF3LOYjM2MU38QbLAvcU647zILA="
+	testBobKey   = "lLISmPX4PxC/mioNoadqFEvW1jFDN00Sc2JIicAXL9k="
+)
+
+// "hello from alice", from alice to bob under a fixed nonce. The same
+// vector is in the app's e2e_test.go, so bots and the app stay able to
+// read each other's messages
+const testVector = "e2e:v1:Zml4ZWQgbm9uY2Uh5E2sSCakueqEtH2vm+uH1q5ytP2Nq8U0mmPFSf58zHg="
+
+func testPrivateKey(t *testing.T, key string) *ecdh.PrivateKey {
+	t.Helper()
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private
+}
+
+func TestE2EVector(t *testing.T) {
+	alice := testPrivateKey(t, testAliceKey)
+	bob := testPrivateKey(t, testBobKey)
+
+	m := &message{Text: testVector, Sender: "alice", Receiver: "bob"}
+	if text, err := decrypt(bob, m, encodePublicKey(alice)); err != nil || text != "hello from alice" {
+		t.Fatalf("bob read %q, error %v", text, err)
+	}
+
+	// Sent messages decrypt from the sender's history too
+	if text, err := decrypt(alice, m, encodePublicKey(bob)); err != nil || text != "hello from alice" {
+		t.Fatalf("alice read %q, error %v", text, err)
+	}
+
+	m.Sender = "carol"
+	if _, err := decrypt(bob, m, encodePublicKey(alice)); err == nil {
+		t.Fatal("decrypted with the sender changed")
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	alice := testPrivateKey(t, testAliceKey)
+	bob := testPrivateKey(t, testBobKey)
+
+	sealed, err := encrypt(bob, "bob", "alice", encodePublicKey(alice), "hi alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &message{Text: sealed, Sender: "bob", Receiver: "alice"}
+	if text, err := decrypt(alice, m, encodePublicKey(bob)); err != nil || text != "hi alice" {
+		t.Fatalf("alice read %q, error %v", text, err)
+	}
+}
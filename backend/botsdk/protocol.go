@@ -0,0 +1,121 @@
+package botsdk
+
+import (
+	"encoding/json"
+)
+
+/*
+	Wire format, mirrored from the server's messages.go and content.go.
+	Only the fields a bot needs are kept.
+*/
+
+type code int
+
+// Same order as the server's MessageCode list, which only ever appends
+const (
+	newLoginDetails code = iota
+	loginDetailsRequired
+	incorrectLogin
+	authenticationError
+	authenticationRequired
+	attemptLogin
+	loginSuccessful
+	allContent
+	welcome
+	aPIKey
+	requestTimeout
+	failedMessageSend
+	connectionError
+	databaseError
+	home
+	gameStart
+	searchUsers
+	searchUsersResults
+	friendRequest
+	friendRequestResult
+	friendAccept
+	friendAcceptResult
+	updateFriendContent
+	openChat
+	sendMessage
+	receiveMessage
+	notifyLogin
+	notifyInactive
+	serverShutdown
+	accountLocked
+	changePassword
+	changePasswordResult
+	recoveryCodes
+	recoverAccount
+	recoverAccountResult
+	deleteAccount
+	deleteAccountResult
+	exportData
+	exportDataResult
+	accountDisabled
+	announcement
+	publishKey
+	keyLookup
+	keyLookupResult
+	messageAck
+)
+
+// Sent to the server
+type clientMessage struct {
+	Payload json.RawMessage `json:"payload"`
+	Code    code            `json:"code"`
+}
+
+// Anything the server sends. Responses carry an error object, bare errors only error_message
+type serverMessage struct {
+	Err          *serverError    `json:"error"`
+	ErrorMessage string          `json:"error_message"`
+	Message      string          `json:"message"`
+	Code         code            `json:"code"`
+	Payload      json.RawMessage `json:"payload"`
+}
+
+type serverError struct {
+	Message string `json:"error_message"`
+	Code    code   `json:"code"`
+}
+
+// Most specific description the server gave
+func (m *serverMessage) text() string {
+	switch {
+	case m.Err != nil && m.Err.Message != "":
+		return m.Err.Message
+	case m.ErrorMessage != "":
+		return m.ErrorMessage
+	}
+	return m.Message
+}
+
+type chat struct {
+	Text     string `json:"text"`
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	ClientId string `json:"client_id,omitempty"`
+}
+
+type message struct {
+	Text     string `json:"text"`
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	Date     string `json:"date"`
+}
+
+type friend struct {
+	Active   bool   `json:"active"`
+	Username string `json:"username"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+type userContent struct {
+	Friends []friend `json:"friends"`
+}
+
+type publicKey struct {
+	Username string `json:"username"`
+	Key      string `json:"key"`
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 )
 
 type BackendMessageCode int
@@ -13,16 +13,60 @@ const (
 	BroadcastChat
 	BroadcastLoggedIn
 	BroadcastLoggedOut
+	BroadcastAccountDeleted
+	BroadcastPublicKey
 )
 
+// Names used as metric labels. Same order as the codes above
+var backendMessageCodeNames = [...]string{
+	"BroadcastFriendship",
+	"BroadcastFriendRequest",
+	"BroadcastChat",
+	"BroadcastLoggedIn",
+	"BroadcastLoggedOut",
+	"BroadcastAccountDeleted",
+	"BroadcastPublicKey",
+}
+
+func (c BackendMessageCode) String() string {
+	if c < 0 || int(c) >= len(backendMessageCodeNames) {
+		return "Unknown"
+	}
+	return backendMessageCodeNames[c]
+}
+
 type BackendMessage struct {
 	Code    BackendMessageCode
 	Payload interface{}
 }
 
+// Registry presence hook. Forwards login and logout to the friends of the user
+func (s *Server) broadcastPresence(e PresenceEvent) {
+	code := BroadcastLoggedOut
+	if e.Active {
+		code = BroadcastLoggedIn
+	}
+
+	s.broadcast <- &BackendMessage{
+		Code:    code,
+		Payload: e.Id,
+	}
+}
+
+// Runs until the broadcast channel is closed on shutdown, handling anything still queued
 func AppListener(s *Server) {
+	defer close(s.listenerDone)
+
+	logger := slog.With("component", "broadcast")
+	logger.Info("Broadcast listener started")
+	defer logger.Info("Broadcast listener stopped")
 
 	for message := range s.broadcast {
+		broadcastsHandled.Inc(message.Code.String())
+		logger.Debug("Broadcast received", "code", message.Code.String(), "queued", len(s.broadcast))
+
+		s.webhooks.publish(message)
+
 		switch message.Code {
 		case BroadcastLoggedIn:
 			if userId, ok := message.Payload.(apiKey); ok {
@@ -30,20 +74,20 @@ func AppListener(s *Server) {
 				// Get API key and get all friends in db
 				friendIds, err := dbConn.GetFriendsById(string(userId))
 				if err != nil {
-					fmt.Println(err)
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", err)
 					break
 				}
 
-				res := UserMap[userId]
+				username := registry.Username(userId)
 
 				for _, id := range *friendIds {
 
-					fri := UserMap[apiKey(id)]
+					fri, ok := registry.Get(apiKey(id))
 
-					if !fri.loggedIn {
+					if !ok || !fri.LoggedIn() {
 						continue
 					}
-					go SendLoggedIn(id, res.username, s)
+					s.goSend(func() { SendLoggedIn(id, username, s) })
 
 				}
 
@@ -54,20 +98,20 @@ func AppListener(s *Server) {
 				// Get API key and get all friends in db
 				friendIds, err := dbConn.GetFriendsById(string(userId))
 				if err != nil {
-					fmt.Println(err)
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", err)
 					break
 				}
 
-				res := UserMap[userId]
+				username := registry.Username(userId)
 
 				for _, id := range *friendIds {
 
-					fri := UserMap[apiKey(id)]
+					fri, ok := registry.Get(apiKey(id))
 
-					if !fri.loggedIn {
+					if !ok || !fri.LoggedIn() {
 						continue
 					}
-					go SendLoggedOut(id, res.username, s)
+					s.goSend(func() { SendLoggedOut(id, username, s) })
 
 				}
 
@@ -77,9 +121,15 @@ func AppListener(s *Server) {
 			// handle friendship broadcast
 			if userIds, ok := message.Payload.(*[]string); ok {
 
-				// Get user content per id, if active in UserMap
-				go SendFriendshipData((*userIds)[1], s)
-				go SendFriendshipData((*userIds)[2], s)
+				// Sent from a goroutine, where a bad index would take the server down
+				if userIds == nil || len(*userIds) < 3 {
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", "no friendship")
+					break
+				}
+
+				// Get user content per id, if active in the registry
+				s.goSend(func() { SendFriendshipData((*userIds)[1], s) })
+				s.goSend(func() { SendFriendshipData((*userIds)[2], s) })
 			}
 		case BroadcastFriendRequest:
 			// handle friendship broadcast
@@ -90,7 +140,7 @@ func AppListener(s *Server) {
 				// Get user ids from friendship id
 				userIds, err = dbConn.GetFriendRequestById(friendRequestId)
 				if err != nil {
-					fmt.Println(err)
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", err)
 					break
 				}
 
@@ -100,29 +150,71 @@ func AppListener(s *Server) {
 				}
 
 				if err != nil {
-					fmt.Println(err)
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", err)
 					break
 				}
 
-				// Get user content per id, if active in UserMap
+				// Sent from a goroutine, where a bad index would take the server down
+				if len(*userIds) < 3 {
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", "no friend request or friendship")
+					break
+				}
+
+				// Get user content per id, if active in the registry
 
 				// First user id is always the requesting user
 				// Second user id is always the receiving user
-				go SendFriendshipData((*userIds)[1], s)
-				go SendFriendshipData((*userIds)[2], s)
+				s.goSend(func() { SendFriendshipData((*userIds)[1], s) })
+				s.goSend(func() { SendFriendshipData((*userIds)[2], s) })
 			}
 		case BroadcastChat:
 			// handle friendship broadcast
 			if chatBroadcast, ok := message.Payload.(*ChatBroadcast); ok {
 
-				if !ok {
+				// Sent from a goroutine, where a bad index would take the server down
+				if chatBroadcast.Friendship == nil || len(*chatBroadcast.Friendship) < 3 {
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", "chat without a friendship")
 					break
 				}
 
 				// First user id is always the requesting user
 				// Second user id is always the receiving user
-				go SendChatData((*chatBroadcast.Friendship)[1], chatBroadcast.Chat, s)
-				go SendChatData((*chatBroadcast.Friendship)[2], chatBroadcast.Chat, s)
+				s.goSend(func() { SendChatData((*chatBroadcast.Friendship)[1], chatBroadcast.Chat, s) })
+				s.goSend(func() { SendChatData((*chatBroadcast.Friendship)[2], chatBroadcast.Chat, s) })
+			}
+		case BroadcastAccountDeleted:
+			// Friends and request counterparts of a deleted user
+			if userIds, ok := message.Payload.(*[]string); ok {
+
+				for _, id := range *userIds {
+					s.goSend(func() { SendFriendshipData(id, s) })
+				}
+			}
+		case BroadcastPublicKey:
+			// New device key, for friends to encrypt to from now on
+			if userId, ok := message.Payload.(apiKey); ok {
+
+				friendIds, err := dbConn.GetFriendsById(string(userId))
+				if err != nil {
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", err)
+					break
+				}
+
+				username := registry.Username(userId)
+				key, err := dbConn.GetPublicKey(username)
+				if err != nil {
+					logger.Error("Error handling broadcast", "code", message.Code.String(), "err", err)
+					break
+				}
+
+				publicKey := &PublicKey{
+					Username: username,
+					Key:      key,
+				}
+
+				for _, id := range *friendIds {
+					s.goSend(func() { SendPublicKey(id, publicKey, s) })
+				}
 			}
 		default:
 			// Do nothing
@@ -130,6 +222,15 @@ func AppListener(s *Server) {
 	}
 }
 
+// Run a send in its own goroutine, tracked so shutdown can wait for it
+func (s *Server) goSend(send func()) {
+	s.sends.Add(1)
+	go func() {
+		defer s.sends.Done()
+		send()
+	}()
+}
+
 func SendLoggedIn(friendId string, user string, s *Server) {
 
 	// Generate client response
@@ -148,10 +249,16 @@ func SendLoggedIn(friendId string, user string, s *Server) {
 		return
 	}
 
-	_, errr := s.clients[apiKey(friendId)].conn.Write(jsonData)
+	client, ok := s.getConnection(apiKey(friendId))
+	if !ok {
+		return
+	}
+
+	_, errr := client.conn.Write(jsonData)
+	observeSend(clientResp.Code, errr)
 
 	if errr != nil {
-		fmt.Println(errr)
+		s.logger(apiKey(friendId)).Warn("Error sending broadcast", "code", clientResp.Code.String(), "err", errr)
 		return
 	}
 }
@@ -174,10 +281,16 @@ func SendLoggedOut(friendId string, user string, s *Server) {
 		return
 	}
 
-	_, errr := s.clients[apiKey(friendId)].conn.Write(jsonData)
+	client, ok := s.getConnection(apiKey(friendId))
+	if !ok {
+		return
+	}
+
+	_, errr := client.conn.Write(jsonData)
+	observeSend(clientResp.Code, errr)
 
 	if errr != nil {
-		fmt.Println(errr)
+		s.logger(apiKey(friendId)).Warn("Error sending broadcast", "code", clientResp.Code.String(), "err", errr)
 		return
 	}
 }
@@ -185,8 +298,8 @@ func SendLoggedOut(friendId string, user string, s *Server) {
 // On update to friendship status, then this sennds data to the parties involved
 func SendFriendshipData(u string, s *Server) {
 
-	res, _ := UserMap[apiKey(u)]
-	if res.loggedIn {
+	res, ok := registry.Get(apiKey(u))
+	if ok && res.LoggedIn() {
 
 		userContent, err := dbConn.GetAllFriendsContent(apiKey(u))
 
@@ -210,10 +323,16 @@ func SendFriendshipData(u string, s *Server) {
 			return
 		}
 
-		_, errr := s.clients[apiKey(u)].conn.Write(jsonData)
+		client, ok := s.getConnection(apiKey(u))
+		if !ok {
+			return
+		}
+
+		_, errr := client.conn.Write(jsonData)
+		observeSend(clientResp.Code, errr)
 
 		if errr != nil {
-			fmt.Println(errr)
+			s.logger(apiKey(u)).Warn("Error sending broadcast", "code", clientResp.Code.String(), "err", errr)
 			return
 		}
 
@@ -224,9 +343,9 @@ func SendFriendshipData(u string, s *Server) {
 // On update to friendship status, then this sennds data to the parties involved
 func SendChatData(u string, chat *Message, s *Server) {
 
-	res, _ := UserMap[apiKey(u)]
+	res, ok := registry.Get(apiKey(u))
 
-	if res.loggedIn {
+	if ok && res.LoggedIn() {
 		// Generate client response
 		clientResp := ClientResponse{
 			Code:    ReceiveMessage,
@@ -243,13 +362,56 @@ func SendChatData(u string, chat *Message, s *Server) {
 			return
 		}
 
-		_, errr := s.clients[apiKey(u)].conn.Write(jsonData)
+		client, ok := s.getConnection(apiKey(u))
+		if !ok {
+			return
+		}
+
+		_, errr := client.conn.Write(jsonData)
+		observeSend(clientResp.Code, errr)
 
 		if errr != nil {
-			fmt.Println(errr)
+			s.logger(apiKey(u)).Warn("Error sending broadcast", "code", clientResp.Code.String(), "err", errr)
 			return
 		}
 
 	}
 
 }
+
+func SendPublicKey(friendId string, key *PublicKey, s *Server) {
+
+	res, ok := registry.Get(apiKey(friendId))
+	if !ok || !res.LoggedIn() {
+		return
+	}
+
+	// Generate client response
+	clientResp := ClientResponse{
+		Code:    KeyLookupResult,
+		Err:     nil,
+		Message: "Friend published a new key",
+		Payload: nil,
+	}
+
+	clientResp.EncodePayload(key)
+
+	jsonData, err := json.Marshal(&clientResp)
+
+	if err != nil {
+		return
+	}
+
+	client, ok := s.getConnection(apiKey(friendId))
+	if !ok {
+		return
+	}
+
+	_, errr := client.conn.Write(jsonData)
+	observeSend(clientResp.Code, errr)
+
+	if errr != nil {
+		s.logger(apiKey(friendId)).Warn("Error sending broadcast", "code", clientResp.Code.String(), "err", errr)
+		return
+	}
+}
@@ -6,22 +6,6 @@ import (
 	"time"
 )
 
-type Users map[apiKey]*clientData
-
-var loggedMu = sync.Mutex{}
-
-// Return all users
-func (l *Users) allUsers() []string {
-	loggedMu.Lock()
-	defer loggedMu.Unlock()
-
-	clientList := []string{}
-	for _, v := range *l {
-		clientList = append(clientList, v.loginDetails.Username)
-	}
-	return clientList
-}
-
 type clientData struct {
 	message      string
 	accountMade  bool
@@ -34,6 +18,9 @@ type clientData struct {
 	err          error
 	mu           sync.Mutex
 	rwmu         sync.RWMutex
+
+	// Logs in with a token instead of a password, see bots.go. Never changes
+	bot bool
 }
 
 func (c *clientData) Read() string {
@@ -42,24 +29,30 @@ func (c *clientData) Read() string {
 	return fmt.Sprintf("The client's status... %q", c.message)
 }
 
-func (c *clientData) Leave() {
+// Returns true if the client was active
+func (c *clientData) Leave() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.active {
 		c.active = false
 		c.loggedIn = false
 		c.message = fmt.Sprintf("Inactive since %q", time.Now())
+		return true
 	}
+	return false
 }
 
-func (c *clientData) LoginClient(k apiKey) {
+// Returns true if the client was inactive
+func (c *clientData) LoginClient(k apiKey) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if !c.active {
 		c.active = true
 		c.loggedIn = true
 		c.message = fmt.Sprintf("Active since %q", time.Now())
+		return true
 	}
+	return false
 }
 
 func (c *clientData) WelcomeSent() bool {
@@ -70,13 +63,71 @@ func (c *clientData) WelcomeSent() bool {
 	return c.welcomeSent
 }
 
+func (c *clientData) SetWelcomeSent() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.welcomeSent = true
+}
+
+func (c *clientData) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.username
+}
+
+func (c *clientData) Bot() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.bot
+}
+
+func (c *clientData) LoggedIn() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.loggedIn
+}
+
+func (c *clientData) Login() LoginDetails {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.loginDetails
+}
+
+// Friend view of the client sent to other users
+func (c *clientData) AsFriend() Friend {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Friend{
+		Username: c.username,
+		Active:   c.active,
+		Message:  c.message,
+		Bot:      c.bot,
+	}
+}
+
 func (c *clientData) SetNewLogin(l *LoginDetails, k apiKey) *RequestError {
 
-	// Copy login details before setting on current USerMap
+	hash, err := hashPassword(l.Password)
+	if err != nil {
+		return &RequestError{
+			Message: "Failed to set new login details",
+			Code:    DatabaseError,
+		}
+	}
+
+	// Copy login details before setting on the registry entry
+	c.mu.Lock()
 	clientCopy := clientData{
 		mu:          sync.Mutex{},
 		rwmu:        sync.RWMutex{},
 		accountMade: c.accountMade,
+		welcomeSent: c.welcomeSent,
 		message:     c.message,
 		loggedIn:    c.loggedIn,
 		apiKey:      c.apiKey,
@@ -85,12 +136,13 @@ func (c *clientData) SetNewLogin(l *LoginDetails, k apiKey) *RequestError {
 		username:    l.Username,
 		loginDetails: LoginDetails{
 			Username: l.Username,
-			Password: l.Password,
+			Password: hash,
 		},
 	}
+	c.mu.Unlock()
 
 	// Try db operation first
-	err := dbConn.UpdateClient(&clientCopy)
+	err = dbConn.UpdateClient(&clientCopy)
 
 	if err != nil {
 		return &RequestError{
@@ -99,19 +151,76 @@ func (c *clientData) SetNewLogin(l *LoginDetails, k apiKey) *RequestError {
 		}
 	}
 
-	// Updte user amp on success
+	// Update registry entry on success. Logging in is left to the caller
 	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// Set user to logged in an active on first time
-	c.loggedIn = true
-	c.active = true
+	old := c.username
 	c.username = clientCopy.username
-	c.message = clientCopy.message
+	c.loginDetails = clientCopy.loginDetails
+	c.mu.Unlock()
+
+	registry.SetUsername(k, old, clientCopy.username)
 
 	return nil
 }
 
+// Hash and save a new password, then update the registry entry
+func (c *clientData) ChangePassword(password string) *RequestError {
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return &RequestError{
+			Message: "Failed to save new password",
+			Code:    DatabaseError,
+		}
+	}
+
+	c.mu.Lock()
+	clientCopy := clientData{
+		mu:           sync.Mutex{},
+		rwmu:         sync.RWMutex{},
+		accountMade:  c.accountMade,
+		welcomeSent:  c.welcomeSent,
+		apiKey:       c.apiKey,
+		username:     c.username,
+		loginDetails: c.loginDetails,
+	}
+	c.mu.Unlock()
+
+	clientCopy.loginDetails.Password = hash
+
+	err = dbConn.UpdateClient(&clientCopy)
+
+	if err != nil {
+		return &RequestError{
+			Message: "Failed to save new password",
+			Code:    DatabaseError,
+		}
+	}
+
+	c.setPassword(hash)
+	return nil
+}
+
+// In memory only, for password hashes already saved
+func (c *clientData) setPassword(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.loginDetails.Password = hash
+}
+
+// In memory only, once the store has replaced the account with a tombstone
+func (c *clientData) setTombstone(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.username = name
+	c.loginDetails = LoginDetails{
+		Username: name,
+		Password: "",
+	}
+}
+
 func generateNewUser(k apiKey) *clientData {
 
 	return &clientData{
@@ -131,24 +240,3 @@ func generateNewUser(k apiKey) *clientData {
 	}
 
 }
-
-// Protect the map with a  mutex
-var UserMap Users = Users{
-	"123456": {
-		message: "dummy message",
-		apiKey:  "123456",
-
-		loginDetails: LoginDetails{
-			Username: "hello",
-			Password: "password",
-		},
-		accountMade: true,
-		active:      true,
-		loggedIn:    true,
-		err:         nil,
-		mu:          sync.Mutex{},
-		rwmu:        sync.RWMutex{},
-
-		welcomeSent: true,
-	},
-}
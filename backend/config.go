@@ -0,0 +1,383 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sbow19/messaging-cli-configfile"
+)
+
+/*
+	Server configuration.
+
+	Values are layered, each overriding the last:
+		1) Defaults
+		2) Config file (-config), flat TOML "key = value" or YAML "key: value"
+		3) Environment variables, MESSAGING_ followed by the upper case key
+		4) Command line flags
+*/
+
+type Config struct {
+	// Address the HTTP server listens on
+	Listen string
+	// SQLite database file
+	DBPath string
+	// How far back messages are sent to clients on login
+	HistoryWindow time.Duration
+	// Largest chat message text accepted, in bytes
+	MaxMessageSize int
+	// Write users, requests and friendships to DebugDumpPath on startup, without passwords or keys
+	DebugDump     bool
+	DebugDumpPath string
+	// PEM certificate and key. Serves TLS when both are set
+	TLSCert string
+	TLSKey  string
+	// How long shutdown waits for connections to close and writes to finish
+	ShutdownTimeout time.Duration
+	// Failed logins in a row before an account is locked, and for how long
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+	// What happens to a deleted account's messages: "delete" removes its
+	// conversations, "anonymize" keeps them under a tombstone user
+	DeletedMessages string
+	// Bearer token for the /admin endpoints. They are off when empty
+	AdminToken string
+	// debug, info, warn or error, and text or json lines on stderr
+	LogLevel  string
+	LogFormat string
+	// Keys sealing messages, passwords and webhook secrets at rest, as a file or inline.
+	// Encryption at rest is off when neither is set. See atrest.go
+	DBKeyFile string
+	DBKey     string
+	// Tries at each webhook delivery, the wait before the first retry,
+	// doubled after each, and how long each try may take. See webhooks.go
+	WebhookAttempts   int
+	WebhookRetryDelay time.Duration
+	WebhookTimeout    time.Duration
+}
+
+const maxMessageSizeLimit = 1 << 20
+
+const minAdminTokenLength = 16
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:         ":8000",
+		DBPath:         defaultDBPath,
+		HistoryWindow:  72 * time.Hour,
+		MaxMessageSize: 4096,
+		DebugDump:      false,
+		DebugDumpPath:  "db.txt",
+		// Leaves room under the usual 30s SIGKILL grace period
+		ShutdownTimeout:  10 * time.Second,
+		LoginMaxFailures: 5,
+		LoginLockout:     15 * time.Minute,
+		DeletedMessages:  "delete",
+		LogLevel:         "info",
+		LogFormat:        "text",
+		// Retries over about a minute
+		WebhookAttempts:   6,
+		WebhookRetryDelay: 2 * time.Second,
+		WebhookTimeout:    10 * time.Second,
+	}
+}
+
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// Active server configuration
+var config = DefaultConfig()
+
+// Set a single key, as named in config files
+func (c *Config) set(key string, value string) error {
+	var err error
+
+	switch key {
+	case "listen":
+		c.Listen = value
+	case "db_path":
+		c.DBPath = value
+	case "history_window":
+		c.HistoryWindow, err = time.ParseDuration(value)
+	case "max_message_size":
+		c.MaxMessageSize, err = strconv.Atoi(value)
+	case "debug_dump":
+		c.DebugDump, err = strconv.ParseBool(value)
+	case "debug_dump_path":
+		c.DebugDumpPath = value
+	case "tls_cert":
+		c.TLSCert = value
+	case "tls_key":
+		c.TLSKey = value
+	case "shutdown_timeout":
+		c.ShutdownTimeout, err = time.ParseDuration(value)
+	case "login_max_failures":
+		c.LoginMaxFailures, err = strconv.Atoi(value)
+	case "login_lockout":
+		c.LoginLockout, err = time.ParseDuration(value)
+	case "deleted_messages":
+		c.DeletedMessages = value
+	case "admin_token":
+		c.AdminToken = value
+	case "log_level":
+		c.LogLevel = value
+	case "log_format":
+		c.LogFormat = value
+	case "db_key_file":
+		c.DBKeyFile = value
+	case "db_key":
+		c.DBKey = value
+	case "webhook_attempts":
+		c.WebhookAttempts, err = strconv.Atoi(value)
+	case "webhook_retry_delay":
+		c.WebhookRetryDelay, err = time.ParseDuration(value)
+	case "webhook_timeout":
+		c.WebhookTimeout, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("unknown config key %q", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s", value, key)
+	}
+	return nil
+}
+
+var configKeys = []string{
+	"listen",
+	"db_path",
+	"history_window",
+	"max_message_size",
+	"debug_dump",
+	"debug_dump_path",
+	"tls_cert",
+	"tls_key",
+	"shutdown_timeout",
+	"login_max_failures",
+	"login_lockout",
+	"deleted_messages",
+	"admin_token",
+	"log_level",
+	"log_format",
+	"db_key_file",
+	"db_key",
+	"webhook_attempts",
+	"webhook_retry_delay",
+	"webhook_timeout",
+}
+
+// Read a flat TOML or YAML file, picked by extension
+func (c *Config) loadFile(path string) error {
+
+	separator := "="
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+	case ".yaml", ".yml":
+		separator = ":"
+	default:
+		return fmt.Errorf("config file %q must be .toml, .yaml or .yml", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return configfile.Parse(file, path, separator, func(e configfile.Entry) error {
+		if e.Header() {
+			return fmt.Errorf("unexpected section %q", e.Section)
+		}
+		return c.set(e.Key, e.Value)
+	})
+}
+
+func (c *Config) loadEnv() error {
+	for _, key := range configKeys {
+		value, ok := os.LookupEnv("MESSAGING_" + strings.ToUpper(key))
+		if !ok {
+			continue
+		}
+
+		if err := c.set(key, value); err != nil {
+			return fmt.Errorf("environment: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	errs := []string{}
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Sprintf("listen %q must be host:port", c.Listen))
+	}
+
+	if c.DBPath == "" {
+		errs = append(errs, "db_path must be set")
+	}
+
+	if c.HistoryWindow <= 0 {
+		errs = append(errs, "history_window must be positive")
+	}
+
+	if c.MaxMessageSize <= 0 || c.MaxMessageSize > maxMessageSizeLimit {
+		errs = append(errs, fmt.Sprintf("max_message_size must be between 1 and %d", maxMessageSizeLimit))
+	}
+
+	if c.DebugDump && c.DebugDumpPath == "" {
+		errs = append(errs, "debug_dump_path must be set when debug_dump is on")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, "shutdown_timeout must be positive")
+	}
+
+	if c.LoginMaxFailures <= 0 {
+		errs = append(errs, "login_max_failures must be positive")
+	}
+
+	if c.LoginLockout <= 0 {
+		errs = append(errs, "login_lockout must be positive")
+	}
+
+	if c.DeletedMessages != "delete" && c.DeletedMessages != "anonymize" {
+		errs = append(errs, fmt.Sprintf("deleted_messages %q must be delete or anonymize", c.DeletedMessages))
+	}
+
+	if c.AdminToken != "" && len(c.AdminToken) < minAdminTokenLength {
+		errs = append(errs, fmt.Sprintf("admin_token must be at least %d characters", minAdminTokenLength))
+	}
+
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Sprintf("log_format %q must be text or json", c.LogFormat))
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, "tls_cert and tls_key must be set together")
+	}
+
+	if c.DBKeyFile != "" && c.DBKey != "" {
+		errs = append(errs, "set only one of db_key_file and db_key")
+	} else if _, err := loadDBKeys(c.DBKeyFile, c.DBKey); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.WebhookAttempts <= 0 {
+		errs = append(errs, "webhook_attempts must be positive")
+	}
+
+	if c.WebhookRetryDelay <= 0 {
+		errs = append(errs, "webhook_retry_delay must be positive")
+	}
+
+	if c.WebhookTimeout <= 0 {
+		errs = append(errs, "webhook_timeout must be positive")
+	}
+
+	for _, f := range []string{c.TLSCert, c.TLSKey} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, fmt.Sprintf("cannot read TLS file %q", f))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// Defaults, overridden by the config file at path if there is one, then the environment
+func loadConfigLayers(path string) (*Config, error) {
+
+	c := DefaultConfig()
+
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Build the server configuration from defaults, file, environment and flags
+func LoadConfig(args []string) (*Config, error) {
+
+	c := DefaultConfig()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("MESSAGING_CONFIG"), "path to a .toml or .yaml config file")
+	listen := fs.String("listen", c.Listen, "address to listen on")
+	dbPath := fs.String("db", c.DBPath, "path to the SQLite database")
+	history := fs.Duration("history", c.HistoryWindow, "how far back messages are sent on login")
+	maxSize := fs.Int("max-message-size", c.MaxMessageSize, "largest chat message accepted, in bytes")
+	debugDump := fs.Bool("debug-dump", c.DebugDump, "write users and friendships to the debug dump file")
+	tlsCert := fs.String("tls-cert", c.TLSCert, "PEM certificate file, enables TLS with -tls-key")
+	tlsKey := fs.String("tls-key", c.TLSKey, "PEM private key file, enables TLS with -tls-cert")
+	shutdownTimeout := fs.Duration("shutdown-timeout", c.ShutdownTimeout, "how long to wait for connections to close on shutdown")
+	logLevel := fs.String("log-level", c.LogLevel, "debug, info, warn or error")
+	logFormat := fs.String("log-format", c.LogFormat, "text or json")
+	dbKeyFile := fs.String("db-key-file", c.DBKeyFile, "file of keys sealing messages and passwords at rest")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c, err := loadConfigLayers(*configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only flags given on the command line override earlier layers
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = *listen
+		case "db":
+			c.DBPath = *dbPath
+		case "history":
+			c.HistoryWindow = *history
+		case "max-message-size":
+			c.MaxMessageSize = *maxSize
+		case "debug-dump":
+			c.DebugDump = *debugDump
+		case "tls-cert":
+			c.TLSCert = *tlsCert
+		case "tls-key":
+			c.TLSKey = *tlsKey
+		case "shutdown-timeout":
+			c.ShutdownTimeout = *shutdownTimeout
+		case "log-level":
+			c.LogLevel = *logLevel
+		case "log-format":
+			c.LogFormat = *logFormat
+		case "db-key-file":
+			c.DBKeyFile = *dbKeyFile
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -7,6 +7,7 @@ type Friend struct {
 	Active   bool   `json:"active"`
 	Message  string `json:"message"`
 	Username string `json:"username"`
+	Bot      bool   `json:"bot,omitempty"`
 }
 
 type FriendReqDetails struct {
@@ -23,6 +24,8 @@ type Message struct {
 	Sender   string `json:"sender"`
 	Receiver string `json:"receiver"`
 	Date     string `json:"date"`
+	// Client id of the chat it was sent as, if any
+	ClientId string `json:"client_id,omitempty"`
 }
 
 // All data
@@ -31,3 +34,12 @@ type UserContent struct {
 	FriendRequests []FriendReqDetails `json:"friend_requests"`
 	Messages       Messages           `json:"messages"`
 }
+
+// Everything held about a user, for data export. Dates are RFC 3339
+type AccountExport struct {
+	Username       string             `json:"username"`
+	ExportedAt     string             `json:"exported_at"`
+	Friends        []Friend           `json:"friends"`
+	FriendRequests []FriendReqDetails `json:"friend_requests"`
+	Messages       Messages           `json:"messages"`
+}
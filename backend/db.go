@@ -5,8 +5,9 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,7 +15,7 @@ import (
 )
 
 /*
-		Load client data into UserMap
+		Load client data into the registry
 
 		type clientData struct {
 		message      string
@@ -28,48 +29,858 @@ import (
 	}
 */
 
+// SQLite implementation of Store
 type DBConn struct {
 	db *sql.DB
+	// Seals messages, passwords and webhook secrets at rest. Nil when encryption at rest is off
+	keys *DBKeys
 }
 
-var dbConn = &DBConn{
-	db: nil,
+func (c *DBConn) CreateNewUser(d *clientData) error {
+
+	var err error
+	var stmt *sql.Stmt
+
+	defer observeQuery("create_new_user", time.Now(), &err)
+
+	password, err := c.keys.seal(sealedPassword, d.loginDetails.Password)
+	if err != nil {
+		return err
+	}
+
+	// Create transaction
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		goto retErr
+	}
+
+	// Prepare save statement
+	stmt, err = tx.Prepare(
+		`
+	INSERT INTO users (id, welcomeSent, accountMade, username, password) VALUES (
+		?,?,?,?,?
+	);
+	`,
+	)
+
+	if err != nil {
+		goto retErr
+	}
+	defer stmt.Close()
+
+	// Execute statement
+	_, err = stmt.Exec(
+		d.apiKey,
+		0,
+		0,
+		d.loginDetails.Username,
+		password,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		goto rollback
+	}
+
+	return nil
+
+	// Cleanup
+rollback:
+	{
+		tx.Rollback()
+	}
+retErr:
+	{
+		return err
+	}
+
+}
+
+func btobool(b uint8) bool {
+
+	if b == 1 {
+		return true
+	} else if b == 0 {
+		return false
+	}
+
+	return false
+
+}
+
+func booltob(b bool) uint8 {
+
+	if b {
+		return 1
+	} else if !b {
+		return 0
+	}
+
+	return 2
+
+}
+
+func (c *DBConn) UpdateClient(d *clientData) error {
+	var err error
+	var stmt *sql.Stmt
+	var accMade uint8
+	var welcomeSent uint8
+
+	defer observeQuery("update_client", time.Now(), &err)
+
+	password, err := c.keys.seal(sealedPassword, d.loginDetails.Password)
+	if err != nil {
+		return err
+	}
+
+	// Create transaction
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		goto retErr
+	}
+
+	// Prepare save statement
+	stmt, err = tx.Prepare(
+		`
+	UPDATE users
+	SET welcomeSent= ?, accountMade = ?, username = ?, password = ?
+	WHERE id = ?
+	;
+	`,
+	)
+
+	if err != nil {
+		goto retErr
+	}
+	defer stmt.Close()
+
+	// Set binary flags
+	accMade = booltob(d.accountMade)
+	welcomeSent = booltob(d.welcomeSent)
+
+	// Execute statement
+	_, err = stmt.Exec(
+		welcomeSent,
+		accMade,
+		d.loginDetails.Username,
+		password,
+		d.apiKey,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		goto rollback
+	}
+
+	return nil
+
+	// Cleanup
+rollback:
+	{
+		tx.Rollback()
+	}
+retErr:
+	{
+		return err
+	}
+}
+
+// Record when a user left
+func (c *DBConn) SetLastSeen(k apiKey, t time.Time) error {
+	var err error
+
+	defer observeQuery("set_last_seen", time.Now(), &err)
+
+	_, err = c.db.Exec(
+		`
+	UPDATE users
+	SET lastSeen = ?
+	WHERE id = ?
+	;
+	`,
+		t.UTC().Format("2006-01-02 15:04:05"),
+		k,
+	)
+
+	return err
+}
+
+// Failed logins in a row, and when the next attempt is allowed. Zero time if never delayed
+func (c *DBConn) GetLoginFailures(k apiKey) (int, time.Time, error) {
+	var err error
+	var failures int
+	var lockedUntil sql.NullTime
+
+	defer observeQuery("get_login_failures", time.Now(), &err)
+
+	err = c.db.QueryRow(
+		`
+	SELECT failedLogins, lockedUntil FROM users
+	WHERE id = ?
+	;
+	`,
+		k,
+	).Scan(&failures, &lockedUntil)
+
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return failures, lockedUntil.Time, nil
+}
+
+// Zero lockedUntil clears the delay
+func (c *DBConn) SetLoginFailures(k apiKey, failures int, lockedUntil time.Time) error {
+	var err error
+
+	defer observeQuery("set_login_failures", time.Now(), &err)
+
+	_, err = c.db.Exec(
+		`
+	UPDATE users
+	SET failedLogins = ?, lockedUntil = ?
+	WHERE id = ?
+	;
+	`,
+		failures,
+		sql.NullTime{Time: lockedUntil.UTC(), Valid: !lockedUntil.IsZero()},
+		k,
+	)
+
+	return err
+}
+
+// Whether an admin has disabled the account, and why
+func (c *DBConn) GetDisabled(k apiKey) (bool, string, error) {
+	var err error
+	var disabledAt sql.NullTime
+	var reason string
+
+	defer observeQuery("get_disabled", time.Now(), &err)
+
+	err = c.db.QueryRow(
+		`
+	SELECT disabledAt, disabledReason FROM users
+	WHERE id = ?
+	;
+	`,
+		k,
+	).Scan(&disabledAt, &reason)
+
+	if err != nil {
+		return false, "", err
+	}
+
+	return disabledAt.Valid, reason, nil
+}
+
+func (c *DBConn) SetDisabled(k apiKey, disabled bool, reason string) error {
+	var err error
+	var res sql.Result
+
+	defer observeQuery("set_disabled", time.Now(), &err)
+
+	query := `
+	UPDATE users
+	SET disabledAt = NULL, disabledReason = ''
+	WHERE id = ?
+	;
+	`
+	args := []interface{}{k}
+
+	if disabled {
+		query = `
+	UPDATE users
+	SET disabledAt = CURRENT_TIMESTAMP, disabledReason = ?
+	WHERE id = ?
+	;
+	`
+		args = []interface{}{reason, k}
+	}
+
+	res, err = c.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+func (c *DBConn) SetPublicKey(k apiKey, key string) error {
+	var err error
+	var res sql.Result
+
+	defer observeQuery("set_public_key", time.Now(), &err)
+
+	res, err = c.db.Exec(
+		`
+	UPDATE users
+	SET publicKey = ?
+	WHERE id = ?
+	;
+	`,
+		key,
+		k,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// Public key of a user, empty if they haven't published one
+func (c *DBConn) GetPublicKey(username string) (string, error) {
+	var err error
+	var key string
+
+	defer observeQuery("get_public_key", time.Now(), &err)
+
+	err = c.db.QueryRow(
+		`
+	SELECT publicKey FROM users
+	WHERE username = ? AND deletedAt IS NULL
+	;
+	`,
+		username,
+	).Scan(&key)
+
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// Save a new bot account. Bots have no password and are never sent the welcome
+func (c *DBConn) CreateBot(k apiKey, username string, tokenHash string) error {
+	var err error
+	var password string
+
+	defer observeQuery("create_bot", time.Now(), &err)
+
+	password, err = c.keys.seal(sealedPassword, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(
+		`
+	INSERT INTO users (id, welcomeSent, accountMade, username, password, kind, botTokenHash) VALUES (
+		?,1,1,?,?,'bot',?
+	);
+	`,
+		k,
+		username,
+		password,
+		tokenHash,
+	)
+
+	return err
+}
+
+// Replace a bot's token. The old one stops working straight away
+func (c *DBConn) SetBotToken(k apiKey, tokenHash string) error {
+	var err error
+	var res sql.Result
+
+	defer observeQuery("set_bot_token", time.Now(), &err)
+
+	res, err = c.db.Exec(
+		`
+	UPDATE users
+	SET botTokenHash = ?
+	WHERE id = ? AND kind = 'bot'
+	;
+	`,
+		tokenHash,
+		k,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("bot not found")
+	}
+
+	return nil
+}
+
+// Key of the bot a token belongs to. sql.ErrNoRows if none does
+func (c *DBConn) GetBotByToken(tokenHash string) (apiKey, error) {
+	var err error
+	var k apiKey
+
+	defer observeQuery("get_bot_by_token", time.Now(), &err)
+
+	err = c.db.QueryRow(
+		`
+	SELECT id FROM users
+	WHERE botTokenHash = ? AND kind = 'bot' AND deletedAt IS NULL
+	;
+	`,
+		tokenHash,
+	).Scan(&k)
+
+	if err != nil {
+		return "", err
+	}
+
+	return k, nil
+}
+
+func (c *DBConn) GetLoginDetails(k apiKey) (LoginDetails, error) {
+	var err error
+	var details LoginDetails
+
+	defer observeQuery("get_login_details", time.Now(), &err)
+
+	err = c.db.QueryRow(
+		`
+	SELECT username, password FROM users
+	WHERE id = ?
+	;
+	`,
+		k,
+	).Scan(&details.Username, &details.Password)
+
+	if err != nil {
+		return details, err
+	}
+
+	details.Password, err = c.keys.open(sealedPassword, details.Password)
+	return details, err
+}
+
+// Set a password hash directly, for admin resets. The running server checks
+// passwords against the store, so it applies to the next login
+func (c *DBConn) SetPassword(k apiKey, password string) error {
+	var err error
+	var res sql.Result
+
+	defer observeQuery("set_password", time.Now(), &err)
+
+	password, err = c.keys.seal(sealedPassword, password)
+	if err != nil {
+		return err
+	}
+
+	res, err = c.db.Exec(
+		`
+	UPDATE users
+	SET password = ?
+	WHERE id = ?
+	;
+	`,
+		password,
+		k,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// Replace all recovery codes for a user
+func (c *DBConn) SetRecoveryCodes(k apiKey, hashes []string) error {
+	var err error
+	var stmt *sql.Stmt
+
+	defer observeQuery("set_recovery_codes", time.Now(), &err)
+
+	// Create transaction
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		goto retErr
+	}
+
+	_, err = tx.Exec(
+		`
+	DELETE FROM recovery_codes
+	WHERE userId = ?
+	;
+	`,
+		k,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	stmt, err = tx.Prepare(
+		`
+	INSERT INTO recovery_codes (userId, codeHash) VALUES (
+		?,?
+	);
+	`,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+	defer stmt.Close()
+
+	for _, hash := range hashes {
+		_, err = stmt.Exec(k, hash)
+		if err != nil {
+			goto rollback
+		}
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		goto rollback
+	}
+
+	return nil
+
+	// Cleanup
+rollback:
+	{
+		tx.Rollback()
+	}
+retErr:
+	{
+		return err
+	}
+}
+
+// Use a recovery code of oldKey to move the account to newKey, replacing the placeholder
+// user made when the new device first connected. Returns false if the code is not an unused one
+func (c *DBConn) RecoverAccount(oldKey apiKey, newKey apiKey, codeHash string, password string) (bool, error) {
+	var err error
+	var res sql.Result
+	var used int64
+
+	defer observeQuery("recover_account", time.Now(), &err)
+
+	password, err = c.keys.seal(sealedPassword, password)
+	if err != nil {
+		return false, err
+	}
+
+	// Create transaction
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		goto retErr
+	}
+
+	// Ids change one table at a time, so check foreign keys on commit
+	_, err = tx.Exec(`PRAGMA defer_foreign_keys = ON;`)
+
+	if err != nil {
+		goto rollback
+	}
+
+	res, err = tx.Exec(
+		`
+	UPDATE recovery_codes
+	SET usedAt = CURRENT_TIMESTAMP
+	WHERE userId = ? AND codeHash = ? AND usedAt IS NULL
+	;
+	`,
+		oldKey,
+		codeHash,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	used, err = res.RowsAffected()
+
+	if err != nil {
+		goto rollback
+	}
+
+	if used == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	_, err = tx.Exec(
+		`
+	DELETE FROM users
+	WHERE id = ? AND username = ''
+	;
+	`,
+		newKey,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	_, err = tx.Exec(
+		`
+	UPDATE users
+	SET id = ?, password = ?, failedLogins = 0, lockedUntil = NULL, publicKey = ''
+	WHERE id = ?
+	;
+	`,
+		newKey,
+		password,
+		oldKey,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	err = moveUserReferences(tx, oldKey, newKey)
+
+	if err != nil {
+		goto rollback
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		goto rollback
+	}
+
+	return true, nil
+
+	// Cleanup
+rollback:
+	{
+		tx.Rollback()
+	}
+retErr:
+	{
+		return false, err
+	}
+}
+
+// Point everything referencing oldKey at newKey. Foreign keys don't cascade
+// updates, so callers must have deferred foreign key checks
+func moveUserReferences(tx *sql.Tx, oldKey apiKey, newKey apiKey) error {
+	for _, query := range []string{
+		`UPDATE friend_requests SET reqId = ? WHERE reqId = ?;`,
+		`UPDATE friend_requests SET resId = ? WHERE resId = ?;`,
+		`UPDATE friends SET user1 = ? WHERE user1 = ?;`,
+		`UPDATE friends SET user2 = ? WHERE user2 = ?;`,
+		`UPDATE messages SET senderId = ? WHERE senderId = ?;`,
+		`UPDATE recovery_codes SET userId = ? WHERE userId = ?;`,
+		`UPDATE webhooks SET userId = ? WHERE userId = ?;`,
+		`UPDATE incoming_webhooks SET senderId = ? WHERE senderId = ?;`,
+		`UPDATE incoming_webhooks SET receiverId = ? WHERE receiverId = ?;`,
+	} {
+		if _, err := tx.Exec(query, newKey, oldKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Friends and friend request counterparts of k, whose views change when k is deleted
+func relatedUsers(tx *sql.Tx, k apiKey) ([]string, error) {
+	rows, err := tx.Query(
+		`
+	SELECT user1, user2 FROM friends
+	WHERE user1 = ? OR user2 = ?
+	UNION
+	SELECT reqId, resId FROM friend_requests
+	WHERE reqId = ? OR resId = ?
+	;
+	`,
+		k, k, k, k,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	related := []string{}
+	for rows.Next() {
+		var user1 string
+		var user2 string
+		if err := rows.Scan(&user1, &user2); err != nil {
+			return nil, err
+		}
+
+		for _, id := range []string{user1, user2} {
+			if id != string(k) && !seen[id] {
+				seen[id] = true
+				related = append(related, id)
+			}
+		}
+	}
+
+	return related, rows.Err()
+}
+
+// Delete a user along with every conversation they were part of. Friendships,
+// requests and recovery codes go by cascade. Returns the users affected
+func (c *DBConn) DeleteAccount(k apiKey) (*[]string, error) {
+	var err error
+	var related []string
+
+	defer observeQuery("delete_account", time.Now(), &err)
+
+	// Create transaction
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		goto retErr
+	}
+
+	related, err = relatedUsers(tx, k)
+
+	if err != nil {
+		goto rollback
+	}
+
+	// messages.friendId has no cascade, so clear conversations before the friendships go
+	_, err = tx.Exec(
+		`
+	DELETE FROM messages
+	WHERE friendId IN (
+		SELECT id FROM friends WHERE user1 = ? OR user2 = ?
+	)
+	;
+	`,
+		k, k,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	_, err = tx.Exec(
+		`
+	DELETE FROM users
+	WHERE id = ?
+	;
+	`,
+		k,
+	)
+
+	if err != nil {
+		goto rollback
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		goto rollback
+	}
+
+	return &related, nil
+
+	// Cleanup
+rollback:
+	{
+		tx.Rollback()
+	}
+retErr:
+	{
+		return nil, err
+	}
 }
 
-func (c *DBConn) CreateNewUser(d *clientData) error {
+// Replace a user with a tombstone under a new id and name. Friendships and messages
+// stay so friends keep their history; credentials, requests, recovery codes,
+// webhook subscriptions to the user and incoming webhooks posting as or to them go.
+// Returns the users affected
+func (c *DBConn) AnonymizeAccount(k apiKey, tombstoneId apiKey, tombstoneName string) (*[]string, error) {
+	var err error
+	var related []string
+
+	defer observeQuery("anonymize_account", time.Now(), &err)
+
+	// Create transaction
+	tx, err := c.db.Begin()
+
+	if err != nil {
+		goto retErr
+	}
+
+	// Ids change one table at a time, so check foreign keys on commit
+	_, err = tx.Exec(`PRAGMA defer_foreign_keys = ON;`)
+
+	if err != nil {
+		goto rollback
+	}
+
+	related, err = relatedUsers(tx, k)
+
+	if err != nil {
+		goto rollback
+	}
+
+	_, err = tx.Exec(`DELETE FROM friend_requests WHERE reqId = ? OR resId = ?;`, k, k)
+
+	if err != nil {
+		goto rollback
+	}
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE userId = ?;`, k)
+
+	if err != nil {
+		goto rollback
+	}
+
+	// As deleting the account would, by cascade
+	_, err = tx.Exec(`DELETE FROM webhooks WHERE userId = ?;`, k)
 
-	var err error
-	var stmt *sql.Stmt
+	if err != nil {
+		goto rollback
+	}
 
-	// Create transaction
-	tx, err := c.db.Begin()
+	_, err = tx.Exec(`DELETE FROM incoming_webhooks WHERE senderId = ? OR receiverId = ?;`, k, k)
 
 	if err != nil {
-		goto retErr
+		goto rollback
 	}
 
-	// Prepare save statement
-	stmt, err = tx.Prepare(
+	_, err = tx.Exec(
 		`
-	INSERT INTO users (id, welcomeSent, accountMade, username, password) VALUES (
-		?,?,?,?,?
-	);
+	UPDATE users
+	SET id = ?, username = ?, password = '', failedLogins = 0, lockedUntil = NULL, publicKey = '', deletedAt = CURRENT_TIMESTAMP
+	WHERE id = ?
+	;
 	`,
+		tombstoneId,
+		tombstoneName,
+		k,
 	)
 
 	if err != nil {
-		goto retErr
+		goto rollback
 	}
-	defer stmt.Close()
 
-	// Execute statement
-	_, err = stmt.Exec(
-		d.apiKey,
-		0,
-		0,
-		d.loginDetails.Username,
-		d.loginDetails.Password,
-	)
+	err = moveUserReferences(tx, k, tombstoneId)
 
 	if err != nil {
 		goto rollback
@@ -81,7 +892,7 @@ func (c *DBConn) CreateNewUser(d *clientData) error {
 		goto rollback
 	}
 
-	return nil
+	return &related, nil
 
 	// Cleanup
 rollback:
@@ -90,100 +901,107 @@ rollback:
 	}
 retErr:
 	{
-		return err
-	}
-
-}
-
-func btobool(b uint8) bool {
-
-	if b == 1 {
-		return true
-	} else if b == 0 {
-		return false
+		return nil, err
 	}
-
-	return false
-
 }
 
-func booltob(b bool) uint8 {
-
-	if b {
-		return 1
-	} else if !b {
-		return 0
-	}
-
-	return 2
+// Everything held about a user, with the full message history rather than the login window
+func (c *DBConn) ExportAccount(k apiKey) (*AccountExport, error) {
+	var err error
+	var rows *sql.Rows
+	var friendsContent *UserContent
 
-}
+	defer observeQuery("export_account", time.Now(), &err)
 
-func (c *DBConn) UpdateClient(d *clientData) error {
-	var err error
-	var stmt *sql.Stmt
-	var accMade uint8
-	var welcomeSent uint8
+	export := AccountExport{}
+	messages := Messages{}
+	username := registry.Username(k)
 
-	// Create transaction
-	tx, err := c.db.Begin()
+	friendsContent, err = c.GetAllFriendsContent(k)
 
 	if err != nil {
 		goto retErr
 	}
 
-	// Prepare save statement
-	stmt, err = tx.Prepare(
+	rows, err = c.db.Query(
 		`
-	UPDATE users
-	SET welcomeSent= ?, accountMade = ?, username = ?, password = ?
-	WHERE id = ?
+	SELECT f.user1, f.user2, m.senderId, m.message, m.date
+	FROM messages m
+	JOIN friends f ON m.friendId = f.id
+	WHERE f.user1 = ? OR f.user2 = ?
+	ORDER BY m.date
 	;
 	`,
+		k, k,
 	)
 
 	if err != nil {
 		goto retErr
 	}
-	defer stmt.Close()
+	defer rows.Close()
 
-	// Set binary flags
-	accMade = booltob(d.accountMade)
-	welcomeSent = booltob(d.welcomeSent)
+	for rows.Next() {
+		var user1 string
+		var user2 string
+		var senderId string
+		var message sql.NullString
+		var date time.Time
 
-	// Execute statement
-	_, err = stmt.Exec(
-		welcomeSent,
-		accMade,
-		d.loginDetails.Username,
-		d.loginDetails.Password,
-		d.apiKey,
-	)
+		err = rows.Scan(&user1, &user2, &senderId, &message, &date)
 
-	if err != nil {
-		goto rollback
+		if err != nil {
+			goto retErr
+		}
+
+		message.String, err = c.keys.open(sealedMessage, message.String)
+
+		if err != nil {
+			goto retErr
+		}
+
+		friendId := user1
+		if friendId == string(k) {
+			friendId = user2
+		}
+		friendName := registry.Username(apiKey(friendId))
+
+		sender, receiver := friendName, username
+		if senderId == string(k) {
+			sender, receiver = username, friendName
+		}
+
+		messages[friendName] = append(messages[friendName], Message{
+			Text:     message.String,
+			Sender:   sender,
+			Receiver: receiver,
+			Date:     date.UTC().Format(time.RFC3339),
+		})
 	}
 
-	err = tx.Commit()
+	err = rows.Err()
 
 	if err != nil {
-		goto rollback
+		goto retErr
 	}
 
-	return nil
-
-	// Cleanup
-rollback:
-	{
-		tx.Rollback()
+	export = AccountExport{
+		Username:       username,
+		ExportedAt:     time.Now().UTC().Format(time.RFC3339),
+		Friends:        friendsContent.Friends,
+		FriendRequests: friendsContent.FriendRequests,
+		Messages:       messages,
 	}
+
+	return &export, nil
+
 retErr:
 	{
-		return err
+		return nil, err
 	}
 }
 
-// Get all users and log to db.txt
+// Get all users into the registry, and log them to the debug dump file if enabled.
+// The dump holds no secrets: keys are fingerprinted and passwords left out
 func (c *DBConn) GetAll() error {
 
 	var err error
@@ -194,7 +1012,7 @@ func (c *DBConn) GetAll() error {
 	// Query db
 	rows, err = c.db.Query(
 		`
-		SELECT * FROM users
+		SELECT id, welcomeSent, accountMade, username, password, kind FROM users
 		;
 		`,
 	)
@@ -210,6 +1028,7 @@ func (c *DBConn) GetAll() error {
 		var accountMade uint8
 		var username string
 		var password string
+		var kind string
 
 		err = rows.Scan(
 			&apiKey,
@@ -217,16 +1036,22 @@ func (c *DBConn) GetAll() error {
 			&accountMade,
 			&username,
 			&password,
+			&kind,
 		)
 
 		if err != nil {
 			goto retErr
 		}
 
-		outputString += fmt.Sprintf("id: %q, u: %q, p: %q, welcome:%d, acc:%d\n",
-			apiKey,
+		password, err = c.keys.open(sealedPassword, password)
+
+		if err != nil {
+			goto retErr
+		}
+
+		outputString += fmt.Sprintf("key: %s, u: %q, welcome:%d, acc:%d\n",
+			keyFingerprint(apiKey),
 			username,
-			password,
 			welcomeSent,
 			accountMade,
 		)
@@ -235,13 +1060,14 @@ func (c *DBConn) GetAll() error {
 		welsent := btobool(welcomeSent)
 		accMade := btobool(accountMade)
 
-		// Add data to UserMap
-		UserMap[apiKey] = &clientData{
+		// Add data to the registry
+		registry.Add(&clientData{
 			apiKey:      apiKey,
 			username:    username,
 			message:     "No new users",
 			accountMade: accMade,
 			welcomeSent: welsent,
+			bot:         kind == "bot",
 			loginDetails: LoginDetails{
 				Username: username,
 				Password: password,
@@ -251,7 +1077,7 @@ func (c *DBConn) GetAll() error {
 			err:      nil,
 			mu:       sync.Mutex{},
 			rwmu:     sync.RWMutex{},
-		}
+		})
 	}
 
 	/*
@@ -286,10 +1112,10 @@ func (c *DBConn) GetAll() error {
 			goto retErr
 		}
 
-		outputString += fmt.Sprintf("requestid: %q, reqId: %q, resId: %q\n",
+		outputString += fmt.Sprintf("requestid: %q, req: %s, res: %s\n",
 			id,
-			user1,
-			user2,
+			keyFingerprint(apiKey(user1)),
+			keyFingerprint(apiKey(user2)),
 		)
 	}
 
@@ -324,14 +1150,18 @@ func (c *DBConn) GetAll() error {
 			goto retErr
 		}
 
-		outputString += fmt.Sprintf("friendshipId: %q, reqId: %q, resId: %q\n",
+		outputString += fmt.Sprintf("friendshipId: %q, req: %s, res: %s\n",
 			id,
-			user1,
-			user2,
+			keyFingerprint(apiKey(user1)),
+			keyFingerprint(apiKey(user2)),
 		)
 	}
 
-	os.WriteFile("db.txt", []byte(outputString), 0644)
+	if config.DebugDump {
+		if err := os.WriteFile(config.DebugDumpPath, []byte(outputString), 0600); err != nil {
+			slog.Error("Error writing debug dump", "path", config.DebugDumpPath, "err", err)
+		}
+	}
 	// Reveal any errors encountered why executing query
 	err = rows.Err()
 
@@ -355,6 +1185,8 @@ func (c *DBConn) GetUsers(s string) (*UsersSearch, error) {
 	var rows *sql.Rows
 	var stmt *sql.Stmt
 
+	defer observeQuery("get_users", time.Now(), &err)
+
 	outputUsers := UsersSearch{}
 
 	// Query db
@@ -362,6 +1194,7 @@ func (c *DBConn) GetUsers(s string) (*UsersSearch, error) {
 		`
 		SELECT username FROM users
 		WHERE username LIKE ?
+		AND deletedAt IS NULL
 		;
 		`,
 	)
@@ -399,6 +1232,8 @@ func (c *DBConn) GetUserAPI(s string) (*UsersSearch, error) {
 	var rows *sql.Rows
 	var stmt *sql.Stmt
 
+	defer observeQuery("get_user_api", time.Now(), &err)
+
 	outputUsers := UsersSearch{}
 
 	// Query db
@@ -406,6 +1241,7 @@ func (c *DBConn) GetUserAPI(s string) (*UsersSearch, error) {
 		`
 		SELECT id FROM users
 		WHERE username = ?
+		AND deletedAt IS NULL
 		;
 		`,
 	)
@@ -444,6 +1280,8 @@ func (c *DBConn) GetFriendRequestByIds(reqId string, resId string) (*UsersSearch
 	var rows *sql.Rows
 	var stmt *sql.Stmt
 
+	defer observeQuery("get_friend_request_by_ids", time.Now(), &err)
+
 	outputUsers := UsersSearch{}
 
 	// Query db
@@ -490,6 +1328,8 @@ func (c *DBConn) GetFriendRequestById(friendshipId string) (*[]string, error) {
 	var stmt *sql.Stmt
 	var output []string
 
+	defer observeQuery("get_friend_request_by_id", time.Now(), &err)
+
 	// Query db
 	stmt, err = c.db.Prepare(
 		`
@@ -536,6 +1376,8 @@ func (c *DBConn) GetFriendshipById(friendshipId string) (*[]string, error) {
 	var stmt *sql.Stmt
 	var output []string
 
+	defer observeQuery("get_friendship_by_id", time.Now(), &err)
+
 	// Query db
 	stmt, err = c.db.Prepare(
 		`
@@ -582,6 +1424,8 @@ func (c *DBConn) GetFriendshipByIds(id1 string, id2 string) (*[]string, error) {
 	var stmt *sql.Stmt
 	var output []string
 
+	defer observeQuery("get_friendship_by_ids", time.Now(), &err)
+
 	// Query db
 	stmt, err = c.db.Prepare(
 		`
@@ -630,6 +1474,8 @@ func (c *DBConn) GetFriendsById(userId string) (*[]string, error) {
 	var stmt *sql.Stmt
 	var output []string
 
+	defer observeQuery("get_friends_by_id", time.Now(), &err)
+
 	// Query db
 	stmt, err = c.db.Prepare(
 		`
@@ -693,6 +1539,8 @@ func (c *DBConn) SetFriendRequest(name string, reqId string) (string, error) {
 	var id string
 	var resId string
 
+	defer observeQuery("set_friend_request", time.Now(), &err)
+
 	// Search for the id of the receiver of the friend request
 	userSearch, err = c.GetUserAPI(name)
 
@@ -789,6 +1637,8 @@ func (c *DBConn) DeleteFriendRequest(requestId string) error {
 	var err error
 	var stmt *sql.Stmt
 
+	defer observeQuery("delete_friend_request", time.Now(), &err)
+
 	var tx *sql.Tx
 	if err != nil {
 		goto retErr
@@ -850,6 +1700,8 @@ func (c *DBConn) CreateFriend(f *FriendAcceptData, userId string) error {
 	var friendshipId string
 	var res *[]string
 
+	defer observeQuery("create_friend", time.Now(), &err)
+
 	//Friend request id
 	friendshipId, err = generateId()
 	if err != nil {
@@ -928,7 +1780,6 @@ rollback:
 	}
 retErr:
 	{
-		fmt.Println(err)
 		return err
 	}
 
@@ -944,6 +1795,19 @@ func (c *DBConn) SaveMessage(chat *Chat, userId apiKey) (*[]string, error) {
 	var messageId string
 	var friendship *[]string
 	var id1 string
+	var text string
+	var clientId sql.NullString
+	var result sql.Result
+	var saved int64
+
+	defer observeQuery("save_message", time.Now(), &err)
+
+	clientId = sql.NullString{String: chat.ClientId, Valid: chat.ClientId != ""}
+
+	text, err = c.keys.seal(sealedMessage, chat.Text)
+	if err != nil {
+		goto retErr
+	}
 
 	//Message id
 	messageId, err = generateId()
@@ -954,7 +1818,13 @@ func (c *DBConn) SaveMessage(chat *Chat, userId apiKey) (*[]string, error) {
 	// Get receiver id
 	res, err = c.GetUserAPI(chat.Receiver)
 
-	if err != nil || len(*res) == 0 {
+	if err != nil {
+		goto retErr
+	}
+
+	// Unknown, or deleted since the sender last heard
+	if len(*res) == 0 {
+		err = errReceiverNotFound
 		goto retErr
 	}
 
@@ -962,6 +1832,15 @@ func (c *DBConn) SaveMessage(chat *Chat, userId apiKey) (*[]string, error) {
 	// Get friendship id
 	friendship, err = c.GetFriendshipByIds(id1, string(userId))
 
+	if err != nil {
+		goto retErr
+	}
+
+	if len(*friendship) == 0 {
+		err = errNotFriends
+		goto retErr
+	}
+
 	// Create transaction
 	tx, err = c.db.Begin()
 
@@ -972,7 +1851,8 @@ func (c *DBConn) SaveMessage(chat *Chat, userId apiKey) (*[]string, error) {
 	// Prepare delete statement
 	stmt, err = tx.Prepare(
 		`
-	INSERT INTO messages (id, friendId, senderId, message) VALUES (?,?,?,?);
+	INSERT INTO messages (id, friendId, senderId, message, clientId) VALUES (?,?,?,?,?)
+	ON CONFLICT (senderId, clientId) DO NOTHING;
 	`,
 	)
 
@@ -982,17 +1862,29 @@ func (c *DBConn) SaveMessage(chat *Chat, userId apiKey) (*[]string, error) {
 	defer stmt.Close()
 
 	// Execute statement
-	_, err = stmt.Exec(
+	result, err = stmt.Exec(
 		messageId,
 		(*friendship)[0],
 		userId,
-		chat.Text,
+		text,
+		clientId,
 	)
 
 	if err != nil {
 		goto rollback
 	}
 
+	saved, err = result.RowsAffected()
+	if err != nil {
+		goto rollback
+	}
+
+	// Resent after the first copy was saved. Not a database error
+	if saved == 0 {
+		tx.Rollback()
+		return nil, errDuplicateMessage
+	}
+
 	err = tx.Commit()
 
 	if err != nil {
@@ -1008,7 +1900,6 @@ rollback:
 	}
 retErr:
 	{
-		fmt.Println(err)
 		return nil, err
 	}
 
@@ -1018,6 +1909,9 @@ func (c *DBConn) GetAllUserContent(k apiKey) (*UserContent, error) {
 
 	var err error
 	var rows *sql.Rows
+
+	defer observeQuery("get_all_user_content", time.Now(), &err)
+
 	userContent := UserContent{}
 
 	matchedFriendids := make(map[string]string)
@@ -1062,15 +1956,11 @@ func (c *DBConn) GetAllUserContent(k apiKey) (*UserContent, error) {
 
 	// Get friend details
 	for key, _ := range matchedFriendids {
-		result, ok := UserMap[apiKey(key)]
+		result, ok := registry.Get(apiKey(key))
 		if !ok {
 			continue
 		}
-		friends = append(friends, Friend{
-			Username: result.username,
-			Active:   result.active,
-			Message:  result.message,
-		})
+		friends = append(friends, result.AsFriend())
 	}
 
 	// Get friend requests
@@ -1099,20 +1989,16 @@ func (c *DBConn) GetAllUserContent(k apiKey) (*UserContent, error) {
 
 		if string(k) != reqId {
 
-			result, _ := UserMap[apiKey(reqId)]
-
 			friendRequests = append(friendRequests, FriendReqDetails{
-				Username:   result.username,
+				Username:   registry.Username(apiKey(reqId)),
 				RequestId:  id,
 				FromClient: false,
 			})
 		}
 
 		if string(k) != resId {
-			result, _ := UserMap[apiKey(resId)]
-
 			friendRequests = append(friendRequests, FriendReqDetails{
-				Username:   result.username,
+				Username:   registry.Username(apiKey(resId)),
 				RequestId:  id,
 				FromClient: true,
 			})
@@ -1125,14 +2011,14 @@ func (c *DBConn) GetAllUserContent(k apiKey) (*UserContent, error) {
 
 		rows, err = c.db.Query(
 			`
-			SELECT * FROM messages
+			SELECT id, friendId, senderId, message, date, clientId FROM messages
 			WHERE friendId = ?
-			AND date > datetime('now', '-3 days')
+			AND date > datetime('now', ?)
 			;
-			`, friendshipId,
+			`, friendshipId, historyModifier(),
 		)
 
-		friendName := UserMap[apiKey(friendId)].username
+		friendName := registry.Username(apiKey(friendId))
 		messages[friendName] = []Message{}
 
 		if err != nil {
@@ -1146,17 +2032,27 @@ func (c *DBConn) GetAllUserContent(k apiKey) (*UserContent, error) {
 			var senderId string
 			var message string
 			var date string
+			var clientId sql.NullString
 			var sender string
+			var receiver string
+
+			if err := rows.Scan(&messageId, &friendshipId, &senderId, &message, &date, &clientId); err != nil {
+				continue
+			}
 
-			if err := rows.Scan(&messageId, &friendshipId, &senderId, &message, &date); err != nil {
+			message, err := c.keys.open(sealedMessage, message)
+			if err != nil {
+				slog.Error("Error opening message", "id", messageId, "err", err)
 				continue
 			}
 
+			// Clients need both ends to decrypt end-to-end encrypted text
 			if senderId == string(k) {
-				result, _ := UserMap[k]
-				sender = result.username
+				sender = registry.Username(k)
+				receiver = friendName
 			} else {
 				sender = friendName
+				receiver = registry.Username(k)
 			}
 
 			// Parse it using the correct layout
@@ -1170,9 +2066,11 @@ func (c *DBConn) GetAllUserContent(k apiKey) (*UserContent, error) {
 			formatted := t.Format(layout)
 
 			messages[friendName] = append(messages[friendName], Message{
-				Text:   message,
-				Date:   formatted,
-				Sender: sender,
+				Text:     message,
+				Date:     formatted,
+				Sender:   sender,
+				Receiver: receiver,
+				ClientId: clientId.String,
 			})
 
 		}
@@ -1199,6 +2097,9 @@ func (c *DBConn) GetAllFriendsContent(k apiKey) (*UserContent, error) {
 
 	var err error
 	var rows *sql.Rows
+
+	defer observeQuery("get_all_friends_content", time.Now(), &err)
+
 	userContent := UserContent{}
 
 	matchedFriendids := make(map[string]string)
@@ -1242,15 +2143,11 @@ func (c *DBConn) GetAllFriendsContent(k apiKey) (*UserContent, error) {
 
 	// Get friend details
 	for key, _ := range matchedFriendids {
-		result, ok := UserMap[apiKey(key)]
+		result, ok := registry.Get(apiKey(key))
 		if !ok {
 			continue
 		}
-		friends = append(friends, Friend{
-			Username: result.username,
-			Active:   result.active,
-			Message:  result.message,
-		})
+		friends = append(friends, result.AsFriend())
 	}
 
 	// Get friend requests
@@ -1279,20 +2176,16 @@ func (c *DBConn) GetAllFriendsContent(k apiKey) (*UserContent, error) {
 
 		if string(k) != reqId {
 
-			result, _ := UserMap[apiKey(reqId)]
-
 			friendRequests = append(friendRequests, FriendReqDetails{
-				Username:   result.username,
+				Username:   registry.Username(apiKey(reqId)),
 				RequestId:  id,
 				FromClient: false,
 			})
 		}
 
 		if string(k) != resId {
-			result, _ := UserMap[apiKey(resId)]
-
 			friendRequests = append(friendRequests, FriendReqDetails{
-				Username:   result.username,
+				Username:   registry.Username(apiKey(resId)),
 				RequestId:  id,
 				FromClient: true,
 			})
@@ -1314,6 +2207,125 @@ retErr:
 
 }
 
+// Add an event to the audit log. The time is set by the database
+func (c *DBConn) AppendAudit(e *AuditEvent) error {
+	var err error
+
+	defer observeQuery("append_audit", time.Now(), &err)
+
+	_, err = c.db.Exec(
+		`
+	INSERT INTO audit_log (event, actor, target, source, detail) VALUES (?,?,?,?,?);
+	`,
+		e.Event,
+		e.Actor,
+		e.Target,
+		e.Source,
+		e.Detail,
+	)
+
+	return err
+}
+
+// Every webhook subscription, with its secret opened
+func (c *DBConn) Webhooks() ([]Webhook, error) {
+	var err error
+	var rows *sql.Rows
+	var hooks []Webhook
+
+	defer observeQuery("webhooks", time.Now(), &err)
+
+	rows, err = c.db.Query(
+		`
+	SELECT w.id, w.url, w.secret, COALESCE(u.username, ''), w.events, w.createdAt
+	FROM webhooks w
+	LEFT JOIN users u ON u.id = w.userId
+	ORDER BY w.createdAt, w.id
+	;
+	`,
+	)
+	if err != nil {
+		goto retErr
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h Webhook
+		var events string
+
+		if err = rows.Scan(&h.Id, &h.URL, &h.Secret, &h.User, &events, &h.CreatedAt); err != nil {
+			goto retErr
+		}
+
+		h.Secret, err = c.keys.open(sealedSecret, h.Secret)
+		if err != nil {
+			goto retErr
+		}
+
+		h.Events = strings.Split(events, ",")
+		hooks = append(hooks, h)
+	}
+
+	if err = rows.Err(); err != nil {
+		goto retErr
+	}
+
+	return hooks, nil
+
+retErr:
+	return nil, err
+}
+
+func (c *DBConn) AddDeadLetter(d *DeadLetter) error {
+	var err error
+
+	defer observeQuery("add_dead_letter", time.Now(), &err)
+
+	_, err = c.db.Exec(
+		`
+	INSERT INTO webhook_dead_letters (webhookId, deliveryId, event, payload, attempts, lastError) VALUES (?,?,?,?,?,?);
+	`,
+		d.WebhookId,
+		d.DeliveryId,
+		d.Event,
+		d.Payload,
+		d.Attempts,
+		d.LastError,
+	)
+
+	return err
+}
+
+// Incoming webhook a token belongs to, while both its users are still around
+func (c *DBConn) GetIncomingWebhook(tokenHash string) (*IncomingWebhook, error) {
+	var err error
+	var h IncomingWebhook
+
+	defer observeQuery("get_incoming_webhook", time.Now(), &err)
+
+	err = c.db.QueryRow(
+		`
+	SELECT h.id, h.senderId, s.username, h.receiverId, r.username, h.createdAt
+	FROM incoming_webhooks h
+	JOIN users s ON s.id = h.senderId
+	JOIN users r ON r.id = h.receiverId
+	WHERE h.tokenHash = ? AND s.deletedAt IS NULL AND r.deletedAt IS NULL
+	;
+	`,
+		tokenHash,
+	).Scan(&h.Id, &h.SenderId, &h.Sender, &h.ReceiverId, &h.Receiver, &h.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+func (c *DBConn) Ping() error {
+	return c.db.Ping()
+}
+
 func (c *DBConn) Close() error {
 	err := c.db.Close()
 
@@ -1323,80 +2335,59 @@ func (c *DBConn) Close() error {
 	return nil
 }
 
-// Create db and load all users into UserMap
-func loadDB() error {
-	db, err := sql.Open("sqlite3", "./cli.db?_foreign_keys=on")
+const defaultDBPath = "./cli.db"
+
+// SQLite datetime modifier for the start of the history window
+func historyModifier() string {
+	return fmt.Sprintf("-%d seconds", int64(config.HistoryWindow.Seconds()))
+}
+
+// Open the SQLite database file at path
+func openDB(path string) (*DBConn, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	dbConn.db = db
+	return &DBConn{
+		db: db,
+	}, nil
+}
 
-	// Users table
-	_, err = dbConn.db.Exec(createUsersDBStmt)
+// Open db, bring the schema up to date and set it as the active store
+func loadDB() error {
+	conn, err := openDB(config.DBPath)
 	if err != nil {
 		return err
 	}
 
-	// Friend requests table
-	_, err = dbConn.db.Exec(createFriendRequestsTable)
+	conn.keys, err = loadDBKeys(config.DBKeyFile, config.DBKey)
 	if err != nil {
+		conn.Close()
 		return err
 	}
+	if conn.keys != nil {
+		slog.Info("Encryption at rest on", "key", conn.keys.ActiveId())
+	}
 
-	// Friends table
-	_, err = dbConn.db.Exec(createFriendsTable)
+	// Migrate on startup, backing up existing data first
+	err = autoMigrate(conn.db, config.DBPath)
 	if err != nil {
+		conn.Close()
 		return err
 	}
 
-	// Messages table
-	_, err = dbConn.db.Exec(messagesTable)
+	// Passwords saved before they were hashed
+	hashed, err := hashStoredPasswords(conn.db, conn.keys)
 	if err != nil {
+		conn.Close()
 		return err
 	}
+	if hashed > 0 {
+		slog.Info("Hashed stored passwords", "count", hashed)
+	}
+
+	dbConn = conn
 	return nil
 
 }
-
-var createUsersDBStmt = `
-	CREATE TABLE IF NOT EXISTS users (
-	id TEXT NOT NULL PRIMARY KEY, 
-	welcomeSent INTEGER NOT NULL DEFAULT 0, 
-	accountMade INTEGER NOT NULL DEFAULT 0,
-	username TEXT NOT NULL UNIQUE,
-	password TEXT NOT NULL
-	);
-	`
-var createFriendRequestsTable = `
-	CREATE TABLE IF NOT EXISTS friend_requests (
-		id TEXT NOT NULL PRIMARY KEY,
-		reqId TEXT NOT NULL, 
-		resId TEXT NOT NULL, 
-		FOREIGN KEY(reqId) REFERENCES users(id) ON DELETE CASCADE,
-		FOREIGN KEY(resId) REFERENCES users(id) ON DELETE CASCADE,
-		UNIQUE(reqId, resId)
-
-	);
-`
-var createFriendsTable = `
-CREATE TABLE IF NOT EXISTS friends (
-	id TEXT NOT NULL PRIMARY KEY,
-	user1 TEXT NOT NULL,
-	user2 TEXT NOT NULL,
-	FOREIGN KEY(user1) REFERENCES users(id) ON DELETE CASCADE,
-	FOREIGN KEY(user2) REFERENCES users(id) ON DELETE CASCADE,
-	UNIQUE(user1, user2)
-);
-`
-
-var messagesTable = `
-	CREATE TABLE IF NOT EXISTS messages (
-	id TEXT NOT NULL PRIMARY KEY,
-	friendId TEXT NOT NULL,
-	senderId TEXT NOT NULL,
-	message TEXT, 
-	date DATETIME DEFAULT CURRENT_TIMESTAMP,
-	FOREIGN KEY(friendId)  REFERENCES friends(id)
-);
-`
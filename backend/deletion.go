@@ -0,0 +1,139 @@
+package main
+
+/*
+	Account deletion and data export.
+
+	Deleting needs the current password and the username typed again. What
+	happens to the user's messages is set by config.DeletedMessages:
+
+		delete     the user and every conversation they were part of go
+		anonymize  the user becomes a tombstone under a new id and a
+		           "deleted-" name, so friends keep their history
+
+	Either way credentials, friend requests and recovery codes are gone, and
+	friends and request counterparts are sent fresh friend content.
+*/
+
+// Result message for a delete request, and whether the account is gone
+func (s *Server) deleteAccount(k apiKey, d *AccountDeletion, addr string) (string, bool) {
+
+	c, ok := registry.Get(k)
+	if !ok {
+		return "Unknown user", false
+	}
+
+	lockedResp, reqErr := checkLoginAllowed(k, addr)
+	if reqErr != nil {
+		return reqErr.Message, false
+	}
+	if lockedResp != nil {
+		return lockedResp.Message, false
+	}
+
+	if !passwordMatches(k, d.Password) {
+		if err := recordLoginFailure(k, addr); err != nil {
+			s.logger(k).Error("Error recording failed login", "err", err)
+		}
+		audit(AuditLoginFailed, c.Username(), "", addr, "incorrect password on account deletion")
+		return "Password incorrect", false
+	}
+
+	username := c.Username()
+	if d.Confirm != username {
+		return "Type your username to confirm", false
+	}
+
+	var affected *[]string
+	var err error
+
+	switch config.DeletedMessages {
+	case "anonymize":
+		var tombstoneId string
+		tombstoneId, err = generateId()
+		if err != nil {
+			break
+		}
+		tombstoneName := "deleted-" + tombstoneId[:8]
+
+		affected, err = dbConn.AnonymizeAccount(k, apiKey(tombstoneId), tombstoneName)
+		if err != nil {
+			break
+		}
+
+		// Friends see the tombstone in place of the user
+		registry.Leave(k)
+		registry.Rebind(k, apiKey(tombstoneId))
+		c.setTombstone(tombstoneName)
+		registry.SetUsername(apiKey(tombstoneId), username, tombstoneName)
+	default:
+		affected, err = dbConn.DeleteAccount(k)
+		if err != nil {
+			break
+		}
+
+		registry.Leave(k)
+		registry.Remove(k)
+	}
+
+	if err != nil {
+		s.logger(k).Error("Error deleting account", "err", err)
+		return "Failed to delete account", false
+	}
+
+	loginLimiter.Succeeded(addr)
+	s.logger(k).Info("Account deleted", "messages", config.DeletedMessages)
+	audit(AuditAccountDeleted, username, "", addr, "messages "+config.DeletedMessages)
+
+	s.broadcast <- &BackendMessage{
+		Code:    BroadcastAccountDeleted,
+		Payload: affected,
+	}
+
+	return "Account deleted", true
+}
+
+// Answer a delete request. Returns true once the account is gone and the connection should close
+func (s *Server) handleDeletion(k apiKey, m *ClientMessage, addr string) bool {
+
+	var deletion AccountDeletion
+	if err := m.DecodePayload(&deletion); err != nil {
+		s.logger(k).Warn("Invalid deletion payload", "err", err)
+	}
+
+	result, deleted := s.deleteAccount(k, &deletion, addr)
+
+	clientResponse := ClientResponse{
+		Code:    DeleteAccountResult,
+		Err:     nil,
+		Message: "",
+		Payload: nil,
+	}
+	clientResponse.EncodePayload(&result)
+
+	s.sendTo(k, &clientResponse)
+
+	return deleted
+}
+
+// Send everything held about the user
+func (s *Server) sendExport(k apiKey) *RequestError {
+
+	export, err := dbConn.ExportAccount(k)
+	if err != nil {
+		s.logger(k).Error("Error exporting account", "err", err)
+		return &RequestError{
+			Message: "Failed to export data",
+			Code:    DatabaseError,
+		}
+	}
+
+	clientResponse := ClientResponse{
+		Code:    ExportDataResult,
+		Err:     nil,
+		Message: "Your data",
+		Payload: nil,
+	}
+	clientResponse.EncodePayload(export)
+
+	return s.sendTo(k, &clientResponse)
+}
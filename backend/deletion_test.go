@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// alice and bob are friends with a chat each way, and carol has asked alice
+func setupDeletion(t *testing.T) (srv *httptest.Server, alice *testClient, bob *testClient) {
+	t.Helper()
+
+	srv = newTestServer(t)
+
+	alice = loginTest(t, srv, "alice-key", "alice")
+	bob = loginTest(t, srv, "bob-key", "bob")
+	carol := loginTest(t, srv, "carol-key", "carol")
+	makeFriends(t, alice, bob, "bob")
+
+	alice.send(SendMessage, Chat{Text: "hi bob", Receiver: "bob", ClientId: "1"})
+	alice.expect(MessageAck)
+	bob.expect(ReceiveMessage)
+
+	bob.send(SendMessage, Chat{Text: "hi alice", Receiver: "alice", ClientId: "1"})
+	bob.expect(MessageAck)
+	alice.expect(ReceiveMessage)
+
+	carol.send(FriendRequest, "alice")
+	carol.expect(FriendRequestResult)
+	alice.expect(UpdateFriendContent)
+
+	return srv, alice, bob
+}
+
+func setTestDeletedMessages(t *testing.T, mode string) {
+	old := config.DeletedMessages
+	config.DeletedMessages = mode
+	t.Cleanup(func() { config.DeletedMessages = old })
+}
+
+func deleteTestAccount(t *testing.T, c *testClient, d AccountDeletion) string {
+	t.Helper()
+
+	c.send(DeleteAccount, d)
+
+	var result string
+	c.expectPayload(DeleteAccountResult, &result)
+	return result
+}
+
+// Next friend content sent to c, skipping presence updates
+func nextContent(t *testing.T, c *testClient) UserContent {
+	t.Helper()
+
+	var content UserContent
+	c.expectPayload(UpdateFriendContent, &content)
+	return content
+}
+
+func exportTest(t *testing.T, c *testClient) AccountExport {
+	t.Helper()
+
+	c.send(ExportData, nil)
+
+	var export AccountExport
+	c.expectPayload(ExportDataResult, &export)
+	return export
+}
+
+func TestExportData(t *testing.T) {
+	_, alice, _ := setupDeletion(t)
+
+	export := exportTest(t, alice)
+
+	if export.Username != "alice" {
+		t.Fatalf("exported user %q", export.Username)
+	}
+	if _, err := time.Parse(time.RFC3339, export.ExportedAt); err != nil {
+		t.Fatalf("export date %q: %v", export.ExportedAt, err)
+	}
+	if len(export.Friends) != 1 || export.Friends[0].Username != "bob" {
+		t.Fatalf("exported friends %+v", export.Friends)
+	}
+	if len(export.FriendRequests) != 1 || export.FriendRequests[0].Username != "carol" {
+		t.Fatalf("exported requests %+v", export.FriendRequests)
+	}
+
+	chat := export.Messages["bob"]
+	if len(chat) != 2 || chat[0].Text != "hi bob" || chat[1].Text != "hi alice" {
+		t.Fatalf("exported messages %+v", chat)
+	}
+}
+
+func TestDeleteAccountChecks(t *testing.T) {
+	_, alice, _ := setupDeletion(t)
+
+	tests := []struct {
+		name     string
+		deletion AccountDeletion
+		want     string
+	}{
+		{"wrong password", AccountDeletion{Password: "wrong", Confirm: "alice"}, "Password incorrect"},
+		{"wrong name", AccountDeletion{Password: "password", Confirm: "bob"}, "Type your username to confirm"},
+	}
+
+	for _, tt := range tests {
+		// Each wrong password delays the next try
+		loginLimiter.Succeeded("127.0.0.1")
+		if err := dbConn.SetLoginFailures("alice-key", 0, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := deleteTestAccount(t, alice, tt.deletion); got != tt.want {
+			t.Fatalf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if !registry.Exists("alice-key") {
+		t.Fatal("account gone after refused deletions")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	setTestDeletedMessages(t, "delete")
+	_, alice, bob := setupDeletion(t)
+
+	if got := deleteTestAccount(t, alice, AccountDeletion{Password: "password", Confirm: "alice"}); got != "Account deleted" {
+		t.Fatalf("deletion answered %q", got)
+	}
+
+	// Bob loses the friendship and the conversation with it
+	content := nextContent(t, bob)
+	if len(content.Friends) != 0 {
+		t.Fatalf("bob's friends after the deletion: %+v", content.Friends)
+	}
+	if export := exportTest(t, bob); len(export.Messages) != 0 {
+		t.Fatalf("bob's messages after the deletion: %+v", export.Messages)
+	}
+
+	if registry.Exists("alice-key") {
+		t.Fatal("deleted account still registered")
+	}
+	if ids, err := dbConn.GetUserAPI("alice"); err != nil || len(*ids) != 0 {
+		t.Fatalf("deleted account still stored: %v, error %v", ids, err)
+	}
+}
+
+func TestAnonymizeAccount(t *testing.T) {
+	setTestDeletedMessages(t, "anonymize")
+	_, alice, bob := setupDeletion(t)
+
+	if got := deleteTestAccount(t, alice, AccountDeletion{Password: "password", Confirm: "alice"}); got != "Account deleted" {
+		t.Fatalf("deletion answered %q", got)
+	}
+
+	// Bob keeps the conversation, with a tombstone in alice's place
+	content := nextContent(t, bob)
+	if len(content.Friends) != 1 || !strings.HasPrefix(content.Friends[0].Username, "deleted-") {
+		t.Fatalf("bob's friends after the deletion: %+v", content.Friends)
+	}
+	tombstone := content.Friends[0].Username
+
+	export := exportTest(t, bob)
+	chat := export.Messages[tombstone]
+	if len(chat) != 2 || chat[0].Sender != tombstone || chat[1].Receiver != tombstone {
+		t.Fatalf("bob's messages after the deletion: %+v", export.Messages)
+	}
+	if _, ok := export.Messages["alice"]; ok {
+		t.Fatal("messages still under alice's name")
+	}
+
+	if registry.Exists("alice-key") {
+		t.Fatal("old key still registered")
+	}
+	if _, ok := registry.GetKey("alice"); ok {
+		t.Fatal("alice's name still registered")
+	}
+
+	// Chats to the tombstone are refused
+	bob.send(SendMessage, Chat{Text: "still there?", Receiver: tombstone, ClientId: "2"})
+	bob.expect(FailedMessageSend)
+}
+
+// Neither the tombstone's name nor its empty password lead back into the account
+func TestTombstoneLogin(t *testing.T) {
+	setTestDeletedMessages(t, "anonymize")
+	srv, alice, bob := setupDeletion(t)
+
+	deleteTestAccount(t, alice, AccountDeletion{Password: "password", Confirm: "alice"})
+	tombstone := nextContent(t, bob).Friends[0].Username
+
+	for _, password := range []string{"", "password"} {
+		c := dialTest(t, srv, "device-key")
+		c.expect(LoginDetailsRequired)
+		c.send(AttemptLogin, LoginDetails{Username: tombstone, Password: password})
+
+		// Whatever the answer, until the server closes or goes quiet
+		c.ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			var r ClientResponse
+			if err := websocket.JSON.Receive(c.ws, &r); err != nil {
+				break
+			}
+			if r.Code == LoginSuccessful {
+				t.Fatalf("logged in as the tombstone with %q", password)
+			}
+		}
+		c.ws.Close()
+	}
+}
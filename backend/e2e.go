@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+/*
+	End-to-end encrypted direct messages.
+
+	Each client device keeps an X25519 key pair and publishes the public
+	half with PublishKey after logging in. Friends fetch it with KeyLookup,
+	and are sent it again whenever it changes. Chat text is encrypted on
+	the sending device, so SaveMessage only ever stores
+
+		e2e:v1:<base64 of nonce and AES-256-GCM sealed text>
+
+	The server never decrypts anything. It only checks that keys look like
+	X25519 public keys, and lets encrypted text take the room its encoding
+	needs on top of the plaintext limit.
+*/
+
+const e2ePrefix = "e2e:v1:"
+
+const publicKeySize = 32
+
+// Nonce and GCM tag added to every encrypted message
+const e2eOverhead = 12 + 16
+
+func validPublicKey(key string) bool {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(raw) == publicKeySize
+}
+
+// Largest chat text accepted. An encrypted message may be as long as the encoding of a full size one
+func maxChatTextSize() int {
+	return len(e2ePrefix) + base64.StdEncoding.EncodedLen(config.MaxMessageSize+e2eOverhead)
+}
+
+func chatTooLarge(text string) bool {
+	if strings.HasPrefix(text, e2ePrefix) {
+		return len(text) > maxChatTextSize()
+	}
+	return len(text) > config.MaxMessageSize
+}
+
+// Save the public key of k's device and pass it on to their friends if it changed
+func (s *Server) publishKey(k apiKey, m *ClientMessage) *RequestError {
+
+	var key string
+	if err := m.DecodePayload(&key); err != nil || !validPublicKey(key) {
+		return &RequestError{
+			Message: "Invalid public key",
+			Code:    PublishKey,
+		}
+	}
+
+	username := registry.Username(k)
+
+	current, err := dbConn.GetPublicKey(username)
+	if err != nil {
+		s.logger(k).Error("Error reading public key", "err", err)
+		return &RequestError{
+			Message: "Failed to save public key",
+			Code:    DatabaseError,
+		}
+	}
+
+	if current == key {
+		return nil
+	}
+
+	if err := dbConn.SetPublicKey(k, key); err != nil {
+		s.logger(k).Error("Error saving public key", "err", err)
+		return &RequestError{
+			Message: "Failed to save public key",
+			Code:    DatabaseError,
+		}
+	}
+
+	s.logger(k).Info("Public key published", "replaced", current != "")
+	audit(AuditKeyPublished, username, "", s.auditSource(k), "")
+
+	s.broadcast <- &BackendMessage{
+		Code:    BroadcastPublicKey,
+		Payload: k,
+	}
+
+	return nil
+}
+
+// Send the public key of a friend. Keys are only handed out to friends, the only people who can message the user
+func (s *Server) sendPublicKey(k apiKey, m *ClientMessage) *RequestError {
+
+	var username string
+	if err := m.DecodePayload(&username); err != nil {
+		return &RequestError{
+			Message: "Invalid key lookup",
+			Code:    KeyLookup,
+		}
+	}
+
+	result := PublicKey{
+		Username: username,
+		Key:      "",
+	}
+
+	if friendKey, ok := registry.GetKey(username); ok {
+		friendship, err := dbConn.GetFriendshipByIds(string(k), string(friendKey))
+		if err == nil && len(*friendship) > 0 {
+			result.Key, err = dbConn.GetPublicKey(username)
+		}
+		if err != nil {
+			s.logger(k).Error("Error looking up public key", "err", err)
+		}
+	}
+
+	clientResponse := ClientResponse{
+		Code:    KeyLookupResult,
+		Err:     nil,
+		Message: "",
+		Payload: nil,
+	}
+	clientResponse.EncodePayload(&result)
+
+	return s.sendTo(k, &clientResponse)
+}
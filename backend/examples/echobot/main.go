@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sbow19/messaging-cli-backend/botsdk"
+)
+
+/*
+	Echo bot: says hello to new friends and sends every message back.
+
+		go run . admin create-bot -user echo
+		BOT_TOKEN=echo:... go run ./examples/echobot -server ws://localhost:8000/ws
+
+	from the backend directory. Anyone can then add "echo" as a friend.
+*/
+
+func main() {
+
+	server := flag.String("server", "ws://localhost:8000/ws", "websocket URL of the server")
+	keyFile := flag.String("key", "echobot.key", "file to keep the bot's encryption key in")
+	flag.Parse()
+
+	bot, err := botsdk.New(botsdk.Config{
+		Server:  *server,
+		Token:   os.Getenv("BOT_TOKEN"),
+		KeyFile: *keyFile,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "echobot:", err)
+		os.Exit(1)
+	}
+
+	bot.OnFriendRequest(func(ctx context.Context, from string) {
+		if err := bot.Send(ctx, from, "Hi, I'm "+bot.Username()+". Say something and I'll say it back"); err != nil {
+			slog.Warn("Greeting not sent", "to", from, "err", err)
+		}
+	})
+
+	bot.OnMessage(func(ctx context.Context, m *botsdk.Message) {
+		if err := bot.Send(ctx, m.From, m.Text); err != nil {
+			slog.Warn("Echo not sent", "to", m.From, "err", err)
+		}
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := bot.Run(ctx); err != nil && ctx.Err() == nil {
+		fmt.Fprintln(os.Stderr, "echobot:", err)
+		os.Exit(1)
+	}
+}
@@ -3,6 +3,9 @@ module github.com/sbow19/messaging-cli-backend
 go 1.24.0
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.28 // indirect
-	golang.org/x/net v0.39.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/sbow19/messaging-cli-configfile v0.0.0
+	golang.org/x/net v0.39.0
 )
+
+replace github.com/sbow19/messaging-cli-configfile => ../configfile
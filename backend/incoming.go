@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+	Incoming webhooks, for CI systems and scripts to post into a
+	conversation without holding a websocket.
+
+	Each one posts as a bot account to one of the bot's friends. An admin
+	makes it with "admin add-incoming-webhook", which prints a URL with a
+	secret token in it, once:
+
+		POST /hooks/TOKEN
+
+	The body is the message, either plain text or JSON:
+
+		{"text": "Deploy finished", "id": "build-1234"}
+
+	"id", or an Idempotency-Key header, makes resends safe: a message with
+	an id already posted is acknowledged but not delivered again. Messages
+	are saved and delivered like any chat, so friends online see them
+	straight away and outgoing webhooks fire. They are not end-to-end
+	encrypted, since the server writes them.
+
+	Answers are JSON, {"ok": true, ...} or {"error": "..."}. Unknown tokens
+	get a 404, so a leaked URL is revoked by removing the webhook.
+*/
+
+type incomingMessage struct {
+	Text string `json:"text"`
+	Id   string `json:"id"`
+}
+
+type incomingResult struct {
+	Ok bool `json:"ok"`
+	// Set when the message was posted before with the same id
+	Duplicate bool   `json:"duplicate,omitempty"`
+	Date      string `json:"date,omitempty"`
+}
+
+type IncomingWebhook struct {
+	Id         string    `json:"id"`
+	SenderId   apiKey    `json:"-"`
+	Sender     string    `json:"sender"`
+	ReceiverId apiKey    `json:"-"`
+	Receiver   string    `json:"receiver"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func newIncomingToken() string {
+	return rand.Text()
+}
+
+func (s *Server) incomingWebhook(w http.ResponseWriter, r *http.Request) {
+
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+
+	if closing {
+		writeJSON(w, http.StatusServiceUnavailable, adminError{"server shutting down"})
+		return
+	}
+
+	hook, err := dbConn.GetIncomingWebhook(hashToken(r.PathValue("token")))
+	if errors.Is(err, sql.ErrNoRows) {
+		incomingPosts.Inc("unknown")
+		slog.Warn("Incoming webhook refused", "remote", r.RemoteAddr, "err", "unknown token")
+		writeJSON(w, http.StatusNotFound, adminError{"unknown webhook"})
+		return
+	}
+	if err != nil {
+		slog.Error("Error reading incoming webhook", "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"error reading webhook"})
+		return
+	}
+
+	logger := slog.With("webhook", hook.Id, "sender", hook.Sender, "receiver", hook.Receiver, "remote", r.RemoteAddr)
+
+	message, status, err := readIncomingMessage(w, r)
+	if err != nil {
+		incomingPosts.Inc("invalid")
+		logger.Warn("Incoming webhook refused", "err", err)
+		writeJSON(w, status, adminError{err.Error()})
+		return
+	}
+
+	// Bans apply to the bot a webhook posts as
+	disabled, _, err := dbConn.GetDisabled(hook.SenderId)
+	if err != nil {
+		logger.Error("Error reading account", "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"error reading account"})
+		return
+	}
+	if disabled {
+		incomingPosts.Inc("disabled")
+		writeJSON(w, http.StatusForbidden, adminError{"sender disabled by an admin"})
+		return
+	}
+
+	friendship, err := dbConn.GetFriendshipByIds(string(hook.SenderId), string(hook.ReceiverId))
+	if err != nil {
+		logger.Error("Error reading friendship", "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"error reading friendship"})
+		return
+	}
+	if len(*friendship) == 0 {
+		incomingPosts.Inc("not_friends")
+		writeJSON(w, http.StatusGone, adminError{fmt.Sprintf("%s and %s are no longer friends", hook.Sender, hook.Receiver)})
+		return
+	}
+
+	chat := Chat{
+		Text:     message.Text,
+		Sender:   hook.Sender,
+		Receiver: hook.Receiver,
+	}
+
+	// Ids are unique per sender, and a bot may post through several webhooks
+	if message.Id != "" {
+		chat.ClientId = hook.Id + "/" + message.Id
+	}
+
+	friendship, err = dbConn.SaveMessage(&chat, hook.SenderId)
+	if errors.Is(err, errDuplicateMessage) {
+		incomingPosts.Inc("duplicate")
+		logger.Debug("Duplicate incoming message acknowledged", "client_id", chat.ClientId)
+		writeJSON(w, http.StatusOK, incomingResult{Ok: true, Duplicate: true})
+		return
+	}
+	if err != nil {
+		logger.Error("Error saving message", "err", err)
+		writeJSON(w, http.StatusInternalServerError, adminError{"error saving message"})
+		return
+	}
+
+	incomingPosts.Inc("posted")
+	logger.Info("Incoming webhook posted", "bytes", len(chat.Text))
+
+	saved := Message{
+		Text:     chat.Text,
+		Date:     time.Now().UTC().Format("2006-01-02 15:04"),
+		Receiver: chat.Receiver,
+		Sender:   chat.Sender,
+		ClientId: chat.ClientId,
+	}
+
+	// Delivered to whoever is online, the same as a chat from a client
+	s.broadcast <- &BackendMessage{
+		Code: BroadcastChat,
+		Payload: &ChatBroadcast{
+			Chat:       &saved,
+			Friendship: friendship,
+			Sender:     hook.Sender,
+		},
+	}
+
+	writeJSON(w, http.StatusOK, incomingResult{Ok: true, Date: saved.Date})
+}
+
+// Message from a plain text or JSON body, with the status to refuse it with
+func readIncomingMessage(w http.ResponseWriter, r *http.Request) (*incomingMessage, int, error) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(config.MaxMessageSize)+4096)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("message is larger than %d bytes", config.MaxMessageSize)
+	}
+
+	message := &incomingMessage{
+		Id: r.Header.Get("Idempotency-Key"),
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.Unmarshal(body, message); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid JSON body")
+		}
+	} else {
+		message.Text = string(body)
+	}
+
+	// echo and most files end in a newline nobody means to send
+	message.Text = strings.TrimRight(message.Text, "\r\n")
+
+	if strings.TrimSpace(message.Text) == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("message text is empty")
+	}
+
+	if chatTooLarge(message.Text) {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("message is larger than %d bytes", config.MaxMessageSize)
+	}
+
+	if len(message.Id) > maxClientIdSize {
+		return nil, http.StatusBadRequest, fmt.Errorf("id is longer than %d bytes", maxClientIdSize)
+	}
+
+	return message, http.StatusOK, nil
+}
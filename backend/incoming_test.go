@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// POST a message to an incoming webhook, returning the status and JSON answer
+func postIncoming(t *testing.T, srv *httptest.Server, token string, contentType string, body string) (int, map[string]interface{}) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/hooks/"+token, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	answer := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, answer
+}
+
+// alice is friends with the ci bot, which has webhooks posting to alice
+// at "alice-token" and to carol, not a friend, at "carol-token"
+func setupIncoming(t *testing.T) (srv *httptest.Server, alice *testClient) {
+	t.Helper()
+
+	srv = newTestServer(t)
+	token := createTestBot(t, "ci")
+
+	// Accepted by the bot while it is connected
+	loginTestBot(t, srv, token)
+	alice = loginTest(t, srv, "alice-key", "alice")
+	alice.send(FriendRequest, "ci")
+	alice.expect(FriendRequestResult)
+
+	var content UserContent
+	alice.expectPayload(UpdateFriendContent, &content)
+	if len(content.Friends) != 1 {
+		t.Fatalf("alice's content after asking the bot: %+v", content)
+	}
+
+	createTestUser(t, dbConn, "carol-key", "carol")
+
+	store := dbConn.(*MemoryStore)
+	store.mu.Lock()
+	store.incomingWebhooks[hashToken("alice-token")] = IncomingWebhook{
+		Id: "to-alice", SenderId: "ci-key", Sender: "ci", ReceiverId: "alice-key", Receiver: "alice",
+	}
+	store.incomingWebhooks[hashToken("carol-token")] = IncomingWebhook{
+		Id: "to-carol", SenderId: "ci-key", Sender: "ci", ReceiverId: "carol-key", Receiver: "carol",
+	}
+	store.mu.Unlock()
+
+	return srv, alice
+}
+
+func TestIncomingWebhookRefused(t *testing.T) {
+	srv, _ := setupIncoming(t)
+
+	tests := []struct {
+		name        string
+		token       string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"unknown token", "wrong-token", "text/plain", "hi", http.StatusNotFound},
+		{"not friends", "carol-token", "text/plain", "hi", http.StatusGone},
+		{"too large", "alice-token", "text/plain", strings.Repeat("x", config.MaxMessageSize+1), http.StatusRequestEntityTooLarge},
+		{"too large for the reader", "alice-token", "text/plain", strings.Repeat("x", config.MaxMessageSize+5000), http.StatusRequestEntityTooLarge},
+		{"empty", "alice-token", "text/plain", "\n", http.StatusBadRequest},
+		{"invalid JSON", "alice-token", "application/json", `{"text":`, http.StatusBadRequest},
+		{"long id", "alice-token", "application/json", `{"text":"hi","id":"` + strings.Repeat("x", maxClientIdSize+1) + `"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		status, answer := postIncoming(t, srv, tt.token, tt.contentType, tt.body)
+		if status != tt.status || answer["error"] == nil {
+			t.Errorf("%s: got %d %v, want %d", tt.name, status, answer, tt.status)
+		}
+	}
+
+	store := dbConn.(*MemoryStore)
+	store.mu.Lock()
+	saved := len(store.messages)
+	store.mu.Unlock()
+	if saved != 0 {
+		t.Fatalf("%d messages saved from refused posts", saved)
+	}
+}
+
+func TestIncomingWebhook(t *testing.T) {
+	srv, alice := setupIncoming(t)
+
+	status, answer := postIncoming(t, srv, "alice-token", "text/plain", "build passed\n")
+	if status != http.StatusOK || answer["ok"] != true {
+		t.Fatalf("got %d %v", status, answer)
+	}
+
+	// Delivered as the bot, like any chat
+	var received Message
+	alice.expectPayload(ReceiveMessage, &received)
+	if received.Sender != "ci" || received.Receiver != "alice" || received.Text != "build passed" {
+		t.Fatalf("alice received %+v", received)
+	}
+
+	// Resent with the same id, acknowledged once only
+	for _, duplicate := range []bool{false, true} {
+		status, answer := postIncoming(t, srv, "alice-token", "application/json", `{"text":"deployed","id":"deploy-1"}`)
+		if status != http.StatusOK || answer["ok"] != true || (answer["duplicate"] == true) != duplicate {
+			t.Fatalf("post with duplicate %v: got %d %v", duplicate, status, answer)
+		}
+	}
+
+	alice.expectPayload(ReceiveMessage, &received)
+	if received.Text != "deployed" {
+		t.Fatalf("alice received %+v", received)
+	}
+
+	chat := exportTest(t, alice).Messages["ci"]
+	if len(chat) != 2 || chat[0].Text != "build passed" || chat[1].Text != "deployed" {
+		t.Fatalf("saved messages %+v", chat)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+/*
+	Structured logging with log/slog.
+
+	main installs the default logger from log_level and log_format. Each
+	websocket connection gets its own logger carrying the remote address
+	and key, plus the username once logged in, so every line about one
+	connection can be pulled out together.
+
+	API keys are credentials, so lines carry a short SHA-256 fingerprint
+	of the key rather than the key itself.
+*/
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("log_level %q must be debug, info, warn or error", s)
+}
+
+func newLogger(w io.Writer, level string, format string) (*slog.Logger, error) {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("log_format %q must be text or json", format)
+}
+
+func keyFingerprint(k apiKey) string {
+	sum := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(sum[:6])
+}
+
+func connLogger(k apiKey, remoteAddr string) *slog.Logger {
+	return slog.Default().With("key", keyFingerprint(k), "remote", remoteAddr)
+}
+
+// Logger of the connection for k. Falls back to one carrying just the key
+func (s *Server) logger(k apiKey) *slog.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.clients[k]; ok {
+		return c.log
+	}
+	return slog.Default().With("key", keyFingerprint(k))
+}
+
+// Add the username to the connection logger once it is known
+func (s *Server) setLoggerUser(k apiKey, username string) *slog.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[k]
+	if !ok {
+		return slog.Default().With("key", keyFingerprint(k), "user", username)
+	}
+
+	c.log = c.log.With("user", username)
+	return c.log
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 /*
@@ -27,38 +30,99 @@ func main() {
 	// go_sqlite3 equired CGO_ENABLED
 	os.Setenv("CGO_ENABLED", "1")
 
+	// Subcommands run instead of the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			if err := runMigrate(os.Args[2:]); err != nil {
+				log.Fatalf("Error migrating database: %q", err)
+			}
+			return
+		case "gencert":
+			if err := runGenCert(os.Args[2:]); err != nil {
+				log.Fatalf("Error generating certificate: %q", err)
+			}
+			return
+		case "rekey":
+			if err := runRekey(os.Args[2:]); err != nil {
+				log.Fatalf("Error rekeying database: %v", err)
+			}
+			return
+		case "admin":
+			if err := runAdmin(os.Args[2:]); err != nil {
+				log.Fatalf("Admin command failed: %v", err)
+			}
+			return
+		}
+	}
+
+	// Flags, config file and environment
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	config = cfg
+
+	logger, err := newLogger(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		log.Fatalf("Error creating logger: %v", err)
+	}
+	slog.SetDefault(logger)
+
 	// Load all user data into memory
-	err := loadDB()
+	err = loadDB()
 
 	if err != nil {
-		log.Fatalf("Error loading database: %q", err)
+		slog.Error("Error loading database", "path", config.DBPath, "err", err)
+		os.Exit(1)
 	}
 
 	// Create socket server
 	wsServer := NewServer()
 
-	// Main routing handle func
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Broadcast presence changes to friends
+	registry.Subscribe(wsServer.broadcastPresence)
 
-		//
-		fmt.Println("Starting Handler")
-		// Spin off new websocket connection handler
-		wsServer.start(w, r)
-	})
-
-	// Get all users --> prints out to txt file
-	go dbConn.GetAll()
+	// Get all users into the registry before accepting connections --> prints out to txt file
+	err = dbConn.GetAll()
+	if err != nil {
+		slog.Error("Error loading users", "err", err)
+		os.Exit(1)
+	}
 
 	//Listen for app wide messages, e.g. for broadcasting to multiple clients
 	go AppListener(wsServer)
 
-	// Start server on PORT
-	fmt.Println("HTTP server started at http://localhost:8000")
+	// Stop on Ctrl-C, or SIGTERM from a process manager
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// This  appears to be a blocking operation
-	listenErr := http.ListenAndServe(":8000", nil)
-	if listenErr != nil {
-		fmt.Println("Error starting server:", listenErr)
+	httpServer := &http.Server{
+		Addr:    config.Listen,
+		Handler: newRouter(wsServer),
 	}
 
+	// Start server on configured address
+	listenErr := make(chan error, 1)
+	go func() {
+		if config.TLSEnabled() {
+			slog.Info("HTTPS server started", "listen", config.Listen)
+			listenErr <- httpServer.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		} else {
+			slog.Info("HTTP server started", "listen", config.Listen)
+			listenErr <- httpServer.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-listenErr:
+		slog.Error("Error starting server", "err", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	}
+
+	// A second signal kills the process straight away
+	stop()
+
+	shutdown(httpServer, wsServer)
 }
@@ -0,0 +1,1088 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	In-memory implementation of Store. Mirrors the SQLite tables closely
+	enough for the socket and broadcast handlers to run against it without
+	a database file.
+*/
+
+type memUser struct {
+	id          string
+	welcomeSent bool
+	accountMade bool
+	username    string
+	password    string
+	lastSeen    time.Time
+	// Failed logins in a row, and when the next attempt is allowed
+	failedLogins int
+	lockedUntil  time.Time
+	// Set when the account is anonymized rather than deleted
+	deletedAt time.Time
+	// Set by an admin
+	disabledAt     time.Time
+	disabledReason string
+	publicKey      string
+	// Bots log in with a token, kept hashed
+	bot          bool
+	botTokenHash string
+}
+
+type memPair struct {
+	id    string
+	user1 string
+	user2 string
+}
+
+type memMessage struct {
+	id       string
+	friendId string
+	senderId string
+	message  string
+	date     time.Time
+	clientId string
+}
+
+type memRecoveryCode struct {
+	hash string
+	used bool
+}
+
+type MemoryStore struct {
+	users          map[string]*memUser
+	recoveryCodes  map[string][]memRecoveryCode
+	friendRequests []memPair
+	friends        []memPair
+	messages       []memMessage
+	audit          []AuditEvent
+	webhooks       []Webhook
+	deadLetters    []DeadLetter
+	// By token hash
+	incomingWebhooks map[string]IncomingWebhook
+	mu               sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:            make(map[string]*memUser),
+		recoveryCodes:    make(map[string][]memRecoveryCode),
+		friendRequests:   []memPair{},
+		friends:          []memPair{},
+		messages:         []memMessage{},
+		audit:            []AuditEvent{},
+		webhooks:         []Webhook{},
+		deadLetters:      []DeadLetter{},
+		incomingWebhooks: make(map[string]IncomingWebhook),
+		mu:               sync.Mutex{},
+	}
+}
+
+func (m *MemoryStore) CreateNewUser(d *clientData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[string(d.apiKey)]; ok {
+		return fmt.Errorf("user already exists")
+	}
+
+	if d.loginDetails.Username != "" && m.usernameTaken(d.loginDetails.Username, string(d.apiKey)) {
+		return fmt.Errorf("username already taken")
+	}
+
+	m.users[string(d.apiKey)] = &memUser{
+		id:       string(d.apiKey),
+		username: d.loginDetails.Username,
+		password: d.loginDetails.Password,
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) UpdateClient(d *clientData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(d.apiKey)]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	if d.loginDetails.Username != "" && m.usernameTaken(d.loginDetails.Username, u.id) {
+		return fmt.Errorf("username already taken")
+	}
+
+	u.welcomeSent = d.welcomeSent
+	u.accountMade = d.accountMade
+	u.username = d.loginDetails.Username
+	u.password = d.loginDetails.Password
+
+	return nil
+}
+
+func (m *MemoryStore) SetLastSeen(k apiKey, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	u.lastSeen = t.UTC()
+	return nil
+}
+
+func (m *MemoryStore) GetLoginFailures(k apiKey) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("user not found")
+	}
+
+	return u.failedLogins, u.lockedUntil, nil
+}
+
+func (m *MemoryStore) SetLoginFailures(k apiKey, failures int, lockedUntil time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	u.failedLogins = failures
+	u.lockedUntil = lockedUntil
+	return nil
+}
+
+func (m *MemoryStore) GetDisabled(k apiKey) (bool, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return false, "", fmt.Errorf("user not found")
+	}
+
+	return !u.disabledAt.IsZero(), u.disabledReason, nil
+}
+
+func (m *MemoryStore) SetDisabled(k apiKey, disabled bool, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	u.disabledAt = time.Time{}
+	u.disabledReason = ""
+	if disabled {
+		u.disabledAt = time.Now().UTC()
+		u.disabledReason = reason
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetLoginDetails(k apiKey) (LoginDetails, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return LoginDetails{}, fmt.Errorf("user not found")
+	}
+
+	return LoginDetails{
+		Username: u.username,
+		Password: u.password,
+	}, nil
+}
+
+func (m *MemoryStore) SetPassword(k apiKey, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	u.password = password
+	return nil
+}
+
+func (m *MemoryStore) SetPublicKey(k apiKey, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return fmt.Errorf("user not found")
+	}
+
+	u.publicKey = key
+	return nil
+}
+
+func (m *MemoryStore) GetPublicKey(username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.username == username && u.deletedAt.IsZero() {
+			return u.publicKey, nil
+		}
+	}
+	return "", fmt.Errorf("user not found")
+}
+
+func (m *MemoryStore) CreateBot(k apiKey, username string, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[string(k)]; ok {
+		return fmt.Errorf("user already exists")
+	}
+
+	if m.usernameTaken(username, string(k)) {
+		return fmt.Errorf("username already taken")
+	}
+
+	m.users[string(k)] = &memUser{
+		id:           string(k),
+		welcomeSent:  true,
+		accountMade:  true,
+		username:     username,
+		bot:          true,
+		botTokenHash: tokenHash,
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) SetBotToken(k apiKey, tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok || !u.bot {
+		return fmt.Errorf("bot not found")
+	}
+
+	u.botTokenHash = tokenHash
+	return nil
+}
+
+func (m *MemoryStore) GetBotByToken(tokenHash string) (apiKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		if u.bot && u.botTokenHash == tokenHash && u.deletedAt.IsZero() {
+			return apiKey(u.id), nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (m *MemoryStore) SetRecoveryCodes(k apiKey, hashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := make([]memRecoveryCode, 0, len(hashes))
+	for _, hash := range hashes {
+		codes = append(codes, memRecoveryCode{
+			hash: hash,
+		})
+	}
+	m.recoveryCodes[string(k)] = codes
+
+	return nil
+}
+
+func (m *MemoryStore) RecoverAccount(oldKey apiKey, newKey apiKey, codeHash string, password string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := m.recoveryCodes[string(oldKey)]
+	found := -1
+	for i, code := range codes {
+		if code.hash == codeHash && !code.used {
+			found = i
+		}
+	}
+
+	if found < 0 {
+		return false, nil
+	}
+
+	u, ok := m.users[string(oldKey)]
+	if !ok {
+		return false, fmt.Errorf("user not found")
+	}
+
+	// Only the placeholder made for the new device may be replaced
+	if placeholder, ok := m.users[string(newKey)]; ok {
+		if placeholder.username != "" {
+			return false, fmt.Errorf("UNIQUE constraint failed: users.id")
+		}
+		delete(m.users, string(newKey))
+	}
+
+	codes[found].used = true
+
+	delete(m.users, string(oldKey))
+	u.id = string(newKey)
+	u.password = password
+	u.failedLogins = 0
+	u.lockedUntil = time.Time{}
+	u.publicKey = ""
+	m.users[string(newKey)] = u
+
+	delete(m.recoveryCodes, string(oldKey))
+	m.recoveryCodes[string(newKey)] = codes
+
+	move := func(id *string) {
+		if *id == string(oldKey) {
+			*id = string(newKey)
+		}
+	}
+
+	for i := range m.friendRequests {
+		move(&m.friendRequests[i].user1)
+		move(&m.friendRequests[i].user2)
+	}
+
+	for i := range m.friends {
+		move(&m.friends[i].user1)
+		move(&m.friends[i].user2)
+	}
+
+	for i := range m.messages {
+		move(&m.messages[i].senderId)
+	}
+
+	for tokenHash, h := range m.incomingWebhooks {
+		if h.SenderId == oldKey {
+			h.SenderId = newKey
+		}
+		if h.ReceiverId == oldKey {
+			h.ReceiverId = newKey
+		}
+		m.incomingWebhooks[tokenHash] = h
+	}
+
+	return true, nil
+}
+
+// Drop incoming webhooks posting as or to k. Callers must hold m.mu
+func (m *MemoryStore) deleteIncomingWebhooks(k apiKey) {
+	maps.DeleteFunc(m.incomingWebhooks, func(_ string, h IncomingWebhook) bool {
+		return h.SenderId == k || h.ReceiverId == k
+	})
+}
+
+// Callers must hold m.mu
+func (m *MemoryStore) relatedUsers(k apiKey) []string {
+	seen := make(map[string]bool)
+	related := []string{}
+
+	for _, pairs := range [][]memPair{m.friends, m.friendRequests} {
+		for _, p := range pairs {
+			if p.user1 != string(k) && p.user2 != string(k) {
+				continue
+			}
+			for _, id := range []string{p.user1, p.user2} {
+				if id != string(k) && !seen[id] {
+					seen[id] = true
+					related = append(related, id)
+				}
+			}
+		}
+	}
+
+	return related
+}
+
+// Pairs that don't involve k
+func withoutUser(pairs []memPair, k apiKey) []memPair {
+	filtered := []memPair{}
+	for _, p := range pairs {
+		if p.user1 != string(k) && p.user2 != string(k) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+func (m *MemoryStore) DeleteAccount(k apiKey) (*[]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	related := m.relatedUsers(k)
+
+	friendships := make(map[string]bool)
+	for _, f := range m.friends {
+		if f.user1 == string(k) || f.user2 == string(k) {
+			friendships[f.id] = true
+		}
+	}
+
+	messages := []memMessage{}
+	for _, msg := range m.messages {
+		if !friendships[msg.friendId] {
+			messages = append(messages, msg)
+		}
+	}
+	m.messages = messages
+
+	m.friends = withoutUser(m.friends, k)
+	m.friendRequests = withoutUser(m.friendRequests, k)
+	delete(m.recoveryCodes, string(k))
+	m.webhooks = slices.DeleteFunc(m.webhooks, func(h Webhook) bool {
+		return h.User == u.username
+	})
+	m.deleteIncomingWebhooks(k)
+	delete(m.users, string(k))
+
+	return &related, nil
+}
+
+func (m *MemoryStore) AnonymizeAccount(k apiKey, tombstoneId apiKey, tombstoneName string) (*[]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[string(k)]
+	if !ok {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	if _, ok := m.users[string(tombstoneId)]; ok {
+		return nil, fmt.Errorf("UNIQUE constraint failed: users.id")
+	}
+
+	related := m.relatedUsers(k)
+
+	m.friendRequests = withoutUser(m.friendRequests, k)
+	delete(m.recoveryCodes, string(k))
+	m.webhooks = slices.DeleteFunc(m.webhooks, func(h Webhook) bool {
+		return h.User == u.username
+	})
+	m.deleteIncomingWebhooks(k)
+
+	delete(m.users, string(k))
+	u.id = string(tombstoneId)
+	u.username = tombstoneName
+	u.password = ""
+	u.failedLogins = 0
+	u.lockedUntil = time.Time{}
+	u.publicKey = ""
+	u.deletedAt = time.Now().UTC()
+	m.users[string(tombstoneId)] = u
+
+	for i := range m.friends {
+		if m.friends[i].user1 == string(k) {
+			m.friends[i].user1 = string(tombstoneId)
+		}
+		if m.friends[i].user2 == string(k) {
+			m.friends[i].user2 = string(tombstoneId)
+		}
+	}
+
+	for i := range m.messages {
+		if m.messages[i].senderId == string(k) {
+			m.messages[i].senderId = string(tombstoneId)
+		}
+	}
+
+	return &related, nil
+}
+
+func (m *MemoryStore) ExportAccount(k apiKey) (*AccountExport, error) {
+
+	friendsContent, err := m.GetAllFriendsContent(k)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	username := registry.Username(k)
+	messages := Messages{}
+
+	for _, f := range m.friends {
+
+		var friendId string
+		switch string(k) {
+		case f.user1:
+			friendId = f.user2
+		case f.user2:
+			friendId = f.user1
+		default:
+			continue
+		}
+		friendName := registry.Username(apiKey(friendId))
+
+		for _, msg := range m.messages {
+			if msg.friendId != f.id {
+				continue
+			}
+
+			sender, receiver := friendName, username
+			if msg.senderId == string(k) {
+				sender, receiver = username, friendName
+			}
+
+			messages[friendName] = append(messages[friendName], Message{
+				Text:     msg.message,
+				Sender:   sender,
+				Receiver: receiver,
+				Date:     msg.date.Format(time.RFC3339),
+			})
+		}
+	}
+
+	return &AccountExport{
+		Username:       username,
+		ExportedAt:     time.Now().UTC().Format(time.RFC3339),
+		Friends:        friendsContent.Friends,
+		FriendRequests: friendsContent.FriendRequests,
+		Messages:       messages,
+	}, nil
+}
+
+func (m *MemoryStore) AdminUsers(prefix string) ([]AdminUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	users := []AdminUser{}
+	lowerPrefix := strings.ToLower(prefix)
+
+	for _, u := range m.users {
+		if u.username == "" || !strings.HasPrefix(strings.ToLower(u.username), lowerPrefix) {
+			continue
+		}
+
+		au := AdminUser{
+			Username:       u.username,
+			Kind:           "user",
+			DisabledReason: u.disabledReason,
+			LastSeen:       "never",
+			FailedLogins:   u.failedLogins,
+		}
+
+		if u.bot {
+			au.Kind = "bot"
+		}
+
+		switch {
+		case !u.deletedAt.IsZero():
+			au.Status = "deleted"
+		case !u.disabledAt.IsZero():
+			au.Status = "disabled"
+		case u.lockedUntil.After(now):
+			au.Status = "locked"
+		default:
+			au.Status = "ok"
+		}
+
+		if !u.lastSeen.IsZero() {
+			au.LastSeen = u.lastSeen.Format(adminTimeLayout)
+		}
+
+		for _, f := range m.friends {
+			if f.user1 == u.id || f.user2 == u.id {
+				au.Friends++
+			}
+		}
+
+		for _, msg := range m.messages {
+			if msg.senderId == u.id {
+				au.MessagesSent++
+			}
+		}
+
+		users = append(users, au)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	return users, nil
+}
+
+// Callers must hold m.mu
+func (m *MemoryStore) usernameTaken(name string, exceptId string) bool {
+	for _, u := range m.users {
+		if u.username == name && u.id != exceptId {
+			return true
+		}
+	}
+	return false
+}
+
+// Load all stored users into the registry
+func (m *MemoryStore) GetAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.users {
+		registry.Add(&clientData{
+			apiKey:      apiKey(u.id),
+			username:    u.username,
+			message:     "No new users",
+			accountMade: u.accountMade,
+			welcomeSent: u.welcomeSent,
+			bot:         u.bot,
+			loginDetails: LoginDetails{
+				Username: u.username,
+				Password: u.password,
+			},
+			loggedIn: false,
+			active:   false,
+			err:      nil,
+			mu:       sync.Mutex{},
+			rwmu:     sync.RWMutex{},
+		})
+	}
+
+	return nil
+}
+
+// Case insensitive prefix search, matching SQLite LIKE
+func (m *MemoryStore) GetUsers(s string) (*UsersSearch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outputUsers := UsersSearch{}
+	prefix := strings.ToLower(s)
+	for _, u := range m.users {
+		if u.deletedAt.IsZero() && strings.HasPrefix(strings.ToLower(u.username), prefix) {
+			outputUsers = append(outputUsers, u.username)
+		}
+	}
+
+	return &outputUsers, nil
+}
+
+func (m *MemoryStore) GetUserAPI(s string) (*UsersSearch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outputUsers := UsersSearch{}
+	for _, u := range m.users {
+		if u.deletedAt.IsZero() && u.username == s {
+			outputUsers = append(outputUsers, u.id)
+		}
+	}
+
+	return &outputUsers, nil
+}
+
+func (m *MemoryStore) SetFriendRequest(name string, reqId string) (string, error) {
+
+	userSearch, err := m.GetUserAPI(name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(*userSearch) == 0 {
+		return "", fmt.Errorf("user not found")
+	}
+
+	// resId is receiving request, req is the requesting user
+	resId := (*userSearch)[0]
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range m.friendRequests {
+		// Check if reverse request has already been made
+		if r.user1 == resId && r.user2 == reqId {
+			return r.id, fmt.Errorf("friend request already sent")
+		}
+		if r.user1 == reqId && r.user2 == resId {
+			return "", fmt.Errorf("UNIQUE constraint failed: friend_requests.reqId, friend_requests.resId")
+		}
+	}
+
+	// Check to see if they are already friends
+	if f, ok := m.findFriendship(resId, reqId); ok {
+		return f.id, fmt.Errorf("Users already friends")
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return "", err
+	}
+
+	m.friendRequests = append(m.friendRequests, memPair{
+		id:    id,
+		user1: reqId,
+		user2: resId,
+	})
+
+	return id, nil
+}
+
+func (m *MemoryStore) GetFriendRequestByIds(reqId string, resId string) (*UsersSearch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	outputUsers := UsersSearch{}
+	for _, r := range m.friendRequests {
+		if r.user1 == reqId && r.user2 == resId {
+			outputUsers = append(outputUsers, r.id)
+		}
+	}
+
+	return &outputUsers, nil
+}
+
+func (m *MemoryStore) GetFriendRequestById(requestId string) (*[]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var output []string
+	for _, r := range m.friendRequests {
+		if r.id == requestId {
+			output = append(output, r.id, r.user1, r.user2)
+		}
+	}
+
+	return &output, nil
+}
+
+func (m *MemoryStore) DeleteFriendRequest(requestId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	filtered := m.friendRequests[:0]
+	for _, r := range m.friendRequests {
+		if r.id != requestId {
+			filtered = append(filtered, r)
+		}
+	}
+	m.friendRequests = filtered
+
+	return nil
+}
+
+func (m *MemoryStore) CreateFriend(f *FriendAcceptData, userId string) error {
+
+	res, err := m.GetFriendRequestById(f.RequestId)
+	if err != nil {
+		return err
+	}
+
+	if len(*res) == 0 {
+		return fmt.Errorf("friend request not found")
+	}
+
+	friendshipId, err := generateId()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.friends = append(m.friends, memPair{
+		id:    friendshipId,
+		user1: (*res)[1], // Requester ID
+		user2: (*res)[2], // Receiver ID
+	})
+	m.mu.Unlock()
+
+	return m.DeleteFriendRequest(f.RequestId)
+}
+
+// Callers must hold m.mu
+func (m *MemoryStore) findFriendship(id1 string, id2 string) (memPair, bool) {
+	for _, f := range m.friends {
+		if (f.user1 == id1 && f.user2 == id2) || (f.user1 == id2 && f.user2 == id1) {
+			return f, true
+		}
+	}
+	return memPair{}, false
+}
+
+func (m *MemoryStore) GetFriendshipById(friendshipId string) (*[]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var output []string
+	for _, f := range m.friends {
+		if f.id == friendshipId {
+			output = append(output, f.id, f.user1, f.user2)
+		}
+	}
+
+	return &output, nil
+}
+
+func (m *MemoryStore) GetFriendshipByIds(id1 string, id2 string) (*[]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var output []string
+	if f, ok := m.findFriendship(id1, id2); ok {
+		output = append(output, f.id, f.user1, f.user2)
+	}
+
+	return &output, nil
+}
+
+func (m *MemoryStore) GetFriendsById(userId string) (*[]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var output []string
+	for _, f := range m.friends {
+		if f.user1 == userId {
+			output = append(output, f.user2)
+		} else if f.user2 == userId {
+			output = append(output, f.user1)
+		}
+	}
+
+	return &output, nil
+}
+
+func (m *MemoryStore) SaveMessage(chat *Chat, userId apiKey) (*[]string, error) {
+
+	res, err := m.GetUserAPI(chat.Receiver)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*res) == 0 {
+		return nil, errReceiverNotFound
+	}
+
+	friendship, err := m.GetFriendshipByIds((*res)[0], string(userId))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*friendship) == 0 {
+		return nil, errNotFriends
+	}
+
+	messageId, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if chat.ClientId != "" {
+		for _, msg := range m.messages {
+			if msg.senderId == string(userId) && msg.clientId == chat.ClientId {
+				return nil, errDuplicateMessage
+			}
+		}
+	}
+
+	m.messages = append(m.messages, memMessage{
+		id:       messageId,
+		friendId: (*friendship)[0],
+		senderId: string(userId),
+		message:  chat.Text,
+		date:     time.Now().UTC(),
+		clientId: chat.ClientId,
+	})
+
+	return friendship, nil
+}
+
+func (m *MemoryStore) GetAllUserContent(k apiKey) (*UserContent, error) {
+
+	userContent, err := m.GetAllFriendsContent(k)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages := Messages{}
+	cutoff := time.Now().UTC().Add(-config.HistoryWindow)
+
+	for _, f := range m.friends {
+
+		var friendId string
+		switch string(k) {
+		case f.user1:
+			friendId = f.user2
+		case f.user2:
+			friendId = f.user1
+		default:
+			continue
+		}
+
+		friendName := registry.Username(apiKey(friendId))
+		if friendName == "" {
+			continue
+		}
+		messages[friendName] = []Message{}
+
+		for _, msg := range m.messages {
+			if msg.friendId != f.id || msg.date.Before(cutoff) {
+				continue
+			}
+
+			sender, receiver := friendName, registry.Username(k)
+			if msg.senderId == string(k) {
+				sender, receiver = receiver, friendName
+			}
+
+			messages[friendName] = append(messages[friendName], Message{
+				Text:     msg.message,
+				Date:     msg.date.Format("2006-01-02 15:04"),
+				Sender:   sender,
+				Receiver: receiver,
+				ClientId: msg.clientId,
+			})
+		}
+	}
+
+	userContent.Messages = messages
+	return userContent, nil
+}
+
+func (m *MemoryStore) GetAllFriendsContent(k apiKey) (*UserContent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userContent := UserContent{}
+	friends := []Friend{}
+	friendRequests := []FriendReqDetails{}
+
+	// Get friend details
+	for _, f := range m.friends {
+
+		var friendId string
+		switch string(k) {
+		case f.user1:
+			friendId = f.user2
+		case f.user2:
+			friendId = f.user1
+		default:
+			continue
+		}
+
+		result, ok := registry.Get(apiKey(friendId))
+		if !ok {
+			continue
+		}
+		friends = append(friends, result.AsFriend())
+	}
+
+	// Get friend requests
+	for _, r := range m.friendRequests {
+
+		if string(k) == r.user2 {
+			if result, ok := registry.Get(apiKey(r.user1)); ok {
+				friendRequests = append(friendRequests, FriendReqDetails{
+					Username:   result.Username(),
+					RequestId:  r.id,
+					FromClient: false,
+				})
+			}
+		}
+
+		if string(k) == r.user1 {
+			if result, ok := registry.Get(apiKey(r.user2)); ok {
+				friendRequests = append(friendRequests, FriendReqDetails{
+					Username:   result.Username(),
+					RequestId:  r.id,
+					FromClient: true,
+				})
+			}
+		}
+	}
+
+	userContent.Friends = friends
+	userContent.FriendRequests = friendRequests
+	userContent.Messages = nil
+
+	return &userContent, nil
+}
+
+func (m *MemoryStore) AppendAudit(e *AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	event := *e
+	event.Id = int64(len(m.audit) + 1)
+	event.At = time.Now().UTC()
+	m.audit = append(m.audit, event)
+	return nil
+}
+
+func (m *MemoryStore) Webhooks() ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Webhook(nil), m.webhooks...), nil
+}
+
+func (m *MemoryStore) AddDeadLetter(d *DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	letter := *d
+	letter.Id = int64(len(m.deadLetters) + 1)
+	letter.FailedAt = time.Now().UTC()
+	m.deadLetters = append(m.deadLetters, letter)
+	return nil
+}
+
+func (m *MemoryStore) GetIncomingWebhook(tokenHash string) (*IncomingWebhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.incomingWebhooks[tokenHash]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	for _, id := range []apiKey{h.SenderId, h.ReceiverId} {
+		if u, ok := m.users[string(id)]; !ok || !u.deletedAt.IsZero() {
+			return nil, sql.ErrNoRows
+		}
+	}
+
+	return &h, nil
+}
+
+func (m *MemoryStore) Ping() error {
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -36,8 +36,85 @@ const (
 	ReceiveMessage
 	NotifyLogin
 	NotifyInactive
+	ServerShutdown
+	AccountLocked
+	ChangePassword
+	ChangePasswordResult
+	RecoveryCodes
+	RecoverAccount
+	RecoverAccountResult
+	DeleteAccount
+	DeleteAccountResult
+	ExportData
+	ExportDataResult
+	AccountDisabled
+	Announcement
+	PublishKey
+	KeyLookup
+	KeyLookupResult
+	MessageAck
+	CommandOutput
+	ClearChat
 )
 
+// Names used as metric labels. Same order as the codes above
+var messageCodeNames = [...]string{
+	"NewLoginDetails",
+	"LoginDetailsRequired",
+	"IncorrectLogin",
+	"AuthenticationError",
+	"AuthenticationRequired",
+	"AttemptLogin",
+	"LoginSuccessful",
+	"AllContent",
+	"Welcome",
+	"APIKey",
+	"RequestTimeout",
+	"FailedMessageSend",
+	"ConnectionError",
+	"DatabaseError",
+	"Home",
+	"GameStart",
+	"SearchUsers",
+	"SearchUsersResults",
+	"FriendRequest",
+	"FriendRequestResult",
+	"FriendAccept",
+	"FriendAcceptResult",
+	"UpdateFriendContent",
+	"OpenChat",
+	"SendMessage",
+	"ReceiveMessage",
+	"NotifyLogin",
+	"NotifyInactive",
+	"ServerShutdown",
+	"AccountLocked",
+	"ChangePassword",
+	"ChangePasswordResult",
+	"RecoveryCodes",
+	"RecoverAccount",
+	"RecoverAccountResult",
+	"DeleteAccount",
+	"DeleteAccountResult",
+	"ExportData",
+	"ExportDataResult",
+	"AccountDisabled",
+	"Announcement",
+	"PublishKey",
+	"KeyLookup",
+	"KeyLookupResult",
+	"MessageAck",
+	"CommandOutput",
+	"ClearChat",
+}
+
+func (c MessageCode) String() string {
+	if c < 0 || int(c) >= len(messageCodeNames) {
+		return "Unknown"
+	}
+	return messageCodeNames[c]
+}
+
 type Response interface {
 	GetMessage() string
 }
@@ -171,6 +248,81 @@ func (m *ClientResponse) EncodePayload(p interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePasswordResult, RecoverAccountResult, MessageAck, FailedMessageSend:
+		// P is the result message, or the client id of a saved or refused chat
+		if result, ok := p.(*string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoveryCodes:
+		// P is the new recovery codes
+		if result, ok := p.(*[]string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccountResult:
+		// P is the result message
+		if result, ok := p.(*string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case ExportDataResult:
+		// P is AccountExport type
+		if result, ok := p.(*AccountExport); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case KeyLookupResult:
+		// P is PublicKey type
+		if result, ok := p.(*PublicKey); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -273,6 +425,71 @@ func (m *ClientResponse) DecodePayload(target interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePasswordResult, RecoverAccountResult, MessageAck, FailedMessageSend:
+		// P is the result message, or the client id of a saved or refused chat
+		if _, ok := target.(*string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoveryCodes:
+		// P is the new recovery codes
+		if _, ok := target.(*[]string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccountResult:
+		// P is the result message
+		if _, ok := target.(*string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case ExportDataResult:
+		// P is AccountExport type
+		if _, ok := target.(*AccountExport); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case KeyLookupResult:
+		// P is PublicKey type
+		if _, ok := target.(*PublicKey); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -349,6 +566,66 @@ func (m *ClientMessage) EncodePayload(p interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePassword:
+		// P is PasswordChange type
+		if result, ok := p.(*PasswordChange); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoverAccount:
+		// P is AccountRecovery type
+		if result, ok := p.(*AccountRecovery); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccount:
+		// P is AccountDeletion type
+		if result, ok := p.(*AccountDeletion); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case PublishKey, KeyLookup:
+		// P is the public key, or the username to look up
+		if result, ok := p.(*string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -423,6 +700,58 @@ func (m *ClientMessage) DecodePayload(target interface{}) error {
 				return err
 			}
 
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case ChangePassword:
+		// P is PasswordChange type
+		if _, ok := target.(*PasswordChange); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoverAccount:
+		// P is AccountRecovery type
+		if _, ok := target.(*AccountRecovery); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccount:
+		// P is AccountDeletion type
+		if _, ok := target.(*AccountDeletion); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case PublishKey, KeyLookup:
+		// P is the public key, or the username to look up
+		if _, ok := target.(*string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
@@ -440,4 +769,31 @@ type Chat struct {
 	Text     string `json:"text"`
 	Sender   string `json:"sender"`
 	Receiver string `json:"receiver"`
+	// Picked by the sending client. Resending with the same id never saves the chat twice
+	ClientId string `json:"client_id,omitempty"`
+}
+
+// Change password request, checked against the current password
+type PasswordChange struct {
+	Current string `json:"current"`
+	New     string `json:"new"`
+}
+
+// Rebind an account to this device with one of its recovery codes
+type AccountRecovery struct {
+	Username    string `json:"username"`
+	Code        string `json:"code"`
+	NewPassword string `json:"new_password"`
+}
+
+// Delete this account. Confirm must repeat the username
+type AccountDeletion struct {
+	Password string `json:"password"`
+	Confirm  string `json:"confirm"`
+}
+
+// X25519 public key a user's device published, base64. Key is empty if they have none
+type PublicKey struct {
+	Username string `json:"username"`
+	Key      string `json:"key"`
 }
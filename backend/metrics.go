@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Prometheus text format metrics, served on GET /metrics.
+
+	No client library: counters and histograms keep one series per label
+	value behind their own mutex, and gauges are read from the server when
+	scraped. Everything is written in the order it was registered here.
+
+		messaging_connections_total            websocket connections accepted
+		messaging_connections_active           open websocket connections
+		messaging_users_logged_in              users logged in on the registry
+		messaging_auth_attempts_total          login attempts by result
+		messaging_messages_received_total      client messages by code
+		messaging_messages_sent_total          server messages by code
+		messaging_send_errors_total            failed writes to a client
+		messaging_broadcast_queue_depth        backend messages waiting for AppListener
+		messaging_broadcasts_total             backend messages handled by code
+		messaging_db_query_duration_seconds    store calls by operation
+		messaging_db_errors_total              failed store calls by operation
+		go_goroutines
+*/
+
+var (
+	connectionsTotal = newCounterVec(
+		"messaging_connections_total",
+		"Websocket connections accepted.",
+		"",
+	)
+	authAttempts = newCounterVec(
+		"messaging_auth_attempts_total",
+		"Login attempts by result: success, incorrect, locked or disabled.",
+		"result",
+	)
+	messagesReceived = newCounterVec(
+		"messaging_messages_received_total",
+		"Messages received from clients by code.",
+		"code",
+	)
+	messagesSent = newCounterVec(
+		"messaging_messages_sent_total",
+		"Messages written to clients by code.",
+		"code",
+	)
+	sendErrors = newCounterVec(
+		"messaging_send_errors_total",
+		"Messages that failed to write to a client, by code.",
+		"code",
+	)
+	broadcastsHandled = newCounterVec(
+		"messaging_broadcasts_total",
+		"Backend messages handled by AppListener, by code.",
+		"code",
+	)
+	dbQueryDuration = newHistogramVec(
+		"messaging_db_query_duration_seconds",
+		"Time spent in store calls, by operation.",
+		"op",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	)
+	dbErrors = newCounterVec(
+		"messaging_db_errors_total",
+		"Store calls that returned an error, by operation.",
+		"op",
+	)
+	incomingPosts = newCounterVec(
+		"messaging_incoming_webhook_posts_total",
+		"Posts to incoming webhooks, by result.",
+		"result",
+	)
+	webhookDeliveries = newCounterVec(
+		"messaging_webhook_deliveries_total",
+		"Webhook delivery attempts, by result: delivered, retried or dead_lettered.",
+		"result",
+	)
+)
+
+// Deferred at the top of store methods with a pointer to the error they return
+func observeQuery(op string, start time.Time, err *error) {
+	dbQueryDuration.Observe(op, time.Since(start).Seconds())
+	if *err != nil {
+		dbErrors.Inc(op)
+	}
+}
+
+// Count a message written to a client
+func observeSend(code MessageCode, err error) {
+	if err != nil {
+		sendErrors.Inc(code.String())
+		return
+	}
+	messagesSent.Inc(code.String())
+}
+
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// An empty label gives a counter with a single unlabelled series
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]float64),
+	}
+}
+
+func (c *counterVec) Inc(value string) {
+	c.mu.Lock()
+	c.values[value]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+
+	for _, value := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, labelPair(c.label, value), formatFloat(c.values[value]))
+	}
+}
+
+type histogram struct {
+	// Per bucket, not cumulative. Summed when written
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) Observe(value string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[value]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = s
+	}
+
+	// Falls past the last bucket into +Inf, which is just the total count
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	for _, value := range sortedKeys(h.series) {
+		s := h.series[value]
+		label := labelPair(h.label, value)
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", h.name, label, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, label, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name string, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+
+	s.mu.Lock()
+	active := len(s.clients)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	connectionsTotal.write(w)
+	writeGauge(w, "messaging_connections_active", "Open websocket connections.", float64(active))
+	writeGauge(w, "messaging_users_logged_in", "Users logged in on the registry.", float64(registry.LoggedInCount()))
+	authAttempts.write(w)
+	messagesReceived.write(w)
+	messagesSent.write(w)
+	sendErrors.write(w)
+	writeGauge(w, "messaging_broadcast_queue_depth", "Backend messages waiting for AppListener.", float64(len(s.broadcast)))
+	broadcastsHandled.write(w)
+	dbQueryDuration.write(w)
+	dbErrors.write(w)
+	incomingPosts.write(w)
+	webhookDeliveries.write(w)
+	writeGauge(w, "go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPair(name string, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
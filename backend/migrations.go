@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Versioned schema migrations.
+
+	Each file in migrations/ is named NNNN_description.sql and holds the
+	up-migration for that version. Applied versions are recorded in the
+	schema_migrations table, and pending ones run in version order, each in
+	its own transaction.
+*/
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	up      string
+}
+
+var createMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL,
+	appliedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+// Read embedded migrations, sorted by version
+func loadMigrations() ([]migration, error) {
+
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []migration{}
+	seen := make(map[int]string)
+
+	for _, e := range entries {
+		fileName := e.Name()
+		if e.IsDir() || !strings.HasSuffix(fileName, ".sql") {
+			continue
+		}
+
+		versionStr, name, ok := strings.Cut(strings.TrimSuffix(fileName, ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q must be named NNNN_description.sql", fileName)
+		}
+
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %q has an invalid version", fileName)
+		}
+
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %q and %q share version %d", other, fileName, version)
+		}
+		seen[version] = fileName
+
+		up, err := migrationFiles.ReadFile(path.Join("migrations", fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{
+			version: version,
+			name:    name,
+			up:      string(up),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+// Migrations not yet recorded in schema_migrations. Does not write to the database
+func pendingMigrations(db *sql.DB) ([]migration, error) {
+
+	applied := make(map[int]bool)
+
+	var tableCount int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations';`,
+	).Scan(&tableCount)
+	if err != nil {
+		return nil, err
+	}
+
+	if tableCount > 0 {
+		rows, err := db.Query(`SELECT version FROM schema_migrations;`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				return nil, err
+			}
+			applied[version] = true
+		}
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	all, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []migration{}
+	for _, m := range all {
+		if !applied[m.version] {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// Run a single migration and record it in the same transaction
+func applyMigration(db *sql.DB, m migration) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(m.up)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schema_migrations (version, name) VALUES (?, ?);`,
+		m.version,
+		m.name,
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+	}
+
+	return tx.Commit()
+}
+
+// Copy the database to a timestamped file next to it
+func backupDB(db *sql.DB, dbPath string) (string, error) {
+	backupPath := fmt.Sprintf("%s.bak-%s", dbPath, time.Now().UTC().Format("20060102T150405"))
+
+	_, err := db.Exec(`VACUUM INTO ?;`, backupPath)
+	if err != nil {
+		return "", err
+	}
+
+	return backupPath, nil
+}
+
+// Apply pending migrations at startup. Databases holding data are backed up first
+func autoMigrate(db *sql.DB, dbPath string) error {
+
+	// Check before the first query creates the file
+	info, statErr := os.Stat(dbPath)
+	hasData := statErr == nil && info.Size() > 0
+
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if hasData {
+		backupPath, err := backupDB(db, dbPath)
+		if err != nil {
+			return fmt.Errorf("backing up database before migrating: %w", err)
+		}
+		slog.Info("Backed up database", "path", backupPath)
+	}
+
+	_, err = db.Exec(createMigrationsTable)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		if err := applyMigration(db, m); err != nil {
+			return err
+		}
+		slog.Info("Applied migration", "version", m.version, "name", m.name)
+	}
+
+	return nil
+}
+
+// migrate subcommand
+func runMigrate(args []string) error {
+
+	// The server's database, as admin commands find it
+	cmd := newAdminCommand("migrate")
+	dryRun := cmd.Bool("dry-run", false, "list pending migrations without applying them")
+	cmd.Parse(args)
+
+	cfg, err := cmd.config()
+	if err != nil {
+		return err
+	}
+
+	conn, err := openDB(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if *dryRun {
+		pending, err := pendingMigrations(conn.db)
+		if err != nil {
+			return err
+		}
+
+		if len(pending) == 0 {
+			fmt.Println("Database is up to date")
+			return nil
+		}
+
+		for _, m := range pending {
+			fmt.Printf("-- Pending %04d_%s\n%s\n", m.version, m.name, strings.TrimSpace(m.up))
+		}
+		return nil
+	}
+
+	return autoMigrate(conn.db, cfg.DBPath)
+}
@@ -0,0 +1,37 @@
+-- Tables created by loadDB before versioned migrations existed.
+-- IF NOT EXISTS keeps this safe to run against those databases.
+
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT NOT NULL PRIMARY KEY,
+	welcomeSent INTEGER NOT NULL DEFAULT 0,
+	accountMade INTEGER NOT NULL DEFAULT 0,
+	username TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS friend_requests (
+	id TEXT NOT NULL PRIMARY KEY,
+	reqId TEXT NOT NULL,
+	resId TEXT NOT NULL,
+	FOREIGN KEY(reqId) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(resId) REFERENCES users(id) ON DELETE CASCADE,
+	UNIQUE(reqId, resId)
+);
+
+CREATE TABLE IF NOT EXISTS friends (
+	id TEXT NOT NULL PRIMARY KEY,
+	user1 TEXT NOT NULL,
+	user2 TEXT NOT NULL,
+	FOREIGN KEY(user1) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY(user2) REFERENCES users(id) ON DELETE CASCADE,
+	UNIQUE(user1, user2)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	id TEXT NOT NULL PRIMARY KEY,
+	friendId TEXT NOT NULL,
+	senderId TEXT NOT NULL,
+	message TEXT,
+	date DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(friendId) REFERENCES friends(id)
+);
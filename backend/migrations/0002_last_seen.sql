@@ -0,0 +1,3 @@
+-- When each user last left the server, set as their connection closes.
+
+ALTER TABLE users ADD COLUMN lastSeen DATETIME;
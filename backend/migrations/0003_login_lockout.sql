@@ -0,0 +1,4 @@
+-- Consecutive failed logins per account, and when the next attempt is allowed.
+
+ALTER TABLE users ADD COLUMN failedLogins INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN lockedUntil DATETIME;
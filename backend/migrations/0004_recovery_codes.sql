@@ -0,0 +1,9 @@
+-- One-time account recovery codes, stored as SHA-256 hashes.
+
+CREATE TABLE recovery_codes (
+	userId TEXT NOT NULL,
+	codeHash TEXT NOT NULL,
+	usedAt DATETIME,
+	PRIMARY KEY(userId, codeHash),
+	FOREIGN KEY(userId) REFERENCES users(id) ON DELETE CASCADE
+);
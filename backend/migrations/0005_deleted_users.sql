@@ -0,0 +1,3 @@
+-- Set on accounts anonymized on deletion. They stay so friends keep their history.
+
+ALTER TABLE users ADD COLUMN deletedAt DATETIME;
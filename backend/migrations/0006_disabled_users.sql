@@ -0,0 +1,4 @@
+-- Accounts disabled by an admin. They can't log in until enabled again.
+
+ALTER TABLE users ADD COLUMN disabledAt DATETIME;
+ALTER TABLE users ADD COLUMN disabledReason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,27 @@
+-- Append-only record of logins, credential changes, friendships, account
+-- deletion and admin actions. Users are named by username, not id, so rows
+-- outlive deleted accounts. Triggers refuse any update or delete.
+
+CREATE TABLE audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	event TEXT NOT NULL,
+	actor TEXT NOT NULL DEFAULT '',
+	target TEXT NOT NULL DEFAULT '',
+	source TEXT NOT NULL DEFAULT '',
+	detail TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX audit_log_at ON audit_log(at);
+CREATE INDEX audit_log_actor ON audit_log(actor, at);
+CREATE INDEX audit_log_target ON audit_log(target, at);
+
+CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+BEGIN
+	SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
@@ -0,0 +1,4 @@
+-- X25519 public keys clients encrypt direct messages with, base64.
+-- One per account, replaced whenever the user's device publishes a new one.
+
+ALTER TABLE users ADD COLUMN publicKey TEXT NOT NULL DEFAULT '';
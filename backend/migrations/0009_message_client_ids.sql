@@ -0,0 +1,7 @@
+-- Id the sending client gave a message, so a resend after a dropped
+-- connection is recognised instead of saved twice. Unique per sender.
+-- Messages from older clients have none.
+
+ALTER TABLE messages ADD COLUMN clientId TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS messages_sender_client ON messages (senderId, clientId);
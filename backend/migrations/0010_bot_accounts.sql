@@ -0,0 +1,7 @@
+-- Bot accounts, created by an admin. They log in with a long-lived token
+-- instead of a password, and only its SHA-256 hash is kept.
+
+ALTER TABLE users ADD COLUMN kind TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN botTokenHash TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_bot_token ON users (botTokenHash);
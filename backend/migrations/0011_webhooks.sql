@@ -0,0 +1,28 @@
+-- Outgoing webhooks, added by an admin. userId is NULL for subscriptions to
+-- every user's events, and events is a comma separated list of event names.
+-- The secret signs each delivery and is sealed when encryption at rest is on.
+
+CREATE TABLE webhooks (
+	id TEXT NOT NULL PRIMARY KEY,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	userId TEXT REFERENCES users(id) ON DELETE CASCADE,
+	events TEXT NOT NULL,
+	createdAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Deliveries that failed every attempt, kept for "admin redeliver-webhook".
+-- Rows outlive the webhook so failures stay visible after it is removed.
+
+CREATE TABLE webhook_dead_letters (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhookId TEXT NOT NULL,
+	deliveryId TEXT NOT NULL,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	lastError TEXT NOT NULL DEFAULT '',
+	failedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX webhook_dead_letters_webhook ON webhook_dead_letters(webhookId);
@@ -0,0 +1,11 @@
+-- Incoming webhooks, added by an admin. Each posts into one conversation,
+-- as a bot (senderId) to one of its friends (receiverId). Only the SHA-256
+-- hash of the token in the webhook's URL is kept.
+
+CREATE TABLE incoming_webhooks (
+	id TEXT NOT NULL PRIMARY KEY,
+	tokenHash TEXT NOT NULL UNIQUE,
+	senderId TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	receiverId TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	createdAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
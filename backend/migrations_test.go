@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func appliedVersions(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT version FROM schema_migrations ORDER BY version;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	versions := []int{}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func backups(t *testing.T, dbPath string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(dbPath + ".bak-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func openTestDBFile(t *testing.T, path string) *DBConn {
+	t.Helper()
+
+	conn, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestLoadMigrations(t *testing.T) {
+	all, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+
+	for i, m := range all {
+		if m.version != i+1 {
+			t.Fatalf("migration %d is version %d, want %d", i, m.version, i+1)
+		}
+		if m.name == "" || m.up == "" {
+			t.Fatalf("migration %04d is missing its name or body", m.version)
+		}
+	}
+}
+
+func TestAutoMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	conn := openTestDBFile(t, path)
+
+	all, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := autoMigrate(conn.db, path); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := appliedVersions(t, conn.db)
+	if len(versions) != len(all) || versions[len(versions)-1] != all[len(all)-1].version {
+		t.Fatalf("applied %v, want all %d migrations", versions, len(all))
+	}
+
+	// A new database has nothing worth backing up
+	if b := backups(t, path); len(b) != 0 {
+		t.Fatalf("backed up a new database: %v", b)
+	}
+
+	// Running again finds nothing to do
+	if err := autoMigrate(conn.db, path); err != nil {
+		t.Fatal(err)
+	}
+	if again := appliedVersions(t, conn.db); len(again) != len(versions) {
+		t.Fatalf("applied %v on the second run, had %v", again, versions)
+	}
+	if b := backups(t, path); len(b) != 0 {
+		t.Fatalf("backed up with nothing to migrate: %v", b)
+	}
+}
+
+// Databases holding data are copied before any migration runs
+func TestAutoMigrateBacksUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	conn := openTestDBFile(t, path)
+
+	all, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As a server from before the later migrations left it
+	if _, err := conn.db.Exec(createMigrationsTable); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyMigration(conn.db, all[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := autoMigrate(conn.db, path); err != nil {
+		t.Fatal(err)
+	}
+
+	b := backups(t, path)
+	if len(b) != 1 {
+		t.Fatalf("got backups %v, want one", b)
+	}
+
+	backup := openTestDBFile(t, b[0])
+	if versions := appliedVersions(t, backup.db); len(versions) != 1 || versions[0] != all[0].version {
+		t.Fatalf("backup has versions %v, want only %d", versions, all[0].version)
+	}
+	if versions := appliedVersions(t, conn.db); len(versions) != len(all) {
+		t.Fatalf("database has versions %v, want all %d", versions, len(all))
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	if err := runMigrate([]string{"-db", path, "-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := openTestDBFile(t, path)
+	pending, err := pendingMigrations(conn.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(all) {
+		t.Fatalf("%d pending after a dry run, want all %d", len(pending), len(all))
+	}
+
+	// Found the way the server finds it
+	t.Setenv("MESSAGING_DB_PATH", path)
+	if err := runMigrate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err = pendingMigrations(conn.db); err != nil || len(pending) != 0 {
+		t.Fatalf("%d pending after migrating, error %v", len(pending), err)
+	}
+}
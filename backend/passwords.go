@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	Password hashing.
+
+	Passwords are kept as PBKDF2-SHA256 hashes, never the password itself,
+	in the store and in the registry alike. A hash is written as
+
+		$pbkdf2-sha256$ITERATIONS$SALT$HASH
+
+	with the salt and hash in unpadded base64, so the iteration count can
+	go up later without breaking stored hashes. With encryption at rest on
+	the hash is sealed as well.
+
+	Databases from before hashing hold the passwords themselves. They are
+	hashed once on startup, by hashStoredPasswords.
+*/
+
+const passwordPrefix = "$pbkdf2-sha256$"
+
+const (
+	passwordSaltSize = 16
+	passwordHashSize = 32
+)
+
+// OWASP's recommendation for PBKDF2-SHA256
+var passwordIterations = 600_000
+
+var passwordEncoding = base64.RawStdEncoding
+
+func hashPassword(password string) (string, error) {
+
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordHashSize)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%d$%s$%s",
+		passwordPrefix,
+		passwordIterations,
+		passwordEncoding.EncodeToString(salt),
+		passwordEncoding.EncodeToString(hash),
+	), nil
+}
+
+// Whether password matches the stored hash. Empty or malformed hashes, as
+// bots and deleted accounts have, match nothing
+func checkPassword(stored string, password string) bool {
+
+	rest, ok := strings.CutPrefix(stored, passwordPrefix)
+	if !ok {
+		return false
+	}
+
+	parts := strings.Split(rest, "$")
+	if len(parts) != 3 {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations < 1 {
+		return false
+	}
+
+	salt, err := passwordEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	want, err := passwordEncoding.DecodeString(parts[2])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// Hash any passwords still stored as themselves, in one transaction.
+// Returns how many were hashed
+func hashStoredPasswords(db *sql.DB, keys *DBKeys) (int, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, password FROM users WHERE password IS NOT NULL AND password != '';`)
+	if err != nil {
+		return 0, err
+	}
+
+	updates := map[string]string{}
+	for rows.Next() {
+		var id string
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		password, err := keys.open(sealedPassword, value)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// Bots and deleted accounts have none, sealed or not
+		if password == "" || strings.HasPrefix(password, passwordPrefix) {
+			continue
+		}
+
+		hash, err := hashPassword(password)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		updates[id], err = keys.seal(sealedPassword, hash)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, value := range updates {
+		if _, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?;`, value, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(updates), nil
+}
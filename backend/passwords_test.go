@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Tests log in many times over, often under -race. Stored hashes carry
+	// their count, so checking is the same at any
+	passwordIterations = 1000
+	os.Exit(m.Run())
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, passwordPrefix) {
+		t.Fatalf("hash %q has no prefix", hash)
+	}
+
+	other, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hash {
+		t.Fatal("same password hashed twice gave the same hash")
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{"match", hash, "correct horse", true},
+		{"wrong", hash, "battery staple", false},
+		{"empty password", hash, "", false},
+		{"no hash", "", "", false},
+		{"password stored as itself", "correct horse", "correct horse", false},
+		{"malformed", passwordPrefix + "1000$abc", "correct horse", false},
+		{"zero iterations", passwordPrefix + "0$c2FsdA$aGFzaA", "correct horse", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPassword(tt.stored, tt.password); got != tt.want {
+				t.Fatalf("checkPassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashStoredPasswords(t *testing.T) {
+	conn := newTestDB(t)
+
+	var err error
+	conn.keys, err = parseDBKeys("k1:" + base64.StdEncoding.EncodeToString(randomKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As written before hashing, sealed at rest
+	createTestUser(t, conn, "alice-key", "alice")
+	if err := conn.CreateBot("bot-key", "bot", "token-hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	hashed, err := hashStoredPasswords(conn.db, conn.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashed != 1 {
+		t.Fatalf("hashed %d passwords, want 1", hashed)
+	}
+
+	details, err := conn.GetLoginDetails("alice-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(details.Password, "password") {
+		t.Fatalf("stored %q doesn't match the old password", details.Password)
+	}
+
+	// Already hashed ones are left alone
+	hashed, err = hashStoredPasswords(conn.db, conn.keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashed != 0 {
+		t.Fatalf("hashed %d passwords again, want 0", hashed)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	Login throttling.
+
+	Each failed login pushes back the next allowed attempt, doubling from
+	loginBaseDelay. Accounts are tracked in the store, so counts survive a
+	restart and `admin unlock` can clear them, and are locked for
+	config.LoginLockout after config.LoginMaxFailures failures in a row.
+
+	Remote addresses are tracked in memory and only ever delayed, up to
+	maxAddressDelay, so users sharing an address can't be locked out by
+	someone else guessing passwords.
+*/
+
+const (
+	loginBaseDelay  = time.Second
+	maxAddressDelay = time.Minute
+	// Forget an address once it has been quiet this long
+	addressIdle = time.Hour
+)
+
+// Delay after n failures in a row, before any cap
+func backoff(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	// Cap the shift so the duration can't overflow
+	return loginBaseDelay << min(n-1, 16)
+}
+
+// Delay before an account may try again after n failures in a row
+func accountBackoff(n int) time.Duration {
+	if n >= config.LoginMaxFailures {
+		return config.LoginLockout
+	}
+	return min(backoff(n), config.LoginLockout)
+}
+
+type addressAttempts struct {
+	failures int
+	retryAt  time.Time
+}
+
+type LoginLimiter struct {
+	byAddr map[string]*addressAttempts
+	mu     sync.Mutex
+}
+
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{
+		byAddr: make(map[string]*addressAttempts),
+		mu:     sync.Mutex{},
+	}
+}
+
+var loginLimiter = NewLoginLimiter()
+
+// When addr may next attempt a login. Zero if it may now
+func (l *LoginLimiter) RetryAt(addr string) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.byAddr[addr]
+	if !ok {
+		return time.Time{}
+	}
+	return a.retryAt
+}
+
+func (l *LoginLimiter) Failed(addr string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	a, ok := l.byAddr[addr]
+	if !ok {
+		a = &addressAttempts{}
+		l.byAddr[addr] = a
+	}
+
+	a.failures++
+	a.retryAt = now.Add(min(backoff(a.failures), maxAddressDelay))
+}
+
+func (l *LoginLimiter) Succeeded(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.byAddr, addr)
+}
+
+// Callers must hold l.mu
+func (l *LoginLimiter) prune(now time.Time) {
+	for addr, a := range l.byAddr {
+		if now.Sub(a.retryAt) > addressIdle {
+			delete(l.byAddr, addr)
+		}
+	}
+}
+
+// Host part of a request's remote address
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// AccountLocked response if k or addr must wait before trying again, nil if the attempt may go ahead
+func checkLoginAllowed(k apiKey, addr string) (*AuthResponse, *RequestError) {
+
+	now := time.Now()
+
+	failures, retryAt, err := dbConn.GetLoginFailures(k)
+	if err != nil {
+		return nil, &RequestError{
+			Message: "Error reading account",
+			Code:    DatabaseError,
+		}
+	}
+
+	if addrRetry := loginLimiter.RetryAt(addr); addrRetry.After(retryAt) {
+		retryAt = addrRetry
+	}
+
+	if !now.Before(retryAt) {
+		return nil, nil
+	}
+
+	wait := max(retryAt.Sub(now).Round(time.Second), time.Second)
+
+	message := fmt.Sprintf("Too many failed logins. Try again in %s", wait)
+	if failures >= config.LoginMaxFailures {
+		message = fmt.Sprintf("Account locked after %d failed logins. Try again in %s or ask an admin to unlock it", failures, wait)
+	}
+
+	return &AuthResponse{
+		Message: message,
+		Code:    AccountLocked,
+	}, nil
+}
+
+func recordLoginFailure(k apiKey, addr string) error {
+
+	now := time.Now()
+	loginLimiter.Failed(addr, now)
+
+	failures, _, err := dbConn.GetLoginFailures(k)
+	if err != nil {
+		return err
+	}
+
+	failures++
+	return dbConn.SetLoginFailures(k, failures, now.Add(accountBackoff(failures)))
+}
+
+func recordLoginSuccess(k apiKey, addr string) error {
+
+	loginLimiter.Succeeded(addr)
+
+	failures, _, err := dbConn.GetLoginFailures(k)
+	if err != nil || failures == 0 {
+		return err
+	}
+
+	return dbConn.SetLoginFailures(k, 0, time.Time{})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestAccountBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{config.LoginMaxFailures, config.LoginLockout},
+		{100, config.LoginLockout},
+	}
+
+	for _, tt := range tests {
+		if got := accountBackoff(tt.failures); got != tt.want {
+			t.Errorf("accountBackoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	l := NewLoginLimiter()
+	now := time.Now()
+
+	if !l.RetryAt("1.2.3.4").IsZero() {
+		t.Fatal("unknown address delayed")
+	}
+
+	l.Failed("1.2.3.4", now)
+	l.Failed("1.2.3.4", now)
+	if got := l.RetryAt("1.2.3.4"); !got.Equal(now.Add(2 * time.Second)) {
+		t.Fatalf("after two failures retry at %v, want %v", got.Sub(now), 2*time.Second)
+	}
+
+	// Addresses are only ever delayed, never locked
+	for range 20 {
+		l.Failed("1.2.3.4", now)
+	}
+	if got := l.RetryAt("1.2.3.4"); !got.Equal(now.Add(maxAddressDelay)) {
+		t.Fatalf("after many failures retry at %v, want %v", got.Sub(now), maxAddressDelay)
+	}
+
+	if !l.RetryAt("5.6.7.8").IsZero() {
+		t.Fatal("other address delayed")
+	}
+
+	l.Succeeded("1.2.3.4")
+	if !l.RetryAt("1.2.3.4").IsZero() {
+		t.Fatal("address still delayed after a successful login")
+	}
+}
+
+// Answer to a login attempt, whichever it is
+func attemptLogin(t *testing.T, c *testClient, username string, password string) ClientResponse {
+	t.Helper()
+
+	c.send(AttemptLogin, LoginDetails{Username: username, Password: password})
+
+	for range 20 {
+		var r ClientResponse
+		c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(c.ws, &r); err != nil {
+			t.Fatalf("waiting for a login result: %v", err)
+		}
+		switch r.Code {
+		case LoginSuccessful, IncorrectLogin, AccountLocked:
+			return r
+		}
+	}
+	t.Fatal("no login result")
+	return ClientResponse{}
+}
+
+// Connection to an existing account, waiting to be sent login details
+func dialLoggedOut(t *testing.T, srv *httptest.Server, c *testClient, k apiKey) *testClient {
+	t.Helper()
+
+	c.ws.Close()
+	eventually(t, "the old session to close", func() bool {
+		return !checkUserLoggedIn(k)
+	})
+
+	again := dialTest(t, srv, k)
+	again.expect(LoginDetailsRequired)
+	return again
+}
+
+func TestLoginThrottling(t *testing.T) {
+	srv := newTestServer(t)
+
+	alice := dialLoggedOut(t, srv, loginTest(t, srv, "alice-key", "alice"), "alice-key")
+	bob := dialLoggedOut(t, srv, loginTest(t, srv, "bob-key", "bob"), "bob-key")
+
+	// The first failure delays the next try, on the account and the address
+	if r := attemptLogin(t, alice, "alice", "wrong"); r.Code != IncorrectLogin {
+		t.Fatalf("wrong password answered with %s", r.Code)
+	}
+	if r := attemptLogin(t, alice, "alice", "password"); r.Code != AccountLocked || !strings.Contains(r.Message, "Too many failed logins") {
+		t.Fatalf("retry straight away answered with %s %q", r.Code, r.Message)
+	}
+	if r := attemptLogin(t, bob, "bob", "password"); r.Code != AccountLocked {
+		t.Fatalf("another account from the same address answered with %s", r.Code)
+	}
+
+	// As if the delays had passed, one failure short of the limit
+	loginLimiter.Succeeded("127.0.0.1")
+	if err := dbConn.SetLoginFailures("alice-key", config.LoginMaxFailures-1, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := attemptLogin(t, alice, "alice", "wrong"); r.Code != IncorrectLogin {
+		t.Fatalf("wrong password answered with %s", r.Code)
+	}
+	failures, retryAt, err := dbConn.GetLoginFailures("alice-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != config.LoginMaxFailures || time.Until(retryAt) < config.LoginLockout-time.Minute {
+		t.Fatalf("after %d failures retry in %v, want a lockout of %v", failures, time.Until(retryAt), config.LoginLockout)
+	}
+
+	// Locked, even with the right password
+	loginLimiter.Succeeded("127.0.0.1")
+	if r := attemptLogin(t, alice, "alice", "password"); r.Code != AccountLocked || !strings.Contains(r.Message, "Account locked") {
+		t.Fatalf("locked account answered with %s %q", r.Code, r.Message)
+	}
+
+	// A successful login clears the count
+	if err := dbConn.SetLoginFailures("alice-key", 2, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if r := attemptLogin(t, alice, "alice", "password"); r.Code != LoginSuccessful {
+		t.Fatalf("right password after the delay answered with %s %q", r.Code, r.Message)
+	}
+	if failures, _, err := dbConn.GetLoginFailures("alice-key"); err != nil || failures != 0 {
+		t.Fatalf("%d failures after logging in, error %v", failures, err)
+	}
+	if !loginLimiter.RetryAt("127.0.0.1").IsZero() {
+		t.Fatal("address still delayed after logging in")
+	}
+}
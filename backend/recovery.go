@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+)
+
+/*
+	Password changes and account recovery.
+
+	Each account gets recoveryCodeCount one-time codes at signup. They are
+	shown to the user once and only their SHA-256 hashes are stored. A new
+	device connects with a fresh API key, so it starts out as a placeholder
+	user; with a recovery code and a new password it takes the account over
+	and the old key stops working.
+
+	Wrong current passwords and wrong recovery codes count as failed logins
+	for the throttling in ratelimit.go.
+*/
+
+const recoveryCodeCount = 10
+
+// Strip the separators users may or may not type
+func normaliseRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normaliseRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Codes are 12 base32 characters (60 bits), written XXXX-XXXX-XXXX
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for range recoveryCodeCount {
+		raw := rand.Text()[:12]
+		codes = append(codes, raw[:4]+"-"+raw[4:8]+"-"+raw[8:])
+		hashes = append(hashes, hashRecoveryCode(raw))
+	}
+
+	return codes, hashes
+}
+
+// Replace the user's recovery codes and send the new ones. They are not kept anywhere else
+func (s *Server) sendRecoveryCodes(k apiKey) *RequestError {
+
+	codes, hashes := newRecoveryCodes()
+
+	err := dbConn.SetRecoveryCodes(k, hashes)
+	if err != nil {
+		s.logger(k).Error("Error saving recovery codes", "err", err)
+		return &RequestError{
+			Message: "Failed to save recovery codes",
+			Code:    DatabaseError,
+		}
+	}
+
+	audit(AuditRecoveryCodes, registry.Username(k), "", s.auditSource(k), "")
+
+	clientResponse := ClientResponse{
+		Code:    RecoveryCodes,
+		Err:     nil,
+		Message: "Recovery codes. Each works once, and they won't be shown again",
+		Payload: nil,
+	}
+	clientResponse.EncodePayload(&codes)
+
+	return s.sendTo(k, &clientResponse)
+}
+
+// Result message for a change password request
+func changePassword(k apiKey, change *PasswordChange, addr string) string {
+
+	c, ok := registry.Get(k)
+	if !ok {
+		return "Unknown user"
+	}
+
+	lockedResp, reqErr := checkLoginAllowed(k, addr)
+	if reqErr != nil {
+		return reqErr.Message
+	}
+	if lockedResp != nil {
+		return lockedResp.Message
+	}
+
+	if !passwordMatches(k, change.Current) {
+		if err := recordLoginFailure(k, addr); err != nil {
+			slog.Error("Error recording failed login", "key", keyFingerprint(k), "err", err)
+		}
+		audit(AuditLoginFailed, c.Username(), "", addr, "incorrect password on password change")
+		return "Current password incorrect"
+	}
+
+	if change.New == "" {
+		return "New password must not be empty"
+	}
+
+	if reqErr := c.ChangePassword(change.New); reqErr != nil {
+		return reqErr.Message
+	}
+
+	slog.Info("Password changed", "key", keyFingerprint(k))
+	audit(AuditPasswordChanged, c.Username(), "", addr, "")
+	return "Password changed"
+}
+
+// Result message for a recovery attempt from the device with key k
+func (s *Server) recoverAccount(k apiKey, r *AccountRecovery, addr string) string {
+
+	current, ok := registry.Get(k)
+	if !ok {
+		return "Unknown user"
+	}
+
+	if current.Username() != "" {
+		return "This device already has an account"
+	}
+
+	if r.Username == "" || r.Code == "" || r.NewPassword == "" {
+		return "Username, recovery code and new password are all required"
+	}
+
+	const incorrect = "Username or recovery code incorrect"
+
+	target, ok := registry.GetByUsername(r.Username)
+	if !ok {
+		return incorrect
+	}
+
+	ids, err := dbConn.GetUserAPI(r.Username)
+	if err != nil || len(*ids) == 0 {
+		return incorrect
+	}
+	oldKey := apiKey((*ids)[0])
+
+	lockedResp, reqErr := checkLoginAllowed(oldKey, addr)
+	if reqErr != nil {
+		return reqErr.Message
+	}
+	if lockedResp != nil {
+		return lockedResp.Message
+	}
+
+	hash, err := hashPassword(r.NewPassword)
+	if err != nil {
+		s.logger(k).Error("Error hashing password", "err", err)
+		return "Failed to recover account"
+	}
+
+	recovered, err := dbConn.RecoverAccount(oldKey, k, hashRecoveryCode(r.Code), hash)
+	if err != nil {
+		s.logger(k).Error("Error recovering account", "err", err)
+		return "Failed to recover account"
+	}
+
+	if !recovered {
+		if err := recordLoginFailure(oldKey, addr); err != nil {
+			s.logger(k).Error("Error recording failed login", "err", err)
+		}
+		audit(AuditLoginFailed, r.Username, "", addr, "incorrect recovery code")
+		return incorrect
+	}
+
+	loginLimiter.Succeeded(addr)
+
+	// Log the old device out and drop it. Its key no longer exists
+	registry.Leave(oldKey)
+	if old, ok := s.getConnection(oldKey); ok {
+		old.SendOnConnection(&ClientResponse{
+			Err:     nil,
+			Message: "Account recovered on another device",
+			Code:    ConnectionError,
+		})
+		old.conn.Close()
+	}
+
+	registry.Rebind(oldKey, k)
+	target.setPassword(hash)
+	s.logger(k).Info("Account recovered", "user", target.Username(), "old_key", keyFingerprint(oldKey))
+	audit(AuditAccountRecovered, target.Username(), "", addr, "")
+
+	return "Account recovered. Log in with your new password"
+}
+
+// Answer a recovery attempt made instead of logging in, then ask for login details again
+func (s *Server) handleRecovery(k apiKey, m *ClientMessage, addr string) *RequestError {
+
+	var recovery AccountRecovery
+	if err := m.DecodePayload(&recovery); err != nil {
+		s.logger(k).Warn("Invalid recovery payload", "err", err)
+	}
+
+	result := s.recoverAccount(k, &recovery, addr)
+
+	clientResponse := ClientResponse{
+		Code:    RecoverAccountResult,
+		Err:     nil,
+		Message: "",
+		Payload: nil,
+	}
+	clientResponse.EncodePayload(&result)
+
+	if reqErr := s.sendTo(k, &clientResponse); reqErr != nil {
+		return reqErr
+	}
+
+	return s.sendTo(k, &AuthResponse{
+		Code:    LoginDetailsRequired,
+		Message: "Login details required",
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}$`)
+	seen := map[string]bool{}
+
+	for i, code := range codes {
+		if !format.MatchString(code) {
+			t.Fatalf("code %q isn't XXXX-XXXX-XXXX", code)
+		}
+		if hashes[i] != hashRecoveryCode(code) || hashes[i] == code {
+			t.Fatalf("code %q has hash %q", code, hashes[i])
+		}
+		if seen[code] {
+			t.Fatalf("code %q given twice", code)
+		}
+		seen[code] = true
+	}
+
+	// However the user types it
+	for _, typed := range []string{"abcd-efgh-ijkl", " ABCD EFGH IJKL ", "abcdefghijkl"} {
+		if hashRecoveryCode(typed) != hashRecoveryCode("ABCD-EFGH-IJKL") {
+			t.Fatalf("%q hashes differently", typed)
+		}
+	}
+}
+
+func TestRecoverAccountStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			createTestUser(t, store, "alice-key", "alice")
+			createTestUser(t, store, "bob-key", "bob")
+
+			requestId, err := store.SetFriendRequest("bob", "alice-key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CreateFriend(&FriendAcceptData{Accept: true, RequestId: requestId}, "bob-key"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.SaveMessage(&Chat{Text: "before", Receiver: "bob"}, "alice-key"); err != nil {
+				t.Fatal(err)
+			}
+
+			codes := []string{hashRecoveryCode("CODE-ONE"), hashRecoveryCode("CODE-TWO")}
+			if err := store.SetRecoveryCodes("alice-key", codes); err != nil {
+				t.Fatal(err)
+			}
+
+			// The placeholder a new device makes on connecting
+			createTestUser(t, store, "new-key", "")
+
+			if ok, err := store.RecoverAccount("alice-key", "new-key", hashRecoveryCode("WRONG"), "hash"); ok || err != nil {
+				t.Fatalf("wrong code: recovered %v, error %v", ok, err)
+			}
+
+			ok, err := store.RecoverAccount("alice-key", "new-key", hashRecoveryCode("CODE-ONE"), "hash")
+			if !ok || err != nil {
+				t.Fatalf("recovered %v, error %v", ok, err)
+			}
+
+			details, err := store.GetLoginDetails("new-key")
+			if err != nil || details.Username != "alice" || details.Password != "hash" {
+				t.Fatalf("new key has %+v, error %v", details, err)
+			}
+			if _, err := store.GetLoginDetails("alice-key"); err == nil {
+				t.Fatal("old key still has an account")
+			}
+
+			// Friendships and messages follow the account
+			if _, err := store.SaveMessage(&Chat{Text: "after", Receiver: "bob"}, "new-key"); err != nil {
+				t.Fatalf("chat to bob after recovering: %v", err)
+			}
+
+			// Each code works once, and the rest move to the new key
+			if ok, _ := store.RecoverAccount("new-key", "third-key", hashRecoveryCode("CODE-ONE"), "hash"); ok {
+				t.Fatal("used code accepted again")
+			}
+			createTestUser(t, store, "third-key", "")
+			if ok, err := store.RecoverAccount("new-key", "third-key", hashRecoveryCode("CODE-TWO"), "hash"); !ok || err != nil {
+				t.Fatalf("unused code: recovered %v, error %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestRecoverAccount(t *testing.T) {
+	srv := newTestServer(t)
+
+	// Signup sends the codes, once
+	alice := dialTest(t, srv, "alice-key")
+	alice.expect(LoginDetailsRequired)
+	alice.send(AttemptLogin, LoginDetails{Username: "alice", Password: "password"})
+	alice.expect(LoginSuccessful)
+
+	var codes []string
+	alice.expectPayload(RecoveryCodes, &codes)
+	alice.expect(AllContent)
+
+	// Kept as hashes only
+	store := dbConn.(*MemoryStore)
+	store.mu.Lock()
+	stored := store.recoveryCodes["alice-key"]
+	store.mu.Unlock()
+	if len(stored) != len(codes) || stored[0].hash != hashRecoveryCode(codes[0]) {
+		t.Fatalf("stored %+v for codes %v", stored, codes)
+	}
+
+	bob := loginTest(t, srv, "bob-key", "bob")
+	makeFriends(t, alice, bob, "bob")
+
+	recover := func(k apiKey, code string) (*testClient, string) {
+		t.Helper()
+
+		c := dialTest(t, srv, k)
+		c.expect(LoginDetailsRequired)
+		c.send(RecoverAccount, AccountRecovery{Username: "alice", Code: code, NewPassword: "new password"})
+
+		var result string
+		c.expectPayload(RecoverAccountResult, &result)
+		c.expect(LoginDetailsRequired)
+		return c, result
+	}
+
+	device, result := recover("new-key", codes[0])
+	if result != "Account recovered. Log in with your new password" {
+		t.Fatalf("recovery answered %q", result)
+	}
+	alice.expect(ConnectionError)
+
+	// The account now lives at the new key
+	if registry.Exists("alice-key") || registry.Username("new-key") != "alice" {
+		t.Fatal("registry not rebound to the new key")
+	}
+
+	device.send(AttemptLogin, LoginDetails{Username: "alice", Password: "new password"})
+	device.expect(LoginSuccessful)
+	device.expect(AllContent)
+
+	device.send(SendMessage, Chat{Text: "back again", Receiver: "bob", ClientId: "1"})
+	device.expect(MessageAck)
+
+	var received Message
+	bob.expectPayload(ReceiveMessage, &received)
+	if received.Sender != "alice" || received.Text != "back again" {
+		t.Fatalf("bob received %+v", received)
+	}
+
+	// A used code is refused, like a wrong one
+	if _, result := recover("third-key", codes[0]); result != "Username or recovery code incorrect" {
+		t.Fatalf("used code answered %q", result)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"sync"
+)
+
+/*
+	Registry of every known user, shared by all connection goroutines.
+
+	Lookups go through the read lock, inserts and username changes through
+	the write lock. Presence transitions are made atomically on the
+	clientData itself, and subscribers are told about each change after
+	the registry lock is released so they can safely call back into it.
+*/
+
+type PresenceEvent struct {
+	Id       apiKey
+	Username string
+	Active   bool
+}
+
+type Registry struct {
+	byId   map[apiKey]*clientData
+	byName map[string]apiKey
+
+	// Presence subscribers, keyed so they can unsubscribe
+	subs    map[int]func(PresenceEvent)
+	nextSub int
+
+	mu sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		byId:   make(map[apiKey]*clientData),
+		byName: make(map[string]apiKey),
+		subs:   make(map[int]func(PresenceEvent)),
+		mu:     sync.RWMutex{},
+	}
+}
+
+// All users, loaded from the store at startup and added to on first connection
+var registry = NewRegistry()
+
+// Add or replace a user
+func (r *Registry) Add(c *clientData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.byId[c.apiKey]; ok {
+		delete(r.byName, old.Username())
+	}
+
+	r.byId[c.apiKey] = c
+	if name := c.Username(); name != "" {
+		r.byName[name] = c.apiKey
+	}
+}
+
+func (r *Registry) Get(k apiKey) (*clientData, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.byId[k]
+	return c, ok
+}
+
+func (r *Registry) GetByUsername(name string) (*clientData, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, ok := r.byName[name]
+	if !ok {
+		return nil, false
+	}
+
+	c, ok := r.byId[k]
+	return c, ok
+}
+
+// Key of the user with this username
+func (r *Registry) GetKey(name string) (apiKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, ok := r.byName[name]
+	return k, ok
+}
+
+func (r *Registry) Exists(k apiKey) bool {
+	_, ok := r.Get(k)
+	return ok
+}
+
+// Username of a user, or empty if unknown
+func (r *Registry) Username(k apiKey) string {
+	c, ok := r.Get(k)
+	if !ok {
+		return ""
+	}
+	return c.Username()
+}
+
+// Reindex a user after their username changes
+func (r *Registry) SetUsername(k apiKey, old string, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byName[old] == k {
+		delete(r.byName, old)
+	}
+
+	if name != "" {
+		r.byName[name] = k
+	}
+}
+
+// Move a user to a new key, replacing whatever was registered there. Returns false if old is unknown
+func (r *Registry) Rebind(old apiKey, new apiKey) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.byId[old]
+	if !ok {
+		return false
+	}
+
+	if replaced, ok := r.byId[new]; ok && r.byName[replaced.Username()] == new {
+		delete(r.byName, replaced.Username())
+	}
+
+	delete(r.byId, old)
+
+	c.mu.Lock()
+	c.apiKey = new
+	c.mu.Unlock()
+
+	r.byId[new] = c
+	if name := c.Username(); name != "" {
+		r.byName[name] = new
+	}
+	return true
+}
+
+// Forget a deleted user
+func (r *Registry) Remove(k apiKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.byId[k]
+	if !ok {
+		return
+	}
+
+	if name := c.Username(); r.byName[name] == k {
+		delete(r.byName, name)
+	}
+	delete(r.byId, k)
+}
+
+// Return all usernames
+func (r *Registry) Usernames() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	clientList := []string{}
+	for name := range r.byName {
+		clientList = append(clientList, name)
+	}
+	return clientList
+}
+
+// Number of users logged in right now
+func (r *Registry) LoggedInCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for _, c := range r.byId {
+		if c.LoggedIn() {
+			n++
+		}
+	}
+	return n
+}
+
+// Mark user as logged in. Returns false if unknown or already logged in
+func (r *Registry) Login(k apiKey) bool {
+	c, ok := r.Get(k)
+	if !ok || !c.LoginClient(k) {
+		return false
+	}
+
+	r.notify(PresenceEvent{
+		Id:       k,
+		Username: c.Username(),
+		Active:   true,
+	})
+	return true
+}
+
+// Mark user as logged out. Returns false if unknown or not logged in
+func (r *Registry) Leave(k apiKey) bool {
+	c, ok := r.Get(k)
+	if !ok || !c.Leave() {
+		return false
+	}
+
+	r.notify(PresenceEvent{
+		Id:       k,
+		Username: c.Username(),
+		Active:   false,
+	})
+	return true
+}
+
+// Register a presence hook. Call the returned func to remove it
+func (r *Registry) Subscribe(fn func(PresenceEvent)) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := r.nextSub
+	r.nextSub++
+	r.subs[id] = fn
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.subs, id)
+	}
+}
+
+func (r *Registry) notify(e PresenceEvent) {
+	r.mu.RLock()
+	hooks := make([]func(PresenceEvent), 0, len(r.subs))
+	for _, fn := range r.subs {
+		hooks = append(hooks, fn)
+	}
+	r.mu.RUnlock()
+
+	for _, fn := range hooks {
+		fn(e)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestRegistry(usernames ...string) *Registry {
+	r := NewRegistry()
+	for _, name := range usernames {
+		r.Add(&clientData{apiKey: apiKey(name + "-key"), username: name})
+	}
+	return r
+}
+
+func TestRegistryPresence(t *testing.T) {
+	r := newTestRegistry("alice")
+
+	var events []PresenceEvent
+	r.Subscribe(func(e PresenceEvent) {
+		events = append(events, e)
+	})
+
+	steps := []struct {
+		name string
+		do   func(apiKey) bool
+		key  apiKey
+		want bool
+	}{
+		{"login", r.Login, "alice-key", true},
+		{"login again", r.Login, "alice-key", false},
+		{"leave", r.Leave, "alice-key", true},
+		{"leave again", r.Leave, "alice-key", false},
+		{"login unknown", r.Login, "nobody-key", false},
+		{"leave unknown", r.Leave, "nobody-key", false},
+		{"login after leaving", r.Login, "alice-key", true},
+	}
+
+	for _, step := range steps {
+		if got := step.do(step.key); got != step.want {
+			t.Fatalf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// Only the transitions are announced
+	want := []PresenceEvent{
+		{Id: "alice-key", Username: "alice", Active: true},
+		{Id: "alice-key", Username: "alice", Active: false},
+		{Id: "alice-key", Username: "alice", Active: true},
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("got events %v, want %v", events, want)
+	}
+}
+
+func TestRegistryUnsubscribe(t *testing.T) {
+	r := newTestRegistry("alice")
+
+	var first, second int
+	unsubscribe := r.Subscribe(func(PresenceEvent) { first++ })
+	r.Subscribe(func(PresenceEvent) { second++ })
+
+	r.Login("alice-key")
+	unsubscribe()
+	r.Leave("alice-key")
+
+	if first != 1 || second != 2 {
+		t.Fatalf("got %d and %d events, want 1 and 2", first, second)
+	}
+
+	// Unsubscribing twice is harmless
+	unsubscribe()
+}
+
+// Subscribers may call back into the registry
+func TestRegistrySubscriberReenters(t *testing.T) {
+	r := newTestRegistry("alice")
+
+	var username string
+	r.Subscribe(func(e PresenceEvent) {
+		username = r.Username(e.Id)
+		r.Subscribe(func(PresenceEvent) {})
+	})
+
+	r.Login("alice-key")
+	if username != "alice" {
+		t.Fatalf("got username %q, want alice", username)
+	}
+}
+
+// Logins and leaves racing from many connections announce each
+// transition once. Run with -race
+func TestRegistryConcurrentPresence(t *testing.T) {
+	const users = 20
+	const rounds = 50
+
+	names := make([]string, users)
+	for i := range names {
+		names[i] = fmt.Sprintf("user%d", i)
+	}
+	r := newTestRegistry(names...)
+
+	var logins, leaves atomic.Int64
+	r.Subscribe(func(e PresenceEvent) {
+		if e.Active {
+			logins.Add(1)
+		} else {
+			leaves.Add(1)
+		}
+	})
+
+	var wg sync.WaitGroup
+	var loggedIn, left atomic.Int64
+
+	for _, name := range names {
+		k := apiKey(name + "-key")
+
+		// Two connections for the same user, as when a client reconnects
+		for range 2 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range rounds {
+					if r.Login(k) {
+						loggedIn.Add(1)
+					}
+					r.Username(k)
+					if r.Leave(k) {
+						left.Add(1)
+					}
+				}
+			}()
+		}
+
+		// Subscribers coming and going meanwhile
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				r.Subscribe(func(PresenceEvent) {})()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logins.Load() != loggedIn.Load() || leaves.Load() != left.Load() {
+		t.Fatalf("announced %d logins and %d leaves, made %d and %d",
+			logins.Load(), leaves.Load(), loggedIn.Load(), left.Load())
+	}
+	if loggedIn.Load() != left.Load() {
+		t.Fatalf("%d logins but %d leaves", loggedIn.Load(), left.Load())
+	}
+}
+
+func TestRegistryUsernames(t *testing.T) {
+	r := newTestRegistry("alice")
+
+	c, _ := r.Get("alice-key")
+	c.username = "alicia"
+	r.SetUsername("alice-key", "alice", "alicia")
+
+	if _, ok := r.GetByUsername("alice"); ok {
+		t.Fatal("old username still registered")
+	}
+	if c, ok := r.GetByUsername("alicia"); !ok || c.apiKey != "alice-key" {
+		t.Fatal("new username not registered")
+	}
+	if names := r.Usernames(); len(names) != 1 || names[0] != "alicia" {
+		t.Fatalf("got usernames %v", names)
+	}
+}
+
+func TestRegistryRebind(t *testing.T) {
+	r := newTestRegistry("alice")
+
+	// The placeholder a new device made on connecting
+	r.Add(&clientData{apiKey: "new-key"})
+
+	if !r.Rebind("alice-key", "new-key") {
+		t.Fatal("rebind failed")
+	}
+	if r.Exists("alice-key") || r.Username("new-key") != "alice" {
+		t.Fatal("user not moved to the new key")
+	}
+	if k, ok := r.GetKey("alice"); !ok || k != "new-key" {
+		t.Fatalf("alice has key %q, want new-key", k)
+	}
+
+	if r.Rebind("alice-key", "other-key") {
+		t.Fatal("rebound a key that is gone")
+	}
+}
+
+func TestRegistryRemove(t *testing.T) {
+	r := newTestRegistry("alice", "bob")
+
+	r.Remove("alice-key")
+	if r.Exists("alice-key") {
+		t.Fatal("user not removed")
+	}
+	if _, ok := r.GetKey("alice"); ok {
+		t.Fatal("removed user's name still registered")
+	}
+	if names := r.Usernames(); len(names) != 1 || names[0] != "bob" {
+		t.Fatalf("got usernames %v, want bob", names)
+	}
+
+	// Removing twice is harmless
+	r.Remove("alice-key")
+}
@@ -1,18 +1,64 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+)
 
-// Handler functions for each http route
-type routesMap map[string]func(r *http.Request)
+/*
+	HTTP routes:
 
-var routes = routesMap{
-	"/": func(r *http.Request) {
+		GET /ws        websocket connection for the client app
+		GET /healthz   the process is up
+		GET /readyz    ready for connections: the database answers and
+		               shutdown hasn't started
+		GET /metrics   Prometheus text format, see metrics.go
+		POST /hooks/{token}
+		               post a message into a conversation, see incoming.go
+		/admin/...     JSON API for operators, see adminapi.go. Only served
+		               when admin_token is set
 
-	},
-	"/login": func(r *http.Request) {
+	Anything else is a 404.
+*/
 
-	},
-	"/error": func(r *http.Request) {
+func newRouter(s *Server) http.Handler {
 
-	},
+	mux := http.NewServeMux()
+
+	// Spin off new websocket connection handler
+	mux.HandleFunc("GET /ws", s.start)
+
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	mux.HandleFunc("GET /readyz", s.ready)
+
+	mux.HandleFunc("GET /metrics", s.metrics)
+
+	mux.HandleFunc("POST /hooks/{token}", s.incomingWebhook)
+
+	if config.AdminToken != "" {
+		s.adminRoutes(mux)
+	}
+
+	return mux
+}
+
+func (s *Server) ready(w http.ResponseWriter, r *http.Request) {
+
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+
+	if closing {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+
+	if err := dbConn.Ping(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "database unavailable"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
 }
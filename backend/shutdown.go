@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+/*
+	Graceful shutdown, on SIGINT or SIGTERM:
+		1) Stop accepting connections
+		2) Tell connected clients the server is going away and close them
+		3) Wait for handlers to finish, which logs users out and saves lastSeen
+		4) Drain the broadcast channel and wait for the sends it started
+		5) Wait for webhook deliveries, dead lettering any still retrying
+		6) Close the database
+
+	Everything after 1) shares config.ShutdownTimeout.
+*/
+
+// Notify and disconnect every client, then wait for handlers, broadcasts and webhooks to finish
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	s.mu.Lock()
+	s.closing = true
+	clients := make([]*ClientConnection, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	deadline, hasDeadline := ctx.Deadline()
+
+	for _, c := range clients {
+		// Don't let a stalled client hold up the rest
+		if hasDeadline {
+			c.conn.SetWriteDeadline(deadline)
+		}
+
+		c.SendOnConnection(&ClientResponse{
+			Err:     nil,
+			Message: "Server shutting down",
+			Code:    ServerShutdown,
+		})
+
+		// Ends the handler's read loop
+		c.conn.Close()
+	}
+
+	if err := waitContext(ctx, s.handlers.Wait); err != nil {
+		return fmt.Errorf("waiting for connections to close: %w", err)
+	}
+
+	// No handlers are left to queue broadcasts, so AppListener can finish what is queued
+	close(s.broadcast)
+
+	if err := waitContext(ctx, func() { <-s.listenerDone }); err != nil {
+		return fmt.Errorf("draining broadcasts: %w", err)
+	}
+
+	if err := waitContext(ctx, s.sends.Wait); err != nil {
+		return fmt.Errorf("waiting for broadcast sends: %w", err)
+	}
+
+	if err := s.webhooks.Close(ctx); err != nil {
+		return fmt.Errorf("waiting for webhook deliveries: %w", err)
+	}
+
+	return nil
+}
+
+// Run wait, giving up when ctx is done
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shut down the HTTP and websocket servers and close the database within the configured timeout
+func shutdown(httpServer *http.Server, wsServer *Server) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	start := time.Now()
+
+	err := httpServer.Shutdown(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Error stopping HTTP server", "err", err)
+	}
+
+	err = wsServer.Shutdown(ctx)
+	if err != nil {
+		// Handlers may still be writing, but the deadline has passed
+		slog.Warn("Shutdown incomplete", "err", err)
+	}
+
+	err = dbConn.Close()
+	if err != nil {
+		slog.Error("Error closing database", "err", err)
+	}
+
+	slog.Info("Server stopped", "duration", time.Since(start).Round(time.Millisecond))
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -17,12 +19,29 @@ type Server struct {
 	clients   conns
 	broadcast chan *BackendMessage
 	mu        sync.Mutex
+	// Set when shutdown starts. New connections are refused
+	closing bool
+	// Connection handlers and broadcast sends still running
+	handlers sync.WaitGroup
+	sends    sync.WaitGroup
+	// Closed once AppListener has drained the broadcast channel
+	listenerDone chan struct{}
+	// Posts broadcasts to webhook subscriptions
+	webhooks *webhookDispatcher
 }
 
 type conns map[apiKey]*ClientConnection
 
+// Handlers only block on a broadcast once this many are waiting for AppListener
+const broadcastQueueSize = 256
+
 type ClientConnection struct {
 	conn *websocket.Conn
+	// Carries the key, remote address and, once logged in, the username
+	log *slog.Logger
+	// Shown by the admin connections endpoint
+	remoteAddr  string
+	connectedAt time.Time
 }
 
 func (c *ClientConnection) SendOnConnection(m Response) *RequestError {
@@ -39,6 +58,7 @@ func (c *ClientConnection) SendOnConnection(m Response) *RequestError {
 
 	// Attempt to write. If failed then close websocket connection
 	_, e := c.conn.Write(jsonData)
+	observeSend(responseCode(m), e)
 
 	if e != nil {
 
@@ -53,18 +73,48 @@ func (c *ClientConnection) SendOnConnection(m Response) *RequestError {
 
 }
 
+// Code of a response, for metrics
+func responseCode(m Response) MessageCode {
+	switch r := m.(type) {
+	case *ClientResponse:
+		return r.Code
+	case *AuthResponse:
+		return r.Code
+	case *RequestError:
+		return r.Code
+	}
+	return -1
+}
+
 func NewServer() *Server {
 	return &Server{
-		clients:   make(map[apiKey]*ClientConnection),
-		broadcast: make(chan *BackendMessage),
-		mu:        sync.Mutex{},
+		clients:      make(map[apiKey]*ClientConnection),
+		broadcast:    make(chan *BackendMessage, broadcastQueueSize),
+		mu:           sync.Mutex{},
+		listenerDone: make(chan struct{}),
+		webhooks:     newWebhookDispatcher(),
 	}
 }
 
 // Start websocket connection
 func (s *Server) start(w http.ResponseWriter, r *http.Request) {
 
+	// Register the handler under the lock so shutdown never misses one
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	s.handlers.Add(1)
+	s.mu.Unlock()
+
+	defer s.handlers.Done()
+
 	websocket.Handler(func(ws *websocket.Conn) {
+		// Leave room for the JSON envelope around the largest chat text
+		ws.MaxPayloadBytes = maxChatTextSize() + 4096
+
 		defer func() {
 			// Close websocket connection and remove from connections map
 			ws.Close()
@@ -74,13 +124,16 @@ func (s *Server) start(w http.ResponseWriter, r *http.Request) {
 		k, err := getApiKey(r)
 
 		if err != nil {
+			slog.Warn("Connection refused", "remote", r.RemoteAddr, "err", err.Message)
 			websocket.JSON.Send(ws, err)
 			return
 		}
 
+		logger := connLogger(k, r.RemoteAddr)
+
 		// Check if api key exists
 		if !doesUserExist(k) {
-			// Add new user details to UserMap
+			// Add new user details to the registry
 			clientData := generateNewUser(k)
 
 			// Save to database
@@ -88,58 +141,143 @@ func (s *Server) start(w http.ResponseWriter, r *http.Request) {
 
 			// TODO: Parse db error messages
 			if err != nil {
+				logger.Error("Error creating new user", "err", err)
 				websocket.JSON.Send(ws, &RequestError{
 					Message: "Error creating new user",
 					Code:    DatabaseError,
 				})
 				return
 			}
-			UserMap[k] = clientData
+			registry.Add(clientData)
+			logger.Info("New user created")
 		}
 
 		// Set new client connection in server clients map
-		s.setConnection(ws, k)
+		s.setConnection(ws, k, logger)
+		connectionsTotal.Inc("")
+		logger.Info("Connection opened")
 
-		s.clients[k].SendOnConnection(
+		s.sendTo(k,
 			&ClientResponse{
 				Err:     nil,
 				Message: "API Key Existing",
 				Code:    APIKey,
 			})
 
-		s.handleWS(ws, k)
+		s.handleWS(ws, k, logger)
 
 	}).ServeHTTP(w, r)
 
 }
 
-func (s *Server) setConnection(ws *websocket.Conn, k apiKey) {
+func (s *Server) setConnection(ws *websocket.Conn, k apiKey, logger *slog.Logger) {
 	s.mu.Lock()
 	s.clients[k] = &ClientConnection{
-		conn: ws,
+		conn:        ws,
+		log:         logger,
+		remoteAddr:  ws.Request().RemoteAddr,
+		connectedAt: time.Now(),
 	}
 	s.mu.Unlock()
 }
 
+func (s *Server) getConnection(k apiKey) (*ClientConnection, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.clients[k]
+	return c, ok
+}
+
+// Send on the connection registered for k
+func (s *Server) sendTo(k apiKey, m Response) *RequestError {
+	c, ok := s.getConnection(k)
+	if !ok {
+		return &RequestError{
+			Message: "Connection closed",
+			Code:    ConnectionError,
+		}
+	}
+
+	return c.SendOnConnection(m)
+}
+
+// Longest client id accepted on a chat
+const maxClientIdSize = 64
+
+// Tell the sender a chat is saved, so it can leave their outbox. Chats from clients without an outbox carry no id
+func (s *Server) ackChat(k apiKey, chat *Chat) {
+	if chat.ClientId == "" {
+		return
+	}
+
+	clientResponse := ClientResponse{
+		Code:    MessageAck,
+		Err:     nil,
+		Message: "Message saved",
+		Payload: nil,
+	}
+	clientResponse.EncodePayload(&chat.ClientId)
+
+	s.sendTo(k, &clientResponse)
+}
+
+// Tell the sender a chat was refused. The payload is its client id, so the
+// client drops it from its outbox rather than sending it again
+func (s *Server) refuseChat(k apiKey, chat *Chat, reason string) {
+
+	clientResponse := ClientResponse{
+		Code: FailedMessageSend,
+		Err: &RequestError{
+			Message: reason,
+			Code:    FailedMessageSend,
+		},
+		Message: "Message not sent",
+		Payload: nil,
+	}
+	if chat.ClientId != "" {
+		clientResponse.EncodePayload(&chat.ClientId)
+	}
+
+	s.sendTo(k, &clientResponse)
+}
+
 // Handler multiplexed off to handl individual socket connection
-func (s *Server) handleWS(ws *websocket.Conn, k apiKey) {
+func (s *Server) handleWS(ws *websocket.Conn, k apiKey, logger *slog.Logger) {
 
 	var err *RequestError
+	opened := time.Now()
+
 	// When loop breaks or returns, remove the connection pointer
 	defer func() {
+		// Picks up the username if login got that far
+		logger = s.logger(k)
+
 		s.mu.Lock()
 		delete(s.clients, k)
 		s.mu.Unlock()
 
-		// Log user out
-		UserMap[k].Leave()
+		// Log user out. Presence subscribers broadcast it to friends
+		registry.Leave(k)
 
-		// TODO: broadcast to friends that user logged out
+		// Keys moved to another device by account recovery no longer exist
+		if registry.Exists(k) {
+			if err := dbConn.SetLastSeen(k, time.Now()); err != nil {
+				logger.Error("Error saving last seen", "err", err)
+			}
+		}
+
+		logger.Info("Connection closed", "duration", time.Since(opened).Round(time.Millisecond))
 	}()
 
+	client, ok := registry.Get(k)
+	if !ok {
+		return
+	}
+
 	// Send welcome message if not sent
-	if !UserMap[k].welcomeSent {
-		err = s.clients[k].SendOnConnection(
+	if !client.WelcomeSent() {
+		err = s.sendTo(k,
 			&ClientResponse{
 				Err:     nil,
 				Message: "Welcome to the server!",
@@ -150,12 +288,14 @@ func (s *Server) handleWS(ws *websocket.Conn, k apiKey) {
 			return
 		}
 
-		UserMap[k].welcomeSent = true
+		client.SetWelcomeSent()
+		logger.Debug("Welcome sent")
 
 		// Update database
-		dbErr := dbConn.UpdateClient(UserMap[k])
+		dbErr := dbConn.UpdateClient(client)
 		if dbErr != nil {
-			err = s.clients[k].SendOnConnection(
+			logger.Error("Error saving client data", "err", dbErr)
+			err = s.sendTo(k,
 				&ClientResponse{
 					Err:     nil,
 					Message: "Error saving client data!",
@@ -170,10 +310,15 @@ func (s *Server) handleWS(ws *websocket.Conn, k apiKey) {
 		}
 	}
 
-	// Send prompt for login details
-	err = s.authLoop(ws, k)
+	// Send prompt for login details. Bots were checked by their token already
+	if client.Bot() {
+		err = s.botLogin(k, remoteHost(ws.Request().RemoteAddr), logger)
+	} else {
+		err = s.authLoop(ws, k, logger)
+	}
 	if err != nil {
-		s.clients[k].SendOnConnection(
+		logger.Info("Authentication ended", "code", err.Code.String(), "reason", err.Message)
+		s.sendTo(k,
 			&ClientResponse{
 				Err:     err,
 				Message: err.Message,
@@ -184,10 +329,13 @@ func (s *Server) handleWS(ws *websocket.Conn, k apiKey) {
 		return
 	}
 
+	logger = s.setLoggerUser(k, registry.Username(k))
+	logger.Info("Logged in")
+
 	// Assuming auth loop passed, then get user data
-	err = s.SendAllContent(ws, k)
+	err = s.SendAllContent(ws, k, logger)
 	if err != nil {
-		s.clients[k].SendOnConnection(
+		s.sendTo(k,
 			&ClientResponse{
 				Err:     err,
 				Message: err.Message,
@@ -199,11 +347,11 @@ func (s *Server) handleWS(ws *websocket.Conn, k apiKey) {
 	}
 
 	// Start listening to frontend messages
-	s.readLoop(ws, k)
+	s.readLoop(ws, k, logger)
 }
 
 // Communicate regarding authentication
-func (s *Server) authLoop(ws *websocket.Conn, k apiKey) *RequestError {
+func (s *Server) authLoop(ws *websocket.Conn, k apiKey, logger *slog.Logger) *RequestError {
 
 	var reqErr *RequestError
 	var authResp *AuthResponse
@@ -211,13 +359,16 @@ func (s *Server) authLoop(ws *websocket.Conn, k apiKey) *RequestError {
 	var loginDetails LoginDetails
 	var err error
 
+	// Failed logins are also throttled per remote address
+	addr := remoteHost(ws.Request().RemoteAddr)
+
 	authResp = &AuthResponse{
 		Code:    LoginDetailsRequired,
 		Message: "Login details required",
 	}
 
 	// Request login details from client
-	reqErr = s.clients[k].SendOnConnection(authResp)
+	reqErr = s.sendTo(k, authResp)
 	if reqErr != nil {
 		goto reqErrSend
 	}
@@ -233,6 +384,17 @@ func (s *Server) authLoop(ws *websocket.Conn, k apiKey) *RequestError {
 			goto reqErrSend
 		}
 
+		messagesReceived.Inc(resp.Code.String())
+
+		// A new device can take over an account with a recovery code, then log in as normal
+		if resp.Code == RecoverAccount {
+			reqErr = s.handleRecovery(k, &resp, addr)
+			if reqErr != nil {
+				goto reqErrSend
+			}
+			continue
+		}
+
 		// Continue with auth loop. Client cannot send any other type of message
 		if resp.Code != AttemptLogin {
 			continue
@@ -242,19 +404,24 @@ func (s *Server) authLoop(ws *websocket.Conn, k apiKey) *RequestError {
 		err := json.Unmarshal(resp.Payload, &loginDetails)
 
 		if err != nil {
-			fmt.Println(err)
+			logger.Warn("Invalid login payload", "err", err)
 		}
 
+		// No username yet means these details create the account
+		newAccount := !userHaveLogin(k)
+
 		// Authenticate new client
-		authResp, reqErr = authenticationCycle(k, &loginDetails)
+		authResp, reqErr = authenticationCycle(k, &loginDetails, addr)
 
 		if reqErr != nil {
 			goto reqErrSend
 		}
 
+		logger.Info("Login attempt", "username", loginDetails.Username, "result", authResp.Code.String())
+
 		if authResp.Code == LoginSuccessful {
 			// Resend auth message
-			err := s.clients[k].SendOnConnection(authResp)
+			err := s.sendTo(k, authResp)
 
 			if err != nil {
 				reqErr = &RequestError{
@@ -264,15 +431,18 @@ func (s *Server) authLoop(ws *websocket.Conn, k apiKey) *RequestError {
 				goto reqErrSend
 			}
 
-			// Broadcast logged in status
-			s.broadcast <- &BackendMessage{
-				Code:    BroadcastLoggedIn,
-				Payload: k,
+			// Recovery codes are shown once, straight after signup
+			if newAccount {
+				if codesErr := s.sendRecoveryCodes(k); codesErr != nil {
+					logger.Error("Error sending recovery codes", "err", codesErr.Message)
+				}
 			}
+
+			// Logged in status is broadcast by the registry presence hook
 			return nil
 		} else {
 			// Resend auth message
-			err := s.clients[k].SendOnConnection(authResp)
+			err := s.sendTo(k, authResp)
 
 			if err != nil {
 				return &RequestError{
@@ -287,11 +457,12 @@ func (s *Server) authLoop(ws *websocket.Conn, k apiKey) *RequestError {
 	}
 
 reqErrSend:
-	fmt.Println(err)
+	// Mostly the client going away before logging in
+	logger.Debug("Auth loop stopped", "err", err)
 	return reqErr
 }
 
-func (s *Server) SendAllContent(ws *websocket.Conn, k apiKey) *RequestError {
+func (s *Server) SendAllContent(ws *websocket.Conn, k apiKey, logger *slog.Logger) *RequestError {
 
 	var reqErr *RequestError
 	var contentResp *ClientResponse
@@ -326,15 +497,17 @@ func (s *Server) SendAllContent(ws *websocket.Conn, k apiKey) *RequestError {
 		goto reqErrSend
 	}
 
-	err = s.clients[k].SendOnConnection(contentResp)
-	if err != nil {
+	reqErr = s.sendTo(k, contentResp)
+	if reqErr != nil {
+		err = reqErr
 		goto reqErrSend
 	}
 
+	logger.Debug("User content sent")
 	return nil
 
 reqErrSend:
-	fmt.Println(err)
+	logger.Error("Error sending user content", "err", err)
 	return reqErr
 }
 
@@ -344,28 +517,47 @@ reqErrSend:
 type ChatBroadcast struct {
 	Chat       *Message  `json:"chat"`
 	Friendship *[]string `json:"friendship"`
+	// Username of the sender as authenticated, for webhooks
+	Sender string `json:"-"`
 }
 
-func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
+func (s *Server) readLoop(ws *websocket.Conn, k apiKey, logger *slog.Logger) {
 
 	var clientMessage ClientMessage
+
+	client, ok := registry.Get(k)
+	if !ok {
+		return
+	}
+	bot := client.Bot()
+
 	for {
 		err := websocket.JSON.Receive(ws, &clientMessage)
 
 		if err != nil {
 
-			if err == io.EOF {
-
-				// Broadcast logged in status
-				s.broadcast <- &BackendMessage{
-					Code:    BroadcastLoggedOut,
-					Payload: k,
-				}
-				// Broadcast inactive status to friends
+			// Closed by the client, or by the server shutting down
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				// Inactive status is broadcast to friends when handleWS leaves
 				break
 			}
 
-			fmt.Println("Read error: ", err)
+			logger.Warn("Read error", "err", err)
+			continue
+		}
+
+		messagesReceived.Inc(clientMessage.Code.String())
+		logger.Debug("Message received", "code", clientMessage.Code.String())
+
+		if bot && botRefused(clientMessage.Code) {
+			s.sendTo(k, &ClientResponse{
+				Err: &RequestError{
+					Message: "Not available to bots",
+					Code:    clientMessage.Code,
+				},
+				Message: "Not available to bots",
+				Code:    clientMessage.Code,
+			})
 			continue
 		}
 
@@ -381,7 +573,8 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 			results, err = UserSearchResults(srch)
 
 			if err != nil {
-				log.Fatal(err)
+				logger.Error("Error searching users", "err", err)
+				break
 			}
 
 			clientResponse := ClientResponse{
@@ -392,10 +585,53 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 			}
 			clientResponse.EncodePayload(results)
 
-			err = websocket.JSON.Send(ws, &clientResponse)
+			if reqErr := s.sendTo(k, &clientResponse); reqErr != nil {
+				logger.Error("Error sending response", "err", reqErr.Message)
+				return
+			}
+
+		case ChangePassword:
+			var change PasswordChange
+			var result string
+
+			clientMessage.DecodePayload(&change)
+			result = changePassword(k, &change, remoteHost(ws.Request().RemoteAddr))
 
-			if err != nil {
-				log.Fatal(err)
+			clientResponse := ClientResponse{
+				Code:    ChangePasswordResult,
+				Payload: nil,
+				Err:     nil,
+				Message: "",
+			}
+			clientResponse.EncodePayload(&result)
+
+			s.sendTo(k, &clientResponse)
+
+		case RecoveryCodes:
+			// New set, replacing any unused codes. Also covers accounts made before codes existed
+			if reqErr := s.sendRecoveryCodes(k); reqErr != nil {
+				logger.Error("Error sending recovery codes", "err", reqErr.Message)
+			}
+
+		case DeleteAccount:
+			// The key no longer exists once deleted, so close the connection
+			if s.handleDeletion(k, &clientMessage, remoteHost(ws.Request().RemoteAddr)) {
+				return
+			}
+
+		case ExportData:
+			if reqErr := s.sendExport(k); reqErr != nil {
+				logger.Error("Error sending export", "err", reqErr.Message)
+			}
+
+		case PublishKey:
+			if reqErr := s.publishKey(k, &clientMessage); reqErr != nil {
+				logger.Warn("Error publishing key", "err", reqErr.Message)
+			}
+
+		case KeyLookup:
+			if reqErr := s.sendPublicKey(k, &clientMessage); reqErr != nil {
+				logger.Warn("Error sending public key", "err", reqErr.Message)
 			}
 
 		case FriendRequest:
@@ -412,6 +648,7 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 				result = "Failed to save friend request"
 			} else {
 				result = "Friend request sent"
+				audit(AuditFriendRequest, registry.Username(k), name, s.auditSource(k), "")
 			}
 
 			clientResponse := ClientResponse{
@@ -422,10 +659,25 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 			}
 			clientResponse.EncodePayload(&result)
 
-			err = websocket.JSON.Send(ws, &clientResponse)
+			if reqErr := s.sendTo(k, &clientResponse); reqErr != nil {
+				logger.Error("Error sending response", "err", reqErr.Message)
+				return
+			}
 
+			// Nothing was saved, so there is nobody to update
 			if err != nil {
-				log.Fatal(err)
+				logger.Warn("Error saving friend request", "err", err)
+				break
+			}
+
+			// Bots accept straight away, so both sides are sent the friendship instead
+			if botId, ok := botKey(name); ok {
+				acceptErr := s.acceptForBot(botId, friendRequestId)
+				if acceptErr == nil {
+					break
+				}
+				// Left pending for the bot's next login
+				logger.Error("Error accepting friend request for bot", "bot", name, "err", acceptErr)
 			}
 
 			// Network broadcast to update clients
@@ -444,7 +696,8 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 			friendIds, err = dbConn.GetFriendRequestById(friendAcceptData.RequestId)
 
 			if err != nil {
-				log.Fatalln(err)
+				logger.Error("Error reading friend request", "err", err)
+				break
 			}
 			err = UpdateFriendRequest(&friendAcceptData, string(k))
 
@@ -452,6 +705,15 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 				result = "Failed to accept request"
 			} else {
 				result = "Friend accepted successfully"
+
+				// Second id is always the requesting user
+				event := AuditFriendDecline
+				if friendAcceptData.Accept {
+					event = AuditFriendAccept
+				}
+				if len(*friendIds) > 1 {
+					audit(event, registry.Username(k), registry.Username(apiKey((*friendIds)[1])), s.auditSource(k), "")
+				}
 			}
 
 			clientResponse := ClientResponse{
@@ -462,10 +724,9 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 			}
 			clientResponse.EncodePayload(&result)
 
-			err = websocket.JSON.Send(ws, &clientResponse)
-
-			if err != nil {
-				log.Fatal(err)
+			if reqErr := s.sendTo(k, &clientResponse); reqErr != nil {
+				logger.Error("Error sending response", "err", reqErr.Message)
+				return
 			}
 
 			// Network broadcast to update friends under  given friendship ID
@@ -483,16 +744,59 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 			err = clientMessage.DecodePayload(&chat)
 
 			if err != nil {
-				log.Fatal(err)
+				logger.Warn("Invalid chat payload", "err", err)
+				break
 			}
 
 			if chat.Receiver == "" {
 				break
 			}
 
+			// Sent as whoever is logged in on this connection, whatever the client claims
+			chat.Sender = registry.Username(k)
+
+			// Ids are random hex from the client. Anything longer is not one
+			if len(chat.ClientId) > maxClientIdSize {
+				s.refuseChat(k, &chat, "Invalid message id")
+				break
+			}
+
+			if chatTooLarge(chat.Text) {
+				s.refuseChat(k, &chat, fmt.Sprintf("Message is larger than %d bytes", config.MaxMessageSize))
+				break
+			}
+
 			// Save message in database
 			friendship, err = dbConn.SaveMessage(&chat, k)
 
+			// A resend of a chat saved before the connection dropped. Acknowledge it again, but don't deliver it twice
+			if errors.Is(err, errDuplicateMessage) {
+				logger.Debug("Duplicate chat acknowledged", "client_id", chat.ClientId)
+				s.ackChat(k, &chat)
+				break
+			}
+
+			// The receiver may have deleted their account, or unfriended the sender, since the client last heard
+			if errors.Is(err, errReceiverNotFound) || errors.Is(err, errNotFriends) {
+				logger.Debug("Chat refused", "receiver", chat.Receiver, "err", err)
+				s.refuseChat(k, &chat, fmt.Sprintf("Can't send to %s: %v", chat.Receiver, err))
+				break
+			}
+
+			// No client id, so the client keeps it and tries again after reconnecting
+			if err != nil {
+				logger.Error("Error saving message", "err", err)
+				s.sendTo(k, &ClientResponse{
+					Err: &RequestError{
+						Message: "Failed to send message",
+						Code:    FailedMessageSend,
+					},
+					Message: "Message not sent",
+					Code:    FailedMessageSend,
+				})
+				break
+			}
+
 			layout := "2006-01-02 15:04"
 			nowUTC := time.Now().UTC()
 			formatted := nowUTC.Format(layout)
@@ -502,11 +806,10 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 				Date:     formatted,
 				Receiver: chat.Receiver,
 				Sender:   chat.Sender,
+				ClientId: chat.ClientId,
 			}
 
-			if err != nil {
-				log.Fatal(err)
-			}
+			s.ackChat(k, &chat)
 
 			// If receiving user is active, then send new message immediately
 			// Network broadcast to update friends under  given friendship ID
@@ -515,6 +818,7 @@ func (s *Server) readLoop(ws *websocket.Conn, k apiKey) {
 				Payload: &ChatBroadcast{
 					Chat:       &message,
 					Friendship: friendship,
+					Sender:     chat.Sender,
 				},
 			}
 
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Server on a MemoryStore behind the real router, with a fresh registry.
+// Shut down when the test ends
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	dbConn = NewMemoryStore()
+	registry = NewRegistry()
+	loginLimiter = NewLoginLimiter()
+
+	s := NewServer()
+	unsubscribe := registry.Subscribe(s.broadcastPresence)
+	go AppListener(s)
+
+	srv := httptest.NewServer(newRouter(s))
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down: %v", err)
+		}
+		srv.Close()
+		unsubscribe()
+	})
+
+	return srv
+}
+
+type testClient struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+// Open a connection with key as the api key, the way the client does
+func dialTest(t *testing.T, srv *httptest.Server, key apiKey) *testClient {
+	t.Helper()
+
+	return dialAuthorized(t, srv, "Basic "+base64.StdEncoding.EncodeToString([]byte(string(key)+":")))
+}
+
+func dialAuthorized(t *testing.T, srv *httptest.Server, authorization string) *testClient {
+	t.Helper()
+
+	cfg, err := websocket.NewConfig(wsURL(srv), "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Header.Set("Authorization", authorization)
+
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	return &testClient{t, ws}
+}
+
+// Sign up or log in, and wait for the content sent on login
+func loginTest(t *testing.T, srv *httptest.Server, key apiKey, username string) *testClient {
+	t.Helper()
+
+	c := dialTest(t, srv, key)
+	c.expect(LoginDetailsRequired)
+	c.send(AttemptLogin, LoginDetails{Username: username, Password: "password"})
+	c.expect(LoginSuccessful)
+	c.expect(AllContent)
+	return c
+}
+
+func (c *testClient) send(code MessageCode, payload interface{}) {
+	c.t.Helper()
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := websocket.JSON.Send(c.ws, ClientMessage{Code: code, Payload: b}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Next response with code, skipping others such as presence updates
+func (c *testClient) expect(code MessageCode) ClientResponse {
+	c.t.Helper()
+
+	for range 20 {
+		var r ClientResponse
+		c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(c.ws, &r); err != nil {
+			c.t.Fatalf("waiting for %d: %v", code, err)
+		}
+		if r.Code == code {
+			return r
+		}
+	}
+	c.t.Fatalf("no response with code %d", code)
+	return ClientResponse{}
+}
+
+// Decode the payload of the next response with code
+func (c *testClient) expectPayload(code MessageCode, payload interface{}) {
+	c.t.Helper()
+
+	if err := json.Unmarshal(c.expect(code).Payload, payload); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// a asks b, named bName, to be friends, and b accepts
+func makeFriends(t *testing.T, a *testClient, b *testClient, bName string) {
+	t.Helper()
+
+	a.send(FriendRequest, bName)
+	a.expect(FriendRequestResult)
+
+	var content UserContent
+	b.expectPayload(UpdateFriendContent, &content)
+	if len(content.FriendRequests) == 0 {
+		t.Fatal("friend request not received")
+	}
+
+	b.send(FriendAccept, FriendAcceptData{Accept: true, RequestId: content.FriendRequests[0].RequestId})
+	b.expect(FriendAcceptResult)
+	a.expect(UpdateFriendContent)
+}
+
+// Requests that fail are answered without a broadcast, which would have
+// nobody to send to
+func TestFriendRequestRefused(t *testing.T) {
+	srv := newTestServer(t)
+
+	alice := loginTest(t, srv, "alice-key", "alice")
+	bob := loginTest(t, srv, "bob-key", "bob")
+	makeFriends(t, alice, bob, "bob")
+
+	for _, name := range []string{"nobody", "bob"} {
+		alice.send(FriendRequest, name)
+
+		var result string
+		alice.expectPayload(FriendRequestResult, &result)
+		if result != "Failed to save friend request" {
+			t.Fatalf("request to %s: got %q", name, result)
+		}
+	}
+
+	// Still serving
+	carol := loginTest(t, srv, "carol-key", "carol")
+	alice.send(FriendRequest, "carol")
+	alice.expect(FriendRequestResult)
+	carol.expect(UpdateFriendContent)
+}
+
+func TestSendMessage(t *testing.T) {
+	srv := newTestServer(t)
+
+	alice := loginTest(t, srv, "alice-key", "alice")
+	bob := loginTest(t, srv, "bob-key", "bob")
+	makeFriends(t, alice, bob, "bob")
+
+	// Sent as the logged in user, whoever the chat claims it is from
+	alice.send(SendMessage, Chat{Text: "hello", Sender: "carol", Receiver: "bob", ClientId: "1"})
+
+	var acked string
+	alice.expectPayload(MessageAck, &acked)
+	if acked != "1" {
+		t.Fatalf("acknowledged %q, want %q", acked, "1")
+	}
+
+	var received Message
+	bob.expectPayload(ReceiveMessage, &received)
+	if received.Text != "hello" || received.Sender != "alice" || received.ClientId != "1" {
+		t.Fatalf("bob received %+v", received)
+	}
+}
+
+func TestSendMessageResent(t *testing.T) {
+	srv := newTestServer(t)
+
+	alice := loginTest(t, srv, "alice-key", "alice")
+	bob := loginTest(t, srv, "bob-key", "bob")
+	makeFriends(t, alice, bob, "bob")
+
+	alice.send(SendMessage, Chat{Text: "one", Sender: "alice", Receiver: "bob", ClientId: "1"})
+	alice.expect(MessageAck)
+	alice.send(SendMessage, Chat{Text: "one", Sender: "alice", Receiver: "bob", ClientId: "1"})
+	alice.expect(MessageAck)
+	alice.send(SendMessage, Chat{Text: "two", Sender: "alice", Receiver: "bob", ClientId: "2"})
+	alice.expect(MessageAck)
+
+	// The resend is acknowledged but not delivered again
+	for _, want := range []string{"one", "two"} {
+		var received Message
+		bob.expectPayload(ReceiveMessage, &received)
+		if received.Text != want {
+			t.Fatalf("bob received %q, want %q", received.Text, want)
+		}
+	}
+}
+
+func TestSendMessageRefused(t *testing.T) {
+	srv := newTestServer(t)
+
+	alice := loginTest(t, srv, "alice-key", "alice")
+	bob := loginTest(t, srv, "bob-key", "bob")
+	loginTest(t, srv, "carol-key", "carol")
+	makeFriends(t, alice, bob, "bob")
+
+	for _, receiver := range []string{"carol", "nobody"} {
+		alice.send(SendMessage, Chat{Text: "hello", Sender: "alice", Receiver: receiver, ClientId: receiver + "-1"})
+		r := alice.expect(FailedMessageSend)
+		if r.Err == nil || !strings.Contains(r.Err.Message, receiver) {
+			t.Fatalf("refusal for %s: %+v", receiver, r.Err)
+		}
+
+		// So the client drops it from its outbox
+		var refused string
+		if err := r.DecodePayload(&refused); err != nil || refused != receiver+"-1" {
+			t.Fatalf("refusal for %s echoed %q, %v", receiver, refused, err)
+		}
+	}
+
+	// Still serving after the refusals
+	alice.send(SendMessage, Chat{Text: "still there?", Sender: "alice", Receiver: "bob"})
+	var received Message
+	bob.expectPayload(ReceiveMessage, &received)
+	if received.Text != "still there?" {
+		t.Fatalf("bob received %+v", received)
+	}
+}
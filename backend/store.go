@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+	Persistence layer used by the socket handlers and the broadcast listener.
+
+	DBConn is the SQLite implementation used by the running server, and
+	MemoryStore keeps everything in maps so handlers can be exercised
+	without a database file.
+*/
+
+// Returned by SaveMessage for a resent chat the store already holds
+var errDuplicateMessage = errors.New("message already saved")
+
+// Returned by SaveMessage when the receiver has no account, or has deleted it
+var errReceiverNotFound = errors.New("receiver not found")
+
+// Returned by SaveMessage when the sender and receiver aren't friends
+var errNotFriends = errors.New("users are not friends")
+
+type Store interface {
+	// Users. Passwords are always hashes, see passwords.go
+	CreateNewUser(d *clientData) error
+	UpdateClient(d *clientData) error
+	SetLastSeen(k apiKey, t time.Time) error
+	GetLoginFailures(k apiKey) (int, time.Time, error)
+	SetLoginFailures(k apiKey, failures int, lockedUntil time.Time) error
+	GetLoginDetails(k apiKey) (LoginDetails, error)
+	SetPassword(k apiKey, passwordHash string) error
+
+	// Accounts disabled by an admin
+	GetDisabled(k apiKey) (bool, string, error)
+	SetDisabled(k apiKey, disabled bool, reason string) error
+
+	// Public keys for end-to-end encrypted messages
+	SetPublicKey(k apiKey, key string) error
+	GetPublicKey(username string) (string, error)
+
+	// Bot accounts, which log in with a token. Only its hash is stored
+	CreateBot(k apiKey, username string, tokenHash string) error
+	SetBotToken(k apiKey, tokenHash string) error
+	GetBotByToken(tokenHash string) (apiKey, error)
+
+	// Account recovery
+	SetRecoveryCodes(k apiKey, hashes []string) error
+	RecoverAccount(oldKey apiKey, newKey apiKey, codeHash string, passwordHash string) (bool, error)
+	GetAll() error
+	GetUsers(s string) (*UsersSearch, error)
+	GetUserAPI(s string) (*UsersSearch, error)
+
+	// Leaving. Delete and anonymize return the friends and request counterparts affected
+	DeleteAccount(k apiKey) (*[]string, error)
+	AnonymizeAccount(k apiKey, tombstoneId apiKey, tombstoneName string) (*[]string, error)
+	ExportAccount(k apiKey) (*AccountExport, error)
+
+	// Admin reports
+	AdminUsers(prefix string) ([]AdminUser, error)
+
+	// Append-only audit log
+	AppendAudit(e *AuditEvent) error
+
+	// Outgoing webhooks, and deliveries that failed every attempt
+	Webhooks() ([]Webhook, error)
+	AddDeadLetter(d *DeadLetter) error
+
+	// Incoming webhooks, by token hash. sql.ErrNoRows if there is none
+	GetIncomingWebhook(tokenHash string) (*IncomingWebhook, error)
+
+	// Friend requests
+	SetFriendRequest(name string, reqId string) (string, error)
+	GetFriendRequestByIds(reqId string, resId string) (*UsersSearch, error)
+	GetFriendRequestById(requestId string) (*[]string, error)
+	DeleteFriendRequest(requestId string) error
+
+	// Friendships
+	CreateFriend(f *FriendAcceptData, userId string) error
+	GetFriendshipById(friendshipId string) (*[]string, error)
+	GetFriendshipByIds(id1 string, id2 string) (*[]string, error)
+	GetFriendsById(userId string) (*[]string, error)
+
+	// Messages. A chat with a client id already saved returns
+	// errDuplicateMessage, and one to a missing account or a non-friend
+	// errReceiverNotFound or errNotFriends
+	SaveMessage(chat *Chat, userId apiKey) (*[]string, error)
+
+	// Content sent to clients on login and friendship updates
+	GetAllUserContent(k apiKey) (*UserContent, error)
+	GetAllFriendsContent(k apiKey) (*UserContent, error)
+
+	// Health check for /readyz
+	Ping() error
+	Close() error
+}
+
+// Active store. Set by loadDB, or swapped for a MemoryStore in tests
+var dbConn Store
+
+var (
+	_ Store = (*DBConn)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// SQLite store in a temporary file, migrated to the latest schema
+func newTestDB(t *testing.T) *DBConn {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	conn, err := openDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := autoMigrate(conn.db, path); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Both implementations, for tests that hold them to the same behaviour
+func testStores(t *testing.T) map[string]Store {
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"sqlite": newTestDB(t),
+	}
+}
+
+func createTestUser(t *testing.T, store Store, k apiKey, username string) {
+	t.Helper()
+
+	err := store.CreateNewUser(&clientData{
+		apiKey:       k,
+		loginDetails: LoginDetails{Username: username, Password: "password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveMessage(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			createTestUser(t, store, "alice-key", "alice")
+			createTestUser(t, store, "bob-key", "bob")
+			createTestUser(t, store, "carol-key", "carol")
+
+			requestId, err := store.SetFriendRequest("bob", "alice-key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreateFriend(&FriendAcceptData{Accept: true, RequestId: requestId}, "bob-key")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name string
+				chat Chat
+				want error
+			}{
+				{"friend", Chat{Text: "hi", Receiver: "bob", ClientId: "1"}, nil},
+				{"resent", Chat{Text: "hi", Receiver: "bob", ClientId: "1"}, errDuplicateMessage},
+				{"not friends", Chat{Text: "hi", Receiver: "carol"}, errNotFriends},
+				{"unknown receiver", Chat{Text: "hi", Receiver: "nobody"}, errReceiverNotFound},
+			}
+
+			for _, tt := range tests {
+				friendship, err := store.SaveMessage(&tt.chat, "alice-key")
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("%s: got error %v, want %v", tt.name, err, tt.want)
+				}
+				if err == nil && (friendship == nil || len(*friendship) != 3) {
+					t.Fatalf("%s: got friendship %v", tt.name, friendship)
+				}
+			}
+		})
+	}
+}
+
+func TestRecoverAccountMovesWebhooks(t *testing.T) {
+	conn := newTestDB(t)
+	createTestUser(t, conn, "alice-key", "alice")
+
+	if err := conn.AddWebhook(&Webhook{Id: "hook", URL: "http://example.com", Secret: "secret"}, "alice-key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetRecoveryCodes("alice-key", []string{hashRecoveryCode("CODE")}); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := conn.RecoverAccount("alice-key", "new-key", hashRecoveryCode("CODE"), "hash")
+	if err != nil || !recovered {
+		t.Fatalf("recovered %v, error %v", recovered, err)
+	}
+
+	hooks, err := conn.Webhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 1 || hooks[0].User != "alice" {
+		t.Fatalf("webhooks after recovery: %+v", hooks)
+	}
+
+	if _, err := conn.AnonymizeAccount("new-key", "tombstone-key", "deleted-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks, err = conn.Webhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 0 {
+		t.Fatalf("webhooks after anonymizing: %+v", hooks)
+	}
+}
+
+func TestRecoverAccountMovesIncomingWebhooks(t *testing.T) {
+	conn := newTestDB(t)
+	createTestUser(t, conn, "alice-key", "alice")
+	createTestUser(t, conn, "bob-key", "bob")
+
+	// One posting as alice, one posting to her
+	for _, h := range []IncomingWebhook{
+		{Id: "from-alice", SenderId: "alice-key", ReceiverId: "bob-key"},
+		{Id: "to-alice", SenderId: "bob-key", ReceiverId: "alice-key"},
+	} {
+		if err := conn.AddIncomingWebhook(&h, h.Id+"-token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.SetRecoveryCodes("alice-key", []string{hashRecoveryCode("CODE")}); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := conn.RecoverAccount("alice-key", "new-key", hashRecoveryCode("CODE"), "hash")
+	if err != nil || !recovered {
+		t.Fatalf("recovered %v, error %v", recovered, err)
+	}
+
+	for _, tokenHash := range []string{"from-alice-token", "to-alice-token"} {
+		h, err := conn.GetIncomingWebhook(tokenHash)
+		if err != nil {
+			t.Fatalf("%s after recovery: %v", tokenHash, err)
+		}
+		if h.SenderId != "new-key" && h.ReceiverId != "new-key" {
+			t.Fatalf("%s not moved: %+v", tokenHash, h)
+		}
+	}
+
+	if _, err := conn.AnonymizeAccount("new-key", "tombstone-key", "deleted-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks, err := conn.IncomingWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 0 {
+		t.Fatalf("incoming webhooks after anonymizing: %+v", hooks)
+	}
+}
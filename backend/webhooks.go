@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Outgoing webhooks, for tooling that would otherwise have to poll.
+
+	An admin subscribes a URL with "admin add-webhook", to every user's
+	events or to one user's, choosing from
+
+		message           a chat was saved. The text is as the client sent
+		                  it, so end-to-end encrypted chats stay encrypted
+		friend_accepted   two users became friends
+		login, logout     a user came online or went offline
+
+	AppListener hands each broadcast to the dispatcher, which builds the
+	event away from the listener, so a slow store doesn't hold up chats,
+	and POSTs
+
+		{"id": "...", "event": "message", "at": "2025-01-31T09:00:00Z", "data": {...}}
+
+	to every matching subscription, with the headers
+
+		X-Messaging-Event       the event name
+		X-Messaging-Delivery    the id, the same on every attempt
+		X-Messaging-Timestamp   unix seconds
+		X-Messaging-Signature   sha256=HEX, the HMAC-SHA256 of "TIMESTAMP.BODY"
+		                        keyed with the subscription's secret
+
+	Subscriptions are read from the store at most every
+	webhookRefresh, so a change from the admin command takes up to that
+	long to apply. Receivers should check the signature and refuse stale
+	timestamps.
+	"admin webhook-receiver" does both, for trying a subscription out.
+
+	Network errors, 429 and 5xx responses are retried up to
+	webhook_attempts times, waiting webhook_retry_delay and doubling it
+	after each try. Deliveries refused outright, out of attempts or cut off
+	by shutdown go to the dead letter table, for "admin webhook-failures"
+	and "admin redeliver-webhook". Deliveries run concurrently, so order
+	by "at" rather than by arrival.
+*/
+
+const (
+	WebhookMessage        = "message"
+	WebhookFriendAccepted = "friend_accepted"
+	WebhookLogin          = "login"
+	WebhookLogout         = "logout"
+)
+
+var webhookEvents = []string{WebhookMessage, WebhookFriendAccepted, WebhookLogin, WebhookLogout}
+
+// How far a receiver's clock may be from the timestamp it was sent
+const webhookTolerance = 5 * time.Minute
+
+// How long subscriptions read from the store are used before reading them again
+const webhookRefresh = 5 * time.Second
+
+type Webhook struct {
+	Id     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"-"`
+	// Username the subscription is for. Empty for every user
+	User      string    `json:"user,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscribed to e, and for every user or one of the users e is about
+func (h *Webhook) matches(e *webhookEvent) bool {
+	if !slices.Contains(h.Events, e.Event) {
+		return false
+	}
+	return h.User == "" || slices.Contains(e.users, h.User)
+}
+
+type DeadLetter struct {
+	Id         int64     `json:"id"`
+	WebhookId  string    `json:"webhook_id"`
+	DeliveryId string    `json:"delivery_id"`
+	Event      string    `json:"event"`
+	Payload    string    `json:"payload"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error"`
+	FailedAt   time.Time `json:"failed_at"`
+}
+
+// Body of every delivery
+type webhookEvent struct {
+	Id    string      `json:"id"`
+	Event string      `json:"event"`
+	At    time.Time   `json:"at"`
+	Data  interface{} `json:"data"`
+	// Usernames matched against per-user subscriptions
+	users []string
+}
+
+type WebhookMessageData struct {
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	Text     string `json:"text"`
+	Date     string `json:"date"`
+	// Text is end-to-end encrypted, readable only by the two users
+	Encrypted bool `json:"encrypted"`
+}
+
+type WebhookFriendData struct {
+	Users []string `json:"users"`
+}
+
+type WebhookPresenceData struct {
+	Username string `json:"username"`
+}
+
+// Event for a broadcast made at at, if it is one webhooks are sent for
+func newWebhookEvent(m *BackendMessage, at time.Time) (*webhookEvent, error) {
+
+	e := &webhookEvent{
+		At: at,
+	}
+
+	switch m.Code {
+	case BroadcastChat:
+		chatBroadcast, ok := m.Payload.(*ChatBroadcast)
+		if !ok {
+			return nil, nil
+		}
+
+		// The sender as authenticated, not as the client named itself
+		chat := chatBroadcast.Chat
+		sender := chatBroadcast.Sender
+		if sender == "" {
+			return nil, nil
+		}
+
+		e.Event = WebhookMessage
+		e.Data = &WebhookMessageData{
+			Sender:    sender,
+			Receiver:  chat.Receiver,
+			Text:      chat.Text,
+			Date:      chat.Date,
+			Encrypted: strings.HasPrefix(chat.Text, e2ePrefix),
+		}
+		e.users = []string{sender, chat.Receiver}
+
+	case BroadcastFriendship:
+		// Sent for declined requests too. Only a friendship is an acceptance
+		userIds, ok := m.Payload.(*[]string)
+		if !ok || len(*userIds) < 3 {
+			return nil, nil
+		}
+
+		friendship, err := dbConn.GetFriendshipByIds((*userIds)[1], (*userIds)[2])
+		if err != nil {
+			return nil, err
+		}
+		if len(*friendship) == 0 {
+			return nil, nil
+		}
+
+		// Requesting user first
+		e.Event = WebhookFriendAccepted
+		e.users = []string{registry.Username(apiKey((*userIds)[1])), registry.Username(apiKey((*userIds)[2]))}
+		e.Data = &WebhookFriendData{
+			Users: e.users,
+		}
+
+	case BroadcastLoggedIn, BroadcastLoggedOut:
+		userId, ok := m.Payload.(apiKey)
+		if !ok {
+			return nil, nil
+		}
+
+		e.Event = WebhookLogin
+		if m.Code == BroadcastLoggedOut {
+			e.Event = WebhookLogout
+		}
+		e.users = []string{registry.Username(userId)}
+		e.Data = &WebhookPresenceData{
+			Username: e.users[0],
+		}
+
+	default:
+		return nil, nil
+	}
+
+	id, err := generateId()
+	if err != nil {
+		return nil, err
+	}
+	e.Id = id
+
+	return e, nil
+}
+
+func newWebhookSecret() string {
+	return rand.Text()
+}
+
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check a delivery's signature, and that it was signed within webhookTolerance of now
+func verifyWebhook(secret string, timestamp string, signature string, body []byte, now time.Time) error {
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+
+	if age := now.Sub(time.Unix(seconds, 0)).Abs(); age > webhookTolerance {
+		return fmt.Errorf("timestamp is %s away from now", age.Round(time.Second))
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(signWebhook(secret, timestamp, body))) {
+		return fmt.Errorf("signature does not match")
+	}
+
+	return nil
+}
+
+// POST a signed delivery once. retry is set for failures worth trying again
+func postWebhook(ctx context.Context, client *http.Client, h *Webhook, event string, deliveryId string, body []byte) (retry bool, err error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "messaging-cli-webhooks")
+	req.Header.Set("X-Messaging-Event", event)
+	req.Header.Set("X-Messaging-Delivery", deliveryId)
+	req.Header.Set("X-Messaging-Timestamp", timestamp)
+	req.Header.Set("X-Messaging-Signature", signWebhook(h.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	// Let the connection be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("receiver responded %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// Sends webhooks for AppListener, retrying in the background
+type webhookDispatcher struct {
+	client *http.Client
+	// Closed on shutdown. Deliveries waiting to retry give up
+	stop chan struct{}
+	// Cancelled when shutdown runs out of time, aborting posts in flight
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+	logger   *slog.Logger
+
+	// Subscriptions as last read from the store, and when
+	mu      sync.Mutex
+	hooks   []Webhook
+	hooksAt time.Time
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &webhookDispatcher{
+		client: &http.Client{
+			Timeout: config.WebhookTimeout,
+		},
+		stop:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		logger: slog.With("component", "webhooks"),
+	}
+}
+
+// Start delivering a broadcast to the subscriptions that want it. Returns
+// straight away, so AppListener isn't held up by the store
+func (d *webhookDispatcher) publish(m *BackendMessage) {
+
+	at := time.Now().UTC()
+
+	d.inflight.Add(1)
+	go func() {
+		defer d.inflight.Done()
+		d.dispatch(m, at)
+	}()
+}
+
+// Subscriptions, read from the store if the last read is older than webhookRefresh
+func (d *webhookDispatcher) subscriptions() ([]Webhook, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.hooksAt.IsZero() && time.Since(d.hooksAt) < webhookRefresh {
+		return d.hooks, nil
+	}
+
+	hooks, err := dbConn.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	d.hooks = hooks
+	d.hooksAt = time.Now()
+	return hooks, nil
+}
+
+func (d *webhookDispatcher) dispatch(m *BackendMessage, at time.Time) {
+
+	hooks, err := d.subscriptions()
+	if err != nil {
+		d.logger.Error("Error reading webhooks", "err", err)
+		return
+	}
+
+	// Most servers have none, so skip building events nobody wants
+	if len(hooks) == 0 {
+		return
+	}
+
+	e, err := newWebhookEvent(m, at)
+	if err != nil {
+		d.logger.Error("Error building webhook event", "code", m.Code.String(), "err", err)
+		return
+	}
+	if e == nil {
+		return
+	}
+
+	var body []byte
+
+	for _, h := range hooks {
+		if !h.matches(e) {
+			continue
+		}
+
+		if body == nil {
+			if body, err = json.Marshal(e); err != nil {
+				d.logger.Error("Error encoding webhook event", "event", e.Event, "err", err)
+				return
+			}
+		}
+
+		d.inflight.Add(1)
+		go func() {
+			defer d.inflight.Done()
+			d.deliver(&h, e, body)
+		}()
+	}
+}
+
+// Post until delivered or out of attempts, then dead letter it
+func (d *webhookDispatcher) deliver(h *Webhook, e *webhookEvent, body []byte) {
+
+	logger := d.logger.With("webhook", h.Id, "event", e.Event, "delivery", e.Id)
+	delay := config.WebhookRetryDelay
+
+	attempts := 0
+	var err error
+
+	for attempts < config.WebhookAttempts {
+		attempts++
+
+		var retry bool
+		retry, err = postWebhook(d.ctx, d.client, h, e.Event, e.Id, body)
+		if err == nil {
+			webhookDeliveries.Inc("delivered")
+			logger.Debug("Webhook delivered", "attempts", attempts)
+			return
+		}
+
+		if !retry || attempts == config.WebhookAttempts {
+			break
+		}
+
+		webhookDeliveries.Inc("retried")
+		logger.Warn("Webhook failed, retrying", "attempt", attempts, "in", delay, "err", err)
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+			continue
+		case <-d.stop:
+			err = fmt.Errorf("server shut down before retrying: %w", err)
+		}
+		break
+	}
+
+	webhookDeliveries.Inc("dead_lettered")
+	logger.Error("Webhook failed", "attempts", attempts, "err", err)
+
+	err = dbConn.AddDeadLetter(&DeadLetter{
+		WebhookId:  h.Id,
+		DeliveryId: e.Id,
+		Event:      e.Event,
+		Payload:    string(body),
+		Attempts:   attempts,
+		LastError:  err.Error(),
+	})
+	if err != nil {
+		logger.Error("Error saving failed webhook", "err", err)
+	}
+}
+
+// Give up retries and wait for deliveries in flight. Those still
+// running when ctx is done are aborted, so they are dead lettered
+// before the database closes
+func (d *webhookDispatcher) Close(ctx context.Context) error {
+
+	close(d.stop)
+
+	err := waitContext(ctx, d.inflight.Wait)
+	if err != nil {
+		d.cancel()
+		d.inflight.Wait()
+	}
+
+	d.cancel()
+	return err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"event":"message"}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := signWebhook("secret", timestamp, body)
+
+	if !strings.HasPrefix(signature, "sha256=") {
+		t.Fatalf("signature %q has no sha256= prefix", signature)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      []byte
+		now       time.Time
+		ok        bool
+	}{
+		{"valid", "secret", timestamp, signature, body, now, true},
+		{"clock skew", "secret", timestamp, signature, body, now.Add(-time.Minute), true},
+		{"wrong secret", "other", timestamp, signature, body, now, false},
+		{"tampered body", "secret", timestamp, signature, []byte(`{"event":"login"}`), now, false},
+		{"changed timestamp", "secret", strconv.FormatInt(now.Unix()-1, 10), signature, body, now, false},
+		{"stale", "secret", timestamp, signature, body, now.Add(webhookTolerance + time.Minute), false},
+		{"bad timestamp", "secret", "yesterday", signature, body, now, false},
+	}
+
+	for _, tt := range tests {
+		err := verifyWebhook(tt.secret, tt.timestamp, tt.signature, tt.body, tt.now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// Posts a receiver got, answered with the status codes in turn, the last repeating
+type testReceiver struct {
+	t        *testing.T
+	statuses []int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *testReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Error(err)
+	}
+
+	r.mu.Lock()
+	n := len(r.requests)
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	r.mu.Unlock()
+
+	w.WriteHeader(r.statuses[min(n, len(r.statuses)-1)])
+}
+
+func (r *testReceiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.requests)
+}
+
+func setTestWebhookRetries(t *testing.T, attempts int, delay time.Duration) {
+	oldAttempts, oldDelay := config.WebhookAttempts, config.WebhookRetryDelay
+	config.WebhookAttempts, config.WebhookRetryDelay = attempts, delay
+	t.Cleanup(func() {
+		config.WebhookAttempts, config.WebhookRetryDelay = oldAttempts, oldDelay
+	})
+}
+
+// A dispatcher posting every message to a receiver answering with statuses
+func newTestWebhook(t *testing.T, statuses ...int) (*webhookDispatcher, *testReceiver, *MemoryStore) {
+	t.Helper()
+
+	receiver := &testReceiver{t: t, statuses: statuses}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	store := NewMemoryStore()
+	store.webhooks = []Webhook{{
+		Id:     "hook",
+		URL:    srv.URL,
+		Secret: "secret",
+		Events: []string{WebhookMessage},
+	}}
+	dbConn = store
+
+	return newWebhookDispatcher(), receiver, store
+}
+
+func publishTestChat(d *webhookDispatcher) {
+	d.publish(&BackendMessage{
+		Code: BroadcastChat,
+		Payload: &ChatBroadcast{
+			Chat:   &Message{Sender: "mallory", Receiver: "bob", Text: "hi bob"},
+			Sender: "alice",
+		},
+	})
+}
+
+func deadLetters(store *MemoryStore) []DeadLetter {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return append([]DeadLetter(nil), store.deadLetters...)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	setTestWebhookRetries(t, 3, 10*time.Millisecond)
+	d, receiver, store := newTestWebhook(t, http.StatusInternalServerError, http.StatusOK)
+
+	publishTestChat(d)
+	eventually(t, "the retry", func() bool {
+		return receiver.count() == 2
+	})
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retried once after the 500
+	if n := receiver.count(); n != 2 {
+		t.Fatalf("receiver got %d posts, want 2", n)
+	}
+	if letters := deadLetters(store); len(letters) != 0 {
+		t.Fatalf("delivered webhook dead lettered: %+v", letters)
+	}
+
+	first, last := receiver.requests[0], receiver.requests[1]
+	if first.Header.Get("X-Messaging-Delivery") != last.Header.Get("X-Messaging-Delivery") {
+		t.Fatal("retry sent with a new delivery id")
+	}
+
+	body := receiver.bodies[1]
+	err := verifyWebhook("secret", last.Header.Get("X-Messaging-Timestamp"), last.Header.Get("X-Messaging-Signature"), body, time.Now())
+	if err != nil {
+		t.Fatalf("signature: %v", err)
+	}
+	if event := last.Header.Get("X-Messaging-Event"); event != WebhookMessage {
+		t.Fatalf("event header %q", event)
+	}
+
+	var e struct {
+		Event string             `json:"event"`
+		Data  WebhookMessageData `json:"data"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		t.Fatal(err)
+	}
+
+	// The authenticated sender, whatever the chat claims
+	if e.Event != WebhookMessage || e.Data.Sender != "alice" || e.Data.Receiver != "bob" || e.Data.Text != "hi bob" {
+		t.Fatalf("delivered %s", body)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{"server error", http.StatusServiceUnavailable, 3},
+		{"rate limited", http.StatusTooManyRequests, 3},
+		// Not worth retrying
+		{"refused", http.StatusBadRequest, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestWebhookRetries(t, 3, 10*time.Millisecond)
+			d, receiver, store := newTestWebhook(t, tt.status)
+
+			publishTestChat(d)
+			eventually(t, "the dead letter", func() bool {
+				return len(deadLetters(store)) > 0
+			})
+			if err := d.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := receiver.count(); n != tt.attempts {
+				t.Fatalf("receiver got %d posts, want %d", n, tt.attempts)
+			}
+
+			letters := deadLetters(store)
+			if len(letters) != 1 {
+				t.Fatalf("got dead letters %+v, want one", letters)
+			}
+
+			letter := letters[0]
+			if letter.WebhookId != "hook" || letter.Event != WebhookMessage || letter.Attempts != tt.attempts {
+				t.Fatalf("dead letter %+v", letter)
+			}
+			if letter.DeliveryId != receiver.requests[0].Header.Get("X-Messaging-Delivery") || letter.Payload != string(receiver.bodies[0]) {
+				t.Fatalf("dead letter %+v isn't the delivery posted", letter)
+			}
+			if !strings.Contains(letter.LastError, strconv.Itoa(tt.status)) {
+				t.Fatalf("last error %q", letter.LastError)
+			}
+		})
+	}
+}
+
+// Shutdown doesn't wait out retry delays, and keeps what was left to send
+func TestWebhookCloseDrains(t *testing.T) {
+	setTestWebhookRetries(t, 3, time.Hour)
+	d, receiver, store := newTestWebhook(t, http.StatusServiceUnavailable)
+
+	publishTestChat(d)
+	eventually(t, "the first post", func() bool {
+		return receiver.count() == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := d.Close(ctx); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("closing took %v", took)
+	}
+
+	letters := deadLetters(store)
+	if len(letters) != 1 || letters[0].Attempts != 1 || !strings.Contains(letters[0].LastError, "shut down") {
+		t.Fatalf("got dead letters %+v, want one for the shutdown", letters)
+	}
+	if n := receiver.count(); n != 1 {
+		t.Fatalf("receiver got %d posts after shutdown, want 1", n)
+	}
+}
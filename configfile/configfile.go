@@ -0,0 +1,100 @@
+/*
+Package configfile reads the flat config files of the server and the
+client: TOML "key = value" lines, or YAML "key: value", with # comments
+and [section] headers.
+
+	# Comment
+	addr = ":8080"
+	log_level = debug # trailing comment
+
+	[profile.work]
+	server = 'chat.example.com'
+
+Values may be quoted with double or single quotes. A # after a quoted
+value, or after a space in an unquoted one, starts a comment. There is
+no escaping, nesting or multi-line value.
+*/
+package configfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A key and value, or a section header, read from a file
+type Entry struct {
+	// Line number, from 1
+	Line int
+	// Name in the last [section] header, empty before the first
+	Section string
+	// Empty for the header itself
+	Key string
+	// Unquoted, without any trailing comment
+	Value string
+}
+
+// Header reports whether the entry is a [section] header rather than a key
+func (e Entry) Header() bool {
+	return e.Key == ""
+}
+
+// Read r line by line, calling fn with each entry in order. separator is
+// "=" for TOML or ":" for YAML. Errors, including those from fn, are
+// prefixed with name and the line number
+func Parse(r io.Reader, name string, separator string, fn func(Entry) error) error {
+
+	section := ""
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip blanks and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry := Entry{Line: lineNo}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			entry.Section = section
+		} else {
+			key, value, ok := strings.Cut(line, separator)
+			if !ok {
+				return fmt.Errorf("%s:%d: expected key %s value", name, lineNo, separator)
+			}
+
+			entry.Section = section
+			entry.Key = strings.TrimSpace(key)
+			entry.Value = Unquote(strings.TrimSpace(value))
+
+			if entry.Key == "" {
+				return fmt.Errorf("%s:%d: missing key", name, lineNo)
+			}
+		}
+
+		if err := fn(entry); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, lineNo, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Strip quotes and any trailing comment from a value
+func Unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') {
+		if end := strings.IndexByte(v[1:], v[0]); end >= 0 {
+			return v[1 : end+1]
+		}
+	}
+
+	if i := strings.Index(v, " #"); i >= 0 {
+		return strings.TrimSpace(v[:i])
+	}
+	return v
+}
@@ -0,0 +1,94 @@
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`plain`, `plain`},
+		{`"double"`, `double`},
+		{`'single'`, `single`},
+		{`"with # hash"`, `with # hash`},
+		{`"quoted" # comment`, `quoted`},
+		{`bare # comment`, `bare`},
+		{`no#comment`, `no#comment`},
+		{`"unterminated`, `"unterminated`},
+		{`""`, ``},
+	}
+
+	for _, tt := range tests {
+		if got := Unquote(tt.in); got != tt.want {
+			t.Errorf("Unquote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	file := `
+# Comment
+addr = ":8080"
+level = debug # trailing
+
+[profile.work]
+server = 'chat.example.com'
+`
+
+	var got []string
+	err := Parse(strings.NewReader(file), "test.toml", "=", func(e Entry) error {
+		got = append(got, fmt.Sprintf("%d %s %s=%s %v", e.Line, e.Section, e.Key, e.Value, e.Header()))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"3  addr=:8080 false",
+		"4  level=debug false",
+		"6 profile.work = true",
+		"7 profile.work server=chat.example.com false",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	errUnknown := errors.New("unknown key")
+
+	tests := []struct {
+		name      string
+		file      string
+		separator string
+		want      string
+	}{
+		{"no separator", "a = 1\nb 2\n", "=", "test:2: expected key = value"},
+		{"yaml separator", "a = 1\n", ":", "test:1: expected key : value"},
+		{"missing key", "= 1\n", "=", "test:1: missing key"},
+		{"from fn", "\n\nbad = 1\n", "=", "test:3: unknown key"},
+	}
+
+	for _, tt := range tests {
+		err := Parse(strings.NewReader(tt.file), "test", tt.separator, func(e Entry) error {
+			if e.Key == "bad" {
+				return errUnknown
+			}
+			return nil
+		})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	err := Parse(strings.NewReader("bad = 1\n"), "test", "=", func(Entry) error { return errUnknown })
+	if !errors.Is(err, errUnknown) {
+		t.Errorf("fn's error not wrapped: %v", err)
+	}
+}
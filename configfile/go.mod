@@ -0,0 +1,3 @@
+module github.com/sbow19/messaging-cli-configfile
+
+go 1.24.0
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+/*
+	Account page: change password, replace recovery codes, recover an
+	account onto this device before logging in, export data and delete the
+	account. Recovery codes arrive once, at signup or when replaced, and are
+	only ever shown here.
+*/
+
+type AccountPrimitive struct {
+	// Reference to underlying primitive
+	prim *tview.Pages
+	UIChannels
+}
+
+func (f *AccountPrimitive) End() {
+	f.done <- struct{}{}
+}
+
+func (f *AccountPrimitive) GetPrim() tview.Primitive {
+	return f.prim
+}
+
+func AccountPage(s *appState) IOPrimitive {
+
+	pages := tview.NewPages()
+
+	uiCh := UIChannels{
+		RecUIMess:      make(chan *AppMessage, 3),
+		UIMessage:      s.UIBroadcast,
+		NetworkMessage: s.networkBroadcast,
+		done:           make(chan struct{}),
+	}
+
+	account := AccountPrimitive{
+		prim:       pages,
+		UIChannels: uiCh,
+	}
+
+	changePassword := func() {
+		account.UIMessage <- &AppMessage{
+			Code:    ChangePassword,
+			Payload: nil,
+			Message: "Change password",
+		}
+	}
+	newRecoveryCodes := func() {
+		account.NetworkMessage <- &AppMessage{
+			Code:    RecoveryCodes,
+			Payload: nil,
+			Message: "New recovery codes",
+		}
+	}
+	recoverAccount := func() {
+		account.UIMessage <- &AppMessage{
+			Code:    RecoverAccount,
+			Payload: nil,
+			Message: "Recover account",
+		}
+	}
+	exportData := func() {
+		account.NetworkMessage <- &AppMessage{
+			Code:    ExportData,
+			Payload: nil,
+			Message: "Export my data",
+		}
+	}
+	deleteAccount := func() {
+		account.UIMessage <- &AppMessage{
+			Code:    DeleteAccount,
+			Payload: nil,
+			Message: "Delete account",
+		}
+	}
+
+	list := NewActionList(s.bindings).
+		AddAction("Change password", "You will need your current password", ActionChangePassword, changePassword).
+		AddAction("New recovery codes", "Replace your recovery codes. Old ones stop working", ActionRecoveryCodes, newRecoveryCodes).
+		AddAction("Recover account", "Before logging in, move your account to this device", ActionRecoverAccount, recoverAccount).
+		AddAction("Export my data", "Save your profile, friends and messages as a ZIP", ActionExport, exportData).
+		AddAction("Delete account", "Permanently delete your account", ActionDeleteAccount, deleteAccount)
+	list.SetBorder(true)
+
+	// Prompts are answered in the input bar, so the palette goes there after
+	prompt := func(run func()) func() {
+		return func() {
+			s.palette.Show(ScreenAccount)
+			run()
+			s.palette.Show(ScreenInput)
+		}
+	}
+
+	s.palette.Add(
+		PaletteEntry{Title: "Change password", Action: ActionChangePassword, Run: prompt(changePassword)},
+		PaletteEntry{Title: "New recovery codes", Action: ActionRecoveryCodes, Run: func() {
+			s.palette.Show(ScreenAccount)
+			newRecoveryCodes()
+		}},
+		PaletteEntry{Title: "Recover account", Action: ActionRecoverAccount, Run: prompt(recoverAccount)},
+		PaletteEntry{Title: "Export my data", Action: ActionExport, Run: func() {
+			s.palette.Show(ScreenAccount)
+			exportData()
+		}},
+		PaletteEntry{Title: "Delete account", Action: ActionDeleteAccount, Run: prompt(deleteAccount)},
+	)
+
+	// Recovery codes, cleared once the user confirms they have saved them
+	codes := tview.NewTextView().SetWordWrap(true)
+	codes.SetBorder(true).
+		SetBorderPadding(1, 1, 1, 1).
+		SetTitle("Recovery codes").
+		SetTitleAlign(tview.AlignCenter)
+
+	codes.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if s.bindings.Is(event, ActionDismiss) {
+			codes.SetText("")
+			pages.SwitchToPage("Menu")
+			s.app.SetFocus(list)
+			return nil
+		}
+		return event
+	})
+
+	pages.AddPage("Menu", list, true, true)
+	pages.AddPage("Codes", codes, true, false)
+
+	// Register primitive with UI broadcast handler
+	err := s.SubscribeChannel(account.RecUIMess, UI)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Listen to UI broadcasts
+	go func() {
+
+		for {
+			select {
+			case m := <-account.RecUIMess:
+
+				switch m.Code {
+				case RecoveryCodes:
+					var recoveryCodes []string
+					if err := m.DecodePayload(&recoveryCodes); err != nil {
+						break
+					}
+
+					text := fmt.Sprintf(
+						"%s\n\nWrite these down somewhere safe. Any one of them, with your username, moves your account to a new device if you lose your details file.\n\n\t%s\n\nPress %s when you have saved them.",
+						m.Message,
+						strings.Join(recoveryCodes, "\n\t"),
+						s.bindings.Label(ActionDismiss),
+					)
+
+					s.app.QueueUpdateDraw(func() {
+						codes.SetText(text)
+						pages.SwitchToPage("Codes")
+						s.app.SetFocus(codes)
+					})
+				default:
+					// Do nothing
+				}
+
+			case <-account.done:
+				break
+			}
+		}
+
+	}()
+
+	return &account
+}
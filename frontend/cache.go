@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+/*
+	Local cache of friends and messages, in content.json in the profile's
+	cache directory. It is written whenever content arrives from the server
+	and read at startup, so chats can be read before connecting or while
+	the server is unreachable.
+
+	With encrypt_cache (or -encrypt-cache) the content is sealed with
+	AES-256-GCM under a key derived from a passphrase with PBKDF2-SHA256.
+	The passphrase is asked for on the terminal before the UI starts, or
+	taken from MESSAGING_CACHE_PASSPHRASE. An encrypted cache always needs
+	it, whatever the setting.
+
+	On reconnect the server is trusted for friends and requests. Its
+	messages only reach back as far as its history window, so cached
+	messages are merged with them rather than replaced, and chats with
+	people who are no longer friends are dropped.
+*/
+
+const (
+	cacheFileName     = "content.json"
+	cacheVersion      = 1
+	cacheKDFRounds    = 600000
+	passphraseRetries = 3
+)
+
+// Content kept between sessions
+type CachedContent struct {
+	Username       string             `json:"username"`
+	SavedAt        string             `json:"saved_at"`
+	Friends        []Friend           `json:"friends"`
+	FriendRequests []FriendReqDetails `json:"friend_requests"`
+	Messages       Messages           `json:"messages"`
+	Outbox         []Chat             `json:"outbox,omitempty"`
+	// Users hidden with /block, on this device only
+	Blocked []string `json:"blocked,omitempty"`
+}
+
+// content.json. Content is set for a plaintext cache, the rest for an encrypted one
+type cacheFile struct {
+	Version    int            `json:"version"`
+	Content    *CachedContent `json:"content,omitempty"`
+	Iterations int            `json:"iterations,omitempty"`
+	Salt       []byte         `json:"salt,omitempty"`
+	Nonce      []byte         `json:"nonce,omitempty"`
+	Sealed     []byte         `json:"sealed,omitempty"`
+}
+
+type Cache struct {
+	path string
+
+	// Derived from the passphrase, nil for a plaintext cache. The salt and rounds are kept so saves don't rederive
+	key        []byte
+	salt       []byte
+	iterations int
+
+	mu sync.Mutex
+}
+
+// Open the profile's cache and read what it holds, asking for a passphrase if needed.
+// Content is nil when there is no cache yet
+func OpenCache(p *Profile) (*Cache, *CachedContent, error) {
+
+	if err := os.MkdirAll(p.CacheDir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	c := &Cache{
+		path: filepath.Join(p.CacheDir, cacheFileName),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if p.EncryptCache {
+			passphrase, err := readPassphrase("New cache passphrase: ", true)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := c.setPassphrase(passphrase, nil, cacheKDFRounds); err != nil {
+				return nil, nil, err
+			}
+		}
+		return c, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", c.path, err)
+	}
+
+	if file.Version != cacheVersion {
+		return nil, nil, fmt.Errorf("%s: unknown cache version %d", c.path, file.Version)
+	}
+
+	// Plaintext. Sealed from the next save on if encryption was turned on since
+	if file.Sealed == nil {
+		if p.EncryptCache {
+			passphrase, err := readPassphrase("New cache passphrase: ", true)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := c.setPassphrase(passphrase, nil, cacheKDFRounds); err != nil {
+				return nil, nil, err
+			}
+		}
+		return c, file.Content, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		passphrase, err := readPassphrase("Cache passphrase: ", false)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := c.setPassphrase(passphrase, file.Salt, file.Iterations); err != nil {
+			return nil, nil, err
+		}
+
+		content, err := c.open(&file)
+		if err == nil {
+			return c, content, nil
+		}
+
+		// The environment won't change between attempts
+		if attempt == passphraseRetries || os.Getenv("MESSAGING_CACHE_PASSPHRASE") != "" {
+			return nil, nil, fmt.Errorf("cache passphrase incorrect")
+		}
+		fmt.Fprintln(os.Stderr, "Passphrase incorrect")
+	}
+}
+
+// Passphrase from the environment, or typed without echo. New ones are asked for twice
+func readPassphrase(prompt string, confirm bool) (string, error) {
+
+	if passphrase := os.Getenv("MESSAGING_CACHE_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("the cache is encrypted: run in a terminal or set MESSAGING_CACHE_PASSPHRASE")
+	}
+
+	for {
+		fmt.Fprint(os.Stderr, prompt)
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		if len(passphrase) == 0 {
+			fmt.Fprintln(os.Stderr, "Passphrase must not be empty")
+			continue
+		}
+
+		if !confirm {
+			return string(passphrase), nil
+		}
+
+		fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+
+		if string(again) == string(passphrase) {
+			return string(passphrase), nil
+		}
+		fmt.Fprintln(os.Stderr, "Passphrases don't match")
+	}
+}
+
+// Derive the cache key. A nil salt picks a new one
+func (c *Cache) setPassphrase(passphrase string, salt []byte, iterations int) error {
+
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+	}
+
+	// The count is read from the file before anything in it is authenticated, so never go below ours
+	if iterations < cacheKDFRounds {
+		return fmt.Errorf("%s: key derivation rounds %d below the minimum of %d", c.path, iterations, cacheKDFRounds)
+	}
+
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return err
+	}
+
+	c.key = key
+	c.salt = salt
+	c.iterations = iterations
+	return nil
+}
+
+func (c *Cache) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c *Cache) open(file *cacheFile) (*CachedContent, error) {
+
+	aead, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(nil, file.Nonce, file.Sealed, []byte(cacheFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var content CachedContent
+	if err := json.Unmarshal(plain, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// Replace the cache with content
+func (c *Cache) Save(content *CachedContent) error {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	file := cacheFile{
+		Version: cacheVersion,
+	}
+
+	if c.key == nil {
+		file.Content = content
+	} else {
+		plain, err := json.Marshal(content)
+		if err != nil {
+			return err
+		}
+
+		aead, err := c.aead()
+		if err != nil {
+			return err
+		}
+
+		file.Iterations = c.iterations
+		file.Salt = c.salt
+		file.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(file.Nonce); err != nil {
+			return err
+		}
+		file.Sealed = aead.Seal(nil, file.Nonce, plain, []byte(cacheFileName))
+	}
+
+	data, err := json.Marshal(&file)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Show cached content until the server sends its own. Friends are shown offline
+func (m *appState) LoadCached(content *CachedContent) {
+	m.mu.Lock()
+	m.username = content.Username
+	m.mu.Unlock()
+
+	m.rwmu.Lock()
+	defer m.rwmu.Unlock()
+
+	for i := range content.Friends {
+		content.Friends[i].Active = false
+	}
+
+	m.cachedUser = content.Username
+	m.friends = content.Friends
+	m.friendRequests = content.FriendRequests
+	m.messages = content.Messages
+	m.outbox = content.Outbox
+	m.blocked = content.Blocked
+	if m.messages == nil {
+		m.messages = Messages{}
+	}
+}
+
+// Take the server's content after logging in, keeping cached messages older than its history window
+func (m *appState) ReconcileContent(u *UserContent) {
+	m.mu.Lock()
+	username := m.username
+	m.mu.Unlock()
+
+	m.rwmu.Lock()
+	defer m.rwmu.Unlock()
+
+	// A different account on this profile starts afresh
+	cached := m.messages
+	if m.cachedUser != username {
+		cached = Messages{}
+	}
+	m.cachedUser = username
+
+	merged := Messages{}
+	for friend, messages := range u.Messages {
+		merged[friend] = mergeMessages(cached[friend], messages)
+	}
+
+	m.friends = u.Friends
+	m.friendRequests = u.FriendRequests
+	m.messages = merged
+}
+
+// Union of two message lists, in date order. Encrypted text has a random nonce, so equal messages are the same message
+func mergeMessages(cached []Message, server []Message) []Message {
+
+	type messageKey struct {
+		sender string
+		date   string
+		text   string
+	}
+
+	seen := make(map[messageKey]bool, len(cached))
+	merged := make([]Message, 0, len(cached)+len(server))
+
+	for _, msg := range cached {
+		seen[messageKey{msg.Sender, msg.Date, msg.Text}] = true
+		merged = append(merged, msg)
+	}
+
+	for _, msg := range server {
+		if !seen[messageKey{msg.Sender, msg.Date, msg.Text}] {
+			merged = append(merged, msg)
+		}
+	}
+
+	// Dates are "2006-01-02 15:04" UTC, so they sort as strings
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Date < merged[j].Date
+	})
+
+	return merged
+}
+
+// Write the current content to the cache
+func (m *appState) SaveCache() error {
+
+	if m.cache == nil {
+		return nil
+	}
+
+	m.rwmu.RLock()
+	content := CachedContent{
+		Username:       m.cachedUser,
+		SavedAt:        time.Now().UTC().Format(time.RFC3339),
+		Friends:        m.friends,
+		FriendRequests: m.friendRequests,
+		Messages:       m.messages,
+		Outbox:         m.outbox,
+		Blocked:        m.blocked,
+	}
+	data, err := json.Marshal(&content)
+	m.rwmu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Marshalled under the lock so later appends can't race the write
+	var snapshot CachedContent
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	return m.cache.Save(&snapshot)
+}
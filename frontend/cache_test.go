@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCachedContent() *CachedContent {
+	return &CachedContent{
+		Username: "alice",
+		Friends:  []Friend{{Username: "bob"}},
+		Messages: Messages{
+			"bob": {{Text: "secret plans", Sender: "alice", Receiver: "bob", Date: "2026-01-02 15:04"}},
+		},
+		Blocked: []string{"mallory"},
+	}
+}
+
+func openTestCache(t *testing.T, p *Profile) (*Cache, *CachedContent) {
+	t.Helper()
+
+	c, content, err := OpenCache(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, content
+}
+
+func readCacheFile(t *testing.T, p *Profile) cacheFile {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(p.CacheDir, cacheFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func writeCacheFile(t *testing.T, p *Profile, file *cacheFile) {
+	t.Helper()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(p.CacheDir, cacheFileName), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkCachedContent(t *testing.T, got *CachedContent) {
+	t.Helper()
+
+	want := testCachedContent()
+	if got == nil || got.Username != want.Username || len(got.Friends) != 1 || len(got.Blocked) != 1 ||
+		len(got.Messages["bob"]) != 1 || got.Messages["bob"][0].Text != want.Messages["bob"][0].Text {
+		t.Fatalf("cache read back as %+v", got)
+	}
+}
+
+func TestCachePlaintext(t *testing.T) {
+	p := &Profile{CacheDir: t.TempDir()}
+
+	c, content := openTestCache(t, p)
+	if content != nil {
+		t.Fatalf("new cache holds %+v", content)
+	}
+	if err := c.Save(testCachedContent()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, content = openTestCache(t, p)
+	checkCachedContent(t, content)
+}
+
+func TestCacheEncrypted(t *testing.T) {
+	t.Setenv("MESSAGING_CACHE_PASSPHRASE", "correct horse")
+	p := &Profile{CacheDir: t.TempDir(), EncryptCache: true}
+
+	c, _ := openTestCache(t, p)
+	if err := c.Save(testCachedContent()); err != nil {
+		t.Fatal(err)
+	}
+
+	file := readCacheFile(t, p)
+	if file.Content != nil || file.Sealed == nil || file.Iterations != cacheKDFRounds {
+		t.Fatalf("saved unsealed, or with %d rounds", file.Iterations)
+	}
+	data, _ := os.ReadFile(filepath.Join(p.CacheDir, cacheFileName))
+	if strings.Contains(string(data), "secret plans") {
+		t.Fatal("message text in the sealed cache")
+	}
+
+	// Needs the passphrase, whatever the setting now
+	p.EncryptCache = false
+	_, content := openTestCache(t, p)
+	checkCachedContent(t, content)
+
+	t.Setenv("MESSAGING_CACHE_PASSPHRASE", "wrong horse")
+	if _, _, err := OpenCache(p); err == nil || err.Error() != "cache passphrase incorrect" {
+		t.Fatalf("wrong passphrase: got error %v", err)
+	}
+}
+
+func TestCacheKDFRounds(t *testing.T) {
+	t.Setenv("MESSAGING_CACHE_PASSPHRASE", "correct horse")
+	p := &Profile{CacheDir: t.TempDir(), EncryptCache: true}
+
+	c, _ := openTestCache(t, p)
+	if err := c.Save(testCachedContent()); err != nil {
+		t.Fatal(err)
+	}
+	saved := readCacheFile(t, p)
+
+	// Refused before deriving anything with fewer rounds
+	for _, rounds := range []int{0, 1, cacheKDFRounds - 1} {
+		file := saved
+		file.Iterations = rounds
+		writeCacheFile(t, p, &file)
+
+		_, _, err := OpenCache(p)
+		if err == nil || !strings.Contains(err.Error(), "key derivation rounds") {
+			t.Fatalf("%d rounds: got error %v", rounds, err)
+		}
+	}
+
+	// More rounds than now are kept on the next save
+	more := cacheKDFRounds + 1
+	c = &Cache{path: filepath.Join(p.CacheDir, cacheFileName)}
+	if err := c.setPassphrase("correct horse", nil, more); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(testCachedContent()); err != nil {
+		t.Fatal(err)
+	}
+
+	c, content := openTestCache(t, p)
+	checkCachedContent(t, content)
+	if err := c.Save(content); err != nil {
+		t.Fatal(err)
+	}
+	if file := readCacheFile(t, p); file.Iterations != more {
+		t.Fatalf("saved with %d rounds, read with %d", file.Iterations, more)
+	}
+}
+
+func TestMergeMessages(t *testing.T) {
+	cached := []Message{
+		{Text: "old", Sender: "bob", Date: "2026-01-01 10:00"},
+		{Text: "both", Sender: "alice", Date: "2026-01-02 10:00"},
+	}
+	server := []Message{
+		{Text: "both", Sender: "alice", Date: "2026-01-02 10:00"},
+		{Text: "new", Sender: "bob", Date: "2026-01-03 10:00"},
+		{Text: "between", Sender: "bob", Date: "2026-01-01 12:00"},
+	}
+
+	merged := mergeMessages(cached, server)
+
+	want := []string{"old", "between", "both", "new"}
+	if len(merged) != len(want) {
+		t.Fatalf("merged %+v", merged)
+	}
+	for i, text := range want {
+		if merged[i].Text != text {
+			t.Fatalf("merged %+v, want %v", merged, want)
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+/*
+	Slash commands, typed in a chat in place of a message.
+
+		/me ACTION       sent as a chat, shown as "* alice waves"
+		/status          connection, login and the friend being chatted with
+		/search NAME     search for users to add
+		/open FRIEND     chat with another friend
+		/block USER      hide a user's messages and notifications
+		/unblock USER
+		/blocked         list blocked users
+		/clear           clear the chat screen
+		/help [COMMAND]
+
+	Tab completes command names, and friends' usernames for commands that
+	take one. A line starting with "//" is sent as a chat with the first
+	slash removed, for messages that really begin with a slash.
+
+	Blocking is local to this profile. The server still delivers a blocked
+	user's messages and they are kept in the cache, so unblocking shows
+	them again.
+
+	Commands live in one list, set in init. Run is given the chat it was
+	typed in, and queues what it sends with the call's Network and UI
+	methods. Those go out to the broadcast channels in order once it
+	returns, so commands never block the UI.
+*/
+
+type Command struct {
+	Name string
+	// Argument shown in /help, empty for none
+	Args string
+	Help string
+	// Tab completes the argument from friends' usernames
+	CompleteFriends bool
+	Run             func(c *CommandCall) error
+}
+
+// A command typed in a chat
+type CommandCall struct {
+	s *appState
+	// Friend being chatted with
+	Friend string
+	// Everything after the command name
+	Args string
+
+	// Sent as a chat in place of the command, if set
+	chat     string
+	messages []commandMessage
+}
+
+type commandMessage struct {
+	to BroadcastTypes
+	m  *AppMessage
+}
+
+// Send to the network part once the command returns
+func (c *CommandCall) Network(m *AppMessage) {
+	c.messages = append(c.messages, commandMessage{Network, m})
+}
+
+// Send to the UI once the command returns
+func (c *CommandCall) UI(m *AppMessage) {
+	c.messages = append(c.messages, commandMessage{UI, m})
+}
+
+// Show a line in the chat screen. Only this client sees it
+func (c *CommandCall) Print(format string, a ...interface{}) {
+	c.UI(&AppMessage{
+		Code:    CommandOutput,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// Send text as a chat to the friend
+func (c *CommandCall) Chat(text string) {
+	c.chat = text
+}
+
+func (c *CommandCall) dispatch() {
+	if len(c.messages) == 0 {
+		return
+	}
+
+	// Run from the UI's key handler, which mustn't wait on the broker
+	go func() {
+		for _, cm := range c.messages {
+			switch cm.to {
+			case Network:
+				c.s.networkBroadcast <- cm.m
+			case UI:
+				c.s.UIBroadcast <- cm.m
+			}
+		}
+	}()
+}
+
+var commands []*Command
+
+// Set here rather than where declared, since /help lists them
+func init() {
+	commands = []*Command{
+		{
+			Name: "me",
+			Args: "ACTION",
+			Help: "Send an action, shown as \"* you ACTION\"",
+			Run: func(c *CommandCall) error {
+				if c.Args == "" {
+					return errors.New("usage: /me ACTION")
+				}
+				c.Chat("/me " + c.Args)
+				return nil
+			},
+		},
+		{
+			Name: "status",
+			Help: "Show the connection and whether your friend is online",
+			Run:  runStatus,
+		},
+		{
+			Name: "search",
+			Args: "NAME",
+			Help: "Search for users to add as friends",
+			Run: func(c *CommandCall) error {
+				if c.Args == "" {
+					return errors.New("usage: /search NAME")
+				}
+				c.s.mu.Lock()
+				loggedIn := c.s.loggedIn
+				c.s.mu.Unlock()
+
+				if !loggedIn {
+					return errors.New("not logged in")
+				}
+
+				search := AppMessage{
+					Code:    SearchUsers,
+					Message: "Search users",
+				}
+				search.EncodePayload(&c.Args)
+				c.Network(&search)
+				c.Print("Searching for %q", c.Args)
+				return nil
+			},
+		},
+		{
+			Name:            "open",
+			Args:            "FRIEND",
+			Help:            "Chat with another friend",
+			CompleteFriends: true,
+			Run: func(c *CommandCall) error {
+				friend, ok := c.s.Friend(c.Args)
+				if !ok {
+					return fmt.Errorf("%q is not a friend", c.Args)
+				}
+
+				open := AppMessage{
+					Code:    OpenChat,
+					Message: "Open chat",
+				}
+				open.EncodePayload(&friend)
+				c.UI(&open)
+				return nil
+			},
+		},
+		{
+			Name:            "block",
+			Args:            "USER",
+			Help:            "Hide a user's messages and notifications on this device",
+			CompleteFriends: true,
+			Run: func(c *CommandCall) error {
+				if c.Args == "" {
+					return errors.New("usage: /block USER")
+				}
+				c.s.mu.Lock()
+				username := c.s.username
+				c.s.mu.Unlock()
+
+				if c.Args == username {
+					return errors.New("you can't block yourself")
+				}
+
+				added, err := c.s.Block(c.Args)
+				if err != nil {
+					return err
+				}
+				if !added {
+					c.Print("%s is already blocked", c.Args)
+					return nil
+				}
+				c.Print("Blocked %s. /unblock %s shows their messages again", c.Args, c.Args)
+				return nil
+			},
+		},
+		{
+			Name:            "unblock",
+			Args:            "USER",
+			Help:            "Show a blocked user's messages again",
+			CompleteFriends: true,
+			Run: func(c *CommandCall) error {
+				if c.Args == "" {
+					return errors.New("usage: /unblock USER")
+				}
+
+				removed, err := c.s.Unblock(c.Args)
+				if err != nil {
+					return err
+				}
+				if !removed {
+					c.Print("%s isn't blocked", c.Args)
+					return nil
+				}
+				c.Print("Unblocked %s. Reopen the chat to see earlier messages", c.Args)
+				return nil
+			},
+		},
+		{
+			Name: "blocked",
+			Help: "List blocked users",
+			Run: func(c *CommandCall) error {
+				blocked := c.s.Blocked()
+				if len(blocked) == 0 {
+					c.Print("Nobody is blocked")
+					return nil
+				}
+				c.Print("Blocked: %s", strings.Join(blocked, ", "))
+				return nil
+			},
+		},
+		{
+			Name: "clear",
+			Help: "Clear the chat screen. Messages are kept",
+			Run: func(c *CommandCall) error {
+				c.UI(&AppMessage{
+					Code:    ClearChat,
+					Message: "Chat cleared",
+				})
+				return nil
+			},
+		},
+		{
+			Name: "help",
+			Args: "[COMMAND]",
+			Help: "List commands, or show one",
+			Run:  runHelp,
+		},
+	}
+}
+
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Split "/name args". ok is false for anything that isn't a command
+func parseCommand(text string) (name string, args string, ok bool) {
+	if !strings.HasPrefix(text, "/") || strings.HasPrefix(text, "//") {
+		return "", "", false
+	}
+
+	name, args, _ = strings.Cut(text[1:], " ")
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// Question filter for a chat with friend: runs commands, and passes
+// anything else on to be sent
+func (m *appState) commandFilter(friend string) func(input string) (string, bool) {
+	return func(input string) (string, bool) {
+
+		// Escaped slash
+		if strings.HasPrefix(input, "//") {
+			return input[1:], true
+		}
+
+		name, args, ok := parseCommand(input)
+		if !ok {
+			return input, true
+		}
+
+		call := CommandCall{
+			s:      m,
+			Friend: friend,
+			Args:   args,
+		}
+
+		cmd := findCommand(name)
+		if cmd == nil {
+			call.Print("Unknown command /%s. Try /help", name)
+		} else if err := cmd.Run(&call); err != nil {
+			call.Print("/%s: %v", cmd.Name, err)
+		}
+		call.dispatch()
+
+		if call.chat != "" {
+			return call.chat, true
+		}
+		return "", false
+	}
+}
+
+// Complete a command name, or the friend's username for a command taking one
+func (m *appState) completeCommand(input string) string {
+
+	if !strings.HasPrefix(input, "/") || strings.HasPrefix(input, "//") {
+		return input
+	}
+
+	name, arg, hasArg := strings.Cut(input[1:], " ")
+	if !hasArg {
+		names := make([]string, 0, len(commands))
+		for _, cmd := range commands {
+			names = append(names, cmd.Name)
+		}
+		return "/" + completeWord(name, names, " ")
+	}
+
+	cmd := findCommand(strings.ToLower(name))
+	if cmd == nil || !cmd.CompleteFriends || strings.Contains(arg, " ") {
+		return input
+	}
+
+	return "/" + name + " " + completeWord(arg, m.FriendNames(), "")
+}
+
+// Extend prefix as far as every candidate starting with it agrees. A
+// single match is completed in full, followed by suffix
+func completeWord(prefix string, candidates []string, suffix string) string {
+
+	matches := []string{}
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			matches = append(matches, c)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return prefix
+	case 1:
+		return matches[0] + suffix
+	}
+
+	common := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	return common
+}
+
+func runStatus(c *CommandCall) error {
+	s := c.s
+
+	s.mu.Lock()
+	connected, loggedIn, username := s.connected, s.loggedIn, s.username
+	s.mu.Unlock()
+
+	server := "the server"
+	if s.profile != nil {
+		server = s.profile.Server
+	}
+
+	switch {
+	case loggedIn:
+		c.Print("Logged in to %s as %s", server, username)
+	case connected:
+		c.Print("Connected to %s, not logged in", server)
+	default:
+		c.Print("Not connected to %s. Messages are queued until reconnected", server)
+	}
+
+	if friend, ok := s.Friend(c.Friend); ok {
+		state := "offline"
+		if friend.Active {
+			state = "online"
+		}
+		c.Print("%s is %s", friend.Username, state)
+	}
+
+	if pending := len(s.PendingChats(c.Friend)); pending > 0 {
+		c.Print("%d messages waiting to be sent", pending)
+	}
+
+	if s.IsBlocked(c.Friend) {
+		c.Print("%s is blocked", c.Friend)
+	}
+
+	return nil
+}
+
+func runHelp(c *CommandCall) error {
+
+	if c.Args != "" {
+		cmd := findCommand(strings.ToLower(strings.TrimPrefix(c.Args, "/")))
+		if cmd == nil {
+			return fmt.Errorf("no command %q", c.Args)
+		}
+		c.Print("/%s %s: %s", cmd.Name, cmd.Args, cmd.Help)
+		return nil
+	}
+
+	lines := []string{"Commands (Tab completes, // sends a message starting with /):"}
+	for _, cmd := range commands {
+		usage := strings.TrimSpace("/" + cmd.Name + " " + cmd.Args)
+		lines = append(lines, fmt.Sprintf("  %-18s %s", usage, cmd.Help))
+	}
+	c.Print("%s", strings.Join(lines, "\n"))
+	return nil
+}
+
+// How a chat line reads, with /me actions as "* alice waves". Text that
+// wasn't end-to-end encrypted is marked, since the server could have written it
+func chatLine(sender string, text string, encrypted bool) string {
+	mark := ""
+	if !encrypted {
+		mark = " [red]" + unencryptedMark + "[white]"
+	}
+
+	if action, ok := strings.CutPrefix(text, "/me "); ok {
+		return fmt.Sprintf("[purple::i]* %v %v[white::-]%v", sender, action, mark)
+	}
+	return fmt.Sprintf("[blue::b]%v[white::-]: %v%v", sender, text, mark)
+}
+
+// Friend by username
+func (m *appState) Friend(username string) (Friend, bool) {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	for _, f := range m.friends {
+		if f.Username == username {
+			return f, true
+		}
+	}
+	return Friend{}, false
+}
+
+func (m *appState) FriendNames() []string {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	names := make([]string, 0, len(m.friends))
+	for _, f := range m.friends {
+		names = append(names, f.Username)
+	}
+	return names
+}
+
+// Hide a user's messages and notifications. Returns false if already blocked
+func (m *appState) Block(user string) (bool, error) {
+	m.rwmu.Lock()
+	if slices.Contains(m.blocked, user) {
+		m.rwmu.Unlock()
+		return false, nil
+	}
+	m.blocked = append(m.blocked, user)
+	m.rwmu.Unlock()
+
+	return true, m.SaveCache()
+}
+
+// Returns false if the user wasn't blocked
+func (m *appState) Unblock(user string) (bool, error) {
+	m.rwmu.Lock()
+	before := len(m.blocked)
+	m.blocked = slices.DeleteFunc(m.blocked, func(u string) bool {
+		return u == user
+	})
+	removed := len(m.blocked) != before
+	m.rwmu.Unlock()
+
+	if !removed {
+		return false, nil
+	}
+	return true, m.SaveCache()
+}
+
+func (m *appState) IsBlocked(user string) bool {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	return slices.Contains(m.blocked, user)
+}
+
+func (m *appState) Blocked() []string {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	return slices.Clone(m.blocked)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// State logged out as alice, friends with alfred, alice2 and bob
+func newTestCommandState(t *testing.T) *appState {
+	t.Helper()
+
+	s := NewAppState(nil, nil, nil, nil)
+	if err := s.SetUsername("alice"); err != nil {
+		t.Fatal(err)
+	}
+	s.AssignAllContent(&UserContent{
+		Friends:  []Friend{{Username: "alfred"}, {Username: "alice2"}, {Username: "bob", Active: true}},
+		Messages: Messages{},
+	})
+	return s
+}
+
+// Type input in the chat with bob. Returns what would be sent, if
+// anything, and what the command sent to the UI and network
+func runTestCommand(t *testing.T, s *appState, input string) (string, bool, []*AppMessage) {
+	t.Helper()
+
+	text, send := s.commandFilter("bob")(input)
+
+	// Sent after the filter returns, so wait until nothing more comes
+	out := []*AppMessage{}
+	for {
+		select {
+		case m := <-s.UIBroadcast:
+			out = append(out, m)
+		case m := <-s.networkBroadcast:
+			out = append(out, m)
+		case <-time.After(50 * time.Millisecond):
+			return text, send, out
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		name string
+		args string
+		ok   bool
+	}{
+		{"/help", "help", "", true},
+		{"/HELP  block ", "help", "block", true},
+		{"/me waves at you", "me", "waves at you", true},
+		{"/", "", "", true},
+		{"//etc/hosts", "", "", false},
+		{"hello", "", "", false},
+		{" /help", "", "", false},
+	}
+
+	for _, tt := range tests {
+		name, args, ok := parseCommand(tt.text)
+		if name != tt.name || args != tt.args || ok != tt.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v, want %q, %q, %v", tt.text, name, args, ok, tt.name, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestCommandFilter(t *testing.T) {
+	tests := []struct {
+		input string
+		// Sent as a chat, if send
+		text string
+		send bool
+		// What the command sent, in order
+		codes    []MessageCode
+		messages []string
+	}{
+		{"hello", "hello", true, nil, nil},
+		{"//etc/hosts is missing", "/etc/hosts is missing", true, nil, nil},
+		{"/me waves", "/me waves", true, nil, nil},
+		{"/me", "", false, []MessageCode{CommandOutput}, []string{"/me: usage: /me ACTION"}},
+		{"/nope", "", false, []MessageCode{CommandOutput}, []string{"Unknown command /nope. Try /help"}},
+		{"/clear", "", false, []MessageCode{ClearChat}, []string{"Chat cleared"}},
+		{"/open alfred", "", false, []MessageCode{OpenChat}, []string{"Open chat"}},
+		{"/open zed", "", false, []MessageCode{CommandOutput}, []string{`/open: "zed" is not a friend`}},
+		{"/search carol", "", false, []MessageCode{CommandOutput}, []string{"/search: not logged in"}},
+	}
+
+	s := newTestCommandState(t)
+
+	for _, tt := range tests {
+		text, send, out := runTestCommand(t, s, tt.input)
+		if text != tt.text || send != tt.send {
+			t.Errorf("%q: got %q, %v, want %q, %v", tt.input, text, send, tt.text, tt.send)
+			continue
+		}
+		if len(out) != len(tt.codes) {
+			t.Errorf("%q: sent %d messages, want %d", tt.input, len(out), len(tt.codes))
+			continue
+		}
+		for i, m := range out {
+			if m.Code != tt.codes[i] || m.Message != tt.messages[i] {
+				t.Errorf("%q: sent %v %q, want %v %q", tt.input, m.Code, m.Message, tt.codes[i], tt.messages[i])
+			}
+		}
+	}
+
+	// Once logged in, searches go to the server
+	s.SetLoggedIn()
+	_, _, out := runTestCommand(t, s, "/search carol")
+	if len(out) != 2 || out[0].Code != SearchUsers || out[1].Message != `Searching for "carol"` {
+		t.Fatalf("search sent %+v", out)
+	}
+	var query string
+	if err := json.Unmarshal(out[0].Payload, &query); err != nil || query != "carol" {
+		t.Fatalf("searched for %q, error %v", query, err)
+	}
+}
+
+func TestBlockCommands(t *testing.T) {
+	s := newTestCommandState(t)
+
+	steps := []struct {
+		input  string
+		output string
+	}{
+		{"/block", "/block: usage: /block USER"},
+		{"/block alice", "/block: you can't block yourself"},
+		{"/blocked", "Nobody is blocked"},
+		{"/block bob", "Blocked bob. /unblock bob shows their messages again"},
+		{"/block bob", "bob is already blocked"},
+		{"/block mallory", "Blocked mallory. /unblock mallory shows their messages again"},
+		{"/blocked", "Blocked: bob, mallory"},
+		{"/unblock bob", "Unblocked bob. Reopen the chat to see earlier messages"},
+		{"/unblock bob", "bob isn't blocked"},
+		{"/blocked", "Blocked: mallory"},
+	}
+
+	for _, step := range steps {
+		_, send, out := runTestCommand(t, s, step.input)
+		if send || len(out) != 1 || out[0].Message != step.output {
+			t.Fatalf("%q: sent %v, output %+v, want %q", step.input, send, out, step.output)
+		}
+	}
+
+	if s.IsBlocked("bob") || !s.IsBlocked("mallory") {
+		t.Fatalf("blocked %v after the commands", s.Blocked())
+	}
+}
+
+func TestCompleteCommand(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		// Command names, in full with a space when only one matches
+		{"/he", "/help "},
+		{"/st", "/status "},
+		{"/b", "/block"},
+		{"/blocke", "/blocked "},
+		{"/x", "/x"},
+		// Friends, for commands that take one
+		{"/open b", "/open bob"},
+		{"/open al", "/open al"},
+		{"/open ali", "/open alice2"},
+		{"/OPEN b", "/OPEN bob"},
+		{"/block alf", "/block alfred"},
+		{"/open bob extra", "/open bob extra"},
+		{"/me b", "/me b"},
+		{"/nope b", "/nope b"},
+		// Not commands
+		{"hello", "hello"},
+		{"//o", "//o"},
+	}
+
+	s := newTestCommandState(t)
+
+	for _, tt := range tests {
+		if got := s.completeCommand(tt.input); got != tt.want {
+			t.Errorf("completeCommand(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sbow19/messaging-cli-configfile"
+)
+
+/*
+	Client configuration, read from $XDG_CONFIG_HOME/messaging-cli/config.toml
+
+		# Profile used when --profile is not given
+		profile = "work"
+
+		[profile.work]
+		server = "wss://chat.example.com:8000/ws"
+		ca = "~/work-ca.pem"
+
+		[profile.test]
+		server = "ws://localhost:8000/ws"
+		credentials = "/tmp/test-details.txt"
+		cache = "/tmp/test-cache"
+		encrypt_cache = true
+
+	Each profile has its own server, credentials file and cache directory, so
+	several accounts can run side by side. Unset paths default to per profile
+	directories under the user config and cache dirs.
+*/
+
+const (
+	appDirName     = "messaging-cli"
+	defaultServer  = "ws://localhost:8000/ws"
+	defaultProfile = "default"
+)
+
+type Profile struct {
+	Name string
+	// Websocket URL of the backend
+	Server string
+	// File holding the API key for this profile
+	CredentialsFile string
+	// Directory for locally cached data
+	CacheDir string
+	// Encrypt the local message cache with a passphrase asked for at startup
+	EncryptCache bool
+	// Extra CA certificate (PEM) trusted for wss:// servers
+	CAFile string
+	// SHA-256 of the server's public key, as printed by the server's gencert
+	Pin string
+}
+
+type ClientConfig struct {
+	// Profile picked when none is given on the command line
+	DefaultProfile string
+	Profiles       map[string]*Profile
+}
+
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, appDirName), nil
+}
+
+// Read the client config file. A missing file gives an empty config
+func LoadClientConfig(path string) (*ClientConfig, error) {
+
+	c := &ClientConfig{
+		DefaultProfile: defaultProfile,
+		Profiles:       make(map[string]*Profile),
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := c.parse(file, path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ClientConfig) parse(r io.Reader, path string) error {
+
+	// Profile of the current [profile.name] section, nil at top level
+	var current *Profile
+
+	return configfile.Parse(r, path, "=", func(e configfile.Entry) error {
+
+		// Section header
+		if e.Header() {
+			name, ok := strings.CutPrefix(e.Section, "profile.")
+			if !ok || name == "" {
+				return fmt.Errorf("unknown section %q", e.Section)
+			}
+
+			current = c.profile(name)
+			return nil
+		}
+
+		key, value := e.Key, e.Value
+
+		if current == nil {
+			switch key {
+			case "profile":
+				c.DefaultProfile = value
+			default:
+				return fmt.Errorf("unknown key %q", key)
+			}
+			return nil
+		}
+
+		switch key {
+		case "server":
+			current.Server = value
+		case "credentials":
+			current.CredentialsFile = expandHome(value)
+		case "cache":
+			current.CacheDir = expandHome(value)
+		case "encrypt_cache":
+			encrypt, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for encrypt_cache", value)
+			}
+			current.EncryptCache = encrypt
+		case "ca":
+			current.CAFile = expandHome(value)
+		case "pin":
+			current.Pin = value
+		default:
+			return fmt.Errorf("unknown profile key %q", key)
+		}
+		return nil
+	})
+}
+
+// Get or create a named profile
+func (c *ClientConfig) profile(name string) *Profile {
+	p, ok := c.Profiles[name]
+	if !ok {
+		p = &Profile{
+			Name: name,
+		}
+		c.Profiles[name] = p
+	}
+	return p
+}
+
+func expandHome(p string) string {
+	rest, ok := strings.CutPrefix(p, "~/")
+	if !ok {
+		return p
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, rest)
+}
+
+// Resolve a profile by name, filling in default paths
+func (c *ClientConfig) Resolve(name string) (*Profile, error) {
+
+	if name == "" {
+		name = c.DefaultProfile
+	}
+
+	p, ok := c.Profiles[name]
+	if !ok {
+		// Only the default profile may be used without a config section
+		if name != defaultProfile {
+			return nil, fmt.Errorf("profile %q not found in config", name)
+		}
+		p = &Profile{
+			Name: name,
+		}
+	}
+
+	resolved := *p
+
+	if resolved.Server == "" {
+		resolved.Server = defaultServer
+	}
+
+	if resolved.CredentialsFile == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		resolved.CredentialsFile = filepath.Join(dir, "profiles", name, "details.txt")
+	}
+
+	if resolved.CacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		resolved.CacheDir = filepath.Join(dir, appDirName, name)
+	}
+
+	return &resolved, nil
+}
+
+// Flags every command takes for picking and overriding a profile
+type profileFlags struct {
+	configPath   *string
+	profileName  *string
+	server       *string
+	caFile       *string
+	pin          *string
+	encryptCache *bool
+}
+
+// Register the profile flags on fs
+func newProfileFlags(fs *flag.FlagSet) (*profileFlags, error) {
+
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return &profileFlags{
+		configPath:   fs.String("config", filepath.Join(dir, "config.toml"), "path to the client config file"),
+		profileName:  fs.String("profile", "", "named profile from the config file"),
+		server:       fs.String("server", "", "websocket URL of the server, overriding the profile"),
+		caFile:       fs.String("ca", "", "extra CA certificate (PEM) to trust for wss:// servers"),
+		pin:          fs.String("pin", "", "SHA-256 pin of the server's public key"),
+		encryptCache: fs.Bool("encrypt-cache", false, "encrypt the local message cache with a passphrase"),
+	}, nil
+}
+
+// Profile picked by the parsed flags
+func (f *profileFlags) Profile() (*Profile, error) {
+
+	c, err := LoadClientConfig(*f.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := c.Resolve(*f.profileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if *f.server != "" {
+		p.Server = *f.server
+	}
+
+	if *f.caFile != "" {
+		p.CAFile = *f.caFile
+	}
+
+	if *f.pin != "" {
+		p.Pin = *f.pin
+	}
+
+	if *f.encryptCache {
+		p.EncryptCache = true
+	}
+
+	p.Server = websocketURL(p.Server)
+
+	return p, nil
+}
+
+// Parse command line flags and pick the active profile
+func LoadProfile(args []string) (*Profile, error) {
+
+	fs := flag.NewFlagSet("messaging-cli", flag.ContinueOnError)
+	flags, err := newProfileFlags(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return flags.Profile()
+}
+
+// Servers used to take websockets on /, so a URL with no path gets the /ws route
+func websocketURL(server string) string {
+	u, err := url.Parse(server)
+	if err != nil || (u.Path != "" && u.Path != "/") {
+		return server
+	}
+
+	u.Path = "/ws"
+	return u.String()
+}
+
+// Make sure the credentials file exists, creating a new API key if needed
+func (p *Profile) EnsureCredentials() error {
+
+	if _, err := os.Stat(p.CredentialsFile); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.CredentialsFile), 0700); err != nil {
+		return err
+	}
+
+	// Earlier versions kept the key in details.txt in the working directory
+	if p.Name == defaultProfile {
+		if legacy, err := os.ReadFile("details.txt"); err == nil {
+			return os.WriteFile(p.CredentialsFile, legacy, 0600)
+		}
+	}
+
+	// Get random id
+	randomId, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+
+	apiString := "API_KEY=" + randomId
+
+	// Generate new file with api key
+	return os.WriteFile(p.CredentialsFile, []byte(apiString), 0600)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+	End-to-end encryption of direct messages.
+
+	Each profile has its own device key: an X25519 private key kept in
+	identity.key next to the credentials file. The public half is published
+	after every login, and friends' keys are fetched with KeyLookup and
+	pinned in known_keys.json the first time they are seen. A different key
+	later on means the friend moved to a new device, or someone is in
+	between. Nothing is encrypted to it until the user accepts it or checks
+	the safety number on the friend card, and chats to the friend are held
+	until then. Replaced keys are kept so older messages still decrypt.
+
+	Both ends of a chat derive the same AES-256 key with X25519 and
+	HKDF-SHA256, and each message is sealed with AES-GCM under a random
+	nonce, with the sender and receiver as additional data so the server
+	can't pass a message off as coming from someone else:
+
+		e2e:v1:<base64 of nonce and sealed text>
+
+	Messages without the prefix were sent before encryption, or by a
+	server stripping it. They are shown as they are, marked unencrypted.
+*/
+
+const (
+	e2ePrefix = "e2e:v1:"
+	e2eInfo   = "messaging-cli e2e v1"
+
+	identityKeyFile = "identity.key"
+	knownKeysFile   = "known_keys.json"
+)
+
+// Shown in place of text this device has no key for
+const undecryptable = "[encrypted message]"
+
+// Shown after text that came without end-to-end encryption
+const unencryptedMark = "(unencrypted)"
+
+// Keys pinned for one friend
+type KnownKeys struct {
+	// Newest first
+	Keys []string `json:"keys"`
+	// Safety number of the newest key checked with the friend
+	Verified bool `json:"verified"`
+	// The newest key replaced another and the user hasn't accepted it yet
+	Unconfirmed bool `json:"unconfirmed,omitempty"`
+}
+
+type Keyring struct {
+	private *ecdh.PrivateKey
+
+	// known_keys.json
+	path  string
+	known map[string]*KnownKeys
+
+	mu sync.Mutex
+}
+
+// Load the device key and pinned keys from dir, creating the device key on first use
+func LoadKeyring(dir string) (*Keyring, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	private, err := loadIdentityKey(filepath.Join(dir, identityKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Keyring{
+		private: private,
+		path:    filepath.Join(dir, knownKeysFile),
+		known:   make(map[string]*KnownKeys),
+	}
+
+	data, err := os.ReadFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &k.known); err != nil {
+		return nil, fmt.Errorf("%s: %w", k.path, err)
+	}
+
+	return k, nil
+}
+
+func loadIdentityKey(path string) (*ecdh.PrivateKey, error) {
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return ecdh.X25519().NewPrivateKey(raw)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(private.Bytes()) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+
+	return private, nil
+}
+
+// Public half of the device key, as published
+func (k *Keyring) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(k.private.PublicKey().Bytes())
+}
+
+// Current key of a friend, if known
+func (k *Keyring) Key(username string) (string, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, ok := k.known[username]
+	if !ok || len(known.Keys) == 0 {
+		return "", false
+	}
+	return known.Keys[0], true
+}
+
+// Pin the key a friend published. Returns true if it replaced a different key
+func (k *Keyring) Pin(username string, key string) (bool, error) {
+
+	if _, err := parsePublicKey(key); err != nil {
+		return false, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, ok := k.known[username]
+	if !ok {
+		k.known[username] = &KnownKeys{Keys: []string{key}}
+		return false, k.save()
+	}
+
+	if len(known.Keys) > 0 && known.Keys[0] == key {
+		return false, nil
+	}
+
+	changed := len(known.Keys) > 0
+	known.Keys = append([]string{key}, slices.DeleteFunc(known.Keys, func(old string) bool {
+		return old == key
+	})...)
+	known.Verified = false
+	known.Unconfirmed = changed
+
+	return changed, k.save()
+}
+
+// Mark the safety number with a friend as checked, or not
+func (k *Keyring) SetVerified(username string, verified bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, ok := k.known[username]
+	if !ok || len(known.Keys) == 0 {
+		return fmt.Errorf("no key for %s yet", username)
+	}
+
+	known.Verified = verified
+	// Checking the safety number accepts the key too
+	if verified {
+		known.Unconfirmed = false
+	}
+	return k.save()
+}
+
+// Accept a friend's changed key without checking the safety number
+func (k *Keyring) Confirm(username string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, ok := k.known[username]
+	if !ok || len(known.Keys) == 0 {
+		return fmt.Errorf("no key for %s yet", username)
+	}
+
+	known.Unconfirmed = false
+	return k.save()
+}
+
+// Whether chats may be encrypted to the friend's current key. False from
+// a key change until the user accepts it
+func (k *Keyring) Confirmed(username string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, ok := k.known[username]
+	return !ok || !known.Unconfirmed
+}
+
+// Whether the friend's current key has been checked, and whether it replaced an earlier one
+func (k *Keyring) Status(username string) (verified bool, changed bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	known, ok := k.known[username]
+	if !ok {
+		return false, false
+	}
+	return known.Verified, len(known.Keys) > 1
+}
+
+// Called with k.mu held
+func (k *Keyring) save() error {
+
+	data, err := json.MarshalIndent(k.known, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+func parsePublicKey(key string) (*ecdh.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// AES-256 key shared by this device and the holder of peerKey
+func (k *Keyring) sharedKey(peerKey string) ([]byte, error) {
+
+	peer, err := parsePublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := k.private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both ends must agree on the salt, so order the keys
+	keys := [][]byte{k.private.PublicKey().Bytes(), peer.Bytes()}
+	slices.SortFunc(keys, bytes.Compare)
+
+	return hkdf.Key(sha256.New, secret, bytes.Join(keys, nil), e2eInfo, 32)
+}
+
+func sealer(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func e2eAdditionalData(sender string, receiver string) []byte {
+	return []byte(sender + "\x00" + receiver)
+}
+
+// Encrypt chat text from sender to receiver, whose key is peerKey
+func (k *Keyring) Encrypt(sender string, receiver string, peerKey string, text string) (string, error) {
+
+	key, err := k.sharedKey(peerKey)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := sealer(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(text), e2eAdditionalData(sender, receiver))
+	return e2ePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Whether a message was end-to-end encrypted when sent
+func (m *Message) Encrypted() bool {
+	return strings.HasPrefix(m.Text, e2ePrefix)
+}
+
+// Decrypt a message to or from a friend, trying each key they have had
+func (k *Keyring) Decrypt(m *Message, self string) (string, error) {
+
+	encoded, ok := strings.CutPrefix(m.Text, e2ePrefix)
+	if !ok {
+		return m.Text, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	peer := m.Sender
+	if m.Sender == self {
+		peer = m.Receiver
+	}
+
+	k.mu.Lock()
+	var keys []string
+	if known, ok := k.known[peer]; ok {
+		keys = slices.Clone(known.Keys)
+	}
+	k.mu.Unlock()
+
+	for _, peerKey := range keys {
+		key, err := k.sharedKey(peerKey)
+		if err != nil {
+			continue
+		}
+
+		aead, err := sealer(key)
+		if err != nil || len(sealed) < aead.NonceSize() {
+			continue
+		}
+
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		plain, err := aead.Open(nil, nonce, ciphertext, e2eAdditionalData(m.Sender, m.Receiver))
+		if err == nil {
+			return string(plain), nil
+		}
+	}
+
+	return "", fmt.Errorf("no key for message from %s", m.Sender)
+}
+
+// Digits both friends see for their pair of keys. If they match when read out in person, nobody is in between
+func (k *Keyring) SafetyNumber(username string) (string, bool) {
+
+	peerKey, ok := k.Key(username)
+	if !ok {
+		return "", false
+	}
+
+	peer, err := parsePublicKey(peerKey)
+	if err != nil {
+		return "", false
+	}
+
+	keys := [][]byte{k.private.PublicKey().Bytes(), peer.Bytes()}
+	slices.SortFunc(keys, bytes.Compare)
+	sum := sha256.Sum256(append([]byte(e2eInfo+" safety number"), bytes.Join(keys, nil)...))
+
+	// Six groups of five digits, each from five bytes of the hash
+	groups := make([]string, 0, 6)
+	for i := 0; i < 30; i += 5 {
+		chunk := binary.BigEndian.Uint64(append([]byte{0, 0, 0}, sum[i:i+5]...))
+		groups = append(groups, fmt.Sprintf("%05d", chunk%100000))
+	}
+
+	return strings.Join(groups[:3], " ") + "\n" + strings.Join(groups[3:], " "), true
+}
+
+// Text of a message as it should be shown. Callers mark it with
+// unencryptedMark if msg isn't Encrypted
+func (m *appState) MessageText(msg *Message) string {
+	text, err := m.keys.Decrypt(msg, m.username)
+	if err != nil {
+		return undecryptable
+	}
+	return text
+}
+
+// Replace encrypted text in an export with what this device can read
+func (m *appState) DecryptExport(export *AccountExport) {
+	for friend, messages := range export.Messages {
+		for i := range messages {
+			text, err := m.keys.Decrypt(&messages[i], export.Username)
+			if err != nil {
+				text = undecryptable
+			}
+			export.Messages[friend][i].Text = text
+		}
+	}
+}
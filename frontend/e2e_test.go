@@ -0,0 +1,238 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+// Device keys for the vector below, base64 as in identity.key
+const (
+	testAliceKey = "6d/p47pQ1WJq1VxcTF3LOYjM2MU38QbLAvcU647zILA="
+	testBobKey   = "lLISmPX4PxC/mioNoadqFEvW1jFDN00Sc2JIicAXL9k="
+)
+
+// "hello from alice", from alice to bob under a fixed nonce. The same
+// vector is in backend/botsdk/e2e_test.go, so the app and bots stay able
+// to read each other's messages
+const testVector = "e2e:v1:Zml4ZWQgbm9uY2Uh5E2sSCakueqEtH2vm+uH1q5ytP2Nq8U0mmPFSf58zHg="
+
+// Keyring in a new directory, with the given device key or a new one if empty
+func newTestKeyring(t *testing.T, private string) (*Keyring, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if private != "" {
+		if err := os.WriteFile(filepath.Join(dir, identityKeyFile), []byte(private+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	k, err := LoadKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, dir
+}
+
+func pinTestKey(t *testing.T, k *Keyring, username string, key string) bool {
+	t.Helper()
+
+	changed, err := k.Pin(username, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changed
+}
+
+func encryptTest(t *testing.T, k *Keyring, sender string, receiver string, peerKey string, text string) *Message {
+	t.Helper()
+
+	sealed, err := k.Encrypt(sender, receiver, peerKey, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Message{Text: sealed, Sender: sender, Receiver: receiver}
+}
+
+// alice and bob with each other's keys pinned
+func testKeyrings(t *testing.T) (alice *Keyring, bob *Keyring) {
+	t.Helper()
+
+	alice, _ = newTestKeyring(t, testAliceKey)
+	bob, _ = newTestKeyring(t, testBobKey)
+	pinTestKey(t, alice, "bob", bob.PublicKey())
+	pinTestKey(t, bob, "alice", alice.PublicKey())
+	return alice, bob
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	alice, bob := testKeyrings(t)
+
+	tests := []struct {
+		sender, receiver string
+		from, to         *Keyring
+	}{
+		{"alice", "bob", alice, bob},
+		{"bob", "alice", bob, alice},
+	}
+
+	for _, tt := range tests {
+		m := encryptTest(t, tt.from, tt.sender, tt.receiver, tt.to.PublicKey(), "hi "+tt.receiver)
+		if !m.Encrypted() {
+			t.Fatalf("%s to %s: %q isn't marked encrypted", tt.sender, tt.receiver, m.Text)
+		}
+
+		// Read by the receiver, and by the sender from their history
+		for _, k := range []struct {
+			self    string
+			keyring *Keyring
+		}{{tt.receiver, tt.to}, {tt.sender, tt.from}} {
+			text, err := k.keyring.Decrypt(m, k.self)
+			if err != nil || text != "hi "+tt.receiver {
+				t.Fatalf("%s to %s, read by %s: got %q, error %v", tt.sender, tt.receiver, k.self, text, err)
+			}
+		}
+	}
+
+	// Text sent before encryption is shown as it is
+	if text, err := bob.Decrypt(&Message{Text: "plain", Sender: "alice", Receiver: "bob"}, "bob"); err != nil || text != "plain" {
+		t.Fatalf("unencrypted message: got %q, error %v", text, err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	alice, bob := testKeyrings(t)
+	m := encryptTest(t, alice, "alice", "bob", bob.PublicKey(), "hi bob")
+
+	// Under a friend who has the same key, so only the additional data differs
+	pinTestKey(t, bob, "carol", alice.PublicKey())
+
+	tests := []struct {
+		name    string
+		message Message
+	}{
+		{"other sender", Message{Text: m.Text, Sender: "carol", Receiver: "bob"}},
+		{"other receiver", Message{Text: m.Text, Sender: "alice", Receiver: "dave"}},
+		{"swapped", Message{Text: m.Text, Sender: "bob", Receiver: "alice"}},
+		{"cut short", Message{Text: e2ePrefix + "AAAA", Sender: "alice", Receiver: "bob"}},
+		{"not base64", Message{Text: e2ePrefix + "!!", Sender: "alice", Receiver: "bob"}},
+		{"unknown friend", Message{Text: m.Text, Sender: "erin", Receiver: "bob"}},
+	}
+
+	for _, tt := range tests {
+		if text, err := bob.Decrypt(&tt.message, "bob"); err == nil {
+			t.Errorf("%s: decrypted to %q", tt.name, text)
+		}
+	}
+}
+
+func TestKeyChange(t *testing.T) {
+	alice, bob := testKeyrings(t)
+	old := encryptTest(t, alice, "alice", "bob", bob.PublicKey(), "from the old device")
+
+	if pinTestKey(t, bob, "alice", alice.PublicKey()) {
+		t.Fatal("pinning the same key counted as a change")
+	}
+	if _, err := bob.Pin("alice", "not a key"); err == nil {
+		t.Fatal("pinned an invalid key")
+	}
+	if err := bob.SetVerified("alice", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice on a new device
+	device, _ := newTestKeyring(t, "")
+	pinTestKey(t, device, "bob", bob.PublicKey())
+
+	if !pinTestKey(t, bob, "alice", device.PublicKey()) {
+		t.Fatal("new key not counted as a change")
+	}
+	if bob.Confirmed("alice") {
+		t.Fatal("changed key confirmed before the user accepted it")
+	}
+	if verified, changed := bob.Status("alice"); verified || !changed {
+		t.Fatalf("status after the change: verified %v, changed %v", verified, changed)
+	}
+
+	// Older messages still decrypt with the replaced key
+	if text, err := bob.Decrypt(old, "bob"); err != nil || text != "from the old device" {
+		t.Fatalf("old message: got %q, error %v", text, err)
+	}
+	m := encryptTest(t, device, "alice", "bob", bob.PublicKey(), "from the new device")
+	if text, err := bob.Decrypt(m, "bob"); err != nil || text != "from the new device" {
+		t.Fatalf("new message: got %q, error %v", text, err)
+	}
+
+	if err := bob.Confirm("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !bob.Confirmed("alice") {
+		t.Fatal("accepted key still unconfirmed")
+	}
+	if err := bob.Confirm("nobody"); err == nil {
+		t.Fatal("confirmed a friend with no key")
+	}
+}
+
+func TestKeyringSaved(t *testing.T) {
+	alice, _ := newTestKeyring(t, testAliceKey)
+	bob, dir := newTestKeyring(t, testBobKey)
+	pinTestKey(t, bob, "alice", alice.PublicKey())
+
+	device, _ := newTestKeyring(t, "")
+	pinTestKey(t, bob, "alice", device.PublicKey())
+
+	again, err := LoadKeyring(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.PublicKey() != bob.PublicKey() {
+		t.Fatal("device key changed on reload")
+	}
+	if key, _ := again.Key("alice"); key != device.PublicKey() {
+		t.Fatalf("alice's key on reload is %q", key)
+	}
+	if again.Confirmed("alice") {
+		t.Fatal("unconfirmed key change forgotten on reload")
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob := testKeyrings(t)
+
+	fromAlice, ok := alice.SafetyNumber("bob")
+	if !ok {
+		t.Fatal("no safety number with a pinned key")
+	}
+	fromBob, _ := bob.SafetyNumber("alice")
+	if fromAlice != fromBob {
+		t.Fatalf("alice sees %q, bob sees %q", fromAlice, fromBob)
+	}
+
+	format := regexp.MustCompile(`^\d{5} \d{5} \d{5}\n\d{5} \d{5} \d{5}$`)
+	if !format.MatchString(fromAlice) {
+		t.Fatalf("safety number %q isn't two rows of three groups", fromAlice)
+	}
+
+	if _, ok := alice.SafetyNumber("nobody"); ok {
+		t.Fatal("safety number with no key")
+	}
+
+	device, _ := newTestKeyring(t, "")
+	pinTestKey(t, bob, "alice", device.PublicKey())
+	if changed, _ := bob.SafetyNumber("alice"); changed == fromBob {
+		t.Fatal("safety number unchanged after a key change")
+	}
+}
+
+// Messages bots send decrypt in the app
+func TestE2EVector(t *testing.T) {
+	_, bob := testKeyrings(t)
+
+	m := &Message{Text: testVector, Sender: "alice", Receiver: "bob"}
+	if text, err := bob.Decrypt(m, "bob"); err != nil || text != "hello from alice" {
+		t.Fatalf("got %q, error %v", text, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	Data export. The server sends everything it holds about the user and it
+	is written to the working directory as export-YYYYMMDD-HHMMSS.zip:
+
+		export.json          the full export
+		messages/<name>.txt  one readable transcript per friend
+
+	Encrypted messages are decrypted with this device's keys first. Ones it
+	has no key for are written as "[encrypted message]".
+*/
+
+func writeExport(export *AccountExport) (string, error) {
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("export-%s.zip", time.Now().Format("20060102-150405")))
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeExportZip(file, export); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
+func writeExportZip(file *os.File, export *AccountExport) error {
+
+	archive := zip.NewWriter(file)
+
+	jsonData, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := archive.Create("export.json")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(jsonData); err != nil {
+		return err
+	}
+
+	friends := make([]string, 0, len(export.Messages))
+	for friend := range export.Messages {
+		friends = append(friends, friend)
+	}
+	sort.Strings(friends)
+
+	for _, friend := range friends {
+		w, err := archive.Create("messages/" + transcriptName(friend) + ".txt")
+		if err != nil {
+			return err
+		}
+
+		var transcript strings.Builder
+		for _, m := range export.Messages[friend] {
+			fmt.Fprintf(&transcript, "[%s] %s: %s\n", m.Date, m.Sender, m.Text)
+		}
+
+		if _, err := w.Write([]byte(transcript.String())); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// Usernames are free text, so keep only what is safe in a file name
+func transcriptName(username string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, username)
+
+	if strings.Trim(name, ".") == "" {
+		return "_"
+	}
+	return name
+}
@@ -43,36 +43,87 @@ func FriendsPages(s *appState) IOPrimitive {
 	}
 
 	// Front page
-	list := tview.NewList().
-		AddItem("Search", "Search for new friends", 's', func() {
-			pages.SwitchToPage("Search")
+	var list *ActionList
 
-			if s.loggedIn {
+	showSearch := func() {
+		pages.SwitchToPage("Search")
 
-				friendPages.UIMessage <- &AppMessage{
-					Code:    SearchUsers,
-					Payload: nil,
-					Message: "Type to search users",
-				}
-			}
+		if s.loggedIn {
 
-		}).
-		AddItem("Friends", "Chat with your friends", 'f', func() {
-			pages.SwitchToPage("Friends")
-		}).
-		AddItem("Pending", "See pending friend requests", 'p', func() {
-			pages.SwitchToPage("Pending")
-		}).
-		AddItem("Home", "Home (ctrl+c at any time)", 'x', func() {
 			friendPages.UIMessage <- &AppMessage{
-				Code:    Home,
+				Code:    SearchUsers,
 				Payload: nil,
-				Message: "Returned to home screen",
+				Message: "Type to search users",
 			}
+		}
 
-		})
+	}
+	showChats := func() {
+		pages.SwitchToPage("Friends")
+	}
+	showRequests := func() {
+		pages.SwitchToPage("Pending")
+	}
+	goHome := func() {
+		friendPages.UIMessage <- &AppMessage{
+			Code:    Home,
+			Payload: nil,
+			Message: "Returned to home screen",
+		}
+
+	}
+
+	list = NewActionList(s.bindings).
+		AddAction("Search", "Search for new friends", ActionSearch, showSearch).
+		AddAction("Friends", "Chat with your friends", ActionChats, showChats).
+		AddAction("Pending", "See pending friend requests", ActionRequests, showRequests).
+		AddAction("Home", "Home (ctrl+c at any time)", ActionHome, goHome)
 	list.SetBorder(true)
 
+	// From anywhere, by way of the friends screen
+	s.palette.Add(
+		PaletteEntry{Title: "Search users", Action: ActionSearch, Run: func() {
+			s.palette.Show(ScreenFriends)
+			showSearch()
+			s.palette.Show(ScreenInput)
+		}},
+		PaletteEntry{Title: "Friends list", Action: ActionChats, Run: func() {
+			s.palette.Show(ScreenFriends)
+			showChats()
+		}},
+		PaletteEntry{Title: "Friend requests", Action: ActionRequests, Run: func() {
+			s.palette.Show(ScreenFriends)
+			showRequests()
+		}},
+	)
+
+	// A chat with each friend, as they are when the palette opens
+	s.palette.AddSource(func() []PaletteEntry {
+		entries := []PaletteEntry{}
+		for _, name := range s.FriendNames() {
+			friend, _ := s.Friend(name)
+			entries = append(entries, PaletteEntry{
+				Title: "Open chat with " + name,
+				Run: func() {
+					s.palette.Show(ScreenFriends)
+
+					open := AppMessage{
+						Code:    OpenChat,
+						Message: "Open chat",
+					}
+					open.EncodePayload(&friend)
+
+					// Typing goes straight to the chat
+					s.palette.Show(ScreenInput)
+					go func() {
+						s.UIBroadcast <- &open
+					}()
+				},
+			})
+		}
+		return entries
+	})
+
 	// Search page
 	search := SearchScreen(s)
 
@@ -92,9 +143,7 @@ func FriendsPages(s *appState) IOPrimitive {
 
 	pages.SetBorder(false)
 	pages.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		name := event.Name()
-		switch name {
-		case "Home", "Esc":
+		if s.bindings.Is(event, ActionBack) {
 
 			pages.SwitchToPage("List")
 			s.app.SetFocus(list)
@@ -126,6 +175,9 @@ func FriendsPages(s *appState) IOPrimitive {
 			case m := <-friendPages.RecUIMess:
 
 				switch m.Code {
+				case SearchUsersResults:
+					// Searches can start from a chat, with /search
+					pages.SwitchToPage("Search")
 				case OpenChat:
 					// Get chat details
 					var friend Friend
@@ -194,13 +246,13 @@ func (f *SearchScreenPrimitive) GetPrim() tview.Primitive {
 	return f.prim
 }
 
-func ResultBoxFac(n string, net chan *AppMessage) *tview.Frame {
+func ResultBoxFac(n string, k *KeyBindings, net chan *AppMessage) *tview.Frame {
 
 	txt := tview.NewTextView()
-	txt.SetText(fmt.Sprintf("%q\nDo you want to add friend?(y)", n))
+	txt.SetText(fmt.Sprintf("%q\nDo you want to add friend?(%v)", n, k.Label(ActionYes)))
 	txt.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Rune() {
-		case 'y':
+		switch {
+		case k.Is(event, ActionYes):
 			// Send network message
 			appMess := AppMessage{
 				Code:    FriendRequest,
@@ -242,9 +294,9 @@ func SearchScreen(s *appState) IOPrimitive {
 	hasFocus := 0
 	grid.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 
-		switch event.Key() {
+		switch {
 
-		case tcell.KeyUp:
+		case s.bindings.Is(event, ActionUp):
 
 			if hasFocus-1 >= 0 {
 				hasFocus -= 1
@@ -253,7 +305,7 @@ func SearchScreen(s *appState) IOPrimitive {
 
 			return nil
 
-		case tcell.KeyDown:
+		case s.bindings.Is(event, ActionDown):
 
 			if hasFocus+1 < len(resultsArr) {
 				hasFocus += 1
@@ -309,7 +361,7 @@ func SearchScreen(s *appState) IOPrimitive {
 					grid.SetTitle(fmt.Sprintf("Results: %d", len(results)))
 
 					for i, n := range results {
-						resultBox := ResultBoxFac(n, search.NetworkMessage)
+						resultBox := ResultBoxFac(n, s.bindings, search.NetworkMessage)
 						resultBox.SetFocusFunc(func() {
 							hasFocus = i
 						})
@@ -352,26 +404,69 @@ func SearchScreen(s *appState) IOPrimitive {
 	return &search
 }
 
-// List of all friends, and their active status
-func FriendFac(n *Friend, UIBroadcast chan *AppMessage) *tview.Frame {
+// List of all friends, and their active status. (k) flips the card to the safety number for their key,
+// and (a) accepts a changed key, sending the messages held for it
+func FriendFac(n *Friend, s *appState, UIBroadcast chan *AppMessage) *tview.Frame {
 
 	var activeText string
 	var borderColor tcell.Color
 
+	k := s.bindings
+
 	if n.Active {
-		activeText = "is active. Message? (y)"
+		activeText = fmt.Sprintf("is active. Message? (%v)", k.Label(ActionYes))
 		borderColor = tcell.ColorGreen
 	} else {
-		activeText = "is inactive. Message? (y)"
+		activeText = fmt.Sprintf("is inactive. Message? (%v)", k.Label(ActionYes))
 		borderColor = tcell.ColorDarkRed
 	}
 
+	name := n.Username
+	if n.Bot {
+		name += " (bot)"
+	}
+
+	statusText := func() string {
+		text := fmt.Sprintf("%v %v", name, activeText)
+		if !s.keys.Confirmed(n.Username) {
+			text += fmt.Sprintf("\nKey changed, messages held. Check safety number (%v) or accept it (%v)", k.Label(ActionSafetyNumber), k.Label(ActionAcceptKey))
+		} else if verified, changed := s.keys.Status(n.Username); changed && !verified {
+			text += fmt.Sprintf("\nKey changed, check safety number (%v)", k.Label(ActionSafetyNumber))
+		}
+		return text
+	}
+
+	// Look the key up again, which sends what was held for it
+	release := func() {
+		lookup := AppMessage{
+			Code: KeyLookup,
+		}
+		lookup.EncodePayload(&n.Username)
+		s.networkBroadcast <- &lookup
+	}
+
+	safetyText := func() string {
+		number, ok := s.keys.SafetyNumber(n.Username)
+		if !ok {
+			return fmt.Sprintf("No key for %v yet\nBack (%v)", n.Username, k.Label(ActionSafetyNumber))
+		}
+
+		verified, _ := s.keys.Status(n.Username)
+		state := fmt.Sprintf("Not verified. Compare with theirs, then (%v)", k.Label(ActionVerify))
+		if verified {
+			state = fmt.Sprintf("Verified. Unverify (%v)", k.Label(ActionVerify))
+		}
+		return fmt.Sprintf("Safety number with %v:\n%v\n%v. Back (%v)", n.Username, number, state, k.Label(ActionSafetyNumber))
+	}
+
+	showingSafety := false
+
 	txt := tview.NewTextView()
-	txt.SetText(fmt.Sprintf("%v %v", n.Username, activeText))
+	txt.SetText(statusText())
 
 	txt.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Rune() {
-		case 'y':
+		switch {
+		case k.Is(event, ActionYes):
 			// Send app message to
 			appMess := AppMessage{
 				Code:    OpenChat,
@@ -382,6 +477,40 @@ func FriendFac(n *Friend, UIBroadcast chan *AppMessage) *tview.Frame {
 
 			UIBroadcast <- &appMess
 			return nil
+		case k.Is(event, ActionSafetyNumber):
+			showingSafety = !showingSafety
+			if showingSafety {
+				txt.SetText(safetyText())
+			} else {
+				txt.SetText(statusText())
+			}
+			return nil
+		case k.Is(event, ActionVerify):
+			if !showingSafety {
+				return event
+			}
+			verified, _ := s.keys.Status(n.Username)
+			confirmed := s.keys.Confirmed(n.Username)
+			if err := s.keys.SetVerified(n.Username, !verified); err != nil {
+				return nil
+			}
+			if !confirmed && !verified {
+				release()
+			}
+			txt.SetText(safetyText())
+			return nil
+		case k.Is(event, ActionAcceptKey):
+			if s.keys.Confirmed(n.Username) {
+				return event
+			}
+			if err := s.keys.Confirm(n.Username); err != nil {
+				return nil
+			}
+			release()
+			if !showingSafety {
+				txt.SetText(statusText())
+			}
+			return nil
 		}
 		return event
 	})
@@ -425,9 +554,9 @@ func FriendsScreen(s *appState) IOPrimitive {
 	hasFocus := 0
 	grid.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 
-		switch event.Key() {
+		switch {
 
-		case tcell.KeyUp:
+		case s.bindings.Is(event, ActionUp):
 
 			if hasFocus-1 >= 0 {
 				hasFocus -= 1
@@ -436,7 +565,7 @@ func FriendsScreen(s *appState) IOPrimitive {
 
 			return nil
 
-		case tcell.KeyDown:
+		case s.bindings.Is(event, ActionDown):
 
 			if hasFocus+1 < len(resultsArr) {
 				hasFocus += 1
@@ -485,7 +614,7 @@ func FriendsScreen(s *appState) IOPrimitive {
 						grid.RemoveItem(p)
 					}
 					for i, n := range s.friends {
-						resultBox := FriendFac(&n, list.UIMessage)
+						resultBox := FriendFac(&n, s, list.UIMessage)
 						resultBox.SetFocusFunc(func() {
 							hasFocus = i
 						})
@@ -523,7 +652,7 @@ func FriendsScreen(s *appState) IOPrimitive {
 					}
 					for i, n := range s.friends {
 
-						resultBox := FriendFac(&n, list.UIMessage)
+						resultBox := FriendFac(&n, s, list.UIMessage)
 						resultBox.SetFocusFunc(func() {
 							hasFocus = i
 						})
@@ -551,7 +680,7 @@ func FriendsScreen(s *appState) IOPrimitive {
 
 						}
 					}
-				case NotifyLogin, NotifyInactive:
+				case NotifyLogin, NotifyInactive, KeyLookupResult:
 					// Set header
 					for _, p := range blankArr {
 						grid.RemoveItem(p)
@@ -561,7 +690,7 @@ func FriendsScreen(s *appState) IOPrimitive {
 					}
 					for i, n := range s.friends {
 
-						resultBox := FriendFac(&n, list.UIMessage)
+						resultBox := FriendFac(&n, s, list.UIMessage)
 						resultBox.SetFocusFunc(func() {
 							hasFocus = i
 						})
@@ -618,7 +747,7 @@ func (f *PendingScreenPrimitive) GetPrim() tview.Primitive {
 	return f.prim
 }
 
-func RequestBoxFac(n *FriendReqDetails, net chan *AppMessage) *tview.Frame {
+func RequestBoxFac(n *FriendReqDetails, k *KeyBindings, net chan *AppMessage) *tview.Frame {
 
 	txt := tview.NewTextView()
 
@@ -628,14 +757,14 @@ func RequestBoxFac(n *FriendReqDetails, net chan *AppMessage) *tview.Frame {
 		displayTxt = fmt.Sprintf("%v\nFriend request pending", n.Username)
 		displayBorderCol = tcell.ColorOrange
 	} else {
-		displayTxt = fmt.Sprintf("Friend request from %v: accept? (y/n)", n.Username)
+		displayTxt = fmt.Sprintf("Friend request from %v: accept? (%v/%v)", n.Username, k.Label(ActionYes), k.Label(ActionNo))
 		displayBorderCol = tcell.ColorBlue
 
 	}
 	txt.SetText(displayTxt)
 	txt.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Rune() {
-		case 'n':
+		switch {
+		case k.Is(event, ActionNo):
 			// Send message to backend with rejection
 			aMess := AppMessage{
 				Code:    FriendAccept,
@@ -653,7 +782,7 @@ func RequestBoxFac(n *FriendReqDetails, net chan *AppMessage) *tview.Frame {
 			net <- &aMess
 
 			return nil
-		case 'y':
+		case k.Is(event, ActionYes):
 			// Send message to backend with acceptance
 			aMess := AppMessage{
 				Code:    FriendAccept,
@@ -697,9 +826,9 @@ func PendingScreen(s *appState) IOPrimitive {
 	hasFocus := 0
 	grid.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 
-		switch event.Key() {
+		switch {
 
-		case tcell.KeyUp:
+		case s.bindings.Is(event, ActionUp):
 
 			if hasFocus-1 >= 0 {
 				hasFocus -= 1
@@ -708,7 +837,7 @@ func PendingScreen(s *appState) IOPrimitive {
 
 			return nil
 
-		case tcell.KeyDown:
+		case s.bindings.Is(event, ActionDown):
 
 			if hasFocus+1 < len(resultsArr) {
 				hasFocus += 1
@@ -759,7 +888,7 @@ func PendingScreen(s *appState) IOPrimitive {
 					}
 					for i, n := range s.friendRequests {
 
-						resultBox := RequestBoxFac(&n, s.networkBroadcast)
+						resultBox := RequestBoxFac(&n, s.bindings, s.networkBroadcast)
 						resultBox.SetFocusFunc(func() {
 							hasFocus = i
 						})
@@ -801,7 +930,7 @@ func PendingScreen(s *appState) IOPrimitive {
 					}
 					for i, n := range s.friendRequests {
 
-						resultBox := RequestBoxFac(&n, s.networkBroadcast)
+						resultBox := RequestBoxFac(&n, s.bindings, s.networkBroadcast)
 						resultBox.SetFocusFunc(func() {
 							hasFocus = i
 						})
@@ -892,13 +1021,29 @@ func ChatScreen(s *appState, chatLog *[]Message, friend *Friend) *ChatScreenPrim
 
 	for _, c := range *chatLog {
 
-		length := len(c.Sender + ": " + c.Text)
-		spaces := strings.Repeat(" ", unifGap-length)
-		logs += fmt.Sprintf("[blue::b]%v[white::-]: %v%vSent: %v\n\n", c.Sender, c.Text, spaces, c.Date)
+		// Blocked with /block
+		if s.IsBlocked(c.Sender) {
+			continue
+		}
+
+		text := s.MessageText(&c)
+		length := len(c.Sender + ": " + text)
+		spaces := strings.Repeat(" ", max(unifGap-length, 1))
+		logs += fmt.Sprintf("%v%vSent: %v\n\n", chatLine(c.Sender, text, c.Encrypted()), spaces, c.Date)
 	}
-	txt.SetText(logs)
 
-	txt.ScrollToEnd()
+	// Sent messages, then any still in the outbox
+	render := func() {
+		pending := ""
+		for _, c := range s.PendingChats(friend.Username) {
+			length := len(c.Sender + ": " + c.Text)
+			spaces := strings.Repeat(" ", max(unifGap-length, 1))
+			pending += fmt.Sprintf("%v%v[yellow]Pending[white]\n\n", chatLine(c.Sender, c.Text, true), spaces)
+		}
+		txt.SetText(logs + pending)
+		txt.ScrollToEnd()
+	}
+	render()
 
 	// Listen to UI broadcasts
 	go func() {
@@ -917,11 +1062,30 @@ func ChatScreen(s *appState, chatLog *[]Message, friend *Friend) *ChatScreenPrim
 						break
 					}
 
-					length := len(message.Sender + ": " + message.Text)
-					spaces := strings.Repeat(" ", unifGap-length)
-					logs += fmt.Sprintf("[blue::b]%v[white::-]: %v%vSent: %v\n\n", message.Sender, message.Text, spaces, message.Date)
-					txt.SetText(logs)
-					txt.ScrollToEnd()
+					// Only messages in this chat
+					if message.Sender != friend.Username && message.Receiver != friend.Username {
+						break
+					}
+
+					if s.IsBlocked(message.Sender) {
+						break
+					}
+
+					text := s.MessageText(&message)
+					length := len(message.Sender + ": " + text)
+					spaces := strings.Repeat(" ", max(unifGap-length, 1))
+					logs += fmt.Sprintf("%v%vSent: %v\n\n", chatLine(message.Sender, text, message.Encrypted()), spaces, message.Date)
+					render()
+				case CommandOutput:
+					// Shown here only, never sent
+					logs += fmt.Sprintf("[yellow]%v[white]\n\n", tview.Escape(m.Message))
+					render()
+				case ClearChat:
+					logs = ""
+					render()
+				case SendMessage, MessageAck, FailedMessageSend:
+					// Queued, acknowledged or refused chats change what is pending
+					render()
 				case NotifyLogin:
 					var usr string
 					err := m.DecodePayload(&usr)
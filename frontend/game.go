@@ -53,33 +53,44 @@ func NewGamesView(s *appState) IOPrimitive {
 	}
 
 	// Games options
-	list := tview.NewList().
-		AddItem("Snake", "", 's', func() {
-			gamePages.SwitchToPage("Snake")
-			// Update message box
-			games.UIMessage <- &AppMessage{
-				Code:    GameStart,
-				Payload: nil,
-				Message: "Press space to start",
-			}
+	playSnake := func() {
+		gamePages.SwitchToPage("Snake")
+		// Update message box
+		games.UIMessage <- &AppMessage{
+			Code:    GameStart,
+			Payload: nil,
+			Message: fmt.Sprintf("Press %v to start", s.bindings.Label(ActionStart)),
+		}
 
-		}).
-		AddItem("Invaders from Space", "", 'b', func() {
-			gamePages.SwitchToPage("Space")
-		}).
-		AddItem("Tic-Tac-Toe", "", 't', func() {
-			gamePages.SwitchToPage("Tic")
+	}
+	playInvaders := func() {
+		gamePages.SwitchToPage("Space")
+	}
+	playTicTacToe := func() {
+		gamePages.SwitchToPage("Tic")
 
-		}).
-		AddItem("Home", "Go to home screen", 'x', func() {
-			games.UIMessage <- &AppMessage{
-				Code:    Home,
-				Payload: nil,
-				Message: "Returned to home screen",
-			}
-		})
+	}
+	goHome := func() {
+		games.UIMessage <- &AppMessage{
+			Code:    Home,
+			Payload: nil,
+			Message: "Returned to home screen",
+		}
+	}
+
+	list := NewActionList(s.bindings).
+		AddAction("Snake", "", ActionSnake, playSnake).
+		AddAction("Invaders from Space", "", ActionInvaders, playInvaders).
+		AddAction("Tic-Tac-Toe", "", ActionTicTacToe, playTicTacToe).
+		AddAction("Home", "Go to home screen", ActionHome, goHome)
 	list.SetBorder(true)
 
+	s.palette.Add(PaletteEntry{Title: "Play snake", Action: ActionSnake, Run: func() {
+		s.palette.Show(ScreenGames)
+		playSnake()
+		s.app.SetFocus(gamePages)
+	}})
+
 	// Direct focus to list
 	frontFlex.SetFocusFunc(func() {
 		s.app.SetFocus(list)
@@ -94,9 +105,7 @@ func NewGamesView(s *appState) IOPrimitive {
 	gamePages.AddPage("List", list, true, true)
 	gamePages.AddPage("Snake", snake, true, false)
 	gamePages.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		name := event.Name()
-		switch name {
-		case "Home", "Esc":
+		if s.bindings.Is(event, ActionBack) {
 			gamePages.SwitchToPage("List")
 			games.UIMessage <- &AppMessage{
 				Code:    GameStart,
@@ -363,54 +372,54 @@ func NewSnakeScreen(state *appState) *tview.Table {
 
 		table.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 
-			key := event.Key()
-			switch key {
-			case tcell.KeyRune:
-				switch event.Rune() {
-				case ' ':
-					start = !start
-					if start {
-						state.UIBroadcast <- &AppMessage{
-							Code:    GameStart,
-							Payload: nil,
-							Message: fmt.Sprintf("Points: %d", points),
-						}
-					} else {
-						state.UIBroadcast <- &AppMessage{
-							Code:    GameStart,
-							Payload: nil,
-							Message: "Press space to start",
-						}
+			k := state.bindings
+			switch {
+			case k.Is(event, ActionStart):
+				start = !start
+				if start {
+					state.UIBroadcast <- &AppMessage{
+						Code:    GameStart,
+						Payload: nil,
+						Message: fmt.Sprintf("Points: %d", points),
+					}
+				} else {
+					state.UIBroadcast <- &AppMessage{
+						Code:    GameStart,
+						Payload: nil,
+						Message: fmt.Sprintf("Press %v to start", k.Label(ActionStart)),
 					}
 				}
 				return nil
-			case tcell.KeyEsc, tcell.KeyHome:
+			case k.Is(event, ActionBack):
 				ticker.Stop()
 				return nil
-			case tcell.KeyUp:
+			case k.Is(event, ActionUp):
 				if (direction == up) || (direction == down) {
 					// Do nothing
 				} else {
 					direction = up
 				}
-			case tcell.KeyDown:
+			case k.Is(event, ActionDown):
 				if (direction == up) || (direction == down) {
 					// Do nothing
 				} else {
 					direction = down
 				}
-			case tcell.KeyLeft:
+			case k.Is(event, ActionLeft):
 				if (direction == left) || (direction == right) {
 					// Do nothing
 				} else {
 					direction = left
 				}
-			case tcell.KeyRight:
+			case k.Is(event, ActionRight):
 				if (direction == left) || (direction == right) {
 					// Do nothing
 				} else {
 					direction = right
 				}
+			case event.Key() == tcell.KeyRune:
+				// Other characters don't reach the table
+				return nil
 			}
 			return event
 		})
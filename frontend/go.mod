@@ -2,16 +2,21 @@ module github.com/sbow19/messaging-cli-frontend
 
 go 1.24.0
 
-require golang.org/x/net v0.39.0
+require (
+	github.com/gdamore/tcell/v2 v2.7.1
+	github.com/rivo/tview v0.0.0-20250330220935-949945f8d922
+	golang.org/x/net v0.39.0
+	golang.org/x/term v0.31.0
+)
 
 require (
 	github.com/gdamore/encoding v1.0.0 // indirect
-	github.com/gdamore/tcell/v2 v2.7.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.15 // indirect
-	github.com/rivo/tview v0.0.0-20250330220935-949945f8d922 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/sbow19/messaging-cli-configfile v0.0.0
 	golang.org/x/sys v0.32.0 // indirect
-	golang.org/x/term v0.31.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
 )
+
+replace github.com/sbow19/messaging-cli-configfile => ../configfile
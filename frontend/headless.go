@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+/*
+	Commands that run without the full screen UI, for scripts and CI.
+
+		messaging-cli send --to alice "deploy done"
+		make test 2>&1 | tail -1 | messaging-cli send --to alice
+		messaging-cli tail --json
+
+	Both take the usual profile flags, and use the profile's credentials
+	and device key, so a script should have a profile of its own. They log
+	in as -user (default $MESSAGING_USER) with the password in
+	$MESSAGING_PASSWORD, or typed in when run from a terminal.
+
+	The connection is the same dialBackend and conn the UI uses. Instead of
+	screens, a subscriber on the UI broadcast answers the login prompt and
+	watches for the events the command is waiting on.
+
+	send queues the chat in the outbox, so it goes out, encrypted, as soon
+	as the server's content arrives. It exits once the server acknowledges
+	it, or with an error if it can't be sent within -timeout.
+
+	send fails if the receiver's key changed since it was last accepted.
+	Accept it in the app first.
+
+	tail prints every message received from then on, one per line, or as a
+	JSON object per line with --json. Messages that weren't end-to-end
+	encrypted are marked, or have "encrypted": false. It reconnects if the
+	connection drops and runs until interrupted.
+*/
+
+// Wait between reconnects in tail, as in the UI
+const headlessRetry = 2 * time.Second
+
+// Dispatch a headless subcommand
+func runHeadless(command string, args []string) error {
+	switch command {
+	case "send":
+		return runSend(args)
+	case "tail":
+		return runTail(args)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// App state with no UI, subscribed to what the connection reports
+func headlessState(profile *Profile, username string) (*appState, chan *AppMessage, error) {
+
+	keys, err := LoadKeyring(filepath.Dir(profile.CredentialsFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading encryption keys: %w", err)
+	}
+
+	// No cache, which may need a passphrase, and would be shared with the UI
+	state := NewAppState(nil, profile, keys, nil)
+	state.SetUsername(username)
+
+	events := make(chan *AppMessage, 16)
+	state.SubscribeChannel(events, UI)
+
+	go messageBroker(state)
+
+	return state, events, nil
+}
+
+// Password from the environment, or typed without echo
+func headlessPassword(username string) (string, error) {
+
+	if password := os.Getenv("MESSAGING_PASSWORD"); password != "" {
+		return password, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no password: set MESSAGING_PASSWORD")
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(password), nil
+}
+
+// Answer the server's login prompt
+func headlessLogin(state *appState, username string, password string) {
+
+	login := AppMessage{
+		Code: AttemptLogin,
+	}
+	login.EncodePayload(&LoginDetails{
+		Username: username,
+		Password: password,
+	})
+
+	// The connection may be busy reporting to the UI broadcast this goroutine drains
+	go func() {
+		state.networkBroadcast <- &login
+	}()
+}
+
+// Logging in with a new username creates the account, and its recovery codes are only sent once
+func printRecoveryCodes(m *AppMessage) {
+	var codes []string
+	m.DecodePayload(&codes)
+	fmt.Fprintf(os.Stderr, "New account. Recovery codes, shown only once: %s\n", strings.Join(codes, " "))
+}
+
+// Parse the flags shared by headless commands, returning the profile, username and password
+func headlessFlags(fs *flag.FlagSet, args []string) (*Profile, string, string, error) {
+
+	flags, err := newProfileFlags(fs)
+	if err != nil {
+		return nil, "", "", err
+	}
+	user := fs.String("user", os.Getenv("MESSAGING_USER"), "username to log in as (default $MESSAGING_USER)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, "", "", err
+	}
+
+	if *user == "" {
+		return nil, "", "", fmt.Errorf("no username: use -user or set MESSAGING_USER")
+	}
+
+	profile, err := flags.Profile()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	password, err := headlessPassword(*user)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return profile, *user, password, nil
+}
+
+// send subcommand
+func runSend(args []string) error {
+
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	to := fs.String("to", "", "friend to send the message to")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up if the message isn't sent in this long")
+
+	profile, username, password, err := headlessFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return fmt.Errorf("no receiver: use -to")
+	}
+
+	// Message from the arguments, or piped in
+	text := strings.Join(fs.Args(), " ")
+	if text == "" || text == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+
+	text = strings.TrimRight(text, "\n")
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("no message to send")
+	}
+
+	state, events, err := headlessState(profile, username)
+	if err != nil {
+		return err
+	}
+
+	chat := Chat{
+		Text:     text,
+		Sender:   username,
+		Receiver: *to,
+		ClientId: newClientId(),
+	}
+	state.QueueChat(&chat)
+
+	// Reports ConnectionError whenever it returns, so only one attempt is made
+	go dialBackend(state)
+
+	deadline := time.After(*timeout)
+	loginSent := false
+
+	for {
+		select {
+		case m := <-events:
+			switch m.Code {
+			case LoginDetailsRequired:
+				// Asked again means the login was refused
+				if loginSent {
+					return fmt.Errorf("login failed: %s", m.Message)
+				}
+				headlessLogin(state, username, password)
+				loginSent = true
+
+			case RecoveryCodes:
+				printRecoveryCodes(m)
+
+			case MessageAck:
+				if len(state.PendingChats(*to)) == 0 {
+					return nil
+				}
+
+			case FailedMessageSend, ConnectionError, DatabaseError:
+				return fmt.Errorf("message not sent: %s", m.Message)
+
+			case KeyLookupResult:
+				// A new key for the receiver, worth knowing about even when scripted
+				if m.Message != "" {
+					fmt.Fprintln(os.Stderr, m.Message)
+				}
+			}
+
+		case <-deadline:
+			return fmt.Errorf("message not sent after %v", *timeout)
+		}
+	}
+}
+
+// tail subcommand
+func runTail(args []string) error {
+
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print each message as a JSON object on its own line")
+
+	profile, username, password, err := headlessFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	state, events, err := headlessState(profile, username)
+	if err != nil {
+		return err
+	}
+
+	// Reconnect whenever the connection drops, like the UI
+	go func() {
+		for {
+			dialBackend(state)
+			time.Sleep(headlessRetry)
+		}
+	}()
+
+	loginSent := false
+	encoder := json.NewEncoder(os.Stdout)
+
+	for m := range events {
+		switch m.Code {
+		case LoginDetailsRequired:
+			if loginSent {
+				return fmt.Errorf("login failed: %s", m.Message)
+			}
+			headlessLogin(state, username, password)
+			loginSent = true
+
+		case RecoveryCodes:
+			printRecoveryCodes(m)
+
+		case AllContent:
+			fmt.Fprintf(os.Stderr, "Logged in as %s, waiting for messages\n", username)
+
+		case ConnectionError:
+			// Each connection asks for login details again
+			loginSent = false
+			fmt.Fprintf(os.Stderr, "%s, reconnecting\n", m.Message)
+
+		case ReceiveMessage:
+			var message Message
+			if err := m.DecodePayload(&message); err != nil {
+				break
+			}
+			encrypted := message.Encrypted()
+			message.Text = state.MessageText(&message)
+
+			if *asJSON {
+				line := struct {
+					*Message
+					Encrypted bool `json:"encrypted"`
+				}{&message, encrypted}
+
+				if err := encoder.Encode(&line); err != nil {
+					return err
+				}
+			} else if encrypted {
+				fmt.Printf("%s %s: %s\n", message.Date, message.Sender, message.Text)
+			} else {
+				fmt.Printf("%s %s: %s %s\n", message.Date, message.Sender, message.Text, unencryptedMark)
+			}
+		}
+	}
+
+	return nil
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 
 	"github.com/rivo/tview"
 )
 
 type FramePrimitive struct {
 	// Reference to underlying primitive
-	prim *tview.Frame
+	prim     *tview.Frame
+	textarea *tview.TextArea
+	// Prompting for chats, where commands can be typed
+	chatting atomic.Bool
 
 	UIChannels
 }
@@ -22,7 +28,34 @@ func (f *FramePrimitive) GetPrim() tview.Primitive {
 	return f.prim
 }
 
-func InputBar(s *appState) IOPrimitive {
+// Whether Tab completes a command being typed, rather than moving between panes
+func (f *FramePrimitive) Completing() bool {
+	return f.chatting.Load() && f.textarea.HasFocus() && strings.HasPrefix(f.textarea.GetText(), "/")
+}
+
+// Prompt for chats to the receiver. Slash commands are run rather than sent
+func chatQuestion(s *appState, chat *Chat) *Question {
+	return &Question{
+		q: "Type to chat, or /help for commands",
+		ref: func(input string) {
+			chat.Text = input
+			chat.ClientId = newClientId()
+			// Kept until the server has it, whether or not connected now
+			if err := s.QueueChat(chat); err != nil {
+				go func() {
+					s.UIBroadcast <- &AppMessage{
+						Code:    DatabaseError,
+						Message: fmt.Sprintf("Outbox not saved: %v", err),
+					}
+				}()
+			}
+		},
+		filter:   s.commandFilter(chat.Receiver),
+		complete: s.completeCommand,
+	}
+}
+
+func InputBar(s *appState) *FramePrimitive {
 
 	// Input part
 	textarea := tview.NewTextArea().SetPlaceholder("Type...").SetSize(1, 100)
@@ -41,6 +74,7 @@ func InputBar(s *appState) IOPrimitive {
 
 	input := FramePrimitive{
 		prim:       frame,
+		textarea:   textarea,
 		UIChannels: uiCh,
 	}
 
@@ -72,6 +106,7 @@ func InputBar(s *appState) IOPrimitive {
 					if cancelPrompt != nil {
 						cancelPrompt()
 					}
+					input.chatting.Store(false)
 
 					// Create a new context for this message
 					var ctx context.Context
@@ -106,6 +141,7 @@ func InputBar(s *appState) IOPrimitive {
 					if cancelPrompt != nil {
 						cancelPrompt()
 					}
+					input.chatting.Store(false)
 
 					// Create a new context for this message
 					var ctx context.Context
@@ -121,11 +157,113 @@ func InputBar(s *appState) IOPrimitive {
 						},
 					}
 					go PromptFlow(ctx, m.Code, &questions, m.Message, textarea, input.NetworkMessage, s.UIBroadcast, input.prim, &user)
+				case ChangePassword:
+					if !s.loggedIn {
+						break
+					}
+					// Cancel any previous prompt
+					if cancelPrompt != nil {
+						cancelPrompt()
+					}
+					input.chatting.Store(false)
+
+					// Create a new context for this message
+					var ctx context.Context
+					ctx, cancelPrompt = context.WithCancel(context.Background())
+
+					change := PasswordChange{}
+
+					questions := Questions{
+						&Question{
+							q: "Please type your current password",
+							ref: func(input string) {
+								change.Current = input
+							},
+						},
+						&Question{
+							q: "Please type your new password",
+							ref: func(input string) {
+								change.New = input
+							},
+						},
+					}
+					go PromptFlow(ctx, m.Code, &questions, m.Message, textarea, input.NetworkMessage, s.UIBroadcast, input.prim, &change)
+				case RecoverAccount:
+					// Only before login, in place of the login prompt
+					if s.loggedIn {
+						break
+					}
+					// Cancel any previous prompt
+					if cancelPrompt != nil {
+						cancelPrompt()
+					}
+					input.chatting.Store(false)
+
+					// Create a new context for this message
+					var ctx context.Context
+					ctx, cancelPrompt = context.WithCancel(context.Background())
+
+					recovery := AccountRecovery{}
+
+					questions := Questions{
+						&Question{
+							q: "Please type your username",
+							ref: func(input string) {
+								recovery.Username = input
+								s.SetUsername(input)
+							},
+						},
+						&Question{
+							q: "Please type a recovery code",
+							ref: func(input string) {
+								recovery.Code = input
+							},
+						},
+						&Question{
+							q: "Please type a new password",
+							ref: func(input string) {
+								recovery.NewPassword = input
+							},
+						},
+					}
+					go PromptFlow(ctx, m.Code, &questions, m.Message, textarea, input.NetworkMessage, s.UIBroadcast, input.prim, &recovery)
+				case DeleteAccount:
+					if !s.loggedIn {
+						break
+					}
+					// Cancel any previous prompt
+					if cancelPrompt != nil {
+						cancelPrompt()
+					}
+					input.chatting.Store(false)
+
+					// Create a new context for this message
+					var ctx context.Context
+					ctx, cancelPrompt = context.WithCancel(context.Background())
+
+					deletion := AccountDeletion{}
+
+					questions := Questions{
+						&Question{
+							q: "Please type your password",
+							ref: func(input string) {
+								deletion.Password = input
+							},
+						},
+						&Question{
+							q: "This cannot be undone. Type your username to confirm",
+							ref: func(input string) {
+								deletion.Confirm = input
+							},
+						},
+					}
+					go PromptFlow(ctx, m.Code, &questions, m.Message, textarea, input.NetworkMessage, s.UIBroadcast, input.prim, &deletion)
 				case GameStart:
 					// Cancel any previous prompt
 					if cancelPrompt != nil {
 						cancelPrompt()
 					}
+					input.chatting.Store(false)
 
 					input.prim.Clear()
 					textarea.SetText("", false)
@@ -135,6 +273,7 @@ func InputBar(s *appState) IOPrimitive {
 					if cancelPrompt != nil {
 						cancelPrompt()
 					}
+					input.chatting.Store(false)
 
 					textarea.SetText("", false)
 
@@ -151,13 +290,9 @@ func InputBar(s *appState) IOPrimitive {
 					}
 
 					questions := Questions{
-						&Question{
-							q: "Type to chat",
-							ref: func(input string) {
-								chat.Text = input
-							},
-						},
+						chatQuestion(s, &chat),
 					}
+					input.chatting.Store(true)
 					go PromptFlow(ctx, SendMessage, &questions, m.Message, textarea, input.NetworkMessage, s.UIBroadcast, input.prim, &chat)
 
 				case SendMessage:
@@ -165,6 +300,7 @@ func InputBar(s *appState) IOPrimitive {
 					if cancelPrompt != nil {
 						cancelPrompt()
 					}
+					input.chatting.Store(false)
 
 					textarea.SetText("", false)
 
@@ -180,13 +316,9 @@ func InputBar(s *appState) IOPrimitive {
 					}
 
 					questions := Questions{
-						&Question{
-							q: "Type to chat",
-							ref: func(input string) {
-								chat.Text = input
-							},
-						},
+						chatQuestion(s, &chat),
 					}
+					input.chatting.Store(true)
 					go PromptFlow(ctx, SendMessage, &questions, m.Message, textarea, input.NetworkMessage, s.UIBroadcast, input.prim, &chat)
 
 				default:
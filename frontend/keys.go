@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/sbow19/messaging-cli-configfile"
+)
+
+/*
+	Key bindings, read from $XDG_CONFIG_HOME/messaging-cli/keys.toml
+
+		# action = "key", or several separated by commas
+		palette = "Ctrl+O"
+		back = "Esc, Ctrl+B"
+		yes = "Enter"
+
+	Keys are a single character, or a name as tcell gives it: Tab, Esc,
+	Enter, Up, F1, Ctrl+P, Alt+x and so on, in any case. Actions left out
+	keep their default, and "messaging-cli keys" prints them all. Bindings
+	are per screen, so the same key can do different things on different
+	screens, as "f" does on the home and friends menus.
+*/
+
+type Action string
+
+const (
+	// Everywhere
+	ActionPalette  Action = "palette"
+	ActionNextPane Action = "next_pane"
+	ActionBack     Action = "back"
+
+	// Home menu
+	ActionAbout   Action = "about"
+	ActionFriends Action = "friends"
+	ActionGames   Action = "games"
+	ActionAccount Action = "account"
+	ActionExit    Action = "exit"
+
+	// Friends menu. Home also leaves the games menu
+	ActionSearch   Action = "search"
+	ActionChats    Action = "chats"
+	ActionRequests Action = "requests"
+	ActionHome     Action = "home"
+
+	// Games menu
+	ActionSnake     Action = "snake"
+	ActionInvaders  Action = "invaders"
+	ActionTicTacToe Action = "tic_tac_toe"
+
+	// Account menu
+	ActionChangePassword Action = "change_password"
+	ActionRecoveryCodes  Action = "recovery_codes"
+	ActionRecoverAccount Action = "recover_account"
+	ActionExport         Action = "export"
+	ActionDeleteAccount  Action = "delete_account"
+	ActionDismiss        Action = "dismiss"
+
+	// Cards for friends, requests, search results and notifications
+	ActionYes          Action = "yes"
+	ActionNo           Action = "no"
+	ActionSafetyNumber Action = "safety_number"
+	ActionVerify       Action = "verify"
+	ActionAcceptKey    Action = "accept_key"
+
+	// Moving between cards, and steering in games
+	ActionUp    Action = "up"
+	ActionDown  Action = "down"
+	ActionLeft  Action = "left"
+	ActionRight Action = "right"
+	ActionStart Action = "start"
+)
+
+// Every action and its default keys, in the order "messaging-cli keys" lists them
+var defaultBindings = []struct {
+	action Action
+	keys   string
+}{
+	{ActionPalette, "Ctrl+P"},
+	{ActionNextPane, "Tab"},
+	{ActionBack, "Esc, Home"},
+
+	{ActionAbout, "h"},
+	{ActionFriends, "f"},
+	{ActionGames, "g"},
+	{ActionAccount, "a"},
+	{ActionExit, "x"},
+
+	{ActionSearch, "s"},
+	{ActionChats, "f"},
+	{ActionRequests, "p"},
+	{ActionHome, "x"},
+
+	{ActionSnake, "s"},
+	{ActionInvaders, "b"},
+	{ActionTicTacToe, "t"},
+
+	{ActionChangePassword, "p"},
+	{ActionRecoveryCodes, "n"},
+	{ActionRecoverAccount, "r"},
+	{ActionExport, "e"},
+	{ActionDeleteAccount, "d"},
+	{ActionDismiss, "Enter"},
+
+	{ActionYes, "y"},
+	{ActionNo, "n"},
+	{ActionSafetyNumber, "k"},
+	{ActionVerify, "v"},
+	{ActionAcceptKey, "a"},
+
+	{ActionUp, "Up"},
+	{ActionDown, "Down"},
+	{ActionLeft, "Left"},
+	{ActionRight, "Right"},
+	{ActionStart, "Space"},
+}
+
+type KeyBindings struct {
+	// Keys as written, for labels
+	keys map[Action][]string
+}
+
+func DefaultKeyBindings() *KeyBindings {
+	k := &KeyBindings{
+		keys: make(map[Action][]string, len(defaultBindings)),
+	}
+	for _, b := range defaultBindings {
+		k.keys[b.action], _ = parseKeys(b.keys)
+	}
+	return k
+}
+
+// Bindings from the user's keys.toml
+func loadKeyBindings() (*KeyBindings, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	return LoadKeyBindings(filepath.Join(dir, "keys.toml"))
+}
+
+// Defaults, overridden by the bindings file if there is one
+func LoadKeyBindings(path string) (*KeyBindings, error) {
+
+	k := DefaultKeyBindings()
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := k.parse(file, path); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KeyBindings) parse(r io.Reader, path string) error {
+	return configfile.Parse(r, path, "=", func(e configfile.Entry) error {
+		if e.Header() {
+			return fmt.Errorf("unexpected section %q", e.Section)
+		}
+
+		action := Action(e.Key)
+		if _, ok := k.keys[action]; !ok {
+			return fmt.Errorf("unknown action %q", action)
+		}
+
+		keys, err := parseKeys(e.Value)
+		if err != nil {
+			return err
+		}
+		k.keys[action] = keys
+		return nil
+	})
+}
+
+// Split a comma separated list of keys, checking each names a key
+func parseKeys(list string) ([]string, error) {
+
+	keys := []string{}
+	for _, key := range strings.Split(list, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if !validKey(key) {
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no keys given")
+	}
+	return keys, nil
+}
+
+// Key names tcell gives, normalized. Filled on first use
+var tcellKeyNames map[string]bool
+
+func validKey(key string) bool {
+
+	if tcellKeyNames == nil {
+		tcellKeyNames = map[string]bool{"space": true}
+		for _, name := range tcell.KeyNames {
+			tcellKeyNames[normalizeKey(name)] = true
+		}
+	}
+
+	name := normalizeKey(key)
+	if utf8.RuneCountInString(name) == 1 || tcellKeyNames[name] {
+		return true
+	}
+
+	// Modifiers before a character or named key
+	for _, mod := range []string{"ctrl+", "alt+", "shift+", "meta+"} {
+		if rest, ok := strings.CutPrefix(name, mod); ok {
+			return validKey(rest)
+		}
+	}
+	return false
+}
+
+// Characters match exactly. Names ignore case, and "Ctrl-P" is "Ctrl+P"
+func normalizeKey(key string) string {
+	if utf8.RuneCountInString(key) == 1 {
+		return key
+	}
+	return strings.ReplaceAll(strings.ToLower(key), "-", "+")
+}
+
+// Name of the key pressed, normalized
+func keyName(event *tcell.EventKey) string {
+
+	if event.Key() != tcell.KeyRune {
+		return normalizeKey(event.Name())
+	}
+
+	name := string(event.Rune())
+	if event.Rune() == ' ' {
+		name = "Space"
+	}
+	if event.Modifiers()&tcell.ModAlt != 0 {
+		name = "Alt+" + name
+	}
+	return normalizeKey(name)
+}
+
+// Whether the event is one of the action's keys
+func (k *KeyBindings) Is(event *tcell.EventKey, action Action) bool {
+	name := keyName(event)
+	for _, key := range k.keys[action] {
+		if normalizeKey(key) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// First key bound to the action, for hints such as "Message? (y)"
+func (k *KeyBindings) Label(action Action) string {
+	keys := k.keys[action]
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+// The action's key if it is a plain character, for list shortcuts. 0 otherwise
+func (k *KeyBindings) Rune(action Action) rune {
+	for _, key := range k.keys[action] {
+		if r, size := utf8.DecodeRuneInString(key); size == len(key) {
+			return r
+		}
+	}
+	return 0
+}
+
+// Write every binding in the file format
+func (k *KeyBindings) Write(w io.Writer) error {
+	for _, b := range defaultBindings {
+		if _, err := fmt.Fprintf(w, "%s = %q\n", b.action, strings.Join(k.keys[b.action], ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Menu whose items are picked with bound keys, which needn't be characters
+type ActionList struct {
+	*tview.List
+	keys    *KeyBindings
+	actions []Action
+}
+
+func NewActionList(k *KeyBindings) *ActionList {
+
+	l := &ActionList{
+		List: tview.NewList(),
+		keys: k,
+	}
+
+	// Ahead of the list's own shortcuts, which only take characters
+	l.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		for i, action := range l.actions {
+			if k.Is(event, action) {
+				l.SetCurrentItem(i)
+				if selected := l.GetItemSelectedFunc(i); selected != nil {
+					selected()
+				}
+				return nil
+			}
+		}
+		return event
+	})
+
+	return l
+}
+
+// Add an item picked with the action's keys
+func (l *ActionList) AddAction(text string, secondary string, action Action, selected func()) *ActionList {
+	l.AddItem(text, secondary, l.keys.Rune(action), selected)
+	l.actions = append(l.actions, action)
+	return l
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func runeEvent(r rune) *tcell.EventKey {
+	return tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone)
+}
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"a", true},
+		{"?", true},
+		{"Space", true},
+		{"Enter", true},
+		{"esc", true},
+		{"F12", true},
+		{"Ctrl+P", true},
+		{"ctrl-p", true},
+		{"Alt+x", true},
+		{"Shift+Tab", true},
+		{"", false},
+		{"ab", false},
+		{"Ctrl+", false},
+		{"Ctrl+Nope", false},
+		{"Hyper+x", false},
+		{"F99", false},
+	}
+
+	for _, tt := range tests {
+		if ok := validKey(tt.key); ok != tt.ok {
+			t.Errorf("validKey(%q) = %v, want %v", tt.key, ok, tt.ok)
+		}
+	}
+}
+
+func TestParseKeyBindings(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		// Error containing this, or none if empty
+		err string
+	}{
+		{"unknown action", "nope = x\n", `unknown action "nope"`},
+		{"unknown key", "yes = Ctrl+Nope\n", `unknown key "Ctrl+Nope"`},
+		{"several characters", "yes = yy\n", `unknown key "yy"`},
+		{"one bad key of several", "back = Esc, Hyper+b\n", `unknown key "Hyper+b"`},
+		{"empty", "yes = \"\"\n", "no keys given"},
+		{"only commas", "yes = \", ,\"\n", "no keys given"},
+		{"section", "[keys]\nyes = y\n", `unexpected section "keys"`},
+		{"no value", "yes\n", "keys.toml"},
+
+		{"comments and quotes", "# mine\npalette = \"Ctrl-O\"\nback = 'Esc, ctrl+b' # and b\n", ""},
+		// Later lines win, as in config.toml
+		{"action twice", "yes = y\nyes = j\n", ""},
+		{"key twice", "yes = y, y\n", ""},
+		// Bindings are per screen, so keys may be shared
+		{"key of another action", "yes = n\n", ""},
+	}
+
+	for _, tt := range tests {
+		err := DefaultKeyBindings().parse(strings.NewReader(tt.file), "keys.toml")
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestKeyBindingsOverride(t *testing.T) {
+	k := DefaultKeyBindings()
+	file := "palette = \"Ctrl-O\"\nback = 'Esc, ctrl+b'\nyes = y\nyes = j\nno = y\n"
+	if err := k.parse(strings.NewReader(file), "keys.toml"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		event  *tcell.EventKey
+		action Action
+		want   bool
+	}{
+		{"new palette key", tcell.NewEventKey(tcell.KeyCtrlO, 0, tcell.ModCtrl), ActionPalette, true},
+		{"replaced palette key", tcell.NewEventKey(tcell.KeyCtrlP, 0, tcell.ModCtrl), ActionPalette, false},
+		{"first of two", tcell.NewEventKey(tcell.KeyEsc, 0, tcell.ModNone), ActionBack, true},
+		{"second of two", tcell.NewEventKey(tcell.KeyCtrlB, 0, tcell.ModCtrl), ActionBack, true},
+		{"dropped default", tcell.NewEventKey(tcell.KeyHome, 0, tcell.ModNone), ActionBack, false},
+		{"last line", runeEvent('j'), ActionYes, true},
+		{"earlier line", runeEvent('y'), ActionYes, false},
+		{"shared key", runeEvent('y'), ActionNo, true},
+		{"case of characters", runeEvent('J'), ActionYes, false},
+		{"left out", tcell.NewEventKey(tcell.KeyTab, 0, tcell.ModNone), ActionNextPane, true},
+	}
+
+	for _, tt := range tests {
+		if got := k.Is(tt.event, tt.action); got != tt.want {
+			t.Errorf("%s: %s is %s = %v, want %v", tt.name, tt.event.Name(), tt.action, got, tt.want)
+		}
+	}
+
+	if k.Label(ActionPalette) != "Ctrl-O" || k.Rune(ActionYes) != 'j' || k.Rune(ActionPalette) != 0 {
+		t.Fatalf("label %q, runes %q and %q", k.Label(ActionPalette), k.Rune(ActionYes), k.Rune(ActionPalette))
+	}
+}
+
+// "messaging-cli keys" output reads back as the same bindings
+func TestKeyBindingsWrite(t *testing.T) {
+	k := DefaultKeyBindings()
+	if err := k.parse(strings.NewReader("back = 'Esc, ctrl+b'\nyes = \"#\"\n"), "keys.toml"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := k.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	again := DefaultKeyBindings()
+	if err := again.parse(strings.NewReader(b.String()), "keys.toml"); err != nil {
+		t.Fatalf("reading back:\n%s\n%v", b.String(), err)
+	}
+
+	for _, d := range defaultBindings {
+		if got, want := strings.Join(again.keys[d.action], ", "), strings.Join(k.keys[d.action], ", "); got != want {
+			t.Errorf("%s read back as %q, want %q", d.action, got, want)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
@@ -80,6 +82,21 @@ func (a *AppMessage) EncodePayload(p interface{}) error {
 
 			a.Payload = jsonData
 
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case KeyLookup:
+		// P is the username whose key to look up
+		if result, ok := p.(*string); ok {
+
+			jsonData, err := json.Marshal(*result)
+
+			if err != nil {
+				return err
+			}
+
+			a.Payload = jsonData
+
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
@@ -173,6 +190,66 @@ func (a *AppMessage) EncodePayload(p interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePassword:
+		// P is PasswordChange type
+		if result, ok := p.(*PasswordChange); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			a.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoverAccount:
+		// P is AccountRecovery type
+		if result, ok := p.(*AccountRecovery); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			a.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoveryCodes:
+		// P is the new recovery codes
+		if result, ok := p.(*[]string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			a.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccount:
+		// P is AccountDeletion type
+		if result, ok := p.(*AccountDeletion); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			a.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -207,6 +284,19 @@ func (a *AppMessage) DecodePayload(target interface{}) error {
 				return err
 			}
 
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case KeyLookup:
+		// P is the username whose key to look up
+		if _, ok := target.(*string); ok {
+
+			err := json.Unmarshal(a.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
@@ -327,6 +417,19 @@ func (a *AppMessage) DecodePayload(target interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case RecoveryCodes:
+		// P is the new recovery codes
+		if _, ok := target.(*[]string); ok {
+
+			err := json.Unmarshal(a.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -335,12 +438,24 @@ func (a *AppMessage) DecodePayload(target interface{}) error {
 
 type appState struct {
 	app *tview.Application
+
+	// Profile selected at launch: server, credentials and cache paths
+	profile *Profile
+	// Device key and friends' pinned keys for encrypted messages
+	keys *Keyring
+	// Friends and messages kept on disk between sessions
+	cache *Cache
+	// Keys for each action, and the actions the palette lists
+	bindings *KeyBindings
+	palette  *Palette
 	// Whether connection socket with backend active
 	connected bool
 	// Logged in message from the backend
 	loggedIn bool
 
 	username string
+	// Account the cached messages belong to
+	cachedUser string
 
 	// Channels between networking and UI portion
 
@@ -358,6 +473,10 @@ type appState struct {
 	friends        []Friend
 	friendRequests []FriendReqDetails
 	messages       Messages
+	// Chats waiting for the server to acknowledge them
+	outbox []Chat
+	// Users whose messages and notifications aren't shown
+	blocked []string
 
 	// Done
 	done chan struct{}
@@ -367,15 +486,22 @@ type appState struct {
 	rwmu sync.RWMutex
 }
 
-func NewAppState(app *tview.Application) *appState {
+func NewAppState(app *tview.Application, profile *Profile, keys *Keyring, cache *Cache) *appState {
 	return &appState{
-		app: app,
+		app:     app,
+		profile: profile,
+		keys:    keys,
+		cache:   cache,
+
+		bindings: DefaultKeyBindings(),
+		palette:  NewPalette(),
 
 		connected:            false,
 		networkBroadcast:     make(chan *AppMessage),
 		networkSubscriptions: []chan *AppMessage{},
 
 		username: "",
+		messages: Messages{},
 
 		UIBroadcast:     make(chan *AppMessage),
 		UISubscriptions: []chan *AppMessage{},
@@ -423,17 +549,27 @@ func (m *appState) AssignFriendshipContent(u *UserContent) error {
 }
 
 func (m *appState) AppendMessage(u *Message) error {
+	m.mu.Lock()
+	username := m.username
+	m.mu.Unlock()
+
 	m.rwmu.Lock()
 	defer m.rwmu.Unlock()
 
-	switch u.Receiver {
-	case m.username:
-		m.messages[u.Sender] = append(m.messages[u.Sender], *u)
-	default:
-		m.messages[u.Receiver] = append(m.messages[u.Receiver], *u)
+	friend := u.Receiver
+	if u.Receiver == username {
+		friend = u.Sender
+	}
 
+	// Already shown, from history sent after a reconnect
+	if u.ClientId != "" && slices.ContainsFunc(m.messages[friend], func(msg Message) bool {
+		return msg.Sender == u.Sender && msg.ClientId == u.ClientId
+	}) {
+		return nil
 	}
 
+	m.messages[friend] = append(m.messages[friend], *u)
+
 	return nil
 
 }
@@ -549,9 +685,57 @@ func (m *appState) UnsubscribeChannel(c chan *AppMessage, t BroadcastTypes) erro
 }
 
 func main() {
+	// Scripting commands run without the UI
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "send", "tail":
+			if err := runHeadless(os.Args[1], os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "messaging-cli %s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		case "keys":
+			// Bindings in force, in the format of the bindings file
+			bindings, err := loadKeyBindings()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "messaging-cli keys: %v\n", err)
+				os.Exit(1)
+			}
+			bindings.Write(os.Stdout)
+			return
+		}
+	}
+
+	// Flags and config file pick the profile
+	profile, err := LoadProfile(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	// Device key lives with the profile's credentials
+	keys, err := LoadKeyring(filepath.Dir(profile.CredentialsFile))
+	if err != nil {
+		log.Fatalf("Error loading encryption keys: %v", err)
+	}
+
+	// Asks for the cache passphrase, so before the UI takes the terminal
+	cache, cached, err := OpenCache(profile)
+	if err != nil {
+		log.Fatalf("Error opening local cache: %v", err)
+	}
+
+	bindings, err := loadKeyBindings()
+	if err != nil {
+		log.Fatalf("Error loading key bindings: %v", err)
+	}
+
 	app := tview.NewApplication()
 
-	myAppState := NewAppState(app)
+	myAppState := NewAppState(app, profile, keys, cache)
+	myAppState.bindings = bindings
+	if cached != nil {
+		myAppState.LoadCached(cached)
+	}
 	// go logger(myAppState)
 
 	// Mnage intra-app messages
@@ -568,10 +752,20 @@ func main() {
 		}
 	}()
 	// Set up UI. Receive channels. Gene
-	flex := getUI(myAppState)
+	root := getUI(myAppState)
+
+	// Show cached chats while the server is reached
+	if cached != nil {
+		go func() {
+			myAppState.UIBroadcast <- &AppMessage{
+				Code:    AllContent,
+				Message: "Offline: showing cached content",
+			}
+		}()
+	}
 
 	// Start UI
-	if err := app.SetRoot(flex, true).EnableMouse(true).Run(); err != nil {
+	if err := app.SetRoot(root, true).EnableMouse(true).Run(); err != nil {
 		panic(err)
 	}
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/gdamore/tcell/v2"
@@ -67,6 +68,8 @@ func NewMessageBox(s *appState) IOPrimitive {
 				case UpdateFriendContent:
 					messageBox.SetText("")
 					messageBox.SetText(m.Message)
+				case ChangePasswordResult, RecoverAccountResult, DeleteAccountResult, ExportDataResult, Announcement, FailedMessageSend, KeyLookupResult, DatabaseError:
+					messageBox.SetText(m.Message)
 				default:
 					//Do nothing
 				}
@@ -189,26 +192,60 @@ func MainScreenPages(s *appState) IOPrimitive {
 	// Friends page - implements Search for new friends
 	friends := FriendsPages(s)
 
+	// Account page - password, recovery codes and recovery
+	account := AccountPage(s)
+
 	// Front page
-	list := tview.NewList().
-		AddItem("About", "Learn more about this project", 'h', func() {
-			pages.SwitchToPage("About")
-			s.app.SetFocus(text)
-
-		}).
-		AddItem("Friends", "Look for friends and chat", 'f', func() {
-			pages.SwitchToPage("Friends")
-			s.app.SetFocus(friends.GetPrim())
-		}).
-		AddItem("Games", "Play some terminal games", 'g', func() {
-			pages.SwitchToPage("Games")
-			s.app.SetFocus(games.GetPrim())
-
-		}).
-		AddItem("Exit", "End session (ctrl+c at any time)", 'x', func() {
-			s.done <- struct{}{}
-		})
-	list.SetBorder(true)
+	var list *ActionList
+
+	showHome := func() {
+		pages.SwitchToPage("Home")
+		s.app.SetFocus(list)
+	}
+	showAbout := func() {
+		pages.SwitchToPage("About")
+		s.app.SetFocus(text)
+	}
+	showFriends := func() {
+		pages.SwitchToPage("Friends")
+		s.app.SetFocus(friends.GetPrim())
+	}
+	showGames := func() {
+		pages.SwitchToPage("Games")
+		s.app.SetFocus(games.GetPrim())
+	}
+	showAccount := func() {
+		pages.SwitchToPage("Account")
+		s.app.SetFocus(account.GetPrim())
+	}
+	exit := func() {
+		s.done <- struct{}{}
+	}
+
+	list = NewActionList(s.bindings).
+		AddAction("About", "Learn more about this project", ActionAbout, showAbout).
+		AddAction("Friends", "Look for friends and chat", ActionFriends, showFriends).
+		AddAction("Games", "Play some terminal games", ActionGames, showGames).
+		AddAction("Account", "Password and account recovery", ActionAccount, showAccount).
+		AddAction("Exit", "End session (ctrl+c at any time)", ActionExit, exit)
+	list.SetBorder(true).
+		SetTitle(fmt.Sprintf(" %v for every action ", s.bindings.Label(ActionPalette)))
+
+	// Other screens' palette entries bring these up first
+	s.palette.AddScreen(ScreenHome, showHome)
+	s.palette.AddScreen(ScreenAbout, showAbout)
+	s.palette.AddScreen(ScreenFriends, showFriends)
+	s.palette.AddScreen(ScreenGames, showGames)
+	s.palette.AddScreen(ScreenAccount, showAccount)
+
+	s.palette.Add(
+		PaletteEntry{Title: "Go home", Run: showHome},
+		PaletteEntry{Title: "Go to about", Action: ActionAbout, Run: showAbout},
+		PaletteEntry{Title: "Go to friends", Action: ActionFriends, Run: showFriends},
+		PaletteEntry{Title: "Go to games", Action: ActionGames, Run: showGames},
+		PaletteEntry{Title: "Go to account", Action: ActionAccount, Run: showAccount},
+		PaletteEntry{Title: "Exit", Action: ActionExit, Run: exit},
+	)
 
 	messageBox := NewMessageBox(s)
 	networkBox := NewNetworkBox(s)
@@ -244,12 +281,11 @@ func MainScreenPages(s *appState) IOPrimitive {
 	pages.AddPage("Games", games.GetPrim(), true, false)
 	pages.AddPage("About", text, true, false)
 	pages.AddPage("Friends", friends.GetPrim(), true, false)
+	pages.AddPage("Account", account.GetPrim(), true, false)
 
 	pages.SetBorder(false)
 	pages.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		name := event.Name()
-		switch name {
-		case "Home", "Esc":
+		if s.bindings.Is(event, ActionBack) {
 
 			//Only Returns in top level parts of the app and games
 			if !games.GetPrim().HasFocus() && !friends.GetPrim().HasFocus() {
@@ -293,6 +329,10 @@ func MainScreenPages(s *appState) IOPrimitive {
 				case LoginDetailsRequired:
 				case Home:
 					pages.SwitchToPage("Home")
+				case RecoveryCodes:
+					// Codes are only sent once, so bring them up straight away
+					pages.SwitchToPage("Account")
+					s.app.SetFocus(account.GetPrim())
 				default:
 					// Do nothing
 				}
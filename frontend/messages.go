@@ -44,6 +44,25 @@ const (
 	ReceiveMessage
 	NotifyLogin
 	NotifyInactive
+	ServerShutdown
+	AccountLocked
+	ChangePassword
+	ChangePasswordResult
+	RecoveryCodes
+	RecoverAccount
+	RecoverAccountResult
+	DeleteAccount
+	DeleteAccountResult
+	ExportData
+	ExportDataResult
+	AccountDisabled
+	Announcement
+	PublishKey
+	KeyLookup
+	KeyLookupResult
+	MessageAck
+	CommandOutput
+	ClearChat
 )
 
 type AuthResponse struct {
@@ -186,6 +205,81 @@ func (m *ClientResponse) EncodePayload(p interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePasswordResult, RecoverAccountResult, MessageAck, FailedMessageSend:
+		// P is the result message, or the client id of a saved or refused chat
+		if result, ok := p.(*string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoveryCodes:
+		// P is the new recovery codes
+		if result, ok := p.(*[]string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccountResult:
+		// P is the result message
+		if result, ok := p.(*string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case ExportDataResult:
+		// P is AccountExport type
+		if result, ok := p.(*AccountExport); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case KeyLookupResult:
+		// P is PublicKey type
+		if result, ok := p.(*PublicKey); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -301,6 +395,71 @@ func (m *ClientResponse) DecodePayload(target interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePasswordResult, RecoverAccountResult, MessageAck, FailedMessageSend:
+		// P is the result message, or the client id of a saved or refused chat
+		if _, ok := target.(*string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoveryCodes:
+		// P is the new recovery codes
+		if _, ok := target.(*[]string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccountResult:
+		// P is the result message
+		if _, ok := target.(*string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case ExportDataResult:
+		// P is AccountExport type
+		if _, ok := target.(*AccountExport); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case KeyLookupResult:
+		// P is PublicKey type
+		if _, ok := target.(*PublicKey); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -362,6 +521,66 @@ func (m *ClientMessage) EncodePayload(p interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePassword:
+		// P is PasswordChange type
+		if result, ok := p.(*PasswordChange); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoverAccount:
+		// P is AccountRecovery type
+		if result, ok := p.(*AccountRecovery); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccount:
+		// P is AccountDeletion type
+		if result, ok := p.(*AccountDeletion); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case PublishKey, KeyLookup:
+		// P is the public key, or the username to look up
+		if result, ok := p.(*string); ok {
+
+			jsonData, err := json.Marshal(result)
+
+			if err != nil {
+				return err
+			}
+
+			m.Payload = jsonData
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -425,6 +644,58 @@ func (m *ClientMessage) DecodePayload(target interface{}) error {
 		} else {
 			return fmt.Errorf("incorrect details")
 		}
+	case ChangePassword:
+		// P is PasswordChange type
+		if _, ok := target.(*PasswordChange); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case RecoverAccount:
+		// P is AccountRecovery type
+		if _, ok := target.(*AccountRecovery); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case DeleteAccount:
+		// P is AccountDeletion type
+		if _, ok := target.(*AccountDeletion); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
+	case PublishKey, KeyLookup:
+		// P is the public key, or the username to look up
+		if _, ok := target.(*string); ok {
+
+			err := json.Unmarshal(m.Payload, target)
+
+			if err != nil {
+				return err
+			}
+
+		} else {
+			return fmt.Errorf("incorrect details")
+		}
 
 	}
 
@@ -444,4 +715,31 @@ type Chat struct {
 	Text     string `json:"text"`
 	Sender   string `json:"sender"`
 	Receiver string `json:"receiver"`
+	// Picked when the chat is composed, so resends are recognised by the server
+	ClientId string `json:"client_id,omitempty"`
+}
+
+// Change password request, checked against the current password
+type PasswordChange struct {
+	Current string `json:"current"`
+	New     string `json:"new"`
+}
+
+// Rebind an account to this device with one of its recovery codes
+type AccountRecovery struct {
+	Username    string `json:"username"`
+	Code        string `json:"code"`
+	NewPassword string `json:"new_password"`
+}
+
+// Delete this account. Confirm must repeat the username
+type AccountDeletion struct {
+	Password string `json:"password"`
+	Confirm  string `json:"confirm"`
+}
+
+// X25519 public key a user's device published, base64. Key is empty if they have none
+type PublicKey struct {
+	Username string `json:"username"`
+	Key      string `json:"key"`
 }
@@ -34,17 +34,17 @@ func BlankBox() *tview.Frame {
 
 }
 
-func MessageNotificationBoxFac(m *Message, UIBroadcast chan *AppMessage) *tview.Frame {
+func MessageNotificationBoxFac(m *Message, k *KeyBindings, UIBroadcast chan *AppMessage) *tview.Frame {
 
 	txt := tview.NewTextView().SetDynamicColors(true)
-	txt.SetText(fmt.Sprintf("[blue::b]%v[white::-]: %v\nsent: %v\n Open chat?(y) ", m.Sender, m.Text, m.Date))
+	txt.SetText(fmt.Sprintf("[blue::b]%v[white::-]: %v\nsent: %v\n Open chat?(%v) ", m.Sender, m.Text, m.Date, k.Label(ActionYes)))
 
 	frame := tview.NewFrame(
 		txt,
 	)
 	frame.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Rune() {
-		case 'y':
+		switch {
+		case k.Is(event, ActionYes):
 			// Send app message to
 			appMess := AppMessage{
 				Code:    OpenChat,
@@ -82,17 +82,17 @@ func MessageNotificationBoxFac(m *Message, UIBroadcast chan *AppMessage) *tview.
 	return frame
 }
 
-func OnlineNotificationBoxFac(user string, UIBroadcast chan *AppMessage) *tview.Frame {
+func OnlineNotificationBoxFac(user string, k *KeyBindings, UIBroadcast chan *AppMessage) *tview.Frame {
 
 	txt := tview.NewTextView().SetDynamicColors(true)
-	txt.SetText(fmt.Sprintf("[green::b]%v[::-] is active.[white]\nOpen chat?(y) ", user))
+	txt.SetText(fmt.Sprintf("[green::b]%v[::-] is active.[white]\nOpen chat?(%v) ", user, k.Label(ActionYes)))
 
 	frame := tview.NewFrame(
 		txt,
 	)
 	frame.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Rune() {
-		case 'y':
+		switch {
+		case k.Is(event, ActionYes):
 			// Send app message to
 			appMess := AppMessage{
 				Code:    OpenChat,
@@ -141,9 +141,9 @@ func NotificationsBar(s *appState) IOPrimitive {
 	hasFocus := 0
 	grid.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 
-		switch event.Key() {
+		switch {
 
-		case tcell.KeyUp:
+		case s.bindings.Is(event, ActionUp):
 
 			if hasFocus-1 >= 0 {
 				hasFocus -= 1
@@ -152,7 +152,7 @@ func NotificationsBar(s *appState) IOPrimitive {
 
 			return nil
 
-		case tcell.KeyDown:
+		case s.bindings.Is(event, ActionDown):
 
 			if hasFocus+1 < len(resultsArr) {
 				hasFocus += 1
@@ -204,7 +204,7 @@ func NotificationsBar(s *appState) IOPrimitive {
 						break
 					}
 
-					if message.Sender == s.username {
+					if message.Sender == s.username || s.IsBlocked(message.Sender) {
 						break
 					}
 
@@ -213,7 +213,14 @@ func NotificationsBar(s *appState) IOPrimitive {
 						resultsArr = resultsArr[1:]
 
 					}
-					notifBox := MessageNotificationBoxFac(&message, friendBar.UIMessage)
+					// Shown decrypted. The message itself stays as sent
+					shown := message
+					shown.Text = s.MessageText(&message)
+					if !message.Encrypted() {
+						shown.Text += " " + unencryptedMark
+					}
+
+					notifBox := MessageNotificationBoxFac(&shown, s.bindings, friendBar.UIMessage)
 					resultsArr = append(resultsArr, notifBox)
 
 					// Clear Grid and re add messages. 5 Recent notifications
@@ -235,7 +242,7 @@ func NotificationsBar(s *appState) IOPrimitive {
 
 					err := m.DecodePayload(&user)
 
-					if err != nil {
+					if err != nil || s.IsBlocked(user) {
 						break
 					}
 
@@ -244,7 +251,7 @@ func NotificationsBar(s *appState) IOPrimitive {
 						resultsArr = resultsArr[1:]
 
 					}
-					notifBox := OnlineNotificationBoxFac(user, friendBar.UIMessage)
+					notifBox := OnlineNotificationBoxFac(user, s.bindings, friendBar.UIMessage)
 					resultsArr = append(resultsArr, notifBox)
 
 					// Clear Grid and re add messages. 5 Recent notifications
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+/*
+	Outbox of chats not yet saved by the server.
+
+	Every chat is given a random client id and queued here as it is
+	composed, before any attempt to send it. It stays queued, shown as
+	pending in the chat screen, until the server answers with MessageAck
+	for its id, or refuses it with FailedMessageSend carrying the id. A
+	refused chat, say to someone who unfriended the sender, is dropped
+	rather than sent again, and the reason shown. The outbox is kept in
+	the local cache, so chats written while disconnected survive a
+	restart, and it is sent again in order once the server's content
+	arrives after each login.
+
+	The server saves at most one message per client id and sender, so a
+	chat sent again after a lost acknowledgement is acknowledged without
+	being delivered twice.
+*/
+
+// Random id for a new chat
+func newClientId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Queue a composed chat until the server acknowledges it
+func (m *appState) QueueChat(chat *Chat) error {
+	m.rwmu.Lock()
+	m.outbox = append(m.outbox, *chat)
+	m.rwmu.Unlock()
+
+	return m.SaveCache()
+}
+
+// Remove a chat the server acknowledged or refused. Returns false if it wasn't queued
+func (m *appState) AckChat(clientId string) (bool, error) {
+	m.rwmu.Lock()
+	before := len(m.outbox)
+	m.outbox = slices.DeleteFunc(m.outbox, func(chat Chat) bool {
+		return chat.ClientId == clientId
+	})
+	removed := len(m.outbox) != before
+	m.rwmu.Unlock()
+
+	if !removed {
+		return false, nil
+	}
+	return true, m.SaveCache()
+}
+
+// Chats to a friend still waiting for the server, oldest first
+func (m *appState) PendingChats(friend string) []Chat {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+
+	pending := []Chat{}
+	for _, chat := range m.outbox {
+		if chat.Receiver == friend {
+			pending = append(pending, chat)
+		}
+	}
+	return pending
+}
+
+// Take queued chats to send after logging in. Chats to people who are no longer friends can't be sent and are dropped
+func (m *appState) TakeOutbox() (send []Chat, dropped []Chat) {
+	m.mu.Lock()
+	username := m.username
+	m.mu.Unlock()
+
+	m.rwmu.Lock()
+	defer m.rwmu.Unlock()
+
+	friends := make(map[string]bool, len(m.friends))
+	for _, f := range m.friends {
+		friends[f.Username] = true
+	}
+
+	kept := m.outbox[:0]
+	for _, chat := range m.outbox {
+		if friends[chat.Receiver] && chat.Sender == username {
+			kept = append(kept, chat)
+		} else {
+			dropped = append(dropped, chat)
+		}
+	}
+	m.outbox = kept
+
+	return slices.Clone(kept), dropped
+}
+
+// Send everything in the outbox again, in the order it was written
+func (c *conn) flushOutbox(state *appState) {
+
+	send, dropped := state.TakeOutbox()
+
+	if len(dropped) > 0 {
+		c.saveCache(state)
+		c.UIBroadcast <- &AppMessage{
+			Code:    FailedMessageSend,
+			Message: fmt.Sprintf("%d queued messages dropped: they can no longer be sent", len(dropped)),
+		}
+	}
+
+	for i := range send {
+		c.sendChat(state, &send[i])
+	}
+}
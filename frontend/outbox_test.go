@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// State logged in as alice, friends with bob and carol
+func newTestOutboxState(t *testing.T) *appState {
+	t.Helper()
+
+	s := NewAppState(nil, nil, nil, nil)
+	if err := s.SetUsername("alice"); err != nil {
+		t.Fatal(err)
+	}
+	s.AssignAllContent(&UserContent{
+		Friends:  []Friend{{Username: "bob"}, {Username: "carol"}},
+		Messages: Messages{},
+	})
+	return s
+}
+
+func queueTestChats(t *testing.T, s *appState, chats ...Chat) {
+	t.Helper()
+
+	for i := range chats {
+		if err := s.QueueChat(&chats[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func chatIds(chats []Chat) []string {
+	ids := []string{}
+	for _, chat := range chats {
+		ids = append(ids, chat.ClientId)
+	}
+	return ids
+}
+
+func sameIds(got []Chat, want ...string) bool {
+	ids := chatIds(got)
+	if len(ids) != len(want) {
+		return false
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOutboxQueueAndAck(t *testing.T) {
+	s := newTestOutboxState(t)
+
+	queueTestChats(t, s,
+		Chat{Text: "one", Sender: "alice", Receiver: "bob", ClientId: "1"},
+		Chat{Text: "two", Sender: "alice", Receiver: "carol", ClientId: "2"},
+		Chat{Text: "three", Sender: "alice", Receiver: "bob", ClientId: "3"},
+	)
+
+	if pending := s.PendingChats("bob"); !sameIds(pending, "1", "3") {
+		t.Fatalf("pending to bob %v, want [1 3]", chatIds(pending))
+	}
+
+	if removed, err := s.AckChat("1"); !removed || err != nil {
+		t.Fatalf("ack: removed %v, error %v", removed, err)
+	}
+	// Acknowledged twice, after a resend
+	if removed, _ := s.AckChat("1"); removed {
+		t.Fatal("chat removed twice")
+	}
+	if removed, _ := s.AckChat("unknown"); removed {
+		t.Fatal("removed a chat that wasn't queued")
+	}
+
+	if pending := s.PendingChats("bob"); !sameIds(pending, "3") {
+		t.Fatalf("pending to bob after the ack %v, want [3]", chatIds(pending))
+	}
+	if pending := s.PendingChats("carol"); !sameIds(pending, "2") {
+		t.Fatalf("pending to carol %v, want [2]", chatIds(pending))
+	}
+}
+
+func TestTakeOutbox(t *testing.T) {
+	s := newTestOutboxState(t)
+
+	queueTestChats(t, s,
+		Chat{Text: "one", Sender: "alice", Receiver: "bob", ClientId: "1"},
+		// No longer a friend
+		Chat{Text: "two", Sender: "alice", Receiver: "dave", ClientId: "2"},
+		Chat{Text: "three", Sender: "alice", Receiver: "carol", ClientId: "3"},
+		// Written by another account on this profile
+		Chat{Text: "four", Sender: "erin", Receiver: "bob", ClientId: "4"},
+		Chat{Text: "five", Sender: "alice", Receiver: "bob", ClientId: "5"},
+	)
+
+	send, dropped := s.TakeOutbox()
+	if !sameIds(send, "1", "3", "5") {
+		t.Fatalf("sent %v, want [1 3 5] in the order written", chatIds(send))
+	}
+	if !sameIds(dropped, "2", "4") {
+		t.Fatalf("dropped %v, want [2 4]", chatIds(dropped))
+	}
+
+	// Kept until acknowledged, and taken again on the next login
+	if send, dropped = s.TakeOutbox(); !sameIds(send, "1", "3", "5") || len(dropped) != 0 {
+		t.Fatalf("taken again: sent %v, dropped %v", chatIds(send), chatIds(dropped))
+	}
+}
+
+func TestOutboxCached(t *testing.T) {
+	p := &Profile{CacheDir: t.TempDir()}
+	cache, _ := openTestCache(t, p)
+
+	s := NewAppState(nil, p, nil, cache)
+	s.LoadCached(&CachedContent{Username: "alice", Friends: []Friend{{Username: "bob"}}})
+	queueTestChats(t, s, Chat{Text: "offline", Sender: "alice", Receiver: "bob", ClientId: "1"})
+
+	// Survives a restart
+	_, content := openTestCache(t, p)
+	if content == nil || !sameIds(content.Outbox, "1") {
+		t.Fatalf("cached outbox %+v", content)
+	}
+
+	restarted := NewAppState(nil, p, nil, cache)
+	restarted.LoadCached(content)
+	if send, _ := restarted.TakeOutbox(); !sameIds(send, "1") {
+		t.Fatalf("sent after the restart %v, want [1]", chatIds(send))
+	}
+}
+
+// Logins set the username while the network goroutine flushes the outbox
+func TestTakeOutboxUsername(t *testing.T) {
+	s := newTestOutboxState(t)
+	queueTestChats(t, s, Chat{Text: "one", Sender: "alice", Receiver: "bob", ClientId: "1"})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			s.SetUsername("alice")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			s.TakeOutbox()
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+/*
+	Command palette, opened with Ctrl-P (the "palette" key binding) from
+	any screen. Typing filters every action the app has by fuzzy match,
+	Up and Down pick one and Enter runs it. Esc closes it.
+
+	Screens register their actions as they are built, with the same
+	functions their menus call, so the palette and the menus can't drift
+	apart. Entries that depend on content, such as a chat with each
+	friend, come from sources asked each time the palette opens. An entry
+	for something on another screen brings that screen up first with
+	Show, using the functions screens register with AddScreen.
+
+	Entries run on the UI goroutine once the palette has closed, the same
+	as a menu item.
+*/
+
+const (
+	ScreenHome    = "Home"
+	ScreenAbout   = "About"
+	ScreenFriends = "Friends"
+	ScreenGames   = "Games"
+	ScreenAccount = "Account"
+	ScreenInput   = "Input"
+)
+
+type PaletteEntry struct {
+	Title string
+	// Its key binding, shown beside the title. Empty for none
+	Action Action
+	Run    func()
+}
+
+type Palette struct {
+	entries []PaletteEntry
+	// Asked for entries each time the palette opens
+	sources []func() []PaletteEntry
+	// Bring a screen up and focus it
+	screens map[string]func()
+
+	mu sync.Mutex
+}
+
+func NewPalette() *Palette {
+	return &Palette{
+		screens: make(map[string]func()),
+	}
+}
+
+func (p *Palette) Add(entries ...PaletteEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.entries = append(p.entries, entries...)
+}
+
+func (p *Palette) AddSource(source func() []PaletteEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sources = append(p.sources, source)
+}
+
+func (p *Palette) AddScreen(name string, show func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.screens[name] = show
+}
+
+// Bring a registered screen up. Unknown screens are ignored
+func (p *Palette) Show(name string) {
+	p.mu.Lock()
+	show := p.screens[name]
+	p.mu.Unlock()
+
+	if show != nil {
+		show()
+	}
+}
+
+// Every entry, fixed ones first
+func (p *Palette) Entries() []PaletteEntry {
+	p.mu.Lock()
+	entries := append([]PaletteEntry{}, p.entries...)
+	sources := append([]func() []PaletteEntry{}, p.sources...)
+	p.mu.Unlock()
+
+	for _, source := range sources {
+		entries = append(entries, source()...)
+	}
+	return entries
+}
+
+// Score how well query matches title, its letters in order but not
+// necessarily together. Runs of letters and the starts of words score
+// higher, the start of the title most. ok is false if it doesn't match
+func fuzzyScore(query string, title string) (score int, ok bool) {
+
+	query = strings.ToLower(strings.Join(strings.Fields(query), ""))
+	if query == "" {
+		return 0, true
+	}
+
+	q := []rune(query)
+	i := 0
+	prev := -2
+	start := true
+
+	for pos, r := range []rune(strings.ToLower(title)) {
+		if i < len(q) && r == q[i] {
+			score++
+			if pos == prev+1 {
+				score += 3
+			}
+			if start {
+				score += 5
+			}
+			if pos == 0 {
+				score += 2
+			}
+			prev = pos
+			i++
+		}
+		start = !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}
+
+	if i < len(q) {
+		return 0, false
+	}
+	return score, true
+}
+
+type paletteMatch struct {
+	entry PaletteEntry
+	score int
+}
+
+// Entries matching query, best first. Ties keep their registered order
+func filterPalette(entries []PaletteEntry, query string) []PaletteEntry {
+
+	matches := []paletteMatch{}
+	for _, e := range entries {
+		if score, ok := fuzzyScore(query, e.Title); ok {
+			matches = append(matches, paletteMatch{e, score})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	filtered := make([]PaletteEntry, len(matches))
+	for i, m := range matches {
+		filtered[i] = m.entry
+	}
+	return filtered
+}
+
+// Palette shown over root. Returns the function opening it, for the UI goroutine
+func PaletteView(s *appState, root *tview.Pages) (open func()) {
+
+	input := tview.NewInputField().
+		SetLabel("> ").
+		SetPlaceholder("Type to search actions")
+
+	list := tview.NewList().
+		ShowSecondaryText(false).
+		SetHighlightFullLine(true)
+
+	box := tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(input, 1, 0, true).
+		AddItem(list, 0, 1, false)
+	box.SetBorder(true).
+		SetTitle(fmt.Sprintf(" Actions (%s) ", s.bindings.Label(ActionPalette)))
+
+	// Centred, half the width and most of the height
+	modal := tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().
+			SetDirection(tview.FlexRow).
+			AddItem(nil, 0, 1, false).
+			AddItem(box, 0, 4, true).
+			AddItem(nil, 0, 1, false),
+			0, 2, true).
+		AddItem(nil, 0, 1, false)
+
+	var (
+		entries []PaletteEntry
+		shown   []PaletteEntry
+		// Focused before opening, given back on close
+		previous tview.Primitive
+	)
+
+	refresh := func(query string) {
+		shown = filterPalette(entries, query)
+
+		list.Clear()
+		for _, e := range shown {
+			text := tview.Escape(e.Title)
+			if key := s.bindings.Label(e.Action); e.Action != "" && key != "" {
+				text += fmt.Sprintf("  [gray](%s)[-]", tview.Escape(key))
+			}
+			list.AddItem(text, "", 0, nil)
+		}
+	}
+
+	closePalette := func() {
+		root.RemovePage("Palette")
+		if previous != nil {
+			s.app.SetFocus(previous)
+		}
+	}
+
+	input.SetChangedFunc(refresh)
+
+	// Clicked
+	list.SetSelectedFunc(func(i int, _ string, _ string, _ rune) {
+		closePalette()
+		if i < len(shown) {
+			shown[i].Run()
+		}
+	})
+
+	input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyUp:
+			if i := list.GetCurrentItem(); i > 0 {
+				list.SetCurrentItem(i - 1)
+			}
+			return nil
+		case tcell.KeyDown:
+			if i := list.GetCurrentItem(); i+1 < list.GetItemCount() {
+				list.SetCurrentItem(i + 1)
+			}
+			return nil
+		case tcell.KeyEnter:
+			i := list.GetCurrentItem()
+			closePalette()
+			if i >= 0 && i < len(shown) {
+				shown[i].Run()
+			}
+			return nil
+		case tcell.KeyEsc:
+			closePalette()
+			return nil
+		}
+
+		// The palette key closes it too
+		if s.bindings.Is(event, ActionPalette) {
+			closePalette()
+			return nil
+		}
+		return event
+	})
+
+	return func() {
+		if root.HasPage("Palette") {
+			return
+		}
+
+		previous = s.app.GetFocus()
+		entries = s.palette.Entries()
+
+		input.SetText("")
+		refresh("")
+
+		root.AddPage("Palette", modal, true, true)
+		s.app.SetFocus(input)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func paletteTitles(entries []PaletteEntry) []string {
+	titles := []string{}
+	for _, e := range entries {
+		titles = append(titles, e.Title)
+	}
+	return titles
+}
+
+func TestFilterPalette(t *testing.T) {
+	entries := []PaletteEntry{
+		{Title: "Go to games"},
+		{Title: "Open chat with alice"},
+		{Title: "Open chat with bob"},
+		{Title: "Go to friends"},
+		{Title: "Friend requests"},
+		{Title: "Search users"},
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", paletteTitles(entries)},
+		{"zzz", []string{}},
+		{"games", []string{"Go to games"}},
+		{"GAMES", []string{"Go to games"}},
+		{"su", []string{"Search users"}},
+		{"gtf", []string{"Go to friends"}},
+		{"go to f", []string{"Go to friends"}},
+		// "a" starts a word in alice's, and is inside "chat" in bob's
+		{"oca", []string{"Open chat with alice", "Open chat with bob"}},
+		// Ties keep the order registered
+		{"chat", []string{"Open chat with alice", "Open chat with bob"}},
+		// The start of the title beats the start of a later word
+		{"fr", []string{"Friend requests", "Go to friends"}},
+	}
+
+	for _, tt := range tests {
+		if got := paletteTitles(filterPalette(entries, tt.query)); !slices.Equal(got, tt.want) {
+			t.Errorf("filterPalette(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPaletteEntries(t *testing.T) {
+	p := NewPalette()
+
+	friends := []string{"alice"}
+	asked := 0
+	p.AddSource(func() []PaletteEntry {
+		asked++
+		entries := []PaletteEntry{}
+		for _, f := range friends {
+			entries = append(entries, PaletteEntry{Title: "Open chat with " + f})
+		}
+		return entries
+	})
+	p.Add(PaletteEntry{Title: "Go to games", Action: ActionGames})
+
+	// Fixed entries first, then the sources as they are now
+	if got := paletteTitles(p.Entries()); !slices.Equal(got, []string{"Go to games", "Open chat with alice"}) {
+		t.Fatalf("entries %q", got)
+	}
+	friends = append(friends, "bob")
+	if got := paletteTitles(p.Entries()); len(got) != 3 || asked != 2 {
+		t.Fatalf("entries %q after %d asks", got, asked)
+	}
+
+	shown := ""
+	p.AddScreen(ScreenGames, func() { shown = ScreenGames })
+	p.Show("Nowhere")
+	p.Show(ScreenGames)
+	if shown != ScreenGames {
+		t.Fatalf("showed %q", shown)
+	}
+}
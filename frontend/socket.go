@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 
 	"golang.org/x/net/websocket"
 )
@@ -27,6 +26,12 @@ type conn struct {
 
 	// Connection closed
 	done chan struct{}
+
+	// Server said it was shutting down before closing the connection
+	serverShutdown bool
+
+	// Chats waiting on a key lookup for their receiver
+	pending map[string][]*Chat
 }
 
 func NewConnection(ws *websocket.Conn, c chan *AppMessage) *conn {
@@ -37,36 +42,38 @@ func NewConnection(ws *websocket.Conn, c chan *AppMessage) *conn {
 		err:         make(chan error),
 		messages:    make(chan Response),
 		done:        make(chan struct{}),
+		pending:     make(map[string][]*Chat),
 	}
 }
 
 // Establish connection with backend and create message channel
 func dialBackend(state *appState) {
 	// Prepare a custom WebSocket config
-	origin := "ws://localhost:8000/"
+	origin := state.profile.Server
 	config, err := websocket.NewConfig(origin, "http://localhost/")
 	if err != nil {
 		log.Fatalf("Failed to create config: %v", err)
 	}
 
-	// Generate API key to connect with backend
-	detailsFile := "details.txt"
-	if _, err := os.Stat(detailsFile); err != nil {
-		//If file doesn't exist
-		if os.IsNotExist(err) {
-			// Get random id
-			randomId, _ := generateAPIKey()
-
-			apiString := "API_KEY=" + randomId
-
-			// Generate new file with api key
-			os.WriteFile(detailsFile, []byte(apiString), 0644)
-		} else {
-			// Other errors break
-			log.Fatal("Failed to read details file")
+	// Verify wss:// servers against the profile's CA and pin
+	if config.Location.Scheme == "wss" {
+		config.TlsConfig, err = state.profile.TLSConfig()
+		if err != nil {
+			state.UIBroadcast <- &AppMessage{
+				Code:    ConnectionError,
+				Message: fmt.Sprintf("TLS settings invalid: %v", err),
+				Payload: nil,
+			}
+			return
 		}
 	}
 
+	// Generate API key to connect with backend if this profile has none
+	detailsFile := state.profile.CredentialsFile
+	if err := state.profile.EnsureCredentials(); err != nil {
+		log.Fatalf("Failed to create details file: %v", err)
+	}
+
 	// Fetch API key from details file
 	key, readErr := ReadAPIKey(detailsFile)
 	if readErr != nil {
@@ -84,7 +91,7 @@ func dialBackend(state *appState) {
 		// Send UI message
 		aMess := AppMessage{
 			Code:    ConnectionError,
-			Message: "Error connecting to server",
+			Message: describeDialError(err),
 			Payload: nil,
 		}
 		state.UIBroadcast <- &aMess
@@ -148,6 +155,12 @@ readLoop:
 					Code:    LoginDetailsRequired,
 					Message: "Error: login details incorrect",
 				}
+			case AccountLocked, AccountDisabled:
+				// Server explains how long to wait, or why the account is disabled
+				c.UIBroadcast <- &AppMessage{
+					Code:    LoginDetailsRequired,
+					Message: "Error: " + response.GetMessage(),
+				}
 			case LoginSuccessful:
 				state.SetLoggedIn()
 				c.UIBroadcast <- &AppMessage{
@@ -155,6 +168,14 @@ readLoop:
 					Message: "You are logged in",
 				}
 
+				// Friends encrypt to whichever key this device last published
+				publicKey := state.keys.PublicKey()
+				clientMess := ClientMessage{
+					Code: PublishKey,
+				}
+				clientMess.EncodePayload(&publicKey)
+				c.SendMessage(&clientMess)
+
 			case AllContent:
 				/*
 					Receive all conetnt from backend.
@@ -170,11 +191,14 @@ readLoop:
 				if err != nil {
 
 				}
-				err = state.AssignAllContent(&userContent)
+				// Keeps cached messages the server no longer sends
+				state.ReconcileContent(&userContent)
+				c.saveCache(state)
 
-				if err != nil {
+				c.lookupKeys(userContent.Friends)
 
-				}
+				// Now the server's friends are known, send what was written while away
+				c.flushOutbox(state)
 
 				c.UIBroadcast <- &AppMessage{
 					Code:    AllContent,
@@ -195,6 +219,9 @@ readLoop:
 					log.Fatal(err)
 
 				}
+				c.saveCache(state)
+
+				c.lookupKeys(userContent.Friends)
 
 				c.UIBroadcast <- &AppMessage{
 					Code:    UpdateFriendContent,
@@ -236,6 +263,7 @@ readLoop:
 					log.Fatal(err)
 
 				}
+				c.saveCache(state)
 
 				appMessage := AppMessage{
 					Code:    ReceiveMessage,
@@ -308,6 +336,98 @@ readLoop:
 
 				c.UIBroadcast <- &appMessage
 
+			case RecoveryCodes:
+				// Shown once on the account page
+				c.UIBroadcast <- &AppMessage{
+					Code:    RecoveryCodes,
+					Message: response.GetMessage(),
+					Payload: response.GetPayload(),
+				}
+
+			case ChangePasswordResult, RecoverAccountResult, DeleteAccountResult:
+				var result string
+				response.DecodePayload(&result)
+
+				c.UIBroadcast <- &AppMessage{
+					Code:    response.GetCode(),
+					Message: result,
+				}
+
+			case ExportDataResult:
+				var export AccountExport
+				result := "Failed to read export"
+
+				if err := response.DecodePayload(&export); err == nil {
+					state.DecryptExport(&export)
+					if path, err := writeExport(&export); err != nil {
+						result = fmt.Sprintf("Failed to save export: %v", err)
+					} else {
+						result = "Exported to " + path
+					}
+				}
+
+				c.UIBroadcast <- &AppMessage{
+					Code:    ExportDataResult,
+					Message: result,
+				}
+
+			case Announcement:
+				c.UIBroadcast <- &AppMessage{
+					Code:    Announcement,
+					Message: "Announcement: " + response.GetMessage(),
+				}
+
+			case KeyLookupResult:
+				var publicKey PublicKey
+				if err := response.DecodePayload(&publicKey); err != nil {
+					break
+				}
+				c.receiveKey(state, &publicKey)
+
+			case MessageAck:
+				var clientId string
+				if err := response.DecodePayload(&clientId); err != nil {
+					break
+				}
+
+				if _, err := state.AckChat(clientId); err != nil {
+					c.UIBroadcast <- &AppMessage{
+						Code:    DatabaseError,
+						Message: fmt.Sprintf("Local cache not saved: %v", err),
+					}
+				}
+
+				c.UIBroadcast <- &AppMessage{
+					Code:    MessageAck,
+					Message: "Message sent",
+				}
+
+			case FailedMessageSend:
+				result := "Message not sent"
+				if r, ok := response.(*ClientResponse); ok && r.Err != nil {
+					result = "Message not sent: " + r.Err.Message
+				}
+
+				// Refused for good. Without an id it failed on the server, and is sent again after reconnecting
+				var clientId string
+				if err := response.DecodePayload(&clientId); err == nil && clientId != "" {
+					if _, err := state.AckChat(clientId); err != nil {
+						c.UIBroadcast <- &AppMessage{
+							Code:    DatabaseError,
+							Message: fmt.Sprintf("Local cache not saved: %v", err),
+						}
+					}
+				}
+
+				c.UIBroadcast <- &AppMessage{
+					Code:    FailedMessageSend,
+					Message: result,
+				}
+
+			case ServerShutdown:
+				// Connection closes next. Explain why when it does
+				c.serverShutdown = true
+
 			default:
 
 			}
@@ -350,6 +470,20 @@ readLoop:
 				// Send message
 				c.SendMessage(&clientMess)
 			case SendMessage:
+				// Encrypted here, so the server only sees ciphertext
+				var chat Chat
+				if err := message.DecodePayload(&chat); err != nil {
+					break
+				}
+				c.sendChat(state, &chat)
+			case KeyLookup:
+				// A key accepted on the friend card. The answer sends any chats held for it
+				var username string
+				if err := message.DecodePayload(&username); err != nil {
+					break
+				}
+				c.lookupKey(username)
+			case ChangePassword, RecoverAccount, RecoveryCodes, DeleteAccount, ExportData:
 				// Message
 				clientMess := ClientMessage{
 					Code:    message.Code,
@@ -367,8 +501,14 @@ readLoop:
 				Code:    ConnectionError,
 				Message: "Lost connection to server",
 			}
+			if c.serverShutdown {
+				aMess.Message = "Server shut down"
+			}
 			c.UIBroadcast <- &aMess
 
+			// Logging in again is needed once reconnected
+			state.SetLoggedOut()
+
 			// Unsubscribe listener channel
 			state.UnsubscribeChannel(c.RecNetMess, Network)
 			break readLoop
@@ -385,3 +525,111 @@ func (c *conn) SendMessage(m *ClientMessage) {
 		c.done <- struct{}{}
 	}
 }
+
+// Ask for the keys of friends, pinning new ones and noticing changes
+func (c *conn) lookupKeys(friends []Friend) {
+	for _, f := range friends {
+		c.lookupKey(f.Username)
+	}
+}
+
+func (c *conn) lookupKey(username string) {
+	clientMess := ClientMessage{
+		Code: KeyLookup,
+	}
+	clientMess.EncodePayload(&username)
+	c.SendMessage(&clientMess)
+}
+
+// Encrypt a chat to the receiver's key and send it, or hold it until
+// their key is known, or accepted after a change
+func (c *conn) sendChat(state *appState, chat *Chat) {
+
+	peerKey, ok := state.keys.Key(chat.Receiver)
+	if !ok {
+		if len(c.pending[chat.Receiver]) == 0 {
+			c.lookupKey(chat.Receiver)
+		}
+		c.pending[chat.Receiver] = append(c.pending[chat.Receiver], chat)
+		return
+	}
+
+	// Sent once accepted, by the lookup the friend card makes
+	if !state.keys.Confirmed(chat.Receiver) {
+		if len(c.pending[chat.Receiver]) == 0 {
+			c.UIBroadcast <- &AppMessage{
+				Code:    FailedMessageSend,
+				Message: fmt.Sprintf("Message to %s held: their encryption key changed. Accept it on their friend card", chat.Receiver),
+			}
+		}
+		c.pending[chat.Receiver] = append(c.pending[chat.Receiver], chat)
+		return
+	}
+
+	encrypted, err := state.keys.Encrypt(chat.Sender, chat.Receiver, peerKey, chat.Text)
+	if err != nil {
+		c.UIBroadcast <- &AppMessage{
+			Code:    FailedMessageSend,
+			Message: fmt.Sprintf("Message not sent: %v", err),
+		}
+		return
+	}
+
+	clientMess := ClientMessage{
+		Code: SendMessage,
+	}
+	clientMess.EncodePayload(&Chat{
+		Text:     encrypted,
+		Sender:   chat.Sender,
+		Receiver: chat.Receiver,
+		ClientId: chat.ClientId,
+	})
+	c.SendMessage(&clientMess)
+}
+
+// Pin a friend's key and send anything that was waiting on it
+func (c *conn) receiveKey(state *appState, publicKey *PublicKey) {
+
+	pending := c.pending[publicKey.Username]
+	delete(c.pending, publicKey.Username)
+
+	if publicKey.Key == "" {
+		if len(pending) > 0 {
+			c.UIBroadcast <- &AppMessage{
+				Code:    FailedMessageSend,
+				Message: fmt.Sprintf("Message waiting: %s has no encryption key yet", publicKey.Username),
+			}
+		}
+		return
+	}
+
+	changed, err := state.keys.Pin(publicKey.Username, publicKey.Key)
+	if err != nil {
+		c.UIBroadcast <- &AppMessage{
+			Code:    FailedMessageSend,
+			Message: fmt.Sprintf("Key for %s not saved: %v", publicKey.Username, err),
+		}
+		return
+	}
+
+	if changed {
+		c.UIBroadcast <- &AppMessage{
+			Code:    KeyLookupResult,
+			Message: fmt.Sprintf("%s has a new encryption key. Compare safety numbers on their friend card, or accept it there", publicKey.Username),
+		}
+	}
+
+	for _, chat := range pending {
+		c.sendChat(state, chat)
+	}
+}
+
+// Write content to the local cache, reporting failures without stopping
+func (c *conn) saveCache(state *appState) {
+	if err := state.SaveCache(); err != nil {
+		c.UIBroadcast <- &AppMessage{
+			Code:    DatabaseError,
+			Message: fmt.Sprintf("Local cache not saved: %v", err),
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+/*
+	TLS settings for wss:// servers.
+
+	A profile can trust an extra CA file, pin the server's public key, or
+	both. With only a pin, the chain is not checked and the pinned key is
+	the sole trust anchor, which suits the server's self-signed dev cert.
+*/
+
+type pinMismatchError struct {
+	got string
+}
+
+func (e *pinMismatchError) Error() string {
+	return fmt.Sprintf("server public key %s does not match the pinned key", e.got)
+}
+
+// Normalise a pin written as hex, optionally with colons or a sha256: prefix
+func normalisePin(pin string) string {
+	pin = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(pin)), "sha256:")
+	return strings.ReplaceAll(pin, ":", "")
+}
+
+func (p *Profile) TLSConfig() (*tls.Config, error) {
+
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if p.CAFile != "" {
+		pem, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", p.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	if p.Pin != "" {
+		want := normalisePin(p.Pin)
+
+		// A pin without a CA trusts the pinned key alone
+		conf.InsecureSkipVerify = p.CAFile == ""
+
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return &pinMismatchError{got: "none"}
+			}
+
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			got := hex.EncodeToString(sum[:])
+			if got != want {
+				return &pinMismatchError{got: got}
+			}
+			return nil
+		}
+	}
+
+	return conf, nil
+}
+
+// User facing reason for a failed dial, calling out TLS verification failures
+func describeDialError(err error) string {
+
+	var dialErr *websocket.DialError
+	if errors.As(err, &dialErr) {
+		err = dialErr.Err
+	}
+
+	var pinErr *pinMismatchError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &pinErr):
+		return "TLS verification failed: " + pinErr.Error()
+	case errors.As(err, &unknownAuthority):
+		return "TLS verification failed: certificate signed by an unknown authority. Set ca or pin in your profile"
+	case errors.As(err, &hostnameErr):
+		return "TLS verification failed: " + hostnameErr.Error()
+	case errors.As(err, &invalidErr):
+		return "TLS verification failed: " + invalidErr.Error()
+	case errors.As(err, &recordErr):
+		return "TLS handshake failed: server is not speaking TLS. Try ws:// instead of wss://"
+	}
+
+	return "Error connecting to server"
+}
@@ -29,7 +29,7 @@ type IOPrimitive interface {
 }
 
 // TODO: add channels to receive input from network calls
-func getUI(state *appState) *tview.Flex {
+func getUI(state *appState) *tview.Pages {
 
 	// Input and user prompt
 	inputBar := InputBar(state)
@@ -48,6 +48,12 @@ func getUI(state *appState) *tview.Flex {
 			0, 4, false).
 		AddItem(notificationsBar.GetPrim(), 0, 1, false)
 
+	// Layout, with the palette shown over it
+	root := tview.NewPages().
+		AddPage("Main", flex, true, true)
+
+	openPalette := PaletteView(state, root)
+
 	pageSlice := []IOPrimitive{
 		inputBar,
 		display,
@@ -55,20 +61,46 @@ func getUI(state *appState) *tview.Flex {
 	}
 	i := 0
 
+	nextPane := func() {
+		if i = i + 1; i > 2 {
+			i = 0
+		}
+		state.app.SetFocus(pageSlice[i].GetPrim())
+	}
+
+	state.palette.AddScreen(ScreenInput, func() {
+		i = 0
+		state.app.SetFocus(inputBar.GetPrim())
+	})
+	state.palette.Add(
+		PaletteEntry{Title: "Next pane", Action: ActionNextPane, Run: nextPane},
+		PaletteEntry{Title: "Go to notifications", Run: func() {
+			i = 2
+			state.app.SetFocus(notificationsBar.GetPrim())
+		}},
+	)
+
 	flex.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 
-		// Cycle through main boxes using tab key, globally available
-		if event.Name() == "Tab" {
+		// Globally available
+		if state.bindings.Is(event, ActionPalette) {
+			openPalette()
+			return nil
+		}
+
+		// Cycle through main boxes, globally available
+		if state.bindings.Is(event, ActionNextPane) {
 
-			if i = i + 1; i > 2 {
-				i = 0
+			// Left to the input bar to complete a command
+			if event.Key() == tcell.KeyTab && inputBar.Completing() {
+				return event
 			}
-			state.app.SetFocus(pageSlice[i].GetPrim())
 
+			nextPane()
 			return nil
 		}
 		return event
 	})
 
-	return flex
+	return root
 }
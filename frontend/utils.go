@@ -45,6 +45,12 @@ type Questions []*Question
 type Question struct {
 	q   string             // Question to display
 	ref func(input string) // reference to property in struct
+
+	// Optional. Sees the input before ref, returning what ref gets, or false
+	// if it dealt with the input itself and the question stays open
+	filter func(input string) (string, bool)
+	// Optional. Completes the input when Tab is pressed
+	complete func(input string) string
 }
 
 func PromptFlow(ctx context.Context, code MessageCode, order *Questions, m string, input *tview.TextArea, output chan *AppMessage, ui chan *AppMessage, qArea *tview.Frame, content interface{}) error {
@@ -71,8 +77,17 @@ func PromptFlow(ctx context.Context, code MessageCode, order *Questions, m strin
 			// Send input to next stage
 			if event.Key() == tcell.KeyEnter {
 
+				text := input.GetText()
+				if question.filter != nil {
+					var ok bool
+					if text, ok = question.filter(text); !ok {
+						input.SetText("", false)
+						return nil
+					}
+				}
+
 				//Assign input to data structure
-				question.ref(input.GetText())
+				question.ref(text)
 
 				qArea.Clear()
 				input.SetText("", false)
@@ -81,6 +96,9 @@ func PromptFlow(ctx context.Context, code MessageCode, order *Questions, m strin
 				i++
 				next <- struct{}{}
 				return nil
+			} else if event.Key() == tcell.KeyTab && question.complete != nil {
+				input.SetText(question.complete(input.GetText()), true)
+				return nil
 			} else {
 				return event
 			}
@@ -120,6 +138,24 @@ func PromptFlow(ctx context.Context, code MessageCode, order *Questions, m strin
 			Payload: nil,
 			Code:    SendMessage,
 		}
+	case ChangePassword:
+		aMess = AppMessage{
+			Message: "Change password",
+			Payload: nil,
+			Code:    ChangePassword,
+		}
+	case RecoverAccount:
+		aMess = AppMessage{
+			Message: "Recover account",
+			Payload: nil,
+			Code:    RecoverAccount,
+		}
+	case DeleteAccount:
+		aMess = AppMessage{
+			Message: "Delete account",
+			Payload: nil,
+			Code:    DeleteAccount,
+		}
 
 	}
 